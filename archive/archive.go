@@ -0,0 +1,228 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive keeps a history of the alarm events the router processed
+// and what became of them, for incident reviews and for replaying real
+// events against routing changes.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/s3"
+)
+
+// MaxSpan is the longest an invocation's entries, written together under the
+// day the earliest was processed, may take to process: the Lambda's maximum
+// timeout.
+const MaxSpan = 15 * time.Minute
+
+// Entry is an archived event and its routing and delivery outcome.
+type Entry struct {
+	ProcessedAt time.Time `json:"processed_at"`
+	Event       *cw.Event `json:"event"`
+	// Action is the PagerDuty action of the transition, empty for
+	// transitions that aren't routed
+	Action       string            `json:"action,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	SlackChannel string            `json:"slack_channel,omitempty"`
+	Outcomes     []Outcome         `json:"outcomes,omitempty"`
+	// Error is why processing the event failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// Outcome is the result of delivering an archived event to one destination.
+type Outcome struct {
+	Destination string `json:"destination"`
+	Skipped     bool   `json:"skipped,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Time returns when the entry's event was processed or, for events that
+// weren't archived by the router, when it happened.
+func (e Entry) Time() time.Time {
+	if !e.ProcessedAt.IsZero() || e.Event == nil {
+		return e.ProcessedAt
+	}
+	t, _ := time.Parse(time.RFC3339, e.Event.Time)
+	return t
+}
+
+// Store keeps archived entries.
+type Store interface {
+	// Write stores the entries together and returns where they went.
+	Write(ctx context.Context, entries []Entry) (string, error)
+}
+
+// S3 archives entries as gzipped JSON lines objects in a bucket, partitioned
+// by date.
+type S3 struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 returns an archive in the bucket, under the key prefix.
+func NewS3(client *s3.Client, bucket, prefix string) *S3 {
+	return &S3{client: client, bucket: bucket, prefix: strings.Trim(prefix, "/")}
+}
+
+// Write implements Store. The object is keyed by the date and time the
+// earliest entry was processed, and a random ID.
+func (s *S3) Write(ctx context.Context, entries []Entry) (string, error) {
+	if len(entries) == 0 {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return "", fmt.Errorf("encoding archive entry: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("compressing archive entries: %w", err)
+	}
+
+	t := entries[0].ProcessedAt
+	for _, e := range entries[1:] {
+		if e.ProcessedAt.Before(t) {
+			t = e.ProcessedAt
+		}
+	}
+	t = t.UTC()
+	key := fmt.Sprintf("%s%s-%s.jsonl.gz", s.dayPrefix(t), t.Format("150405"), uuid.NewString())
+	if err := s.client.WriteBytes(ctx, s.bucket, key, &buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key), nil
+}
+
+// Read calls fn with the entries processed in [from, to), in the order they
+// were written.
+func (s *S3) Read(ctx context.Context, from, to time.Time, fn func(Entry) error) error {
+	first := from.Add(-MaxSpan).UTC().Truncate(24 * time.Hour)
+	for day := first; day.Before(to); day = day.AddDate(0, 0, 1) {
+		keys, err := s.client.ListKeys(ctx, s.bucket, s.dayPrefix(day))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := s.readObject(ctx, key, func(e Entry) error {
+				if t := e.Time(); t.Before(from) || !t.Before(to) {
+					return nil
+				}
+				return fn(e)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *S3) readObject(ctx context.Context, key string, fn func(Entry) error) error {
+	r, err := s.client.ReadObject(ctx, s.bucket, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := Decode(r, fn); err != nil {
+		return fmt.Errorf("reading s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return nil
+}
+
+// dayPrefix returns the key prefix of the objects written on the day of t.
+func (s *S3) dayPrefix(t time.Time) string {
+	p := fmt.Sprintf("%d/%02d/%02d/", t.Year(), t.Month(), t.Day())
+	if s.prefix != "" {
+		p = s.prefix + "/" + p
+	}
+	return p
+}
+
+// Decode reads archived entries, or bare events, and calls fn with each. The
+// input may be gzipped, and holds JSON values one after another (JSON lines,
+// or concatenated as Firehose writes them) or in arrays. Values with an
+// "event" are entries; anything else is decoded as an event (see
+// cw.DecodeEvent), e.g. an export of an EventBridge archive.
+func Decode(r io.Reader, fn func(Entry) error) error {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("decompressing: %w", err)
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	dec := json.NewDecoder(br)
+	for n := 1; ; n++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("decoding value %d: %w", n, err)
+		}
+		values := []json.RawMessage{raw}
+		if bytes.HasPrefix(raw, []byte("[")) {
+			if err := json.Unmarshal(raw, &values); err != nil {
+				return fmt.Errorf("decoding value %d: %w", n, err)
+			}
+		}
+		for _, v := range values {
+			e, err := decodeEntry(v)
+			if err != nil {
+				return fmt.Errorf("decoding value %d: %w", n, err)
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// decodeEntry decodes an archived entry or a bare alarm state change event.
+func decodeEntry(raw json.RawMessage) (Entry, error) {
+	var e Entry
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return Entry{}, err
+	}
+	if e.Event != nil {
+		return e, nil
+	}
+	evt, err := cw.DecodeEvent(raw)
+	if err != nil {
+		return Entry{}, err
+	}
+	if evt.DetailType != cw.DetailTypeAlarmStateChange {
+		return Entry{}, fmt.Errorf("not an alarm state change event: detail type %q", evt.DetailType)
+	}
+	return Entry{Event: evt}, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/archive"
+	"github.com/tidal-music/cw-alert-router/v2/s3"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+func entryAt(t time.Time, name string) archive.Entry {
+	evt := test.AlarmEvent(test.TriggeredAlarmDetails, name)
+	return archive.Entry{
+		ProcessedAt:  t,
+		Event:        &evt,
+		Action:       "trigger",
+		Tags:         map[string]string{"service": "test-service"},
+		SlackChannel: "test-alarms",
+		Outcomes: []archive.Outcome{
+			{Destination: "slack"},
+			{Destination: "pagerduty", Error: "pagerduty unavailable"},
+		},
+		Error: "delivering alarm failed",
+	}
+}
+
+func TestS3WriteAndRead(t *testing.T) {
+	ctx := context.Background()
+	api := &test.MockS3API{}
+	client, err := s3.New(ctx, s3.WithAPI(api))
+	if err != nil {
+		t.Fatalf("failed creating s3 client: %v", err)
+	}
+	store := archive.NewS3(client, "bucket", "/archive/")
+
+	midnight := time.Date(2024, 3, 7, 0, 0, 0, 0, time.UTC)
+	batches := [][]archive.Entry{
+		// written under the 6th, processed until after midnight
+		{entryAt(midnight.Add(-time.Minute), "a"), entryAt(midnight.Add(time.Minute), "b")},
+		{entryAt(midnight.Add(12*time.Hour), "c")},
+		{entryAt(midnight.Add(36*time.Hour), "d")},
+	}
+	for _, b := range batches {
+		location, err := store.Write(ctx, b)
+		if err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+		day := b[0].ProcessedAt.Format("2006/01/02")
+		if !strings.HasPrefix(location, "s3://bucket/archive/"+day+"/") || !strings.HasSuffix(location, ".jsonl.gz") {
+			t.Errorf("unexpected location %s", location)
+		}
+	}
+
+	var got []archive.Entry
+	err = store.Read(ctx, midnight, midnight.Add(24*time.Hour), func(e archive.Entry) error {
+		got = append(got, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Read returned error: %v", err)
+	}
+	want := []archive.Entry{batches[0][1], batches[1][0]}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d entries, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("entry %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	entry := entryAt(time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC), "a")
+	entryJSON, _ := json.Marshal(entry)
+	resolved, _ := json.Marshal(test.ResolvedEvent(test.TriggeredAlarmDetails))
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(append(entryJSON, '\n'))
+	zw.Close()
+
+	tests := map[string]struct {
+		input string
+		want  []string
+	}{
+		"json lines":   {string(entryJSON) + "\n" + string(resolved) + "\n", []string{"a", "test-service-alarm-abcd"}},
+		"concatenated": {string(resolved) + string(entryJSON), []string{"test-service-alarm-abcd", "a"}},
+		"array":        {"[" + string(resolved) + "," + string(entryJSON) + "]", []string{"test-service-alarm-abcd", "a"}},
+		"gzipped":      {gz.String(), []string{"a"}},
+		"sns classic":  {test.SNSNotification(test.ClassicAlarmJSON), []string{"test-service-alarm-abcd"}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			err := archive.Decode(strings.NewReader(tc.input), func(e archive.Entry) error {
+				got = append(got, e.Event.Detail.AlarmName)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Decode returned error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	if err := archive.Decode(strings.NewReader(`{"detail-type":"EC2 Instance State-change Notification"}`), func(archive.Entry) error { return nil }); err == nil {
+		t.Error("expected an error decoding something that isn't an alarm event")
+	}
+}
+
+func TestEntryTime(t *testing.T) {
+	processed := time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC)
+	evt := test.TriggeredAlarmDetails
+	if got := (archive.Entry{ProcessedAt: processed, Event: &evt}).Time(); !got.Equal(processed) {
+		t.Errorf("expected the processing time, got %v", got)
+	}
+	want, _ := time.Parse(time.RFC3339, evt.Time)
+	if got := (archive.Entry{Event: &evt}).Time(); !got.Equal(want) {
+		t.Errorf("expected the event time, got %v", got)
+	}
+}
+
+var _ archive.Store = (*archive.S3)(nil)
@@ -0,0 +1,51 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command cw-alert-router-server runs the router as a long-running HTTP
+// server, receiving alarm events from EventBridge API destinations and SNS.
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tidal-music/cw-alert-router/v2/lambda"
+	"github.com/tidal-music/cw-alert-router/v2/server"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	h, err := lambda.New(ctx, lambda.ConfigFromEnv())
+	if err != nil {
+		slog.Error("failed initializing handler", "error", err)
+		os.Exit(1)
+	}
+	if !h.Config().PreflightDisabled {
+		h.LogPreflight(ctx)
+	}
+	srv, err := server.New(h, server.ConfigFromEnv())
+	if err != nil {
+		slog.Error("failed initializing server", "error", err)
+		os.Exit(1)
+	}
+	if err := srv.Run(ctx); err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/lambda"
+)
+
+// accountPlaceholder is replaced with each account ID in the -role template.
+const accountPlaceholder = "{account}"
+
+// auditReport is the audit's JSON output.
+type auditReport struct {
+	Alarms   int              `json:"alarms"`
+	Findings []lambda.Finding `json:"findings"`
+}
+
+// audit checks the routing tags of every alarm in the accounts and regions,
+// and fails if anything was found, for CI gating.
+func audit(ctx context.Context, args []string) error {
+	cfg := routerConfig()
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	regions := fs.String("regions", strings.Join(cfg.AllowedRegions, ","), "comma separated regions to audit (default: "+lambda.AllowedRegionsEnv+", or the AWS config's region)")
+	accounts := fs.String("accounts", strings.Join(cfg.AllowedAccounts, ","), "comma separated accounts to audit with -role (default: "+lambda.AllowedAccountsEnv+")")
+	role := fs.String("role", "", "role ARN to assume in each account, with "+accountPlaceholder+" for the account ID (default: audit the current credentials' account)")
+	asJSON := fs.Bool("json", false, "print the findings as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cw-alert-router audit [flags]")
+		fmt.Fprintln(fs.Output(), "\nLists every alarm and reports missing owner and service tags, Slack channels")
+		fmt.Fprintln(fs.Output(), "that don't exist, services without a PagerDuty routing key and unknown alerts:*")
+		fmt.Fprintln(fs.Output(), "tags. It exits with status 1 if anything was found.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *role != "" && !strings.Contains(*role, accountPlaceholder) {
+		return fmt.Errorf("-role must contain %s", accountPlaceholder)
+	}
+	if *role != "" && *accounts == "" {
+		return fmt.Errorf("-role requires -accounts")
+	}
+
+	h, err := lambda.New(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("initializing router: %w", err)
+	}
+	auditor, err := h.NewAuditor(ctx)
+	if err != nil {
+		return err
+	}
+
+	clients, err := auditClients(ctx, splitFlag(*accounts), splitFlag(*regions), *role)
+	if err != nil {
+		return err
+	}
+	report := auditReport{Findings: []lambda.Finding{}}
+	for _, client := range clients {
+		alarms, err := client.cw.Alarms(ctx)
+		if err != nil {
+			return fmt.Errorf("auditing %s: %w", client.name, err)
+		}
+		for _, alarm := range alarms {
+			report.Alarms++
+			report.Findings = append(report.Findings, auditor.Audit(ctx, client.cw, alarm)...)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else if err := printFindings(os.Stdout, report); err != nil {
+		return err
+	}
+	if len(report.Findings) > 0 {
+		return fmt.Errorf("%d findings in %d alarms", len(report.Findings), report.Alarms)
+	}
+	return nil
+}
+
+// auditClient is the CloudWatch client of one account and region.
+type auditClient struct {
+	name string
+	cw   *cw.Client
+}
+
+// auditClients returns a CloudWatch client per account and region: the
+// current credentials' account unless a role is given to assume in each
+// account, in the AWS config's region unless regions are given.
+func auditClients(ctx context.Context, accounts, regions []string, role string) ([]auditClient, error) {
+	if role == "" {
+		accounts = []string{""}
+	}
+	if len(regions) == 0 {
+		regions = []string{""}
+	}
+	var clients []auditClient
+	for _, account := range accounts {
+		for _, region := range regions {
+			c := auditClient{name: strings.Trim(account+" "+region, " ")}
+			var opts []func(*config.LoadOptions) error
+			if region != "" {
+				opts = append(opts, config.WithRegion(region))
+			}
+			awscfg, err := config.LoadDefaultConfig(ctx, opts...)
+			if err != nil {
+				return nil, fmt.Errorf("loading aws config: %w", err)
+			}
+			if role != "" {
+				roleARN := strings.ReplaceAll(role, accountPlaceholder, account)
+				awscfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awscfg), roleARN))
+			}
+			c.cw = cw.NewClient(awscfg)
+			clients = append(clients, c)
+		}
+	}
+	return clients, nil
+}
+
+// splitFlag splits a comma separated flag value.
+func splitFlag(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// printFindings writes the findings as a table for humans.
+func printFindings(w io.Writer, report auditReport) error {
+	if len(report.Findings) == 0 {
+		_, err := fmt.Fprintf(w, "%d alarms audited, nothing found\n", report.Alarms)
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tREGION\tALARM\tCHECK\tDETAIL")
+	for _, f := range report.Findings {
+		a, _ := arn.Parse(f.AlarmARN)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", a.AccountID, a.Region, f.Alarm, f.Check, f.Detail)
+	}
+	return tw.Flush()
+}
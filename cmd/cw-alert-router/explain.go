@@ -0,0 +1,155 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/lambda"
+)
+
+// explain prints how an event, read from a file or stdin, or the event an
+// alarm sent entering its current state would be routed.
+func explain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the explanation as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cw-alert-router explain [-json] <event file | alarm arn | ->")
+		fmt.Fprintln(fs.Output(), "\nThe event may be an EventBridge event, a classic SNS alarm notification or")
+		fmt.Fprintln(fs.Output(), "either wrapped in an SNS envelope; - reads it from stdin. For an alarm ARN,")
+		fmt.Fprintln(fs.Output(), "the alarm's current state is explained.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	arg := fs.Arg(0)
+
+	h, err := lambda.New(ctx, routerConfig())
+	if err != nil {
+		return fmt.Errorf("initializing router: %w", err)
+	}
+	var e *lambda.Explanation
+	if strings.HasPrefix(arg, "arn:") {
+		e, err = h.ExplainAlarm(ctx, arg)
+	} else {
+		var evt *cw.Event
+		if evt, err = readEvent(arg); err != nil {
+			return err
+		}
+		e, err = h.Explain(ctx, evt)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e)
+	}
+	return printExplanation(os.Stdout, e)
+}
+
+// readEvent reads and decodes the event in the file, or stdin for "-".
+func readEvent(path string) (*cw.Event, error) {
+	var body []byte
+	var err error
+	if path == "-" {
+		body, err = io.ReadAll(os.Stdin)
+	} else {
+		body, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading event: %w", err)
+	}
+	evt, err := cw.DecodeEvent(body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding event: %w", err)
+	}
+	return evt, nil
+}
+
+// printExplanation writes the explanation for humans.
+func printExplanation(w io.Writer, e *lambda.Explanation) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Alarm:\t%s\n", e.Alarm)
+	fmt.Fprintf(tw, "ARN:\t%s\n", e.AlarmARN)
+	fmt.Fprintf(tw, "Transition:\t%s (%s)\n", e.Transition, e.Action)
+	if e.Rejected != "" {
+		fmt.Fprintf(tw, "Rejected:\t%s\n", e.Rejected)
+		return tw.Flush()
+	}
+
+	keys := make([]string, 0, len(e.Tags))
+	for k := range e.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tags := make([]string, 0, len(keys))
+	for _, k := range keys {
+		tags = append(tags, fmt.Sprintf("%s=%s", k, e.Tags[k]))
+	}
+	fmt.Fprintf(tw, "Tags:\t%s\n", strings.Join(tags, ", "))
+	fmt.Fprintf(tw, "Slack channel:\t%s (from %s)\n", e.SlackChannel, e.SlackChannelSource)
+
+	switch pd := e.PagerDuty; {
+	case pd.Suppressed:
+		fmt.Fprintf(tw, "PagerDuty:\tsuppressed\n")
+	case pd.Error != "":
+		fmt.Fprintf(tw, "PagerDuty:\trouting key lookup failed: %s\n", pd.Error)
+	default:
+		fmt.Fprintf(tw, "PagerDuty:\trouting key %s (from %s, service %q)\n", pd.RoutingKey, pd.Source, pd.Service)
+	}
+
+	if e.Destinations != nil {
+		fmt.Fprintf(tw, "Destinations:\t%s\n", strings.Join(e.Destinations, ", "))
+	}
+	for i, d := range e.Decisions {
+		label := ""
+		if i == 0 {
+			label = "Decisions:"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", label, d)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if e.SlackMessage == nil {
+		return nil
+	}
+	var msg bytes.Buffer
+	if err := json.Indent(&msg, e.SlackMessage, "", "  "); err != nil {
+		return errors.New("slack message isn't valid json")
+	}
+	_, err := fmt.Fprintf(w, "\nSlack message (Block Kit):\n%s\n", msg.String())
+	return err
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command cw-alert-router is the router's command line tool, for working
+// out what the deployed router does, or did, without running it.
+//
+// Usage:
+//
+//	cw-alert-router explain [-json] <event file | alarm arn | ->
+//	cw-alert-router replay [flags] <s3://bucket/prefix | file | ->
+//	cw-alert-router audit [flags]
+//	cw-alert-router preflight [-json]
+//
+// It reads the router's configuration from the same environment variables
+// as the Lambda, and uses the default AWS credentials.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tidal-music/cw-alert-router/v2/lambda"
+)
+
+// commands are the subcommands, by name.
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"audit":     audit,
+	"explain":   explain,
+	"preflight": preflight,
+	"replay":    replay,
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: cw-alert-router <command> [arguments]
+
+commands:
+  audit       check every alarm's routing tags, e.g. in CI
+  explain     show how an alarm event would be routed, without sending anything
+  preflight   check the router's tokens, keys and permissions
+  replay      route archived or exported events again, as a dry run or to a test channel
+`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	// keep the handler's logging out of the way unless asked for
+	if os.Getenv(lambda.LogLevelEnv) == "" {
+		os.Setenv(lambda.LogLevelEnv, "warn")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := cmd(ctx, os.Args[2:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "cw-alert-router %s: %v\n", os.Args[1], err)
+		}
+		os.Exit(1)
+	}
+}
+
+// routerConfig reads the router's configuration from the environment. The
+// tool never emits metrics: they would mix with its output on stdout, and
+// count as the deployed router's.
+func routerConfig() lambda.Config {
+	cfg := lambda.ConfigFromEnv()
+	cfg.MetricsDisabled = true
+	return cfg
+}
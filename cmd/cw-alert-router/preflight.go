@@ -0,0 +1,85 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/tidal-music/cw-alert-router/v2/lambda"
+)
+
+// preflight runs the router's startup self-check and fails if any check
+// does, e.g. to verify a deployment's configuration before it takes
+// traffic.
+func preflight(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("preflight", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the checks as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cw-alert-router preflight [-json]")
+		fmt.Fprintln(fs.Output(), "\nChecks the Slack token, its scopes and the default channel, the default")
+		fmt.Fprintln(fs.Output(), "PagerDuty routing key and the CloudWatch, Parameter Store and image bucket")
+		fmt.Fprintln(fs.Output(), "permissions. It exits with status 1 if any check fails.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	h, err := lambda.New(ctx, routerConfig())
+	if err != nil {
+		return fmt.Errorf("initializing router: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, lambda.DefaultPreflightTimeout)
+	defer cancel()
+	report := h.Preflight(ctx)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else if err := printChecks(os.Stdout, report); err != nil {
+		return err
+	}
+	if !report.OK() {
+		return fmt.Errorf("preflight failed: %s", report.Summary())
+	}
+	return nil
+}
+
+// printChecks writes the checks as a table for humans, with the summary.
+func printChecks(w io.Writer, report *lambda.PreflightReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, c := range report.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Name, c.Status, c.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, "\n"+report.Summary())
+	return err
+}
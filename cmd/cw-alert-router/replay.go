@@ -0,0 +1,279 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/archive"
+	"github.com/tidal-music/cw-alert-router/v2/lambda"
+	"github.com/tidal-music/cw-alert-router/v2/s3"
+)
+
+// replayResult is what became of one replayed event.
+type replayResult struct {
+	EventID    string    `json:"event_id"`
+	Alarm      string    `json:"alarm"`
+	Time       time.Time `json:"time"`
+	Transition string    `json:"transition"`
+	// Destinations are the destinations the event is routed to now (dry
+	// run) or was delivered to (live).
+	Destinations []string `json:"destinations"`
+	// Archived are the destinations the event was delivered to when it was
+	// archived, and Changed whether its routing differs now (dry run only).
+	Archived    []string            `json:"archived_destinations,omitempty"`
+	Changed     bool                `json:"changed,omitempty"`
+	Explanation *lambda.Explanation `json:"explanation,omitempty"`
+	Outcomes    []archive.Outcome   `json:"outcomes,omitempty"`
+	Error       string              `json:"error,omitempty"`
+}
+
+// replay feeds archived events, or an export of EventBridge events, through
+// the router again: as a dry run explaining how each would be routed now,
+// or live with every delivery redirected to the given Slack channel (and
+// PagerDuty routing key).
+func replay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	from := fs.String("from", "", "replay events processed from this time (RFC 3339 or a date)")
+	to := fs.String("to", "", "replay events processed before this time (RFC 3339 or a date, default now for the archive)")
+	live := fs.Bool("live", false, "deliver the events, instead of explaining their routing")
+	slackChannel := fs.String("slack-channel", "", "Slack channel live deliveries go to (required with -live)")
+	routingKey := fs.String("pagerduty-routing-key", "", "PagerDuty routing key live deliveries page (default: PagerDuty is skipped)")
+	asJSON := fs.Bool("json", false, "print a JSON result per event")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cw-alert-router replay [flags] <s3://bucket/prefix | file | ->")
+		fmt.Fprintln(fs.Output(), "\nThe events are read from the router's archive (e.g. s3://bucket/archive, which")
+		fmt.Fprintln(fs.Output(), "requires -from), or a file of archive entries or events such as an EventBridge")
+		fmt.Fprintln(fs.Output(), "archive export, as JSON lines or arrays and optionally gzipped; - reads stdin.")
+		fmt.Fprintln(fs.Output(), "Without -live nothing is delivered. Live replays deliver only to the given Slack")
+		fmt.Fprintln(fs.Output(), "channel and PagerDuty routing key, and never touch the delivery ledger, flapping")
+		fmt.Fprintln(fs.Output(), "state or the archive.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	source := fs.Arg(0)
+
+	var start, end time.Time
+	var err error
+	if *from != "" {
+		if start, err = parseTime(*from); err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+	}
+	if *to != "" {
+		if end, err = parseTime(*to); err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+	}
+	if *live && *slackChannel == "" {
+		return fmt.Errorf("-live requires -slack-channel")
+	}
+
+	// replays mustn't see or change what the deployed router keeps
+	cfg := routerConfig()
+	cfg.DeliveryLedgerTable = ""
+	cfg.AlarmStateTable = ""
+	cfg.ArchiveBucket = ""
+	cfg.QuarantineBucket = ""
+	cfg.QuarantineQueueURL = ""
+	var opts []lambda.Option
+	if *live {
+		// only Slack and PagerDuty can be redirected
+		cfg.IncidentManagerEnabled = false
+		cfg.OpsCenterEnabled = false
+		cfg.ServiceNowInstanceURL = ""
+		cfg.GoogleChatEnabled = false
+		cfg.MattermostEnabled = false
+		opts = append(opts, lambda.WithDestinationOverride(lambda.Override{
+			SlackChannel:        *slackChannel,
+			PagerDutyRoutingKey: *routingKey,
+		}))
+	}
+	h, err := lambda.New(ctx, cfg, opts...)
+	if err != nil {
+		return fmt.Errorf("initializing router: %w", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	enc := json.NewEncoder(os.Stdout)
+	var replayed, changed, failed int
+	err = readEntries(ctx, source, start, end, func(e archive.Entry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res := replayEntry(ctx, h, e, *live)
+		replayed++
+		if res.Changed {
+			changed++
+		}
+		if res.Error != "" {
+			failed++
+		}
+		if *asJSON {
+			return enc.Encode(res)
+		}
+		printResult(tw, res)
+		return nil
+	})
+	if ferr := tw.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case *asJSON:
+	case *live:
+		fmt.Fprintf(os.Stderr, "replayed %d events: %d failed\n", replayed, failed)
+	default:
+		fmt.Fprintf(os.Stderr, "replayed %d events: %d routed differently, %d failed\n", replayed, changed, failed)
+	}
+	return nil
+}
+
+// readEntries calls fn with the entries from the source, an archive in S3
+// or a file, processed (or, for bare events, sent) in [from, to). Zero
+// times don't limit the range of files; the archive requires from, and to
+// defaults to now.
+func readEntries(ctx context.Context, source string, from, to time.Time, fn func(archive.Entry) error) error {
+	if strings.HasPrefix(source, "s3://") {
+		u, err := url.Parse(source)
+		if err != nil {
+			return fmt.Errorf("parsing archive url: %w", err)
+		}
+		if from.IsZero() {
+			return fmt.Errorf("-from is required to replay from an archive")
+		}
+		if to.IsZero() {
+			to = time.Now()
+		}
+		client, err := s3.New(ctx)
+		if err != nil {
+			return err
+		}
+		return archive.NewS3(client, u.Host, u.Path).Read(ctx, from, to, fn)
+	}
+
+	var r io.Reader = os.Stdin
+	if source != "-" {
+		f, err := os.Open(source)
+		if err != nil {
+			return fmt.Errorf("opening events: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	return archive.Decode(r, func(e archive.Entry) error {
+		t := e.Time()
+		if (!from.IsZero() && t.Before(from)) || (!to.IsZero() && !t.Before(to)) {
+			return nil
+		}
+		return fn(e)
+	})
+}
+
+// replayEntry explains or delivers the entry's event.
+func replayEntry(ctx context.Context, h *lambda.Handler, e archive.Entry, live bool) replayResult {
+	evt := e.Event
+	res := replayResult{
+		EventID:    evt.ID,
+		Alarm:      evt.Detail.AlarmName,
+		Time:       e.Time(),
+		Transition: fmt.Sprintf("%s -> %s", evt.Detail.PreviousState.Value, evt.Detail.State.Value),
+	}
+
+	if live {
+		outcomes, err := h.DeliverEvent(ctx, evt)
+		for _, o := range outcomes {
+			ao := archive.Outcome{Destination: o.Destination, Skipped: o.Skipped}
+			if o.Err != nil {
+				ao.Error = o.Err.Error()
+			}
+			res.Outcomes = append(res.Outcomes, ao)
+			res.Destinations = append(res.Destinations, o.Destination)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		return res
+	}
+
+	x, err := h.Explain(ctx, evt)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Explanation = x
+	res.Destinations = x.Destinations
+	if x.Rejected != "" {
+		res.Error = x.Rejected
+	}
+	// bare events carry no history to compare with
+	if !e.ProcessedAt.IsZero() {
+		for _, o := range e.Outcomes {
+			res.Archived = append(res.Archived, o.Destination)
+		}
+		res.Changed = !sameDestinations(res.Destinations, res.Archived)
+	}
+	return res
+}
+
+// sameDestinations reports whether a and b hold the same destinations, in
+// any order.
+func sameDestinations(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// printResult writes a line about the result for humans.
+func printResult(w io.Writer, res replayResult) {
+	status := strings.Join(res.Destinations, ", ")
+	if status == "" {
+		status = "not routed"
+	}
+	switch {
+	case res.Error != "":
+		status = "failed: " + res.Error
+	case res.Changed:
+		status = fmt.Sprintf("%s (changed, was: %s)", status, strings.Join(res.Archived, ", "))
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", res.Time.UTC().Format(time.RFC3339), res.Alarm, res.Transition, status)
+}
+
+// parseTime parses an RFC 3339 time or a date (midnight UTC).
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
@@ -0,0 +1,234 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cw
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// ClassicAlarm is the alarm notification CloudWatch publishes to the SNS
+// topics in an alarm's actions, predating EventBridge.
+type ClassicAlarm struct {
+	AlarmName        string  `json:"AlarmName"`
+	AlarmDescription *string `json:"AlarmDescription"`
+	AWSAccountID     string  `json:"AWSAccountId"`
+	AlarmARN         string  `json:"AlarmArn"`
+	NewStateValue    string  `json:"NewStateValue"`
+	NewStateReason   string  `json:"NewStateReason"`
+	OldStateValue    string  `json:"OldStateValue"`
+	StateChangeTime  string  `json:"StateChangeTime"`
+	Trigger          Trigger `json:"Trigger"`
+}
+
+// Trigger is the metric configuration of a classic alarm notification:
+// either a single metric, or the metric math queries in Metrics.
+type Trigger struct {
+	MetricName        string             `json:"MetricName"`
+	Namespace         string             `json:"Namespace"`
+	Statistic         string             `json:"Statistic"`
+	ExtendedStatistic string             `json:"ExtendedStatistic"`
+	Dimensions        []TriggerDimension `json:"Dimensions"`
+	Period            int64              `json:"Period"`
+	Threshold         *float64           `json:"Threshold"`
+	Metrics           []TriggerQuery     `json:"Metrics"`
+}
+
+// TriggerDimension is a metric dimension of a classic alarm notification.
+type TriggerDimension struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// TriggerQuery is a metric math query of a classic alarm notification.
+type TriggerQuery struct {
+	ID         string `json:"Id"`
+	Expression string `json:"Expression"`
+	Label      string `json:"Label"`
+	ReturnData bool   `json:"ReturnData"`
+	MetricStat *struct {
+		Metric struct {
+			MetricName string             `json:"MetricName"`
+			Namespace  string             `json:"Namespace"`
+			Dimensions []TriggerDimension `json:"Dimensions"`
+		} `json:"Metric"`
+		Period int64  `json:"Period"`
+		Stat   string `json:"Stat"`
+	} `json:"MetricStat"`
+}
+
+// classicStatistics maps the statistics of classic notifications to the
+// names metric queries use.
+var classicStatistics = map[string]string{
+	"AVERAGE":      "Average",
+	"SUM":          "Sum",
+	"SAMPLE_COUNT": "SampleCount",
+	"MINIMUM":      "Minimum",
+	"MAXIMUM":      "Maximum",
+}
+
+// snsEnvelope is the envelope SNS wraps messages in, unless raw message
+// delivery is enabled.
+type snsEnvelope struct {
+	Type     string `json:"Type"`
+	TopicARN string `json:"TopicArn"`
+	Message  string `json:"Message"`
+}
+
+// DecodeEvent decodes an alarm event from a message body: an EventBridge
+// alarm state change event, or a classic alarm notification, either as is
+// or wrapped in an SNS envelope (which gives the event its TopicARN).
+// Anything else is decoded as an EventBridge event, for Verify to reject.
+func DecodeEvent(body []byte) (*Event, error) {
+	var env snsEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, err
+	}
+	if env.Type == "Notification" && env.TopicARN != "" {
+		body = []byte(env.Message)
+	}
+
+	var probe struct {
+		DetailType    string `json:"detail-type"`
+		AlarmName     string `json:"AlarmName"`
+		NewStateValue string `json:"NewStateValue"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, err
+	}
+	if probe.DetailType == "" && probe.AlarmName != "" && probe.NewStateValue != "" {
+		var a ClassicAlarm
+		if err := json.Unmarshal(body, &a); err != nil {
+			return nil, fmt.Errorf("decoding classic alarm notification: %w", err)
+		}
+		evt := a.Event()
+		evt.TopicARN = env.TopicARN
+		return evt, nil
+	}
+
+	evt := &Event{}
+	if err := json.Unmarshal(body, evt); err != nil {
+		return nil, err
+	}
+	return evt, nil
+}
+
+// Event converts the notification into the EventBridge event CloudWatch
+// sends for the same state change. The event ID is derived from the alarm
+// and the time of the change, so the same notification received twice has
+// the same ID.
+func (a *ClassicAlarm) Event() *Event {
+	evt := &Event{
+		Version:    "0",
+		ID:         a.AlarmARN + "/" + a.StateChangeTime,
+		DetailType: DetailTypeAlarmStateChange,
+		Source:     SourceCloudWatch,
+		Account:    a.AWSAccountID,
+		Resources:  []string{a.AlarmARN},
+		Classic:    true,
+		Detail: AlarmStateChange{
+			AlarmName: a.AlarmName,
+			State: State{
+				Value:     a.NewStateValue,
+				Reason:    a.NewStateReason,
+				Timestamp: a.StateChangeTime,
+			},
+			PreviousState: State{Value: a.OldStateValue},
+			Configuration: Configuration{Metrics: a.Trigger.queries()},
+		},
+	}
+	// the notification's region is a display name, e.g. "EU (Ireland)"
+	if parsed, err := arn.Parse(a.AlarmARN); err == nil {
+		evt.Region = parsed.Region
+	}
+	if t, err := time.Parse(stateTimestampLayout, a.StateChangeTime); err == nil {
+		evt.Time = t.UTC().Format(time.RFC3339)
+	}
+	if a.AlarmDescription != nil {
+		evt.Detail.Configuration.Description = *a.AlarmDescription
+	}
+	if a.Trigger.Threshold != nil {
+		rd, _ := json.Marshal(struct {
+			Threshold float64 `json:"threshold"`
+		}{*a.Trigger.Threshold})
+		evt.Detail.State.ReasonData = string(rd)
+	}
+	return evt
+}
+
+// queries returns the trigger's metric queries.
+func (t *Trigger) queries() []MetricDataQuery {
+	if len(t.Metrics) == 0 {
+		if t.MetricName == "" {
+			// composite alarms have no metrics
+			return nil
+		}
+		stat := t.ExtendedStatistic
+		if stat == "" {
+			stat = classicStatistic(t.Statistic)
+		}
+		return []MetricDataQuery{{
+			ID:         "m1",
+			ReturnData: true,
+			MetricStat: &MetricStat{
+				Metric: Metric{Namespace: t.Namespace, Name: t.MetricName, Dimensions: dimensions(t.Dimensions)},
+				Period: t.Period,
+				Stat:   stat,
+			},
+		}}
+	}
+
+	queries := make([]MetricDataQuery, 0, len(t.Metrics))
+	for _, m := range t.Metrics {
+		q := MetricDataQuery{ID: m.ID, Expression: m.Expression, Label: m.Label, ReturnData: m.ReturnData}
+		if m.MetricStat != nil {
+			q.MetricStat = &MetricStat{
+				Metric: Metric{
+					Namespace:  m.MetricStat.Metric.Namespace,
+					Name:       m.MetricStat.Metric.MetricName,
+					Dimensions: dimensions(m.MetricStat.Metric.Dimensions),
+				},
+				Period: m.MetricStat.Period,
+				Stat:   m.MetricStat.Stat,
+			}
+		}
+		queries = append(queries, q)
+	}
+	return queries
+}
+
+// classicStatistic returns the metric query name of a classic statistic.
+func classicStatistic(stat string) string {
+	if s, ok := classicStatistics[strings.ToUpper(stat)]; ok {
+		return s
+	}
+	return stat
+}
+
+// dimensions converts a notification's dimensions into the event's.
+func dimensions(ds []TriggerDimension) map[string]string {
+	if len(ds) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(ds))
+	for _, d := range ds {
+		m[d.Name] = d.Value
+	}
+	return m
+}
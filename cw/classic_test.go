@@ -0,0 +1,191 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cw_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+func TestDecodeEventClassic(t *testing.T) {
+	for name, body := range map[string]string{
+		"raw":     test.ClassicAlarmJSON,
+		"wrapped": test.SNSNotification(test.ClassicAlarmJSON),
+	} {
+		evt, err := cw.DecodeEvent([]byte(body))
+		if err != nil {
+			t.Fatalf("%s: failed decoding: %v", name, err)
+		}
+		if err := evt.Verify(); err != nil {
+			t.Errorf("%s: converted event doesn't verify: %v", name, err)
+		}
+		if !evt.Classic {
+			t.Errorf("%s: expected the event to be marked classic", name)
+		}
+
+		expected := test.TriggeredAlarmDetails
+		if evt.Region != expected.Region || evt.Account != expected.Account || evt.Time != expected.Time {
+			t.Errorf("%s: expected region %s, account %s and time %s, got %s, %s and %s", name,
+				expected.Region, expected.Account, expected.Time, evt.Region, evt.Account, evt.Time)
+		}
+		if !reflect.DeepEqual(evt.Resources, expected.Resources) {
+			t.Errorf("%s: expected resources %v, got %v", name, expected.Resources, evt.Resources)
+		}
+		d := evt.Detail
+		if d.AlarmName != expected.Detail.AlarmName || d.State.Value != cw.StateAlarm ||
+			d.PreviousState.Value != cw.StateInsufficientData || d.State.Reason != expected.Detail.State.Reason {
+			t.Errorf("%s: unexpected alarm state: %+v", name, d)
+		}
+		if !evt.StateChangeTime().Equal(expected.StateChangeTime()) {
+			t.Errorf("%s: expected state change time %s, got %s", name, expected.StateChangeTime(), evt.StateChangeTime())
+		}
+		if threshold, ok := evt.Threshold(); !ok || threshold != 60 {
+			t.Errorf("%s: expected threshold 60, got %v (%t)", name, threshold, ok)
+		}
+
+		metrics := d.Configuration.Metrics
+		if len(metrics) != 1 || metrics[0].MetricStat == nil || !metrics[0].ReturnData {
+			t.Fatalf("%s: expected one returned metric, got %+v", name, metrics)
+		}
+		expectedStat := *expected.Detail.Configuration.Metrics[0].MetricStat
+		if !reflect.DeepEqual(*metrics[0].MetricStat, expectedStat) {
+			t.Errorf("%s: expected metric %+v, got %+v", name, expectedStat, *metrics[0].MetricStat)
+		}
+	}
+}
+
+func TestDecodeEventClassicTopic(t *testing.T) {
+	raw, err := cw.DecodeEvent([]byte(test.ClassicAlarmJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.TopicARN != "" {
+		t.Errorf("expected no topic without an envelope, got %s", raw.TopicARN)
+	}
+	wrapped, err := cw.DecodeEvent([]byte(test.SNSNotification(test.ClassicAlarmJSON)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.TopicARN != "arn:aws:sns:us-east-1:1234567890123:alarms" {
+		t.Errorf("expected the envelope's topic, got %q", wrapped.TopicARN)
+	}
+}
+
+func TestDecodeEventClassicID(t *testing.T) {
+	raw, err := cw.DecodeEvent([]byte(test.ClassicAlarmJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := cw.DecodeEvent([]byte(test.SNSNotification(test.ClassicAlarmJSON)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.ID == "" || raw.ID != wrapped.ID {
+		t.Errorf("expected the same state change to get the same id, got %q and %q", raw.ID, wrapped.ID)
+	}
+}
+
+func TestDecodeEventClassicMetricMath(t *testing.T) {
+	var a map[string]any
+	if err := json.Unmarshal([]byte(test.ClassicAlarmJSON), &a); err != nil {
+		t.Fatal(err)
+	}
+	a["Trigger"] = map[string]any{
+		"Period":            60,
+		"Threshold":         1.5,
+		"EvaluationPeriods": 1,
+		"Metrics": []any{
+			map[string]any{"Id": "e1", "Expression": "m1/m2*100", "Label": "Error rate", "ReturnData": true},
+			map[string]any{"Id": "m1", "ReturnData": false, "MetricStat": map[string]any{
+				"Metric": map[string]any{
+					"Namespace":  "AWS/ApplicationELB",
+					"MetricName": "HTTPCode_Target_5XX_Count",
+					"Dimensions": []any{map[string]any{"name": "LoadBalancer", "value": "app/test/123"}},
+				},
+				"Period": 60, "Stat": "Sum",
+			}},
+			map[string]any{"Id": "m2", "ReturnData": false, "MetricStat": map[string]any{
+				"Metric": map[string]any{"Namespace": "AWS/ApplicationELB", "MetricName": "RequestCount"},
+				"Period": 60, "Stat": "Sum",
+			}},
+		},
+	}
+	body, _ := json.Marshal(a)
+
+	evt, err := cw.DecodeEvent(body)
+	if err != nil {
+		t.Fatalf("failed decoding: %v", err)
+	}
+	expected := []cw.MetricDataQuery{
+		{ID: "e1", Expression: "m1/m2*100", Label: "Error rate", ReturnData: true},
+		{ID: "m1", MetricStat: &cw.MetricStat{Period: 60, Stat: "Sum", Metric: cw.Metric{
+			Namespace: "AWS/ApplicationELB", Name: "HTTPCode_Target_5XX_Count",
+			Dimensions: map[string]string{"LoadBalancer": "app/test/123"},
+		}}},
+		{ID: "m2", MetricStat: &cw.MetricStat{Period: 60, Stat: "Sum", Metric: cw.Metric{
+			Namespace: "AWS/ApplicationELB", Name: "RequestCount",
+		}}},
+	}
+	if !reflect.DeepEqual(evt.Detail.Configuration.Metrics, expected) {
+		t.Errorf("expected metrics %+v, got %+v", expected, evt.Detail.Configuration.Metrics)
+	}
+}
+
+func TestDecodeEventClassicExtendedStatistic(t *testing.T) {
+	var a map[string]any
+	if err := json.Unmarshal([]byte(test.ClassicAlarmJSON), &a); err != nil {
+		t.Fatal(err)
+	}
+	trigger := a["Trigger"].(map[string]any)
+	trigger["StatisticType"] = "ExtendedStatistic"
+	trigger["Statistic"] = nil
+	trigger["ExtendedStatistic"] = "p99"
+	body, _ := json.Marshal(a)
+
+	evt, err := cw.DecodeEvent(body)
+	if err != nil {
+		t.Fatalf("failed decoding: %v", err)
+	}
+	if stat := evt.Detail.Configuration.Metrics[0].MetricStat.Stat; stat != "p99" {
+		t.Errorf("expected stat p99, got %s", stat)
+	}
+}
+
+func TestDecodeEventEventBridge(t *testing.T) {
+	for name, body := range map[string]string{
+		"raw":     test.TestEventJSON,
+		"wrapped": test.SNSNotification(test.TestEventJSON),
+	} {
+		evt, err := cw.DecodeEvent([]byte(body))
+		if err != nil {
+			t.Fatalf("%s: failed decoding: %v", name, err)
+		}
+		if !reflect.DeepEqual(evt, &test.ExpectedAlarmDetails) {
+			t.Errorf("%s: decoded event didn't match.\ndecoded:  %+v\nexpected: %+v", name, evt, test.ExpectedAlarmDetails)
+		}
+	}
+}
+
+func TestDecodeEventMalformed(t *testing.T) {
+	for _, body := range []string{"this is not json{", `"a string"`, test.SNSNotification("this is not json{")} {
+		if _, err := cw.DecodeEvent([]byte(body)); err == nil {
+			t.Errorf("expected an error decoding %q", body)
+		}
+	}
+}
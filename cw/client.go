@@ -17,6 +17,7 @@ package cw
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"maps"
 	"regexp"
@@ -25,6 +26,7 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 )
 
 // DefaultGraphWindow is how much metric history the alarm graph shows.
@@ -40,6 +42,7 @@ const (
 type API interface {
 	ListTagsForResource(ctx context.Context, params *cloudwatch.ListTagsForResourceInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.ListTagsForResourceOutput, error)
 	GetMetricWidgetImage(ctx context.Context, params *cloudwatch.GetMetricWidgetImageInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricWidgetImageOutput, error)
+	DescribeAlarms(ctx context.Context, params *cloudwatch.DescribeAlarmsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.DescribeAlarmsOutput, error)
 }
 
 // Client provides the CloudWatch calls this service needs.
@@ -72,6 +75,13 @@ func (c *Client) AlarmTags(ctx context.Context, alarmARN string) (map[string]str
 	return tags, nil
 }
 
+// IsNotFound reports whether the error means the requested alarm does not
+// exist.
+func IsNotFound(err error) bool {
+	var nf *types.ResourceNotFoundException
+	return errors.As(err, &nf)
+}
+
 // widget is the metric-widget definition passed to GetMetricWidgetImage.
 // It is built from the metric queries in the alarm event payload:
 // GetMetricWidgetImage does not accept the dashboard-only alarm annotation
@@ -18,10 +18,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+
 	"github.com/tidal-music/cw-alert-router/v2/cw"
 	"github.com/tidal-music/cw-alert-router/v2/test"
 )
@@ -38,8 +42,8 @@ func TestAlarmTags(t *testing.T) {
 		t.Errorf("expected owner tag 'test', got %q (all tags: %v)", tags["owner"], tags)
 	}
 
-	if _, err := client.AlarmTags(context.Background(), "arn:aws:cloudwatch:us-east-1:1234567890123:alarm:nonexistent"); err == nil {
-		t.Errorf("expected error for unknown alarm arn")
+	if _, err := client.AlarmTags(context.Background(), "arn:aws:cloudwatch:us-east-1:1234567890123:alarm:nonexistent"); !cw.IsNotFound(err) {
+		t.Errorf("expected a not found error for unknown alarm arn, got %v", err)
 	}
 }
 
@@ -138,3 +142,67 @@ func TestAlarmWidgetImageNoMetrics(t *testing.T) {
 		t.Errorf("expected error for an event without metrics (e.g. composite alarm)")
 	}
 }
+
+func TestAlarmEvent(t *testing.T) {
+	client := cw.NewClientWithAPI(&test.MockCWAPI{})
+	expected := test.TriggeredAlarmDetails
+
+	evt, err := client.AlarmEvent(context.Background(), expected.Resources[0])
+	if err != nil {
+		t.Fatalf("failed describing alarm: %v", err)
+	}
+	if err := evt.Verify(); err != nil {
+		t.Errorf("described event doesn't verify: %v", err)
+	}
+	if evt.Detail.State.Value != cw.StateAlarm || evt.Detail.PreviousState.Value != cw.StateOK {
+		t.Errorf("expected an OK -> ALARM transition, got %s -> %s", evt.Detail.PreviousState.Value, evt.Detail.State.Value)
+	}
+	if !evt.StateChangeTime().Equal(expected.StateChangeTime()) {
+		t.Errorf("expected state change time %s, got %s", expected.StateChangeTime(), evt.StateChangeTime())
+	}
+	if threshold, ok := evt.Threshold(); !ok || threshold != 60 {
+		t.Errorf("expected threshold 60, got %v (%t)", threshold, ok)
+	}
+	metrics := evt.Detail.Configuration.Metrics
+	if len(metrics) != 1 || metrics[0].MetricStat == nil {
+		t.Fatalf("expected one metric, got %+v", metrics)
+	}
+	if got, want := *metrics[0].MetricStat, *expected.Detail.Configuration.Metrics[0].MetricStat; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected metric %+v, got %+v", want, got)
+	}
+
+	if _, err := client.AlarmEvent(context.Background(), "arn:aws:cloudwatch:us-east-1:1234567890123:alarm:missing"); err == nil {
+		t.Error("expected an error for a missing alarm")
+	}
+	if _, err := client.AlarmEvent(context.Background(), "arn:aws:sns:us-east-1:1234567890123:alarms"); err == nil {
+		t.Error("expected an error for a non-alarm arn")
+	}
+}
+
+func TestAlarms(t *testing.T) {
+	other := test.DescribedAlarm
+	other.AlarmName = aws.String("other-alarm")
+	other.AlarmArn = aws.String("arn:aws:cloudwatch:us-east-1:1234567890123:alarm:other-alarm")
+	client := cw.NewClientWithAPI(&test.MockCWAPI{
+		Alarms: []cwtypes.MetricAlarm{test.DescribedAlarm, other},
+		CompositeAlarms: []cwtypes.CompositeAlarm{{
+			AlarmName: aws.String("composite"),
+			AlarmArn:  aws.String("arn:aws:cloudwatch:us-east-1:1234567890123:alarm:composite"),
+		}},
+	})
+
+	alarms, err := client.Alarms(context.Background())
+	if err != nil {
+		t.Fatalf("failed listing alarms: %v", err)
+	}
+	var names []string
+	for _, a := range alarms {
+		names = append(names, a.Name)
+		if !strings.HasSuffix(a.ARN, ":alarm:"+a.Name) {
+			t.Errorf("unexpected arn %s for %s", a.ARN, a.Name)
+		}
+	}
+	if want := []string{"test-service-alarm-abcd", "other-alarm", "composite"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected every page listed %v, got %v", want, names)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cw
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// Alarm identifies a CloudWatch alarm.
+type Alarm struct {
+	Name string `json:"name"`
+	ARN  string `json:"arn"`
+}
+
+// Alarms lists the metric and composite alarms in the client's account and
+// region.
+func (c *Client) Alarms(ctx context.Context) ([]Alarm, error) {
+	var alarms []Alarm
+	p := cloudwatch.NewDescribeAlarmsPaginator(c.api, &cloudwatch.DescribeAlarmsInput{
+		AlarmTypes: []types.AlarmType{types.AlarmTypeMetricAlarm, types.AlarmTypeCompositeAlarm},
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing alarms: %w", err)
+		}
+		for _, a := range page.MetricAlarms {
+			alarms = append(alarms, Alarm{Name: aws.ToString(a.AlarmName), ARN: aws.ToString(a.AlarmArn)})
+		}
+		for _, a := range page.CompositeAlarms {
+			alarms = append(alarms, Alarm{Name: aws.ToString(a.AlarmName), ARN: aws.ToString(a.AlarmArn)})
+		}
+	}
+	return alarms, nil
+}
+
+// AlarmEvent describes the alarm and returns the event CloudWatch sent when
+// it entered its current state. The previous state isn't kept by
+// CloudWatch: an alarm in ALARM is taken to have come from OK and vice
+// versa, so the event is routed like the alarm's last trigger or resolve.
+func (c *Client) AlarmEvent(ctx context.Context, alarmARN string) (*Event, error) {
+	parsed, err := arn.Parse(alarmARN)
+	if err != nil {
+		return nil, fmt.Errorf("parsing alarm arn: %w", err)
+	}
+	name, ok := strings.CutPrefix(parsed.Resource, "alarm:")
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an alarm arn", alarmARN)
+	}
+	out, err := c.api.DescribeAlarms(ctx, &cloudwatch.DescribeAlarmsInput{
+		AlarmNames: []string{name},
+		AlarmTypes: []types.AlarmType{types.AlarmTypeMetricAlarm, types.AlarmTypeCompositeAlarm},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing alarm %s: %w", name, err)
+	}
+
+	evt := &Event{
+		Version:    "0",
+		DetailType: DetailTypeAlarmStateChange,
+		Source:     SourceCloudWatch,
+		Account:    parsed.AccountID,
+		Region:     parsed.Region,
+		Resources:  []string{alarmARN},
+		Detail:     AlarmStateChange{AlarmName: name},
+	}
+	var state types.StateValue
+	var reason, reasonData, description *string
+	var changed *time.Time
+	switch {
+	case len(out.MetricAlarms) > 0:
+		a := out.MetricAlarms[0]
+		state, reason, reasonData, description = a.StateValue, a.StateReason, a.StateReasonData, a.AlarmDescription
+		changed = a.StateTransitionedTimestamp
+		evt.Detail.Configuration.Metrics = metricAlarmQueries(a)
+	case len(out.CompositeAlarms) > 0:
+		a := out.CompositeAlarms[0]
+		state, reason, reasonData, description = a.StateValue, a.StateReason, a.StateReasonData, a.AlarmDescription
+		changed = a.StateTransitionedTimestamp
+	default:
+		return nil, fmt.Errorf("alarm %s not found", name)
+	}
+
+	evt.Detail.State = State{
+		Value:      string(state),
+		Reason:     aws.ToString(reason),
+		ReasonData: aws.ToString(reasonData),
+	}
+	switch evt.Detail.State.Value {
+	case StateAlarm:
+		evt.Detail.PreviousState.Value = StateOK
+	case StateOK:
+		evt.Detail.PreviousState.Value = StateAlarm
+	}
+	evt.Detail.Configuration.Description = aws.ToString(description)
+	if changed != nil {
+		evt.Time = changed.UTC().Format(time.RFC3339)
+		evt.Detail.State.Timestamp = changed.UTC().Format(stateTimestampLayout)
+	}
+	evt.ID = alarmARN + "/" + evt.Detail.State.Timestamp
+	return evt, nil
+}
+
+// metricAlarmQueries returns the metric queries of a metric alarm, as the
+// event's configuration lists them.
+func metricAlarmQueries(a types.MetricAlarm) []MetricDataQuery {
+	if len(a.Metrics) == 0 {
+		stat := aws.ToString(a.ExtendedStatistic)
+		if stat == "" {
+			stat = string(a.Statistic)
+		}
+		return []MetricDataQuery{{
+			ID:         "m1",
+			ReturnData: true,
+			MetricStat: &MetricStat{
+				Metric: Metric{
+					Namespace:  aws.ToString(a.Namespace),
+					Name:       aws.ToString(a.MetricName),
+					Dimensions: describedDimensions(a.Dimensions),
+				},
+				Period: int64(aws.ToInt32(a.Period)),
+				Stat:   stat,
+			},
+		}}
+	}
+
+	queries := make([]MetricDataQuery, 0, len(a.Metrics))
+	for _, m := range a.Metrics {
+		q := MetricDataQuery{
+			ID:         aws.ToString(m.Id),
+			Expression: aws.ToString(m.Expression),
+			Label:      aws.ToString(m.Label),
+			ReturnData: m.ReturnData == nil || *m.ReturnData,
+		}
+		if ms := m.MetricStat; ms != nil && ms.Metric != nil {
+			q.MetricStat = &MetricStat{
+				Metric: Metric{
+					Namespace:  aws.ToString(ms.Metric.Namespace),
+					Name:       aws.ToString(ms.Metric.MetricName),
+					Dimensions: describedDimensions(ms.Metric.Dimensions),
+				},
+				Period: int64(aws.ToInt32(ms.Period)),
+				Stat:   aws.ToString(ms.Stat),
+			}
+		}
+		queries = append(queries, q)
+	}
+	return queries
+}
+
+// describedDimensions converts described dimensions into the event's.
+func describedDimensions(ds []types.Dimension) map[string]string {
+	if len(ds) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(ds))
+	for _, d := range ds {
+		m[aws.ToString(d.Name)] = aws.ToString(d.Value)
+	}
+	return m
+}
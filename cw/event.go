@@ -21,6 +21,8 @@ import (
 	"fmt"
 	"net/url"
 	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 )
 
 // Alarm state values as sent by CloudWatch.
@@ -30,6 +32,12 @@ const (
 	StateInsufficientData = "INSUFFICIENT_DATA"
 )
 
+// EventBridge source and detail type of alarm state change events.
+const (
+	SourceCloudWatch           = "aws.cloudwatch"
+	DetailTypeAlarmStateChange = "CloudWatch Alarm State Change"
+)
+
 // stateTimestampLayout is the timestamp format CloudWatch uses inside the
 // alarm state payload (differs from the RFC3339 event envelope time).
 const stateTimestampLayout = "2006-01-02T15:04:05.000-0700"
@@ -46,6 +54,14 @@ type Event struct {
 	Region     string           `json:"region"`
 	Resources  []string         `json:"resources"`
 	Detail     AlarmStateChange `json:"detail"`
+
+	// Classic marks events converted from a classic SNS alarm notification
+	// (see ClassicAlarm.Event). Their envelope fields come from the
+	// notification's body, not from EventBridge.
+	Classic bool `json:"-"`
+	// TopicARN is the SNS topic a classic notification was published to,
+	// if known.
+	TopicARN string `json:"-"`
 }
 
 // AlarmStateChange is the event detail payload for a CloudWatch alarm state change.
@@ -109,6 +125,41 @@ func (e *Event) AlarmARN() (string, error) {
 	return e.Resources[0], nil
 }
 
+// Verify checks that the event is consistent with one CloudWatch emits: its
+// source and detail type, and an alarm ARN in the event's account and region
+// naming the alarm in the payload. EventBridge sets the envelope fields, so
+// a mismatch means the event was put on the queue by someone else. A
+// Classic event's envelope is derived from its body, so Verify passes for
+// any well-formed notification; the topic it came from (TopicARN) has to
+// be checked instead.
+func (e *Event) Verify() error {
+	if e.Source != SourceCloudWatch {
+		return fmt.Errorf("unexpected event source %q", e.Source)
+	}
+	if e.DetailType != DetailTypeAlarmStateChange {
+		return fmt.Errorf("unexpected detail type %q", e.DetailType)
+	}
+	alarmARN, err := e.AlarmARN()
+	if err != nil {
+		return err
+	}
+	a, err := arn.Parse(alarmARN)
+	if err != nil {
+		return fmt.Errorf("parsing alarm arn: %w", err)
+	}
+	switch {
+	case a.Service != "cloudwatch":
+		return fmt.Errorf("alarm arn %s isn't a cloudwatch arn", alarmARN)
+	case a.AccountID != e.Account:
+		return fmt.Errorf("alarm arn %s isn't in the event's account %s", alarmARN, e.Account)
+	case a.Region != e.Region:
+		return fmt.Errorf("alarm arn %s isn't in the event's region %s", alarmARN, e.Region)
+	case a.Resource != "alarm:"+e.Detail.AlarmName:
+		return fmt.Errorf("alarm arn %s doesn't match alarm name %q", alarmARN, e.Detail.AlarmName)
+	}
+	return nil
+}
+
 // ConsoleLink returns a URL to the alarm in the AWS console.
 func (e *Event) ConsoleLink() string {
 	return fmt.Sprintf("https://console.aws.amazon.com/cloudwatch/home?region=%s#alarmsV2:alarm/%s",
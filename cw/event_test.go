@@ -108,3 +108,32 @@ func TestStateChangeTime(t *testing.T) {
 		t.Errorf("fallback state change time (%v) didn't match expected (%v)", got, want)
 	}
 }
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*cw.Event)
+		valid  bool
+	}{
+		{name: "cloudwatch event", modify: func(*cw.Event) {}, valid: true},
+		{name: "other source", modify: func(e *cw.Event) { e.Source = "custom.app" }},
+		{name: "other detail type", modify: func(e *cw.Event) { e.DetailType = "EC2 Instance State-change Notification" }},
+		{name: "no resources", modify: func(e *cw.Event) { e.Resources = nil }},
+		{name: "not an arn", modify: func(e *cw.Event) { e.Resources = []string{"test-service-alarm-abcd"} }},
+		{name: "other account", modify: func(e *cw.Event) { e.Account = "999999999999" }},
+		{name: "other region", modify: func(e *cw.Event) { e.Region = "eu-west-1" }},
+		{name: "other alarm name", modify: func(e *cw.Event) { e.Detail.AlarmName = "someone-elses-alarm" }},
+		{name: "other service", modify: func(e *cw.Event) {
+			e.Resources = []string{"arn:aws:sqs:us-east-1:1234567890123:alarm:test-service-alarm-abcd"}
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			evt := test.TriggeredAlarmDetails
+			tc.modify(&evt)
+			if err := evt.Verify(); (err == nil) != tc.valid {
+				t.Errorf("Verify() = %v, expected valid: %t", err, tc.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+# Event archive: every processed event with its routing and delivery outcome,
+# for incident reviews and replays (cw-alert-router replay).
+resource "aws_s3_bucket" "archive" {
+  bucket_prefix = "${var.name}-archive-"
+}
+
+resource "aws_s3_bucket_public_access_block" "archive" {
+  bucket                  = aws_s3_bucket.archive.id
+  block_public_acls       = true
+  block_public_policy     = true
+  ignore_public_acls      = true
+  restrict_public_buckets = true
+}
+
+resource "aws_s3_bucket_lifecycle_configuration" "archive" {
+  bucket = aws_s3_bucket.archive.id
+
+  rule {
+    id     = "expire"
+    status = "Enabled"
+
+    filter {
+      prefix = "archive/"
+    }
+
+    expiration {
+      days = var.archive_retention_days
+    }
+  }
+}
+
+data "aws_iam_policy_document" "archive_permissions" {
+  statement {
+    sid       = "Archive"
+    effect    = "Allow"
+    actions   = ["s3:PutObject"]
+    resources = ["${aws_s3_bucket.archive.arn}/archive/*"]
+  }
+}
+
+resource "aws_iam_role_policy" "archive" {
+  name   = "${var.name}-archive"
+  role   = aws_iam_role.lambda.id
+  policy = data.aws_iam_policy_document.archive_permissions.json
+}
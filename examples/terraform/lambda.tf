@@ -47,6 +47,62 @@ data "aws_iam_policy_document" "lambda_permissions" {
   }
 }
 
+data "aws_iam_policy_document" "ledger_permissions" {
+  statement {
+    sid    = "DeliveryLedger"
+    effect = "Allow"
+    actions = [
+      "dynamodb:PutItem",
+      "dynamodb:UpdateItem",
+      "dynamodb:DeleteItem",
+    ]
+    resources = [aws_dynamodb_table.ledger.arn]
+  }
+}
+
+resource "aws_iam_role_policy" "ledger" {
+  name   = "${var.name}-ledger"
+  role   = aws_iam_role.lambda.id
+  policy = data.aws_iam_policy_document.ledger_permissions.json
+}
+
+data "aws_iam_policy_document" "alarm_state_permissions" {
+  statement {
+    sid    = "AlarmState"
+    effect = "Allow"
+    actions = [
+      "dynamodb:GetItem",
+      "dynamodb:PutItem",
+      "dynamodb:Query",
+    ]
+    resources = [
+      aws_dynamodb_table.alarm_state.arn,
+      "${aws_dynamodb_table.alarm_state.arn}/index/flapping",
+    ]
+  }
+}
+
+resource "aws_iam_role_policy" "alarm_state" {
+  name   = "${var.name}-alarm-state"
+  role   = aws_iam_role.lambda.id
+  policy = data.aws_iam_policy_document.alarm_state_permissions.json
+}
+
+data "aws_iam_policy_document" "quarantine_permissions" {
+  statement {
+    sid       = "Quarantine"
+    effect    = "Allow"
+    actions   = ["sqs:SendMessage"]
+    resources = [aws_sqs_queue.quarantine.arn]
+  }
+}
+
+resource "aws_iam_role_policy" "quarantine" {
+  name   = "${var.name}-quarantine"
+  role   = aws_iam_role.lambda.id
+  policy = data.aws_iam_policy_document.quarantine_permissions.json
+}
+
 resource "aws_iam_role" "lambda" {
   name               = var.name
   assume_role_policy = data.aws_iam_policy_document.assume_role.json
@@ -82,6 +138,13 @@ resource "aws_lambda_function" "router" {
       SLACK_TOKEN_SSM_KEY           = var.slack_token_ssm_key
       PAGERDUTY_DEFAULT_ROUTING_KEY = var.pagerduty_default_routing_key
       GRAPH_MODE                    = "slack"
+      DELIVERY_LEDGER_TABLE         = aws_dynamodb_table.ledger.name
+      ALARM_STATE_TABLE             = aws_dynamodb_table.alarm_state.name
+      FLAP_THRESHOLD                = var.flap_threshold
+      QUARANTINE_QUEUE_URL          = aws_sqs_queue.quarantine.url
+      ARCHIVE_BUCKET                = aws_s3_bucket.archive.id
+      ALLOWED_ACCOUNTS              = data.aws_caller_identity.current.account_id
+      ALLOWED_REGIONS               = data.aws_region.current.name
       LOG_LEVEL                     = var.log_level
     }
   }
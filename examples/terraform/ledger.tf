@@ -0,0 +1,23 @@
+# Delivery ledger: records which destinations each event reached, so SQS
+# redeliveries don't double-post.
+resource "aws_dynamodb_table" "ledger" {
+  name         = "${var.name}-deliveries"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "event_id"
+  range_key    = "destination"
+
+  attribute {
+    name = "event_id"
+    type = "S"
+  }
+
+  attribute {
+    name = "destination"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+}
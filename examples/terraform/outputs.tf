@@ -9,3 +9,7 @@ output "queue_url" {
 output "dead_letter_queue_url" {
   value = aws_sqs_queue.dlq.url
 }
+
+output "archive_url" {
+  value = "s3://${aws_s3_bucket.archive.id}/archive"
+}
@@ -22,6 +22,13 @@ resource "aws_sqs_queue" "dlq" {
   message_retention_seconds = 1209600 # 14 days
 }
 
+# Messages that aren't alarm events at all (e.g. routed to the queue by
+# mistake) are moved here on first sight instead of being retried.
+resource "aws_sqs_queue" "quarantine" {
+  name                      = "${var.name}-quarantine"
+  message_retention_seconds = 1209600 # 14 days
+}
+
 resource "aws_sqs_queue" "alarms" {
   name = var.name
 
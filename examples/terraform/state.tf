@@ -0,0 +1,51 @@
+# Alarm state: recent transitions per alarm, used to detect flapping alarms
+# and collapse their notifications.
+resource "aws_dynamodb_table" "alarm_state" {
+  name         = "${var.name}-alarm-state"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "alarm_arn"
+
+  attribute {
+    name = "alarm_arn"
+    type = "S"
+  }
+
+  # sparse: only flapping alarms have a flapping_key
+  attribute {
+    name = "flapping_key"
+    type = "S"
+  }
+
+  global_secondary_index {
+    name            = "flapping"
+    hash_key        = "flapping_key"
+    projection_type = "ALL"
+  }
+
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+}
+
+# Flapping alarms are announced as stable on the next invocation after a
+# quiet window; this schedule makes sure there is one when no other alarm
+# fires.
+resource "aws_cloudwatch_event_rule" "stabilised_sweep" {
+  name                = "${var.name}-stabilised-sweep"
+  description         = "Announce flapping alarms that have stabilised"
+  schedule_expression = "rate(5 minutes)"
+}
+
+resource "aws_cloudwatch_event_target" "stabilised_sweep" {
+  rule = aws_cloudwatch_event_rule.stabilised_sweep.name
+  arn  = aws_lambda_function.router.arn
+}
+
+resource "aws_lambda_permission" "stabilised_sweep" {
+  statement_id  = "AllowStabilisedSweep"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.router.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.stabilised_sweep.arn
+}
@@ -33,6 +33,18 @@ variable "log_level" {
   default     = "info"
 }
 
+variable "flap_threshold" {
+  description = "Transitions within 30 minutes that make an alarm flapping (0 = only alarms tagged alerts:flap_threshold)"
+  type        = number
+  default     = 4
+}
+
+variable "archive_retention_days" {
+  description = "Days archived events are kept for replays"
+  type        = number
+  default     = 90
+}
+
 variable "function_zip" {
   description = "Path to the built lambda package (task publish / task build-local)"
   type        = string
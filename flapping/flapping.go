@@ -0,0 +1,291 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flapping detects alarms that keep toggling between ALARM and OK,
+// tracking recent transitions per alarm ARN in a state store.
+package flapping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+)
+
+const (
+	// DefaultWindow is the period transitions are counted over.
+	DefaultWindow = 30 * time.Minute
+	// retainFor is how long state outlives its last transition in the store.
+	retainFor = 24 * time.Hour
+	// maxAttempts bounds retries on concurrent updates of the same alarm.
+	maxAttempts = 5
+)
+
+// ErrConflict is returned by Store.Put when the state changed since it was
+// read.
+var ErrConflict = errors.New("alarm state was modified concurrently")
+
+// State is the recent transition history of one alarm.
+type State struct {
+	AlarmARN string
+	// Transitions are the alarm's state change times within the window.
+	Transitions []time.Time
+	// Flapping is set from detection until the alarm stabilises.
+	Flapping bool
+	// Collapsed counts the notifications collapsed while flapping.
+	Collapsed int
+	// SlackChannelID and SlackTS identify the flapping Slack message.
+	SlackChannelID string
+	SlackTS        string
+	// LastEvent is the alarm's most recent state change.
+	LastEvent *cw.Event
+	// Version increments on every write (optimistic locking).
+	Version int64
+}
+
+// LastTransition returns the time of the most recent transition.
+func (s State) LastTransition() time.Time {
+	if len(s.Transitions) == 0 {
+		return time.Time{}
+	}
+	return s.Transitions[len(s.Transitions)-1]
+}
+
+// recorded reports whether the transition at t is already in the state.
+func (s State) recorded(t time.Time) bool {
+	for _, r := range s.Transitions {
+		if r.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store persists alarm states.
+type Store interface {
+	// Get returns the alarm's state, or a zero State (Version 0) if none.
+	Get(ctx context.Context, alarmARN string) (State, error)
+	// Put writes the state if its Version still matches the stored one,
+	// and returns ErrConflict otherwise. The stored Version is incremented.
+	Put(ctx context.Context, state State, expiresAt time.Time) error
+	// Flapping returns the states of all alarms currently flapping.
+	Flapping(ctx context.Context) ([]State, error)
+}
+
+// Decision is what to do with a transition.
+type Decision int
+
+const (
+	// Normal means the alarm isn't flapping: notify as usual.
+	Normal Decision = iota
+	// Started means this transition made the alarm flap.
+	Started
+	// Continuing means the alarm was already flapping.
+	Continuing
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Normal:
+		return "normal"
+	case Started:
+		return "started"
+	case Continuing:
+		return "continuing"
+	}
+	return "unknown"
+}
+
+// Detector tracks alarm transitions and decides when alarms are flapping:
+// a threshold number of transitions within the window. Flapping alarms are
+// stable again once the window passes without a transition.
+type Detector struct {
+	store  Store
+	window time.Duration
+	now    func() time.Time
+}
+
+// Option configures a Detector.
+type Option func(*Detector)
+
+// WithClock overrides the time source (for testing).
+func WithClock(now func() time.Time) Option {
+	return func(d *Detector) { d.now = now }
+}
+
+// NewDetector returns a Detector counting transitions over the window
+// (DefaultWindow if <= 0).
+func NewDetector(store Store, window time.Duration, opts ...Option) *Detector {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	d := &Detector{store: store, window: window, now: time.Now}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Window returns the period transitions are counted over.
+func (d *Detector) Window() time.Duration {
+	return d.window
+}
+
+// Observe records the transition in evt and returns what to do with it,
+// along with the alarm's updated state. A threshold <= 0 disables
+// detection for the alarm (transitions are still recorded). A transition
+// already recorded (a redelivered event) leaves the state unchanged.
+func (d *Detector) Observe(ctx context.Context, evt *cw.Event, threshold int) (Decision, State, error) {
+	alarmARN, err := evt.AlarmARN()
+	if err != nil {
+		return Normal, State{}, err
+	}
+	at := evt.StateChangeTime()
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		state, err := d.store.Get(ctx, alarmARN)
+		if err != nil {
+			return Normal, State{}, fmt.Errorf("reading alarm state: %w", err)
+		}
+		state.AlarmARN = alarmARN
+		if state.recorded(at) {
+			slog.Debug("alarm transition already recorded", "alarm_arn", alarmARN, "at", at)
+			if state.Flapping {
+				return Continuing, state, nil
+			}
+			return Normal, state, nil
+		}
+
+		recent := d.recent(state, at)
+		state.Transitions = recent
+		// an older event arriving late mustn't replace the latest one
+		if state.LastEvent == nil || !at.Before(state.LastEvent.StateChangeTime()) {
+			state.LastEvent = evt
+		}
+
+		decision := Normal
+		switch {
+		case state.Flapping:
+			decision = Continuing
+			state.Collapsed++
+		case threshold > 0 && len(recent) >= threshold:
+			decision = Started
+			state.Flapping = true
+			state.Collapsed = 1
+			state.SlackChannelID, state.SlackTS = "", ""
+		}
+
+		err = d.store.Put(ctx, state, d.expiresAt(state))
+		if errors.Is(err, ErrConflict) {
+			slog.Debug("alarm state changed concurrently, retrying", "alarm_arn", alarmARN, "attempt", attempt+1)
+			continue
+		}
+		if err != nil {
+			return Normal, State{}, fmt.Errorf("writing alarm state: %w", err)
+		}
+		state.Version++
+		return decision, state, nil
+	}
+	return Normal, State{}, ErrConflict
+}
+
+// Tracking reports whether the alarm of evt is flapping, or would start
+// flapping with this transition, without recording it.
+func (d *Detector) Tracking(ctx context.Context, evt *cw.Event, threshold int) (bool, error) {
+	alarmARN, err := evt.AlarmARN()
+	if err != nil {
+		return false, err
+	}
+	state, err := d.store.Get(ctx, alarmARN)
+	if err != nil {
+		return false, fmt.Errorf("reading alarm state: %w", err)
+	}
+	at := evt.StateChangeTime()
+	if state.Flapping || state.recorded(at) {
+		return state.Flapping, nil
+	}
+	return threshold > 0 && len(d.recent(state, at)) >= threshold, nil
+}
+
+// recent returns the state's transitions within the window before at,
+// followed by at, in order.
+func (d *Detector) recent(state State, at time.Time) []time.Time {
+	var recent []time.Time
+	for _, t := range state.Transitions {
+		if at.Sub(t) < d.window && !t.Equal(at) {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, at)
+	sort.Slice(recent, func(i, j int) bool { return recent[i].Before(recent[j]) })
+	return recent
+}
+
+// SetMessage records the flapping Slack message of a flapping alarm, so
+// later transitions update it.
+func (d *Detector) SetMessage(ctx context.Context, alarmARN, channelID, ts string) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		state, err := d.store.Get(ctx, alarmARN)
+		if err != nil {
+			return fmt.Errorf("reading alarm state: %w", err)
+		}
+		if !state.Flapping {
+			return nil
+		}
+		state.SlackChannelID, state.SlackTS = channelID, ts
+		err = d.store.Put(ctx, state, d.expiresAt(state))
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+// Stabilised returns the flapping alarms without a transition for a full
+// window. They stay flapping until Clear is called.
+func (d *Detector) Stabilised(ctx context.Context) ([]State, error) {
+	states, err := d.store.Flapping(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing flapping alarms: %w", err)
+	}
+	var stable []State
+	for _, s := range states {
+		if d.now().Sub(s.LastTransition()) >= d.window {
+			stable = append(stable, s)
+		}
+	}
+	return stable, nil
+}
+
+// Clear ends the flapping of a stabilised alarm. It returns ErrConflict if
+// the alarm transitioned since state was read.
+func (d *Detector) Clear(ctx context.Context, state State) error {
+	state.Flapping = false
+	state.Collapsed = 0
+	state.Transitions = nil
+	state.SlackChannelID, state.SlackTS = "", ""
+	return d.store.Put(ctx, state, d.expiresAt(state))
+}
+
+func (d *Detector) expiresAt(state State) time.Time {
+	last := state.LastTransition()
+	if last.IsZero() || d.now().After(last) {
+		last = d.now()
+	}
+	return last.Add(d.window + retainFor)
+}
@@ -0,0 +1,191 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flapping_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/flapping"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+// transition returns the test alarm's state change at the given time.
+func transition(at time.Time) *cw.Event {
+	evt := test.TriggeredAlarmDetails
+	evt.Detail.State.Timestamp = at.Format("2006-01-02T15:04:05.000-0700")
+	return &evt
+}
+
+func stores() map[string]flapping.Store {
+	return map[string]flapping.Store{
+		"memory":   flapping.NewMemory(),
+		"dynamodb": flapping.NewDynamoDBWithAPI(&test.MockStateTableAPI{}, "alarm-state"),
+	}
+}
+
+func TestObserve(t *testing.T) {
+	start := time.Date(2020, 7, 31, 6, 0, 0, 0, time.UTC)
+	for name, store := range stores() {
+		t.Run(name, func(t *testing.T) {
+			now := start
+			d := flapping.NewDetector(store, 10*time.Minute, flapping.WithClock(func() time.Time { return now }))
+			ctx := context.Background()
+
+			// transitions spread wider than the window never flap
+			for i := 0; i < 4; i++ {
+				now = start.Add(time.Duration(i) * 11 * time.Minute)
+				decision, _, err := d.Observe(ctx, transition(now), 3)
+				if err != nil {
+					t.Fatalf("Observe returned error: %v", err)
+				}
+				if decision != flapping.Normal {
+					t.Fatalf("transition %d: expected normal, got %s", i, decision)
+				}
+			}
+
+			// three within the window do
+			base := now
+			want := []flapping.Decision{flapping.Normal, flapping.Started, flapping.Continuing, flapping.Continuing}
+			var state flapping.State
+			for i, w := range want {
+				now = base.Add(time.Duration(i+1) * 2 * time.Minute)
+				var decision flapping.Decision
+				var err error
+				decision, state, err = d.Observe(ctx, transition(now), 3)
+				if err != nil {
+					t.Fatalf("Observe returned error: %v", err)
+				}
+				if decision != w {
+					t.Errorf("transition %d: expected %s, got %s", i, w, decision)
+				}
+			}
+			if state.Collapsed != 3 {
+				t.Errorf("expected 3 collapsed notifications, got %d", state.Collapsed)
+			}
+
+			if err := d.SetMessage(ctx, state.AlarmARN, "C123", "1600000000.000100"); err != nil {
+				t.Fatalf("SetMessage returned error: %v", err)
+			}
+
+			// not stable within the window
+			stable, err := d.Stabilised(ctx)
+			if err != nil {
+				t.Fatalf("Stabilised returned error: %v", err)
+			}
+			if len(stable) != 0 {
+				t.Fatalf("expected no stabilised alarms yet, got %d", len(stable))
+			}
+
+			now = now.Add(10 * time.Minute)
+			stable, err = d.Stabilised(ctx)
+			if err != nil {
+				t.Fatalf("Stabilised returned error: %v", err)
+			}
+			if len(stable) != 1 || stable[0].SlackTS != "1600000000.000100" || stable[0].LastEvent == nil {
+				t.Fatalf("expected the alarm to be stabilised with its message, got %+v", stable)
+			}
+			if err := d.Clear(ctx, stable[0]); err != nil {
+				t.Fatalf("Clear returned error: %v", err)
+			}
+			if stable, _ = d.Stabilised(ctx); len(stable) != 0 {
+				t.Errorf("cleared alarm should no longer be flapping, got %d", len(stable))
+			}
+		})
+	}
+}
+
+func TestObserveDisabled(t *testing.T) {
+	start := time.Date(2020, 7, 31, 6, 0, 0, 0, time.UTC)
+	d := flapping.NewDetector(flapping.NewMemory(), 10*time.Minute)
+	for i := 0; i < 5; i++ {
+		decision, _, err := d.Observe(context.Background(), transition(start.Add(time.Duration(i)*time.Minute)), 0)
+		if err != nil {
+			t.Fatalf("Observe returned error: %v", err)
+		}
+		if decision != flapping.Normal {
+			t.Fatalf("a zero threshold should never flap, got %s", decision)
+		}
+	}
+}
+
+func TestObserveRedeliveredAndLate(t *testing.T) {
+	start := time.Date(2020, 7, 31, 6, 0, 0, 0, time.UTC)
+	for name, store := range stores() {
+		t.Run(name, func(t *testing.T) {
+			d := flapping.NewDetector(store, 10*time.Minute)
+			ctx := context.Background()
+			observe := func(at time.Time) (flapping.Decision, flapping.State) {
+				t.Helper()
+				decision, state, err := d.Observe(ctx, transition(at), 2)
+				if err != nil {
+					t.Fatalf("Observe returned error: %v", err)
+				}
+				return decision, state
+			}
+
+			observe(start)
+			latest := start.Add(4 * time.Minute)
+			if decision, _ := observe(latest); decision != flapping.Started {
+				t.Fatalf("expected started, got %s", decision)
+			}
+
+			// a redelivered transition is not collapsed again
+			decision, state := observe(latest)
+			if decision != flapping.Continuing {
+				t.Errorf("expected continuing, got %s", decision)
+			}
+			if state.Collapsed != 1 || len(state.Transitions) != 2 {
+				t.Errorf("expected 1 collapsed of 2 transitions, got %d of %d", state.Collapsed, len(state.Transitions))
+			}
+
+			// a late transition is counted but doesn't replace the latest event
+			_, state = observe(start.Add(2 * time.Minute))
+			if state.Collapsed != 2 || len(state.Transitions) != 3 {
+				t.Errorf("expected 2 collapsed of 3 transitions, got %d of %d", state.Collapsed, len(state.Transitions))
+			}
+			if got := state.LastEvent.StateChangeTime(); !got.Equal(latest) {
+				t.Errorf("expected last event at %s, got %s", latest, got)
+			}
+		})
+	}
+}
+
+func TestClearConflict(t *testing.T) {
+	start := time.Date(2020, 7, 31, 6, 0, 0, 0, time.UTC)
+	now := start
+	d := flapping.NewDetector(flapping.NewMemory(), 10*time.Minute, flapping.WithClock(func() time.Time { return now }))
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, _, err := d.Observe(ctx, transition(start.Add(time.Duration(i)*time.Minute)), 2); err != nil {
+			t.Fatalf("Observe returned error: %v", err)
+		}
+	}
+	now = start.Add(time.Hour)
+	stable, _ := d.Stabilised(ctx)
+	if len(stable) != 1 {
+		t.Fatalf("expected 1 stabilised alarm, got %d", len(stable))
+	}
+
+	// a transition between listing and clearing keeps the alarm flapping
+	if _, _, err := d.Observe(ctx, transition(now), 2); err != nil {
+		t.Fatalf("Observe returned error: %v", err)
+	}
+	if err := d.Clear(ctx, stable[0]); err != flapping.ErrConflict {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flapping
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+)
+
+// Memory is an in-process Store. State only lives as long as the process
+// (one warm lambda container), so it's meant for tests and deployments
+// without a state table. It keeps one entry per alarm and ignores expiry.
+type Memory struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+// NewMemory returns an empty in-memory Store.
+func NewMemory() *Memory {
+	return &Memory{states: make(map[string]State)}
+}
+
+// Get implements Store.
+func (m *Memory) Get(ctx context.Context, alarmARN string) (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.states[alarmARN]
+	if !ok {
+		return State{AlarmARN: alarmARN}, nil
+	}
+	state.Transitions = append([]time.Time(nil), state.Transitions...)
+	return state, nil
+}
+
+// Put implements Store.
+func (m *Memory) Put(ctx context.Context, state State, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.states[state.AlarmARN].Version != state.Version {
+		return ErrConflict
+	}
+	state.Version++
+	state.Transitions = append([]time.Time(nil), state.Transitions...)
+	m.states[state.AlarmARN] = state
+	return nil
+}
+
+// Flapping implements Store.
+func (m *Memory) Flapping(ctx context.Context) ([]State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []State
+	for _, s := range m.states {
+		if s.Flapping {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// DynamoDB table attribute names. The table's partition key is
+// AttrAlarmARN (string); TTL should be enabled on AttrExpiresAt.
+// AttrFlappingKey is only set on flapping alarms, as the partition key
+// (string) of the sparse FlappingIndex.
+const (
+	AttrAlarmARN       = "alarm_arn"
+	AttrTransitions    = "transitions"
+	AttrFlapping       = "flapping"
+	AttrFlappingKey    = "flapping_key"
+	AttrCollapsed      = "collapsed"
+	AttrSlackChannelID = "slack_channel_id"
+	AttrSlackTS        = "slack_ts"
+	AttrLastEvent      = "last_event"
+	AttrVersion        = "version"
+	AttrExpiresAt      = "expires_at"
+)
+
+// FlappingIndex is the name of the table's global secondary index on
+// AttrFlappingKey, projecting all attributes. Only flapping alarms are in
+// it, so listing them doesn't scan the table.
+const FlappingIndex = "flapping"
+
+// flappingKey is the AttrFlappingKey value of every flapping alarm.
+const flappingKey = "flapping"
+
+// API is the subset of the DynamoDB API the state store uses.
+type API interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+}
+
+// DynamoDB is a Store backed by a DynamoDB table, one item per alarm.
+type DynamoDB struct {
+	api   API
+	table string
+}
+
+// NewDynamoDB returns a DynamoDB store backed by the real DynamoDB API.
+func NewDynamoDB(cfg aws.Config, table string) *DynamoDB {
+	return &DynamoDB{api: dynamodb.NewFromConfig(cfg), table: table}
+}
+
+// NewDynamoDBWithAPI returns a DynamoDB store backed by the given API
+// implementation (for testing).
+func NewDynamoDBWithAPI(api API, table string) *DynamoDB {
+	return &DynamoDB{api: api, table: table}
+}
+
+// Get implements Store.
+func (d *DynamoDB) Get(ctx context.Context, alarmARN string) (State, error) {
+	resp, err := d.api.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            map[string]types.AttributeValue{AttrAlarmARN: &types.AttributeValueMemberS{Value: alarmARN}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return State{}, err
+	}
+	if resp.Item == nil {
+		return State{AlarmARN: alarmARN}, nil
+	}
+	return unmarshalState(resp.Item)
+}
+
+// Put implements Store.
+func (d *DynamoDB) Put(ctx context.Context, state State, expiresAt time.Time) error {
+	item, err := marshalState(state, expiresAt)
+	if err != nil {
+		return err
+	}
+	_, err = d.api.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(d.table),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#arn) OR #version = :version"),
+		ExpressionAttributeNames: map[string]string{"#arn": AttrAlarmARN, "#version": AttrVersion},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": numberValue(state.Version),
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return ErrConflict
+	}
+	return err
+}
+
+// Flapping implements Store. It queries FlappingIndex, which only holds
+// flapping alarms.
+func (d *DynamoDB) Flapping(ctx context.Context) ([]State, error) {
+	paginator := dynamodb.NewQueryPaginator(d.api, &dynamodb.QueryInput{
+		TableName:                 aws.String(d.table),
+		IndexName:                 aws.String(FlappingIndex),
+		KeyConditionExpression:    aws.String("#key = :flapping"),
+		ExpressionAttributeNames:  map[string]string{"#key": AttrFlappingKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":flapping": &types.AttributeValueMemberS{Value: flappingKey}},
+	})
+	var out []State
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			state, err := unmarshalState(item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, state)
+		}
+	}
+	return out, nil
+}
+
+func numberValue(n int64) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+func numberAttr(v types.AttributeValue) int64 {
+	if n, ok := v.(*types.AttributeValueMemberN); ok {
+		i, _ := strconv.ParseInt(n.Value, 10, 64)
+		return i
+	}
+	return 0
+}
+
+func stringAttr(v types.AttributeValue) string {
+	if s, ok := v.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+func marshalState(state State, expiresAt time.Time) (map[string]types.AttributeValue, error) {
+	transitions := make([]types.AttributeValue, 0, len(state.Transitions))
+	for _, t := range state.Transitions {
+		transitions = append(transitions, numberValue(t.UnixMilli()))
+	}
+	item := map[string]types.AttributeValue{
+		AttrAlarmARN:    &types.AttributeValueMemberS{Value: state.AlarmARN},
+		AttrTransitions: &types.AttributeValueMemberL{Value: transitions},
+		AttrFlapping:    &types.AttributeValueMemberBOOL{Value: state.Flapping},
+		AttrCollapsed:   numberValue(int64(state.Collapsed)),
+		AttrVersion:     numberValue(state.Version + 1),
+		AttrExpiresAt:   numberValue(expiresAt.Unix()),
+	}
+	if state.Flapping {
+		item[AttrFlappingKey] = &types.AttributeValueMemberS{Value: flappingKey}
+	}
+	if state.SlackChannelID != "" {
+		item[AttrSlackChannelID] = &types.AttributeValueMemberS{Value: state.SlackChannelID}
+		item[AttrSlackTS] = &types.AttributeValueMemberS{Value: state.SlackTS}
+	}
+	if state.LastEvent != nil {
+		raw, err := json.Marshal(state.LastEvent)
+		if err != nil {
+			return nil, fmt.Errorf("encoding last event: %w", err)
+		}
+		item[AttrLastEvent] = &types.AttributeValueMemberS{Value: string(raw)}
+	}
+	return item, nil
+}
+
+func unmarshalState(item map[string]types.AttributeValue) (State, error) {
+	state := State{
+		AlarmARN:       stringAttr(item[AttrAlarmARN]),
+		Collapsed:      int(numberAttr(item[AttrCollapsed])),
+		SlackChannelID: stringAttr(item[AttrSlackChannelID]),
+		SlackTS:        stringAttr(item[AttrSlackTS]),
+		Version:        numberAttr(item[AttrVersion]),
+	}
+	if b, ok := item[AttrFlapping].(*types.AttributeValueMemberBOOL); ok {
+		state.Flapping = b.Value
+	}
+	if l, ok := item[AttrTransitions].(*types.AttributeValueMemberL); ok {
+		for _, v := range l.Value {
+			state.Transitions = append(state.Transitions, time.UnixMilli(numberAttr(v)).UTC())
+		}
+	}
+	if raw := stringAttr(item[AttrLastEvent]); raw != "" {
+		state.LastEvent = &cw.Event{}
+		if err := json.Unmarshal([]byte(raw), state.LastEvent); err != nil {
+			return State{}, fmt.Errorf("decoding last event of %s: %w", state.AlarmARN, err)
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package googlechat sends alarm notifications to Google Chat spaces via
+// incoming webhooks, as cardsV2 messages.
+package googlechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/tidal-music/cw-alert-router/v2/message"
+)
+
+// Emoji prefixes for the card titles.
+const (
+	triggeredPrefix = "🚨 (triggered)"
+	resolvedPrefix  = "✅ (resolved)"
+)
+
+// replyOption makes messages with the same thread key share a thread, so a
+// resolve lands under its trigger.
+const replyOption = "REPLY_MESSAGE_FALLBACK_TO_NEW_THREAD"
+
+// Client posts messages to Google Chat incoming webhooks.
+type Client struct {
+	httpClient *http.Client
+}
+
+// ClientOptions provides the function opts pattern for overriding.
+type ClientOptions func(*Client)
+
+// WithHTTPClient allows overriding the HTTP client (for testing).
+func WithHTTPClient(hc *http.Client) ClientOptions {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// New returns a new Client.
+func New(opts ...ClientOptions) (*Client, error) {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+	return c, nil
+}
+
+// Payload is a Google Chat webhook message body.
+type Payload struct {
+	Text    string   `json:"text,omitempty"`
+	CardsV2 []CardV2 `json:"cardsV2"`
+}
+
+// CardV2 wraps a card with its ID.
+type CardV2 struct {
+	CardID string `json:"cardId"`
+	Card   Card   `json:"card"`
+}
+
+// Card is a Google Chat card.
+type Card struct {
+	Header   CardHeader `json:"header"`
+	Sections []Section  `json:"sections"`
+}
+
+// CardHeader is the card title area.
+type CardHeader struct {
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle,omitempty"`
+}
+
+// Section is a group of widgets.
+type Section struct {
+	Widgets []Widget `json:"widgets"`
+}
+
+// Widget is one card element; exactly one field is set.
+type Widget struct {
+	DecoratedText *DecoratedText `json:"decoratedText,omitempty"`
+	Image         *Image         `json:"image,omitempty"`
+	ButtonList    *ButtonList    `json:"buttonList,omitempty"`
+}
+
+// DecoratedText is a labelled text widget.
+type DecoratedText struct {
+	TopLabel string `json:"topLabel,omitempty"`
+	Text     string `json:"text"`
+	WrapText bool   `json:"wrapText,omitempty"`
+}
+
+// Image is an image widget.
+type Image struct {
+	ImageURL string `json:"imageUrl"`
+	AltText  string `json:"altText,omitempty"`
+}
+
+// ButtonList is a row of buttons.
+type ButtonList struct {
+	Buttons []Button `json:"buttons"`
+}
+
+// Button is a button opening a link.
+type Button struct {
+	Text    string  `json:"text"`
+	OnClick OnClick `json:"onClick"`
+}
+
+// OnClick is a button action.
+type OnClick struct {
+	OpenLink OpenLink `json:"openLink"`
+}
+
+// OpenLink opens a URL.
+type OpenLink struct {
+	URL string `json:"url"`
+}
+
+// BuildPayload renders the message as a cardsV2 webhook payload.
+func BuildPayload(msg message.Message) Payload {
+	prefix := triggeredPrefix
+	if msg.Resolved() {
+		prefix = resolvedPrefix
+	}
+	title := fmt.Sprintf("%s %s", prefix, msg.Title())
+
+	widgets := []Widget{
+		{DecoratedText: &DecoratedText{TopLabel: "Metrics", Text: msg.MetricsText("<br>"), WrapText: true}},
+	}
+	if msg.Reason != "" {
+		widgets = append(widgets, Widget{DecoratedText: &DecoratedText{TopLabel: "Reason", Text: msg.Reason, WrapText: true}})
+	}
+	if msg.ImageURL != "" {
+		widgets = append(widgets, Widget{Image: &Image{ImageURL: msg.ImageURL, AltText: "metric graph"}})
+	}
+	widgets = append(widgets, Widget{ButtonList: &ButtonList{Buttons: []Button{
+		{Text: "AWS Console", OnClick: OnClick{OpenLink: OpenLink{URL: msg.ConsoleLink}}},
+	}}})
+
+	return Payload{
+		Text: title,
+		CardsV2: []CardV2{{
+			CardID: "alarm",
+			Card: Card{
+				Header:   CardHeader{Title: title, Subtitle: msg.Description},
+				Sections: []Section{{Widgets: widgets}},
+			},
+		}},
+	}
+}
+
+// SendMessage posts the message to the given incoming webhook URL. Messages
+// for the same alarm are threaded together.
+func (c *Client) SendMessage(ctx context.Context, webhookURL string, msg message.Message) error {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return fmt.Errorf("parsing google chat webhook url: %w", err)
+	}
+	q := u.Query()
+	q.Set("threadKey", msg.AlarmName)
+	q.Set("messageReplyOption", replyOption)
+	u.RawQuery = q.Encode()
+
+	body, err := json.Marshal(BuildPayload(msg))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+	slog.Info("sending google chat message", "alarm", msg.AlarmName, "host", u.Host)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting google chat message: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("posting google chat message: status %d: %s", resp.StatusCode, detail)
+	}
+	return nil
+}
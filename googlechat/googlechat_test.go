@@ -0,0 +1,100 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package googlechat_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tidal-music/cw-alert-router/v2/googlechat"
+	"github.com/tidal-music/cw-alert-router/v2/message"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+func TestBuildPayload(t *testing.T) {
+	msg := message.New(&test.TriggeredAlarmDetails, pagerduty.ActionTrigger)
+	msg.ImageURL = "https://images.example.com/graph.png"
+
+	got, err := json.Marshal(googlechat.BuildPayload(msg))
+	if err != nil {
+		t.Fatalf("couldn't marshal payload: %v", err)
+	}
+	for _, want := range []string{
+		`"cardsV2"`,
+		"(triggered) CloudWatch Alarm: test-service-alarm-abcd",
+		"CPUUtilization",
+		"Threshold Crossed",
+		"https://images.example.com/graph.png",
+		"https://console.aws.amazon.com/cloudwatch/home?region=us-east-1#alarmsV2:alarm/test-service-alarm-abcd",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("payload missing %q: %s", want, got)
+		}
+	}
+
+	resolved := googlechat.BuildPayload(message.New(&test.TriggeredAlarmDetails, pagerduty.ActionResolve))
+	if !strings.Contains(resolved.CardsV2[0].Card.Header.Title, "(resolved)") {
+		t.Errorf("resolved payload should have a resolved title: %s", resolved.CardsV2[0].Card.Header.Title)
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	server := test.NewWebhookServer()
+	defer server.Close()
+
+	client, err := googlechat.New()
+	if err != nil {
+		t.Fatalf("failed creating google chat client: %v", err)
+	}
+	msg := message.New(&test.TriggeredAlarmDetails, pagerduty.ActionTrigger)
+	if err := client.SendMessage(context.Background(), server.URL("/v1/spaces/AAA/messages?key=k&token=t"), msg); err != nil {
+		t.Fatalf("failed sending message: %v", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 webhook request, got %d", len(requests))
+	}
+	query, err := url.ParseQuery(requests[0].Query)
+	if err != nil {
+		t.Fatalf("couldn't parse query: %v", err)
+	}
+	if query.Get("token") != "t" {
+		t.Errorf("webhook credentials should be kept, got query %s", requests[0].Query)
+	}
+	if query.Get("threadKey") != "test-service-alarm-abcd" {
+		t.Errorf("messages should be threaded by alarm, got query %s", requests[0].Query)
+	}
+}
+
+func TestSendMessageError(t *testing.T) {
+	server := test.NewWebhookServer()
+	defer server.Close()
+	server.Status = http.StatusBadRequest
+
+	client, err := googlechat.New()
+	if err != nil {
+		t.Fatalf("failed creating google chat client: %v", err)
+	}
+	msg := message.New(&test.TriggeredAlarmDetails, pagerduty.ActionTrigger)
+	if err := client.SendMessage(context.Background(), server.URL("/v1/spaces/AAA/messages"), msg); err == nil {
+		t.Errorf("expected an error for a non-2xx response")
+	}
+}
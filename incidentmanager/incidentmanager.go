@@ -0,0 +1,250 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package incidentmanager pages via AWS Systems Manager Incident Manager:
+// alarms start incidents against a response plan and resolve them again.
+package incidentmanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssmincidents"
+	"github.com/aws/aws-sdk-go-v2/service/ssmincidents/types"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/message"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+)
+
+const (
+	// triggerSource identifies the router as the incident source (the
+	// "aws." prefix is reserved for AWS services).
+	triggerSource = "cw-alert-router"
+	// timelineEventType is the timeline event type for our updates.
+	timelineEventType = "Custom Event"
+	// maxRawDataLength is the limit Incident Manager puts on trigger raw data.
+	maxRawDataLength = 10000
+	// maxTitleLength is the limit Incident Manager puts on incident titles.
+	maxTitleLength = 200
+)
+
+// API is the subset of the Incident Manager API this service uses.
+type API interface {
+	StartIncident(ctx context.Context, params *ssmincidents.StartIncidentInput, optFns ...func(*ssmincidents.Options)) (*ssmincidents.StartIncidentOutput, error)
+	ListIncidentRecords(ctx context.Context, params *ssmincidents.ListIncidentRecordsInput, optFns ...func(*ssmincidents.Options)) (*ssmincidents.ListIncidentRecordsOutput, error)
+	CreateTimelineEvent(ctx context.Context, params *ssmincidents.CreateTimelineEventInput, optFns ...func(*ssmincidents.Options)) (*ssmincidents.CreateTimelineEventOutput, error)
+	UpdateIncidentRecord(ctx context.Context, params *ssmincidents.UpdateIncidentRecordInput, optFns ...func(*ssmincidents.Options)) (*ssmincidents.UpdateIncidentRecordOutput, error)
+}
+
+// Client starts and resolves Incident Manager incidents for alarms.
+type Client struct {
+	api API
+}
+
+// New returns a Client backed by the real Incident Manager API.
+func New(cfg aws.Config) *Client {
+	return &Client{api: ssmincidents.NewFromConfig(cfg)}
+}
+
+// NewWithAPI returns a Client backed by the given API implementation (for testing).
+func NewWithAPI(api API) *Client {
+	return &Client{api: api}
+}
+
+// DedupString returns the string identifying one alarm state change. It is
+// used (hashed) as the client token of every call made for the change, so a
+// redelivered event never starts a second incident or repeats an update.
+func DedupString(evt *cw.Event) (string, error) {
+	alarmARN, err := evt.AlarmARN()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%s", alarmARN, evt.Detail.State.Value, evt.Detail.State.Timestamp), nil
+}
+
+// clientToken derives an idempotency token from the dedup string and the
+// operation it's used for (tokens must be unique per operation).
+func clientToken(dedup, op string) string {
+	sum := sha256.Sum256([]byte(op + "/" + dedup))
+	return hex.EncodeToString(sum[:])
+}
+
+// SubmitEvent starts (ActionTrigger) or resolves (ActionResolve) the
+// incident for the alarm in the CloudWatch event, using the pagerduty
+// action semantics for alarm state transitions.
+func (c *Client) SubmitEvent(ctx context.Context, responsePlanARN string, action string, evt *cw.Event) error {
+	switch action {
+	case pagerduty.ActionTrigger:
+		return c.startIncident(ctx, responsePlanARN, evt)
+	case pagerduty.ActionResolve:
+		return c.resolveIncident(ctx, evt)
+	default:
+		return nil
+	}
+}
+
+// startIncident starts an incident for the alarm, or adds a timeline event
+// to the alarm's incident if one is already open.
+func (c *Client) startIncident(ctx context.Context, responsePlanARN string, evt *cw.Event) error {
+	alarmARN, err := evt.AlarmARN()
+	if err != nil {
+		return err
+	}
+	dedup, err := DedupString(evt)
+	if err != nil {
+		return err
+	}
+
+	open, err := c.OpenIncident(ctx, alarmARN)
+	if err != nil {
+		return err
+	}
+	if open != "" {
+		slog.Info("incident already open for alarm, adding timeline event",
+			"alarm", evt.Detail.AlarmName, "incident", open)
+		return c.addTimelineEvent(ctx, open, dedup, evt,
+			fmt.Sprintf("Alarm %s triggered again: %s", evt.Detail.AlarmName, evt.Detail.State.Reason))
+	}
+
+	title := message.Truncate(evt.Detail.AlarmName, maxTitleLength)
+	trigger := &types.TriggerDetails{
+		Source:     aws.String(triggerSource),
+		Timestamp:  aws.Time(evt.StateChangeTime()),
+		TriggerArn: aws.String(alarmARN),
+	}
+	if raw, err := json.Marshal(evt); err == nil && len(raw) <= maxRawDataLength {
+		trigger.RawData = aws.String(string(raw))
+	}
+
+	slog.Info("starting incident", "response_plan", responsePlanARN, "alarm", evt.Detail.AlarmName)
+	resp, err := c.api.StartIncident(ctx, &ssmincidents.StartIncidentInput{
+		ResponsePlanArn: aws.String(responsePlanARN),
+		ClientToken:     aws.String(clientToken(dedup, "start")),
+		Title:           aws.String(title),
+		TriggerDetails:  trigger,
+		RelatedItems: []types.RelatedItem{
+			{
+				Title: aws.String("CloudWatch alarm"),
+				Identifier: &types.ItemIdentifier{
+					Type:  types.ItemTypeOther,
+					Value: &types.ItemValueMemberArn{Value: alarmARN},
+				},
+			},
+			{
+				Title: aws.String("AWS Console"),
+				Identifier: &types.ItemIdentifier{
+					Type:  types.ItemTypeOther,
+					Value: &types.ItemValueMemberUrl{Value: evt.ConsoleLink()},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("starting incident for %s: %w", evt.Detail.AlarmName, err)
+	}
+	slog.Debug("incident started", "incident", aws.ToString(resp.IncidentRecordArn))
+	return nil
+}
+
+// resolveIncident adds a timeline event to the alarm's open incident and
+// resolves it. It's a no-op when no incident is open.
+func (c *Client) resolveIncident(ctx context.Context, evt *cw.Event) error {
+	alarmARN, err := evt.AlarmARN()
+	if err != nil {
+		return err
+	}
+	dedup, err := DedupString(evt)
+	if err != nil {
+		return err
+	}
+
+	open, err := c.OpenIncident(ctx, alarmARN)
+	if err != nil {
+		return err
+	}
+	if open == "" {
+		slog.Info("no open incident to resolve", "alarm", evt.Detail.AlarmName)
+		return nil
+	}
+
+	if err := c.addTimelineEvent(ctx, open, dedup, evt,
+		fmt.Sprintf("Alarm %s returned to OK: %s", evt.Detail.AlarmName, evt.Detail.State.Reason)); err != nil {
+		return err
+	}
+
+	slog.Info("resolving incident", "incident", open, "alarm", evt.Detail.AlarmName)
+	_, err = c.api.UpdateIncidentRecord(ctx, &ssmincidents.UpdateIncidentRecordInput{
+		Arn:         aws.String(open),
+		ClientToken: aws.String(clientToken(dedup, "resolve")),
+		Status:      types.IncidentRecordStatusResolved,
+	})
+	if err != nil {
+		return fmt.Errorf("resolving incident %s: %w", open, err)
+	}
+	return nil
+}
+
+// addTimelineEvent records a custom event with the given text on an incident.
+func (c *Client) addTimelineEvent(ctx context.Context, incidentARN, dedup string, evt *cw.Event, text string) error {
+	// custom event data is a JSON document; a JSON string renders as text
+	data, err := json.Marshal(text)
+	if err != nil {
+		return err
+	}
+	_, err = c.api.CreateTimelineEvent(ctx, &ssmincidents.CreateTimelineEventInput{
+		IncidentRecordArn: aws.String(incidentARN),
+		ClientToken:       aws.String(clientToken(dedup, "timeline")),
+		EventType:         aws.String(timelineEventType),
+		EventTime:         aws.Time(evt.StateChangeTime()),
+		EventData:         aws.String(string(data)),
+	})
+	if err != nil {
+		return fmt.Errorf("adding timeline event to incident %s: %w", incidentARN, err)
+	}
+	return nil
+}
+
+// OpenIncident returns the ARN of the open incident started for the given
+// alarm, or "" if there is none.
+func (c *Client) OpenIncident(ctx context.Context, alarmARN string) (string, error) {
+	input := &ssmincidents.ListIncidentRecordsInput{
+		Filters: []types.Filter{{
+			Key: aws.String("status"),
+			Condition: &types.ConditionMemberEquals{
+				Value: &types.AttributeValueListMemberStringValues{
+					Value: []string{string(types.IncidentRecordStatusOpen)},
+				},
+			},
+		}},
+	}
+	paginator := ssmincidents.NewListIncidentRecordsPaginator(c.api, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", fmt.Errorf("listing open incidents: %w", err)
+		}
+		for _, rec := range page.IncidentRecordSummaries {
+			if rec.IncidentRecordSource != nil && aws.ToString(rec.IncidentRecordSource.ResourceArn) == alarmARN {
+				return aws.ToString(rec.Arn), nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package incidentmanager_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	imtypes "github.com/aws/aws-sdk-go-v2/service/ssmincidents/types"
+
+	"github.com/tidal-music/cw-alert-router/v2/incidentmanager"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+const testResponsePlan = "arn:aws:ssm-incidents::1234567890123:response-plan/test-service"
+
+func TestSubmitEventTrigger(t *testing.T) {
+	mock := &test.MockIncidentsAPI{}
+	client := incidentmanager.NewWithAPI(mock)
+
+	evt := test.TriggeredAlarmDetails
+	if err := client.SubmitEvent(context.Background(), testResponsePlan, pagerduty.ActionTrigger, &evt); err != nil {
+		t.Fatalf("failed starting incident: %v", err)
+	}
+
+	started := mock.Started()
+	if len(started) != 1 {
+		t.Fatalf("expected 1 started incident, got %d", len(started))
+	}
+	in := started[0]
+	if aws.ToString(in.ResponsePlanArn) != testResponsePlan {
+		t.Errorf("unexpected response plan: %s", aws.ToString(in.ResponsePlanArn))
+	}
+	if aws.ToString(in.TriggerDetails.TriggerArn) != evt.Resources[0] {
+		t.Errorf("trigger arn should be the alarm arn, got %s", aws.ToString(in.TriggerDetails.TriggerArn))
+	}
+	var foundAlarm bool
+	for _, item := range in.RelatedItems {
+		if v, ok := item.Identifier.Value.(*imtypes.ItemValueMemberArn); ok && v.Value == evt.Resources[0] {
+			foundAlarm = true
+		}
+	}
+	if !foundAlarm {
+		t.Errorf("related items should include the alarm arn: %+v", in.RelatedItems)
+	}
+	if in.ClientToken == nil || *in.ClientToken == "" {
+		t.Errorf("expected a client token")
+	}
+}
+
+func TestSubmitEventTriggerDeduplicates(t *testing.T) {
+	mock := &test.MockIncidentsAPI{}
+	client := incidentmanager.NewWithAPI(mock)
+
+	evt := test.TriggeredAlarmDetails
+	for range 2 {
+		if err := client.SubmitEvent(context.Background(), testResponsePlan, pagerduty.ActionTrigger, &evt); err != nil {
+			t.Fatalf("failed starting incident: %v", err)
+		}
+	}
+
+	// the second trigger finds the open incident and only adds to its timeline
+	if got := len(mock.Started()); got != 1 {
+		t.Errorf("expected 1 started incident, got %d", got)
+	}
+	if got := len(mock.Timeline()); got != 1 {
+		t.Errorf("expected 1 timeline event, got %d", got)
+	}
+}
+
+func TestSubmitEventResolve(t *testing.T) {
+	mock := &test.MockIncidentsAPI{}
+	client := incidentmanager.NewWithAPI(mock)
+
+	triggered := test.TriggeredAlarmDetails
+	if err := client.SubmitEvent(context.Background(), testResponsePlan, pagerduty.ActionTrigger, &triggered); err != nil {
+		t.Fatalf("failed starting incident: %v", err)
+	}
+
+	resolved := test.TriggeredAlarmDetails
+	resolved.Detail.PreviousState = test.TestTriggeredAlarm.State
+	resolved.Detail.State = test.TestOKAlarm.State
+	if err := client.SubmitEvent(context.Background(), testResponsePlan, pagerduty.ActionResolve, &resolved); err != nil {
+		t.Fatalf("failed resolving incident: %v", err)
+	}
+
+	incidents := mock.Incidents()
+	if len(incidents) != 1 {
+		t.Fatalf("expected 1 incident, got %d", len(incidents))
+	}
+	if incidents[0].Status != imtypes.IncidentRecordStatusResolved {
+		t.Errorf("expected incident to be resolved, got %s", incidents[0].Status)
+	}
+	if got := len(mock.Timeline()); got != 1 {
+		t.Errorf("expected a timeline event for the resolution, got %d", got)
+	}
+
+	open, err := client.OpenIncident(context.Background(), triggered.Resources[0])
+	if err != nil {
+		t.Fatalf("OpenIncident returned error: %v", err)
+	}
+	if open != "" {
+		t.Errorf("expected no open incident after resolving, got %s", open)
+	}
+}
+
+func TestSubmitEventResolveWithoutIncident(t *testing.T) {
+	mock := &test.MockIncidentsAPI{}
+	client := incidentmanager.NewWithAPI(mock)
+
+	evt := test.ExpectedAlarmDetails
+	if err := client.SubmitEvent(context.Background(), testResponsePlan, pagerduty.ActionResolve, &evt); err != nil {
+		t.Fatalf("resolving without an open incident should be a no-op, got: %v", err)
+	}
+	if len(mock.Timeline()) != 0 || len(mock.Started()) != 0 {
+		t.Errorf("expected no incident manager calls")
+	}
+}
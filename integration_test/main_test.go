@@ -20,6 +20,7 @@ import (
 	"context"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambdacontext"
 
@@ -28,6 +29,7 @@ import (
 	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
 	"github.com/tidal-music/cw-alert-router/v2/parameterstore"
 	"github.com/tidal-music/cw-alert-router/v2/test"
+	"github.com/tidal-music/cw-alert-router/v2/worker"
 )
 
 const (
@@ -57,7 +59,7 @@ func setup(t *testing.T) *fixture {
 	}
 	t.Cleanup(f.slack.Close)
 
-	pdclient, err := pagerduty.New(pagerduty.WithAPI(f.pd))
+	pdclient, err := pagerduty.New(pagerduty.WithAPI(f.pd), pagerduty.WithRetry(2, time.Millisecond))
 	if err != nil {
 		t.Fatalf("failed creating pagerduty client: %v", err)
 	}
@@ -119,3 +121,39 @@ func TestLambdaHandler(t *testing.T) {
 		t.Errorf("expected service routing key pagerduty-key-1, got %s", events[0].RoutingKey)
 	}
 }
+
+func TestWorker(t *testing.T) {
+	f := setup(t)
+	t.Setenv(worker.QueueURLEnv, "https://sqs.us-east-1.amazonaws.com/1234567890123/alarms")
+	t.Setenv(worker.WaitTimeEnv, "1s")
+
+	q := &test.SQSQueue{}
+	for _, msg := range test.GenTestSQSEvent().Records {
+		q.Send(msg.Body, "")
+	}
+	w, err := worker.NewWithAPI(q, f.handler, worker.ConfigFromEnv())
+	if err != nil {
+		t.Fatalf("failed creating worker: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+	for deadline := time.Now().Add(5 * time.Second); q.Len() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	if q.Len() != 0 {
+		t.Fatalf("expected the queue to be drained, %d messages left", q.Len())
+	}
+	if got := len(f.slack.Messages()); got != 1 {
+		t.Errorf("expected 1 slack message, got %d", got)
+	}
+	if events := f.pd.Events(); len(events) != 1 || events[0].Action != pagerduty.ActionResolve {
+		t.Errorf("expected 1 pagerduty resolve, got %+v", events)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/archive"
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+)
+
+// archivePrefix is the key prefix of the event archive in S3.
+const archivePrefix = "archive"
+
+type archiveBatchKey struct{}
+
+// archiveBatch collects the entries archived while handling an invocation.
+type archiveBatch struct {
+	mu      sync.Mutex
+	entries []archive.Entry
+}
+
+// withArchiveBatch returns a context collecting the entries archived while
+// handling an invocation, and flush to write them together once it's
+// handled. flush uses ctx, so it should be the invocation's own context,
+// not one cancelled before the invocation ends.
+func (h *Handler) withArchiveBatch(ctx context.Context) (_ context.Context, flush func()) {
+	if h.archive == nil {
+		return ctx, func() {}
+	}
+	b := &archiveBatch{}
+	return context.WithValue(ctx, archiveBatchKey{}, b), func() {
+		b.mu.Lock()
+		entries := b.entries
+		b.entries = nil
+		b.mu.Unlock()
+		h.writeArchive(ctx, entries)
+	}
+}
+
+// archiveEvent archives the event with its routing and delivery outcome:
+// in the invocation's batch, or on its own outside of one (e.g. in server
+// mode). p is nil if the event wasn't routed.
+func (h *Handler) archiveEvent(ctx context.Context, evt *cw.Event, action string, p *prepared, outcomes []Outcome, err error) {
+	if h.archive == nil {
+		return
+	}
+	e := archive.Entry{ProcessedAt: time.Now().UTC(), Event: evt, Action: action}
+	if p != nil {
+		e.Tags = p.tags
+		e.SlackChannel = h.SlackChannel(p.tags)
+	}
+	for _, o := range outcomes {
+		ao := archive.Outcome{Destination: o.Destination, Skipped: o.Skipped}
+		if o.Err != nil {
+			ao.Error = o.Err.Error()
+		}
+		e.Outcomes = append(e.Outcomes, ao)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	if b, ok := ctx.Value(archiveBatchKey{}).(*archiveBatch); ok {
+		b.mu.Lock()
+		b.entries = append(b.entries, e)
+		b.mu.Unlock()
+		return
+	}
+	h.writeArchive(ctx, []archive.Entry{e})
+}
+
+// writeArchive writes archive entries. Failures are logged, not returned -
+// losing history should never fail an alert.
+func (h *Handler) writeArchive(ctx context.Context, entries []archive.Entry) {
+	if len(entries) == 0 {
+		return
+	}
+	location, err := h.archive.Write(ctx, entries)
+	if err != nil {
+		slog.Error("failed archiving events", "events", len(entries), "error", err)
+		return
+	}
+	slog.Debug("archived events", "events", len(entries), "location", location)
+}
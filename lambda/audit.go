@@ -0,0 +1,152 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/slack"
+)
+
+// Audit checks, as reported in findings.
+const (
+	CheckTagsUnavailable     = "tags_unavailable"
+	CheckMissingOwner        = "missing_owner"
+	CheckMissingService      = "missing_service"
+	CheckUnknownSlackChannel = "unknown_slack_channel"
+	CheckNoRoutingKey        = "no_routing_key"
+	CheckUnknownTag          = "unknown_tag"
+)
+
+// alertsTagPrefix is the prefix of the tags that tune an alarm's routing.
+const alertsTagPrefix = "alerts:"
+
+// knownTags are the alerts:* tags the router reads.
+var knownTags = map[string]bool{
+	SlackChannelOverrideTagKey:    true,
+	SuppressPagerDutyTagKey:       true,
+	SuppressIncidentManagerTagKey: true,
+	SuppressServiceNowTagKey:      true,
+	MattermostChannelTagKey:       true,
+	FlapThresholdTagKey:           true,
+}
+
+// Finding is a problem with an alarm's routing, found by an Auditor.
+type Finding struct {
+	Alarm    string `json:"alarm"`
+	AlarmARN string `json:"alarm_arn"`
+	Check    string `json:"check"`
+	Detail   string `json:"detail"`
+}
+
+// routingKeyLookup is the cached result of looking up a service's routing
+// key.
+type routingKeyLookup struct {
+	registered bool
+	err        error
+}
+
+// Auditor checks the routing tags of alarms for what silently falls back to
+// defaults, or fails when the alarm fires. It caches the Slack channels and
+// routing keys alarms share, and isn't safe for concurrent use.
+type Auditor struct {
+	h           *Handler
+	channels    map[string]slack.Channel
+	routingKeys map[string]routingKeyLookup
+}
+
+// NewAuditor returns an Auditor, listing the Slack channels alarms can be
+// routed to.
+func (h *Handler) NewAuditor(ctx context.Context) (*Auditor, error) {
+	channels, err := h.sl.Channels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Auditor{h: h, channels: channels, routingKeys: make(map[string]routingKeyLookup)}, nil
+}
+
+// Audit checks the alarm, fetching its tags with the CloudWatch client of
+// its account and region (the handler's own if nil):
+//   - missing owner and service tags, which fall back to the default Slack
+//     channel and PagerDuty routing key;
+//   - a Slack channel that doesn't exist, or the bot can't see;
+//   - a service without its own PagerDuty routing key, unless paging is
+//     suppressed;
+//   - alerts:* tags the router doesn't know, e.g. misspelled ones.
+func (a *Auditor) Audit(ctx context.Context, client *cw.Client, alarm cw.Alarm) []Finding {
+	if client == nil {
+		client = a.h.cw
+	}
+	var findings []Finding
+	add := func(check, format string, args ...any) {
+		findings = append(findings, Finding{Alarm: alarm.Name, AlarmARN: alarm.ARN, Check: check, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	tags, err := client.AlarmTags(ctx, alarm.ARN)
+	if err != nil {
+		add(CheckTagsUnavailable, "%v", err)
+		return findings
+	}
+	h := a.h
+	suppressed := tags[SuppressPagerDutyTagKey] == "true"
+	channel, source := h.slackChannel(tags)
+
+	if h.OwnerFromTags(tags) == "" {
+		if tags[SlackChannelOverrideTagKey] == "" {
+			add(CheckMissingOwner, "no %s tag, alerts go to the default channel %s", h.cfg.OwnerTagKey, channel)
+		} else {
+			add(CheckMissingOwner, "no %s tag", h.cfg.OwnerTagKey)
+		}
+	}
+	service := h.ServiceNameFromTags(tags)
+	if service == "" {
+		if suppressed {
+			add(CheckMissingService, "no %s tag", h.cfg.ServiceNameTagKey)
+		} else {
+			add(CheckMissingService, "no %s tag, pages go to the default routing key", h.cfg.ServiceNameTagKey)
+		}
+	}
+
+	if _, ok := a.channels[strings.TrimPrefix(channel, "#")]; !ok {
+		add(CheckUnknownSlackChannel, "slack channel %s (from %s) doesn't exist, or the bot can't see it", channel, source)
+	}
+
+	if service != "" && !suppressed {
+		lookup, ok := a.routingKeys[service]
+		if !ok {
+			_, key, err := h.lookupNamedParameter(ctx, h.cfg.PagerDutyRoutingKeySSMPattern, service, "")
+			lookup = routingKeyLookup{registered: key != "", err: err}
+			a.routingKeys[service] = lookup
+		}
+		switch {
+		case lookup.err != nil:
+			add(CheckNoRoutingKey, "looking up the routing key of service %s: %v", service, lookup.err)
+		case !lookup.registered:
+			add(CheckNoRoutingKey, "service %s has no routing key registered, pages go to the default routing key", service)
+		}
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		if strings.HasPrefix(k, alertsTagPrefix) && !knownTags[k] {
+			add(CheckUnknownTag, "unknown tag %s=%s", k, tags[k])
+		}
+	}
+	return findings
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	awsevents "github.com/aws/aws-lambda-go/events"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+)
+
+// messageGroupIDAttribute is the SQS system attribute holding a FIFO
+// queue's message group ID.
+const messageGroupIDAttribute = "MessageGroupId"
+
+// recordGroup is a batch's records that must be processed in order.
+type recordGroup struct {
+	key     string
+	records []awsevents.SQSMessage
+}
+
+// groupRecords splits the batch into groups processed in order: by message
+// group ID on FIFO queues, otherwise by alarm ARN. Records whose alarm
+// can't be determined are a group of their own. Groups and the records
+// within them keep their batch order.
+func groupRecords(records []awsevents.SQSMessage) []*recordGroup {
+	var groups []*recordGroup
+	byKey := make(map[string]*recordGroup)
+	for _, msg := range records {
+		key := msg.Attributes[messageGroupIDAttribute]
+		if key == "" {
+			key = "message:" + msg.MessageId
+			if evt, err := cw.DecodeEvent([]byte(msg.Body)); err == nil {
+				if alarmARN, err := evt.AlarmARN(); err == nil {
+					key = alarmARN
+				}
+			}
+		}
+		g, ok := byKey[key]
+		if !ok {
+			g = &recordGroup{key: key}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.records = append(g.records, msg)
+	}
+	return groups
+}
+
+// processBatch processes the record groups concurrently, at most
+// MaxConcurrency at a time, and returns the IDs of the records to retry.
+// Within a group records are processed in order, and a failure stops the
+// group: the failed record and its successors in the group are retried, so
+// an alarm's transitions are never handled out of order.
+func (h *Handler) processBatch(ctx context.Context, records []awsevents.SQSMessage) map[string]bool {
+	groups := groupRecords(records)
+	failed := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, h.cfg.MaxConcurrency)
+	for _, g := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			unprocessed := h.processGroup(ctx, g)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, msg := range unprocessed {
+				failed[msg.MessageId] = true
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+// processGroup processes the group's records in order, and returns the
+// failed record and the ones after it. Malformed and untrusted records are
+// quarantined rather than failed, if possible. Records are only started
+// with at least the record budget left before the deadline; the rest are
+// returned untouched.
+func (h *Handler) processGroup(ctx context.Context, g *recordGroup) []awsevents.SQSMessage {
+	for i, msg := range g.records {
+		if h.outOfTime(ctx) {
+			slog.Warn("running out of time, retrying the rest of the group", "group", g.key, "skipped", len(g.records)-i)
+			return g.records[i:]
+		}
+		slog.Info("processing sqs message", "message_id", msg.MessageId, "source", msg.EventSource, "group", g.key)
+		slog.Debug("sqs message body", "body", msg.Body)
+
+		if err := h.processRecord(ctx, msg); err != nil {
+			if quarantinable(err) && h.quarantineRecord(ctx, msg, err) {
+				continue
+			}
+			slog.Error("failed processing sqs message", "message_id", msg.MessageId, "group", g.key, "error", err)
+			if skipped := len(g.records) - i - 1; skipped > 0 {
+				slog.Warn("retrying the rest of the group in order", "group", g.key, "skipped", skipped)
+			}
+			return g.records[i:]
+		}
+	}
+	return nil
+}
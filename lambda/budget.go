@@ -0,0 +1,65 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"time"
+)
+
+// responseReserve is the time kept back from the invocation's deadline to
+// report the batch item failures: calls still running are cancelled this
+// long before the Lambda would be killed.
+const responseReserve = time.Second
+
+// ledgerTimeout bounds recording a delivery in the ledger after the send,
+// which may outlive the cancelled context (see settle). It fits within the
+// response reserve.
+const ledgerTimeout = responseReserve / 2
+
+// withResponseReserve returns a context whose deadline is responseReserve
+// before the invocation's, if it has one.
+func withResponseReserve(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-responseReserve))
+}
+
+// timeLeft returns the time until the context's deadline, or false if it
+// has none.
+func timeLeft(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
+
+// outOfTime reports whether too little time is left to start processing
+// another record: less than the record budget.
+func (h *Handler) outOfTime(ctx context.Context) bool {
+	left, ok := timeLeft(ctx)
+	return ok && left < h.cfg.RecordBudget
+}
+
+// lowOnTime reports whether optional work (graph rendering, storm grouping,
+// stabilised announcements) should be skipped to get the alerts out: less
+// than twice the record budget is left.
+func (h *Handler) lowOnTime(ctx context.Context) bool {
+	left, ok := timeLeft(ctx)
+	return ok && left < 2*h.cfg.RecordBudget
+}
@@ -18,7 +18,14 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/flapping"
+	"github.com/tidal-music/cw-alert-router/v2/metrics"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+	"github.com/tidal-music/cw-alert-router/v2/slack"
 )
 
 // Graph delivery modes.
@@ -46,6 +53,49 @@ const (
 	// DefaultPagerDutyRoutingKeySSMPattern is the parameter-store key pattern
 	// where services can register their own PagerDuty routing key.
 	DefaultPagerDutyRoutingKeySSMPattern = "/service/cw_alert_router/pagerduty/routing_keys/%s"
+	// SuppressIncidentManagerTagKey is the AWS tag which, when set to "true",
+	// stops the alarm from starting Incident Manager incidents.
+	SuppressIncidentManagerTagKey = "alerts:suppress_incident_manager"
+	// DefaultIncidentManagerResponsePlanSSMPattern is the parameter-store key
+	// pattern where services can register their own Incident Manager response plan ARN.
+	DefaultIncidentManagerResponsePlanSSMPattern = "/service/cw_alert_router/incident_manager/response_plans/%s"
+	// DefaultGoogleChatWebhookSSMPattern is the parameter-store key pattern
+	// where owners can register a Google Chat incoming webhook URL.
+	DefaultGoogleChatWebhookSSMPattern = "/service/cw_alert_router/google_chat/webhooks/%s"
+	// DefaultMattermostWebhookSSMPattern is the parameter-store key pattern
+	// where owners can register a Mattermost incoming webhook URL.
+	DefaultMattermostWebhookSSMPattern = "/service/cw_alert_router/mattermost/webhooks/%s"
+	// MattermostChannelTagKey is the AWS tag which specifies the Mattermost
+	// channel alerts are posted to (default: the webhook's channel).
+	MattermostChannelTagKey = "alerts:mattermost_channel"
+	// SuppressServiceNowTagKey is the AWS tag which, when set to "true",
+	// stops the alarm from creating ServiceNow incidents.
+	SuppressServiceNowTagKey = "alerts:suppress_servicenow"
+	// DefaultServiceNowUsernameSSMKey is the parameter-store key holding the
+	// ServiceNow integration user name.
+	DefaultServiceNowUsernameSSMKey = "/service/cw_alert_router/servicenow/username"
+	// DefaultServiceNowPasswordSSMKey is the parameter-store key holding the
+	// ServiceNow integration user password.
+	DefaultServiceNowPasswordSSMKey = "/service/cw_alert_router/servicenow/password"
+	// DefaultServiceNowAssignmentGroupSSMPattern is the parameter-store key
+	// pattern where owners can register their ServiceNow assignment group.
+	DefaultServiceNowAssignmentGroupSSMPattern = "/service/cw_alert_router/servicenow/assignment_groups/%s"
+	// DefaultServiceNowIncidentSSMPattern is the parameter-store key pattern
+	// the sys_ids of open ServiceNow incidents are stored under.
+	DefaultServiceNowIncidentSSMPattern = "/service/cw_alert_router/servicenow/incidents/%s"
+	// FlapThresholdTagKey is the AWS tag which overrides the number of
+	// transitions within the flap window that make the alarm flapping
+	// ("0" disables flap detection for the alarm).
+	FlapThresholdTagKey = "alerts:flap_threshold"
+	// DefaultMaxConcurrency is the number of alarms whose records are
+	// processed concurrently.
+	DefaultMaxConcurrency = 4
+	// DefaultRecordBudget is the time kept in hand to process one record
+	// before the invocation's deadline.
+	DefaultRecordBudget = 5 * time.Second
+	// DefaultPreflightTimeout bounds the preflight checks run at startup,
+	// well within the Lambda's 10 second init phase.
+	DefaultPreflightTimeout = 5 * time.Second
 )
 
 // Environment variable keys.
@@ -56,6 +106,12 @@ const (
 	DefaultSlackChannelEnv = "DEFAULT_SLACK_CHANNEL"
 	// DefaultPagerDutyRoutingKeyEnv is the environment variable key for the pagerduty routing key.
 	DefaultPagerDutyRoutingKeyEnv = "PAGERDUTY_DEFAULT_ROUTING_KEY"
+	// PagerDutyEventsURLEnv is the env var key for the PagerDuty Events API
+	// base URL (e.g. https://events.eu.pagerduty.com for the EU region).
+	PagerDutyEventsURLEnv = "PAGERDUTY_EVENTS_URL"
+	// PagerDutyFallbackSlackChannelEnv is the env var key for the Slack
+	// channel alerted when PagerDuty rejects an alarm's event.
+	PagerDutyFallbackSlackChannelEnv = "PAGERDUTY_FALLBACK_SLACK_CHANNEL"
 	// GraphModeEnv selects how alarm graphs are delivered: slack (default), s3 or none.
 	GraphModeEnv = "GRAPH_MODE"
 	// ImageBucketEnv is the environment variable key for the images bucket (s3 graph mode).
@@ -76,6 +132,76 @@ const (
 	OwnerTagKeyEnv = "OWNER_TAG_KEY"
 	// ServiceNameTagKeyEnv is used to override the default service name tag key.
 	ServiceNameTagKeyEnv = "SERVICE_NAME_TAG_KEY"
+	// IncidentManagerEnabledEnv enables paging via Incident Manager when set to "true".
+	IncidentManagerEnabledEnv = "INCIDENT_MANAGER_ENABLED"
+	// IncidentManagerDefaultResponsePlanEnv is the env var key for the fallback response plan ARN.
+	IncidentManagerDefaultResponsePlanEnv = "INCIDENT_MANAGER_DEFAULT_RESPONSE_PLAN_ARN"
+	// OpsCenterEnabledEnv enables OpsItems for non-paging alarms when set to "true".
+	OpsCenterEnabledEnv = "OPSCENTER_ENABLED"
+	// GoogleChatEnabledEnv enables Google Chat notifications when set to "true".
+	GoogleChatEnabledEnv = "GOOGLE_CHAT_ENABLED"
+	// MattermostEnabledEnv enables Mattermost notifications when set to "true".
+	MattermostEnabledEnv = "MATTERMOST_ENABLED"
+	// ServiceNowInstanceURLEnv is the env var key for the ServiceNow instance
+	// URL; setting it enables ServiceNow incidents.
+	ServiceNowInstanceURLEnv = "SERVICENOW_INSTANCE_URL"
+	// ServiceNowDefaultAssignmentGroupEnv is the env var key for the fallback assignment group.
+	ServiceNowDefaultAssignmentGroupEnv = "SERVICENOW_DEFAULT_ASSIGNMENT_GROUP"
+	// DeliveryLedgerTableEnv is the env var key for the DynamoDB delivery ledger table.
+	DeliveryLedgerTableEnv = "DELIVERY_LEDGER_TABLE"
+	// FlapThresholdEnv is the env var key for the number of transitions
+	// within the flap window that make an alarm flapping (0 = disabled).
+	FlapThresholdEnv = "FLAP_THRESHOLD"
+	// FlapWindowEnv is the env var key for the flap window (a Go duration, e.g. "30m").
+	FlapWindowEnv = "FLAP_WINDOW"
+	// AlarmStateTableEnv is the env var key for the DynamoDB alarm state table.
+	AlarmStateTableEnv = "ALARM_STATE_TABLE"
+	// StormThresholdEnv is the env var key for the number of triggers to one
+	// Slack channel within a batch that are grouped into one message (0 = disabled).
+	StormThresholdEnv = "STORM_THRESHOLD"
+	// SlackChannelIntervalEnv is the env var key for the minimum time between
+	// messages to one Slack channel (a Go duration, e.g. "1s"; 0 disables
+	// pacing).
+	SlackChannelIntervalEnv = "SLACK_CHANNEL_INTERVAL"
+	// MaxConcurrencyEnv is the env var key for the number of alarms whose
+	// records are processed concurrently.
+	MaxConcurrencyEnv = "MAX_CONCURRENCY"
+	// RecordBudgetEnv is the env var key for the time kept in hand to process
+	// one record before the invocation's deadline (a Go duration, e.g. "5s").
+	RecordBudgetEnv = "RECORD_BUDGET"
+	// QuarantineBucketEnv is the env var key for the S3 bucket malformed
+	// records are quarantined in.
+	QuarantineBucketEnv = "QUARANTINE_BUCKET"
+	// QuarantineQueueURLEnv is the env var key for the SQS queue malformed
+	// records are quarantined in.
+	QuarantineQueueURLEnv = "QUARANTINE_QUEUE_URL"
+	// ArchiveBucketEnv is the env var key for the S3 bucket processed events
+	// are archived in.
+	ArchiveBucketEnv = "ARCHIVE_BUCKET"
+	// PreflightDisabledEnv is the env var key for disabling the preflight
+	// checks at startup ("true").
+	PreflightDisabledEnv = "PREFLIGHT_DISABLED"
+	// DryRunEnv is the env var key for running as a shadow router ("true").
+	DryRunEnv = "DRY_RUN"
+	// ShadowSlackChannelEnv is the env var key for the channel a dry run
+	// posts its Slack messages to.
+	ShadowSlackChannelEnv = "SHADOW_SLACK_CHANNEL"
+	// MetricsNamespaceEnv is the env var key for the CloudWatch namespace
+	// of the router's metrics.
+	MetricsNamespaceEnv = "METRICS_NAMESPACE"
+	// MetricsDisabledEnv is the env var key for disabling the router's
+	// metrics ("true").
+	MetricsDisabledEnv = "METRICS_DISABLED"
+	// AllowedAccountsEnv is the env var key for the comma separated AWS
+	// account IDs alarms are accepted from (default: any).
+	AllowedAccountsEnv = "ALLOWED_ACCOUNTS"
+	// AllowedRegionsEnv is the env var key for the comma separated regions
+	// alarms are accepted from (default: any).
+	AllowedRegionsEnv = "ALLOWED_REGIONS"
+	// AllowedTopicARNsEnv is the env var key for the comma separated SNS
+	// topics classic alarm notifications are accepted from (default: any
+	// topic in ALLOWED_ACCOUNTS).
+	AllowedTopicARNsEnv = "ALLOWED_TOPIC_ARNS"
 )
 
 // Config holds configuration options for the lambda.
@@ -101,6 +227,15 @@ type Config struct {
 	// service-specific PagerDuty routing keys (must contain one %s).
 	PagerDutyRoutingKeySSMPattern string
 
+	// PagerDutyEventsURL is the PagerDuty Events API base URL (default
+	// pagerduty.DefaultEventsURL).
+	PagerDutyEventsURL string
+
+	// PagerDutyFallbackSlackChannel is alerted instead of retrying when
+	// PagerDuty rejects an alarm's event, e.g. for an invalid routing key
+	// (default DefaultSlackChannel).
+	PagerDutyFallbackSlackChannel string
+
 	// GraphMode selects how alarm graphs are delivered: GraphModeSlack,
 	// GraphModeS3 or GraphModeNone.
 	GraphMode string
@@ -123,27 +258,257 @@ type Config struct {
 
 	// LogLevel is the slog level name (debug, info, warn, error).
 	LogLevel string
+
+	// IncidentManagerEnabled turns on paging via Incident Manager.
+	IncidentManagerEnabled bool
+
+	// IncidentManagerDefaultResponsePlanARN is used when no service-specific
+	// response plan is registered in parameter store. If empty, alarms of
+	// services without a registered plan don't start incidents.
+	IncidentManagerDefaultResponsePlanARN string
+
+	// IncidentManagerResponsePlanSSMPattern is the parameter-store key pattern
+	// for service-specific response plan ARNs (must contain one %s).
+	IncidentManagerResponsePlanSSMPattern string
+
+	// OpsCenterEnabled turns on OpsCenter OpsItems for alarms that aren't
+	// paged (neither PagerDuty nor Incident Manager).
+	OpsCenterEnabled bool
+
+	// GoogleChatEnabled turns on Google Chat notifications for owners that
+	// registered a webhook in parameter store.
+	GoogleChatEnabled bool
+
+	// GoogleChatWebhookSSMPattern is the parameter-store key pattern for
+	// owner-specific Google Chat webhook URLs (must contain one %s).
+	GoogleChatWebhookSSMPattern string
+
+	// MattermostEnabled turns on Mattermost notifications for owners that
+	// registered a webhook in parameter store.
+	MattermostEnabled bool
+
+	// MattermostWebhookSSMPattern is the parameter-store key pattern for
+	// owner-specific Mattermost webhook URLs (must contain one %s).
+	MattermostWebhookSSMPattern string
+
+	// ServiceNowInstanceURL is the ServiceNow instance incidents are created
+	// in (e.g. https://example.service-now.com). Empty disables ServiceNow.
+	ServiceNowInstanceURL string
+
+	// ServiceNowUsernameSSMKey and ServiceNowPasswordSSMKey are the
+	// parameter-store keys holding the ServiceNow basic-auth credentials.
+	ServiceNowUsernameSSMKey string
+	ServiceNowPasswordSSMKey string
+
+	// ServiceNowDefaultAssignmentGroup is used when no owner-specific
+	// assignment group is registered in parameter store.
+	ServiceNowDefaultAssignmentGroup string
+
+	// ServiceNowAssignmentGroupSSMPattern is the parameter-store key pattern
+	// for owner-specific assignment groups (must contain one %s).
+	ServiceNowAssignmentGroupSSMPattern string
+
+	// ServiceNowIncidentSSMPattern is the parameter-store key pattern open
+	// incident sys_ids are stored under (must contain one %s).
+	ServiceNowIncidentSSMPattern string
+
+	// DeliveryLedgerTable is the DynamoDB table recording deliveries per
+	// event and destination. If empty, deliveries are only remembered in
+	// memory by the running lambda instance.
+	DeliveryLedgerTable string
+
+	// DeliveryLedgerTTL is how long deliveries are remembered (default
+	// ledger.DefaultTTL).
+	DeliveryLedgerTTL time.Duration
+
+	// FlapThreshold is the number of transitions within FlapWindow that make
+	// an alarm flapping, overridable per alarm with the FlapThresholdTagKey
+	// tag. 0 disables flap detection unless an alarm is tagged.
+	FlapThreshold int
+
+	// FlapWindow is the period transitions are counted over, and how long a
+	// flapping alarm must go without a transition to be stable again
+	// (default flapping.DefaultWindow).
+	FlapWindow time.Duration
+
+	// AlarmStateTable is the DynamoDB table recent alarm transitions are
+	// tracked in. If empty, they're only tracked in memory by the running
+	// lambda instance.
+	AlarmStateTable string
+
+	// StormThreshold is the number of triggers going to the same Slack
+	// channel within one SQS batch from which they are posted as a single
+	// summary message. 0 disables grouping.
+	StormThreshold int
+
+	// SlackChannelInterval is the minimum time between messages to one
+	// Slack channel (default slack.DefaultChannelInterval).
+	SlackChannelInterval time.Duration
+	// SlackPacingDisabled stops Slack messages being paced, e.g. for a
+	// workspace with a raised rate limit.
+	SlackPacingDisabled bool
+
+	// MaxConcurrency is the number of alarms (or FIFO message groups) whose
+	// records are processed concurrently (default DefaultMaxConcurrency).
+	MaxConcurrency int
+
+	// RecordBudget is the time kept in hand to process one record before
+	// the invocation's deadline (default DefaultRecordBudget): records
+	// aren't started with less left, and optional work is skipped with less
+	// than twice that left.
+	RecordBudget time.Duration
+
+	// QuarantineBucket is the S3 bucket malformed records are stored in
+	// (under the "quarantine/" prefix) instead of being retried.
+	QuarantineBucket string
+
+	// QuarantineQueueURL is the SQS queue malformed records are sent to
+	// instead of being retried. Only one of QuarantineBucket and
+	// QuarantineQueueURL may be set.
+	QuarantineQueueURL string
+
+	// ArchiveBucket is the S3 bucket every processed event is archived in
+	// with its routing and delivery outcome (under the "archive/" prefix).
+	// Empty disables the archive.
+	ArchiveBucket string
+
+	// PreflightDisabled skips the preflight checks (see Handler.Preflight)
+	// at startup.
+	PreflightDisabled bool
+
+	// DryRun routes and renders events without delivering them, to run a
+	// new version as a shadow alongside the live router: Slack messages and
+	// PagerDuty events are logged instead, and other destinations only log
+	// that they would have been delivered to. A dry run keeps its own
+	// in-memory delivery ledger and alarm state, and neither quarantines
+	// nor archives, so it never interferes with the live router's state.
+	DryRun bool
+	// ShadowSlackChannel, in a dry run, receives the Slack messages instead,
+	// each noting the channel it was meant for. Empty only logs them.
+	ShadowSlackChannel string
+
+	// MetricsNamespace is the CloudWatch namespace of the router's metrics,
+	// emitted as EMF log lines (see emitEventMetrics). A dry run's metrics
+	// go to MetricsNamespace/DryRun.
+	MetricsNamespace string
+	// MetricsDisabled stops the metrics being emitted.
+	MetricsDisabled bool
+
+	// AllowedAccounts are the AWS account IDs alarms are accepted from.
+	// Empty accepts any account.
+	AllowedAccounts []string
+
+	// AllowedRegions are the regions alarms are accepted from. Empty
+	// accepts any region.
+	AllowedRegions []string
+
+	// AllowedTopicARNs are the SNS topics classic alarm notifications are
+	// accepted from. Empty accepts any topic in AllowedAccounts.
+	AllowedTopicARNs []string
 }
 
 // ConfigFromEnv builds a Config from the environment variables documented in the README.
 func ConfigFromEnv() Config {
 	cfg := Config{
-		DefaultSlackChannel:        os.Getenv(DefaultSlackChannelEnv),
-		DefaultPagerDutyRoutingKey: os.Getenv(DefaultPagerDutyRoutingKeyEnv),
-		SlackTokenSSMKey:           os.Getenv(SlackTokenSSMKeyEnv),
-		OwnerTagKey:                os.Getenv(OwnerTagKeyEnv),
-		ServiceNameTagKey:          os.Getenv(ServiceNameTagKeyEnv),
-		GraphMode:                  os.Getenv(GraphModeEnv),
-		ImageBucket:                os.Getenv(ImageBucketEnv),
-		ImageBucketRegion:          os.Getenv(ImageBucketRegionEnv),
-		ImageBucketRoleArn:         os.Getenv(ImageBucketRoleArnEnv),
-		ImageBucketPrefix:          os.Getenv(ImageBucketPrefixEnv),
-		ImageHost:                  os.Getenv(ImageHostEnv),
-		LogLevel:                   os.Getenv(LogLevelEnv),
+		DefaultSlackChannel:           os.Getenv(DefaultSlackChannelEnv),
+		DefaultPagerDutyRoutingKey:    os.Getenv(DefaultPagerDutyRoutingKeyEnv),
+		PagerDutyEventsURL:            os.Getenv(PagerDutyEventsURLEnv),
+		PagerDutyFallbackSlackChannel: os.Getenv(PagerDutyFallbackSlackChannelEnv),
+		SlackTokenSSMKey:              os.Getenv(SlackTokenSSMKeyEnv),
+		OwnerTagKey:                   os.Getenv(OwnerTagKeyEnv),
+		ServiceNameTagKey:             os.Getenv(ServiceNameTagKeyEnv),
+		GraphMode:                     os.Getenv(GraphModeEnv),
+		ImageBucket:                   os.Getenv(ImageBucketEnv),
+		ImageBucketRegion:             os.Getenv(ImageBucketRegionEnv),
+		ImageBucketRoleArn:            os.Getenv(ImageBucketRoleArnEnv),
+		ImageBucketPrefix:             os.Getenv(ImageBucketPrefixEnv),
+		ImageHost:                     os.Getenv(ImageHostEnv),
+		LogLevel:                      os.Getenv(LogLevelEnv),
+
+		IncidentManagerEnabled:                os.Getenv(IncidentManagerEnabledEnv) == "true",
+		IncidentManagerDefaultResponsePlanARN: os.Getenv(IncidentManagerDefaultResponsePlanEnv),
+		OpsCenterEnabled:                      os.Getenv(OpsCenterEnabledEnv) == "true",
+		GoogleChatEnabled:                     os.Getenv(GoogleChatEnabledEnv) == "true",
+		MattermostEnabled:                     os.Getenv(MattermostEnabledEnv) == "true",
+		ServiceNowInstanceURL:                 os.Getenv(ServiceNowInstanceURLEnv),
+		ServiceNowDefaultAssignmentGroup:      os.Getenv(ServiceNowDefaultAssignmentGroupEnv),
+		DeliveryLedgerTable:                   os.Getenv(DeliveryLedgerTableEnv),
+		AlarmStateTable:                       os.Getenv(AlarmStateTableEnv),
+		QuarantineBucket:                      os.Getenv(QuarantineBucketEnv),
+		QuarantineQueueURL:                    os.Getenv(QuarantineQueueURLEnv),
+		ArchiveBucket:                         os.Getenv(ArchiveBucketEnv),
+		PreflightDisabled:                     os.Getenv(PreflightDisabledEnv) == "true",
+		DryRun:                                os.Getenv(DryRunEnv) == "true",
+		ShadowSlackChannel:                    os.Getenv(ShadowSlackChannelEnv),
+		MetricsNamespace:                      os.Getenv(MetricsNamespaceEnv),
+		MetricsDisabled:                       os.Getenv(MetricsDisabledEnv) == "true",
+		AllowedAccounts:                       splitList(os.Getenv(AllowedAccountsEnv)),
+		AllowedRegions:                        splitList(os.Getenv(AllowedRegionsEnv)),
+		AllowedTopicARNs:                      splitList(os.Getenv(AllowedTopicARNsEnv)),
+	}
+	if v := os.Getenv(FlapThresholdEnv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			slog.Error("invalid flap threshold", "value", v, "error", err)
+			n = -1
+		}
+		cfg.FlapThreshold = n
+	}
+	if v := os.Getenv(StormThresholdEnv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			slog.Error("invalid storm threshold", "value", v, "error", err)
+			n = -1
+		}
+		cfg.StormThreshold = n
+	}
+	if v := os.Getenv(MaxConcurrencyEnv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			slog.Error("invalid max concurrency", "value", v, "error", err)
+			n = -1
+		}
+		cfg.MaxConcurrency = n
+	}
+	if v := os.Getenv(SlackChannelIntervalEnv); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			slog.Error("invalid slack channel interval", "value", v, "error", err)
+			d = -1
+		}
+		cfg.SlackChannelInterval = d
+		cfg.SlackPacingDisabled = d == 0
+	}
+	if v := os.Getenv(RecordBudgetEnv); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			slog.Error("invalid record budget", "value", v, "error", err)
+			d = -1
+		}
+		cfg.RecordBudget = d
+	}
+	if v := os.Getenv(FlapWindowEnv); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			slog.Error("invalid flap window", "value", v, "error", err)
+			d = -1
+		}
+		cfg.FlapWindow = d
 	}
 	return cfg.withDefaults()
 }
 
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
 // withDefaults fills in defaults for unset fields.
 func (c Config) withDefaults() Config {
 	if c.OwnerTagKey == "" {
@@ -155,6 +520,48 @@ func (c Config) withDefaults() Config {
 	if c.PagerDutyRoutingKeySSMPattern == "" {
 		c.PagerDutyRoutingKeySSMPattern = DefaultPagerDutyRoutingKeySSMPattern
 	}
+	if c.PagerDutyEventsURL == "" {
+		c.PagerDutyEventsURL = pagerduty.DefaultEventsURL
+	}
+	if c.MetricsNamespace == "" {
+		c.MetricsNamespace = metrics.DefaultNamespace
+	}
+	if c.PagerDutyFallbackSlackChannel == "" {
+		c.PagerDutyFallbackSlackChannel = c.DefaultSlackChannel
+	}
+	if c.IncidentManagerResponsePlanSSMPattern == "" {
+		c.IncidentManagerResponsePlanSSMPattern = DefaultIncidentManagerResponsePlanSSMPattern
+	}
+	if c.GoogleChatWebhookSSMPattern == "" {
+		c.GoogleChatWebhookSSMPattern = DefaultGoogleChatWebhookSSMPattern
+	}
+	if c.MattermostWebhookSSMPattern == "" {
+		c.MattermostWebhookSSMPattern = DefaultMattermostWebhookSSMPattern
+	}
+	if c.ServiceNowUsernameSSMKey == "" {
+		c.ServiceNowUsernameSSMKey = DefaultServiceNowUsernameSSMKey
+	}
+	if c.ServiceNowPasswordSSMKey == "" {
+		c.ServiceNowPasswordSSMKey = DefaultServiceNowPasswordSSMKey
+	}
+	if c.ServiceNowAssignmentGroupSSMPattern == "" {
+		c.ServiceNowAssignmentGroupSSMPattern = DefaultServiceNowAssignmentGroupSSMPattern
+	}
+	if c.ServiceNowIncidentSSMPattern == "" {
+		c.ServiceNowIncidentSSMPattern = DefaultServiceNowIncidentSSMPattern
+	}
+	if c.MaxConcurrency == 0 {
+		c.MaxConcurrency = DefaultMaxConcurrency
+	}
+	if c.SlackChannelInterval == 0 {
+		c.SlackChannelInterval = slack.DefaultChannelInterval
+	}
+	if c.FlapWindow == 0 {
+		c.FlapWindow = flapping.DefaultWindow
+	}
+	if c.RecordBudget == 0 {
+		c.RecordBudget = DefaultRecordBudget
+	}
 	if c.GraphMode == "" {
 		// backwards compatible default: deployments configured with an image
 		// bucket keep using it; everything else uploads straight to Slack
@@ -185,6 +592,30 @@ func (c Config) validate() error {
 		return fmt.Errorf("invalid graph mode %q (%s must be %s, %s or %s)",
 			c.GraphMode, GraphModeEnv, GraphModeSlack, GraphModeS3, GraphModeNone)
 	}
+	if c.FlapThreshold < 0 {
+		return fmt.Errorf("flap threshold must be a non-negative integer (%s)", FlapThresholdEnv)
+	}
+	if c.StormThreshold < 0 {
+		return fmt.Errorf("storm threshold must be a non-negative integer (%s)", StormThresholdEnv)
+	}
+	if c.MaxConcurrency < 0 {
+		return fmt.Errorf("max concurrency must be a positive integer (%s)", MaxConcurrencyEnv)
+	}
+	if c.SlackChannelInterval < 0 {
+		return fmt.Errorf("slack channel interval must be a positive duration (%s)", SlackChannelIntervalEnv)
+	}
+	if c.FlapWindow <= 0 {
+		return fmt.Errorf("flap window must be a positive duration (%s)", FlapWindowEnv)
+	}
+	if c.RecordBudget < 0 {
+		return fmt.Errorf("record budget must be a positive duration (%s)", RecordBudgetEnv)
+	}
+	if c.ShadowSlackChannel != "" && !c.DryRun {
+		return fmt.Errorf("%s requires %s", ShadowSlackChannelEnv, DryRunEnv)
+	}
+	if c.QuarantineBucket != "" && c.QuarantineQueueURL != "" {
+		return fmt.Errorf("only one of %s and %s may be set", QuarantineBucketEnv, QuarantineQueueURLEnv)
+	}
 	return nil
 }
 
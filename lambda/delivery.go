@@ -0,0 +1,393 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/flapping"
+	"github.com/tidal-music/cw-alert-router/v2/ledger"
+	"github.com/tidal-music/cw-alert-router/v2/message"
+	"github.com/tidal-music/cw-alert-router/v2/metrics"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+	"github.com/tidal-music/cw-alert-router/v2/slack"
+)
+
+// Destination names, as used in delivery outcomes and logs.
+const (
+	DestinationSlack           = "slack"
+	DestinationPagerDuty       = "pagerduty"
+	DestinationIncidentManager = "incident_manager"
+	DestinationOpsCenter       = "opscenter"
+	DestinationServiceNow      = "servicenow"
+	DestinationGoogleChat      = "google_chat"
+	DestinationMattermost      = "mattermost"
+)
+
+// Outcome is the result of delivering an event to one destination.
+type Outcome struct {
+	Destination string
+	// Err is the delivery error, nil on success.
+	Err error
+	// Skipped is set when the destination was already delivered on an
+	// earlier attempt and wasn't sent to again.
+	Skipped bool
+}
+
+// DeliveryError reports the destinations an event couldn't be delivered to.
+type DeliveryError struct {
+	Alarm    string
+	Outcomes []Outcome
+}
+
+// Failed returns the names of the failed destinations.
+func (e *DeliveryError) Failed() []string {
+	var failed []string
+	for _, o := range e.Outcomes {
+		if o.Err != nil {
+			failed = append(failed, o.Destination)
+		}
+	}
+	return failed
+}
+
+func (e *DeliveryError) Error() string {
+	var parts []string
+	for _, o := range e.Outcomes {
+		if o.Err != nil {
+			parts = append(parts, fmt.Sprintf("%s: %v", o.Destination, o.Err))
+		}
+	}
+	return fmt.Sprintf("delivering alarm %s failed: %s", e.Alarm, strings.Join(parts, "; "))
+}
+
+// Unwrap returns the individual destination errors.
+func (e *DeliveryError) Unwrap() []error {
+	var errs []error
+	for _, o := range e.Outcomes {
+		if o.Err != nil {
+			errs = append(errs, o.Err)
+		}
+	}
+	return errs
+}
+
+// delivery sends an event to one destination.
+type delivery struct {
+	destination string
+	send        func(ctx context.Context) error
+}
+
+// ErrInFlight is the delivery error when another attempt at the same
+// delivery holds the ledger claim; the record is retried later.
+var ErrInFlight = errors.New("delivery in progress in another attempt")
+
+// ProcessEvent handles one CloudWatch alarm state change event. It returns a
+// *DeliveryError if any destination failed.
+func (h *Handler) ProcessEvent(ctx context.Context, evt *cw.Event) error {
+	_, err := h.DeliverEvent(ctx, evt)
+	return err
+}
+
+// DeliverEvent delivers one CloudWatch alarm state change event to every
+// destination it is routed to and returns the per-destination outcomes.
+// Destinations are delivered concurrently and independently, and those
+// already delivered for the event (a redelivered record) are skipped.
+// Events that aren't trusted fail with ErrUntrusted, undelivered.
+func (h *Handler) DeliverEvent(ctx context.Context, evt *cw.Event) (outcomes []Outcome, err error) {
+	var action string
+	var p *prepared
+	defer func() { h.archiveEvent(ctx, evt, action, p, outcomes, err) }()
+
+	if err := h.authenticate(evt); err != nil {
+		slog.Warn("rejecting alarm event", "alarm", evt.Detail.AlarmName, "event_id", evt.ID, "error", err)
+		h.emit(metrics.Record{Metrics: []metrics.Metric{count(MetricEventsRejected, 1)}})
+		return nil, err
+	}
+	alarmARN, _ := evt.AlarmARN() // checked by authenticate
+
+	action = pagerduty.Action(evt.Detail.PreviousState.Value, evt.Detail.State.Value)
+	if action == pagerduty.ActionNone {
+		slog.Info("ignoring alarm state transition",
+			"alarm", evt.Detail.AlarmName,
+			"previous", evt.Detail.PreviousState.Value,
+			"current", evt.Detail.State.Value)
+		return nil, nil
+	}
+
+	if p, err = h.prepare(ctx, evt, alarmARN); err != nil {
+		h.emit(metrics.Record{Metrics: []metrics.Metric{count(MetricEventsFailed, 1)}})
+		return nil, err
+	}
+	defer func() {
+		slog.Info("processed alarm", append([]any{"alarm", evt.Detail.AlarmName}, p.timings.logAttrs()...)...)
+	}()
+
+	deliveries := h.deliveries(ctx, p, action, evt)
+	if decision, state := h.observeFlapping(ctx, p.tags, evt); decision != flapping.Normal {
+		deliveries = h.flappingDeliveries(deliveries, p.tags, action, evt, state)
+	}
+	start := time.Now()
+	outcomes = make([]Outcome, len(deliveries))
+	latencies := make([]time.Duration, len(deliveries))
+	var wg sync.WaitGroup
+	for i, d := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outcomes[i] = h.deliver(ctx, evt, d)
+			latencies[i] = time.Since(evt.StateChangeTime())
+		}()
+	}
+	wg.Wait()
+	p.timings.deliver = time.Since(start)
+	h.emitEventMetrics(evt, action, p, outcomes, latencies)
+
+	var failed bool
+	for _, o := range outcomes {
+		switch {
+		case o.Err != nil:
+			failed = true
+			slog.Error("failed delivering alarm", "alarm", evt.Detail.AlarmName, "destination", o.Destination, "error", o.Err)
+		case o.Skipped:
+			slog.Info("alarm already delivered, skipping", "alarm", evt.Detail.AlarmName, "destination", o.Destination)
+		default:
+			slog.Info("delivered alarm", "alarm", evt.Detail.AlarmName, "destination", o.Destination)
+		}
+	}
+	if failed {
+		return outcomes, &DeliveryError{Alarm: evt.Detail.AlarmName, Outcomes: outcomes}
+	}
+	return outcomes, nil
+}
+
+// deliver sends the event to one destination, guarded by the delivery
+// ledger (keyed by EventBridge event ID). Ledger failures don't stop the
+// delivery: an alert sent twice beats one never sent.
+func (h *Handler) deliver(ctx context.Context, evt *cw.Event, d delivery) Outcome {
+	o := Outcome{Destination: d.destination}
+	claim, err := h.ledger.Claim(ctx, evt.ID, d.destination)
+	if err != nil {
+		slog.Error("failed claiming delivery, delivering anyway", "event_id", evt.ID, "destination", d.destination, "error", err)
+		claim = ledger.Claimed
+	}
+	switch claim {
+	case ledger.AlreadyDelivered:
+		o.Skipped = true
+		return o
+	case ledger.InFlight:
+		o.Err = ErrInFlight
+		return o
+	}
+
+	o.Err = d.send(ctx)
+	h.settle(ctx, evt.ID, d.destination, o.Err == nil)
+	return o
+}
+
+// settle records the result of a claimed delivery in the ledger: complete
+// if it was delivered, released to be retried otherwise. It runs even once
+// ctx is cancelled, since the send may have failed, or only just succeeded,
+// because the deadline hit; a claim left behind would block every
+// redelivery until its lease ran out, and then be sent again.
+func (h *Handler) settle(ctx context.Context, eventID, destination string, delivered bool) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ledgerTimeout)
+	defer cancel()
+	if !delivered {
+		if err := h.ledger.Release(ctx, eventID, destination); err != nil {
+			slog.Error("failed releasing delivery", "event_id", eventID, "destination", destination, "error", err)
+		}
+		return
+	}
+	if err := h.ledger.Complete(ctx, eventID, destination); err != nil {
+		slog.Error("failed recording delivery", "event_id", eventID, "destination", destination, "error", err)
+	}
+}
+
+// deliveries returns the destinations the prepared event is routed to.
+// Lookups that decide routing (the Incident Manager response plan) happen
+// here; a failed lookup becomes a failed delivery for its destination.
+func (h *Handler) deliveries(ctx context.Context, p *prepared, action string, evt *cw.Event) []delivery {
+	// the graph is published once, and only if a destination needs it
+	img := sync.OnceValue(func() slack.ImageRef { return h.publishGraph(ctx, evt, p.png) })
+	tags := p.tags
+	serviceName := h.ServiceNameFromTags(tags)
+
+	ds := []delivery{{DestinationSlack, func(ctx context.Context) error {
+		return h.sendSlack(ctx, h.SlackChannel(tags), action, evt, img())
+	}}}
+
+	// paged tracks whether the alarm is routed to a pager; failed pages
+	// still count, they are retried
+	paged := false
+	if tags[SuppressPagerDutyTagKey] == "true" {
+		slog.Info("pagerduty suppressed via tag", "alarm", evt.Detail.AlarmName)
+	} else {
+		ds = append(ds, delivery{DestinationPagerDuty, func(ctx context.Context) error {
+			return h.submitPagerDuty(ctx, serviceName, p.routingKey, p.routingKeyErr, action, evt)
+		}})
+		paged = true
+	}
+
+	if h.cfg.IncidentManagerEnabled {
+		if tags[SuppressIncidentManagerTagKey] == "true" {
+			slog.Info("incident manager suppressed via tag", "alarm", evt.Detail.AlarmName)
+		} else if responsePlan, err := h.IncidentManagerResponsePlan(ctx, serviceName); err != nil {
+			ds = append(ds, delivery{DestinationIncidentManager, func(context.Context) error { return err }})
+			paged = true
+		} else if responsePlan == "" && action == pagerduty.ActionTrigger {
+			// incidents are only started for services with a response plan;
+			// resolving finds the open incident by alarm ARN
+			slog.Info("no incident manager response plan for service", "service", serviceName, "alarm", evt.Detail.AlarmName)
+		} else {
+			ds = append(ds, delivery{DestinationIncidentManager, func(ctx context.Context) error {
+				return h.im.SubmitEvent(ctx, responsePlan, action, evt)
+			}})
+			paged = true
+		}
+	}
+
+	// OpsItems track triggered alarms that aren't paged; resolves are
+	// always attempted
+	if h.cfg.OpsCenterEnabled {
+		if action == pagerduty.ActionTrigger && paged {
+			slog.Debug("alarm was paged, no opsitem needed", "alarm", evt.Detail.AlarmName)
+		} else {
+			ds = append(ds, delivery{DestinationOpsCenter, func(ctx context.Context) error {
+				return h.ops.SubmitEvent(ctx, action, evt, img().URL)
+			}})
+		}
+	}
+
+	// the suppress tag only stops new ServiceNow incidents: open ones are
+	// still resolved
+	if h.sn != nil {
+		if action == pagerduty.ActionTrigger && tags[SuppressServiceNowTagKey] == "true" {
+			slog.Info("servicenow suppressed via tag", "alarm", evt.Detail.AlarmName)
+		} else {
+			ds = append(ds, delivery{DestinationServiceNow, func(ctx context.Context) error {
+				return h.submitServiceNow(ctx, tags, action, evt)
+			}})
+		}
+	}
+
+	owner := h.OwnerFromTags(tags)
+	if owner != "" && (h.cfg.GoogleChatEnabled || h.cfg.MattermostEnabled) {
+		msg := func() message.Message {
+			msg := message.New(evt, action)
+			msg.ImageURL = img().URL
+			return msg
+		}
+		if h.cfg.GoogleChatEnabled {
+			ds = append(ds, delivery{DestinationGoogleChat, func(ctx context.Context) error {
+				return h.sendGoogleChat(ctx, owner, msg)
+			}})
+		}
+		if h.cfg.MattermostEnabled {
+			ds = append(ds, delivery{DestinationMattermost, func(ctx context.Context) error {
+				return h.sendMattermost(ctx, owner, tags[MattermostChannelTagKey], msg)
+			}})
+		}
+	}
+	if h.override != nil {
+		ds = h.overridden(ds, serviceName, action, evt)
+	}
+	if h.cfg.DryRun {
+		ds = h.dryRunDeliveries(ds, p, serviceName, action, evt)
+	}
+	return ds
+}
+
+// sendSlack posts the triggered or resolved message to the channel.
+func (h *Handler) sendSlack(ctx context.Context, channel, action string, evt *cw.Event, img slack.ImageRef) error {
+	var channelID, ts string
+	var err error
+	switch action {
+	case pagerduty.ActionResolve:
+		channelID, ts, err = h.sl.SendEventResolved(ctx, channel, evt, img)
+	case pagerduty.ActionTrigger:
+		channelID, ts, err = h.sl.SendEventTriggered(ctx, channel, evt, img)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("sent slack message", "channel_id", channelID, "timestamp", ts)
+	return nil
+}
+
+// submitPagerDuty sends the event to the service's PagerDuty routing key,
+// as resolved by prepare. Events PagerDuty rejects would be rejected again
+// on every retry, so the fallback Slack channel is alerted instead.
+func (h *Handler) submitPagerDuty(ctx context.Context, serviceName, routingKey string, routingKeyErr error, action string, evt *cw.Event) error {
+	if routingKeyErr != nil {
+		return routingKeyErr
+	}
+	if routingKey == "" {
+		return fmt.Errorf("no pagerduty routing key available for service %q", serviceName)
+	}
+	err := h.pd.SubmitEvent(ctx, routingKey, action, evt)
+	if !errors.Is(err, pagerduty.ErrRejected) {
+		return err
+	}
+	channel := h.cfg.PagerDutyFallbackSlackChannel
+	if h.override != nil {
+		channel = h.override.SlackChannel
+	}
+	slog.Error("pagerduty rejected event, alerting fallback channel", "alarm", evt.Detail.AlarmName,
+		"service", serviceName, "channel", channel, "error", err)
+	if _, _, serr := h.sl.SendPagerDutyRejected(ctx, channel, evt, err); serr != nil {
+		return fmt.Errorf("alerting fallback channel: %w (after: %w)", serr, err)
+	}
+	return nil
+}
+
+// submitServiceNow creates or resolves the alarm's ServiceNow incident.
+func (h *Handler) submitServiceNow(ctx context.Context, tags map[string]string, action string, evt *cw.Event) error {
+	if action != pagerduty.ActionTrigger {
+		return h.sn.SubmitEvent(ctx, action, evt, "", "")
+	}
+	group, err := h.namedParameter(ctx, h.cfg.ServiceNowAssignmentGroupSSMPattern, h.OwnerFromTags(tags), h.cfg.ServiceNowDefaultAssignmentGroup)
+	if err != nil {
+		return err
+	}
+	return h.sn.SubmitEvent(ctx, action, evt, group, h.ServiceNameFromTags(tags))
+}
+
+// sendGoogleChat posts the message to the owner's Google Chat webhook, if
+// one is registered.
+func (h *Handler) sendGoogleChat(ctx context.Context, owner string, msg func() message.Message) error {
+	webhook, err := h.namedParameter(ctx, h.cfg.GoogleChatWebhookSSMPattern, owner, "")
+	if err != nil || webhook == "" {
+		return err
+	}
+	return h.gc.SendMessage(ctx, webhook, msg())
+}
+
+// sendMattermost posts the message to the owner's Mattermost webhook, if
+// one is registered.
+func (h *Handler) sendMattermost(ctx context.Context, owner, channel string, msg func() message.Message) error {
+	webhook, err := h.namedParameter(ctx, h.cfg.MattermostWebhookSSMPattern, owner, "")
+	if err != nil || webhook == "" {
+		return err
+	}
+	return h.mm.SendMessage(ctx, webhook, channel, msg())
+}
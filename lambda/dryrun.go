@@ -0,0 +1,73 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+)
+
+// dryRunDeliveries replaces the event's deliveries with recorders, for a
+// shadow router running alongside the live one (see Config.DryRun). Slack
+// deliveries are kept: the Slack client logs their messages instead of
+// posting them, or posts them to the shadow channel. PagerDuty events are
+// logged instead of submitted, and every other destination only logs that
+// it would have been delivered to.
+func (h *Handler) dryRunDeliveries(ds []delivery, p *prepared, serviceName, action string, evt *cw.Event) []delivery {
+	out := make([]delivery, 0, len(ds))
+	for _, d := range ds {
+		switch d.destination {
+		case DestinationSlack:
+			out = append(out, d)
+		case DestinationPagerDuty:
+			out = append(out, delivery{DestinationPagerDuty, func(context.Context) error {
+				return h.recordPagerDuty(serviceName, p.routingKey, p.routingKeyErr, action, evt)
+			}})
+		default:
+			out = append(out, delivery{d.destination, func(context.Context) error {
+				slog.Info("dry run, not delivering", "alarm", evt.Detail.AlarmName, "destination", d.destination, "action", action)
+				return nil
+			}})
+		}
+	}
+	return out
+}
+
+// recordPagerDuty logs the PagerDuty event submitPagerDuty would send, with
+// the routing key masked. Failed routing key lookups fail as they would
+// live.
+func (h *Handler) recordPagerDuty(serviceName, routingKey string, routingKeyErr error, action string, evt *cw.Event) error {
+	if routingKeyErr != nil {
+		return routingKeyErr
+	}
+	if routingKey == "" {
+		return fmt.Errorf("no pagerduty routing key available for service %q", serviceName)
+	}
+	e, err := pagerduty.NewEvent(mask(routingKey), action, evt)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding pagerduty event: %w", err)
+	}
+	slog.Info("dry run, not submitting pagerduty event", "alarm", evt.Detail.AlarmName, "service", serviceName, "event", string(b))
+	return nil
+}
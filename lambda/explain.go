@@ -0,0 +1,170 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+	"github.com/tidal-music/cw-alert-router/v2/slack"
+)
+
+// Explanation is how an event would be routed, worked out by Explain
+// without delivering anything.
+type Explanation struct {
+	Alarm      string `json:"alarm"`
+	AlarmARN   string `json:"alarm_arn,omitempty"`
+	Transition string `json:"transition"`
+	// Action is the PagerDuty action of the transition; "none" transitions
+	// aren't delivered.
+	Action string `json:"action"`
+	// Rejected is why the event would be rejected as untrusted, if it would.
+	Rejected string            `json:"rejected,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+
+	SlackChannel string `json:"slack_channel,omitempty"`
+	// SlackChannelSource is the tag or default the channel came from.
+	SlackChannelSource string          `json:"slack_channel_source,omitempty"`
+	PagerDuty          *PagerDutyRoute `json:"pagerduty,omitempty"`
+
+	// Destinations are the destinations the event would be delivered to.
+	Destinations []string `json:"destinations,omitempty"`
+	// Decisions explain destinations left out.
+	Decisions []string `json:"decisions,omitempty"`
+	// SlackMessage is the Block Kit payload of the Slack message, without
+	// the graph.
+	SlackMessage json.RawMessage `json:"slack_message,omitempty"`
+}
+
+// PagerDutyRoute is how an event would be paged.
+type PagerDutyRoute struct {
+	Suppressed bool   `json:"suppressed,omitempty"`
+	Service    string `json:"service,omitempty"`
+	// RoutingKey is masked, all but its last 4 characters.
+	RoutingKey string `json:"routing_key,omitempty"`
+	// Source is the parameter-store key the routing key came from, or
+	// "default".
+	Source string `json:"source,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Explain works out how the event would be routed: the alarm's tags, the
+// Slack channel, the PagerDuty routing key and the destinations, with the
+// Slack message that would be sent. Nothing is delivered, and neither the
+// delivery ledger nor flapping and storm state are consulted or changed.
+func (h *Handler) Explain(ctx context.Context, evt *cw.Event) (*Explanation, error) {
+	action := pagerduty.Action(evt.Detail.PreviousState.Value, evt.Detail.State.Value)
+	e := &Explanation{
+		Alarm:      evt.Detail.AlarmName,
+		Transition: fmt.Sprintf("%s -> %s", evt.Detail.PreviousState.Value, evt.Detail.State.Value),
+		Action:     action,
+	}
+	e.AlarmARN, _ = evt.AlarmARN()
+	if err := h.authenticate(evt); err != nil {
+		e.Rejected = err.Error()
+		return e, nil
+	}
+
+	tags, err := h.alarmTags(ctx, e.AlarmARN)
+	if err != nil {
+		return nil, fmt.Errorf("fetching alarm tags: %w", err)
+	}
+	e.Tags = tags
+	e.SlackChannel, e.SlackChannelSource = h.slackChannel(tags)
+
+	p := &prepared{tags: tags}
+	serviceName := h.ServiceNameFromTags(tags)
+	e.PagerDuty = &PagerDutyRoute{Service: serviceName}
+	if tags[SuppressPagerDutyTagKey] == "true" {
+		e.PagerDuty.Suppressed = true
+		e.Decisions = append(e.Decisions, fmt.Sprintf("pagerduty suppressed by tag %s", SuppressPagerDutyTagKey))
+	} else {
+		var key string
+		p.routingKey, key, p.routingKeyErr = h.lookupNamedParameter(ctx, h.cfg.PagerDutyRoutingKeySSMPattern, serviceName, h.cfg.DefaultPagerDutyRoutingKey)
+		e.PagerDuty.RoutingKey = mask(p.routingKey)
+		e.PagerDuty.Source = key
+		if key == "" {
+			e.PagerDuty.Source = "default"
+		}
+		if p.routingKeyErr != nil {
+			e.PagerDuty.Error = p.routingKeyErr.Error()
+		}
+	}
+
+	if action == pagerduty.ActionNone {
+		e.Decisions = append(e.Decisions, "transition isn't routed, only OK <-> ALARM are")
+		return e, nil
+	}
+	for _, d := range h.deliveries(ctx, p, action, evt) {
+		e.Destinations = append(e.Destinations, d.destination)
+	}
+	e.Decisions = append(e.Decisions, h.decisions(tags, action, e.Destinations)...)
+
+	blocks, err := json.Marshal(map[string]any{"blocks": h.sl.EventBlocks(evt, action, slack.ImageRef{})})
+	if err != nil {
+		return nil, fmt.Errorf("encoding slack message: %w", err)
+	}
+	e.SlackMessage = blocks
+	return e, nil
+}
+
+// ExplainAlarm explains the routing of the event the alarm sent when it
+// entered its current state (see cw.Client.AlarmEvent).
+func (h *Handler) ExplainAlarm(ctx context.Context, alarmARN string) (*Explanation, error) {
+	evt, err := h.cw.AlarmEvent(ctx, alarmARN)
+	if err != nil {
+		return nil, err
+	}
+	return h.Explain(ctx, evt)
+}
+
+// decisions lists why enabled optional destinations are left out of the
+// destinations, beyond PagerDuty's suppression.
+func (h *Handler) decisions(tags map[string]string, action string, destinations []string) []string {
+	var ds []string
+	if h.cfg.IncidentManagerEnabled && !slices.Contains(destinations, DestinationIncidentManager) {
+		if tags[SuppressIncidentManagerTagKey] == "true" {
+			ds = append(ds, fmt.Sprintf("incident manager suppressed by tag %s", SuppressIncidentManagerTagKey))
+		} else {
+			ds = append(ds, fmt.Sprintf("incident manager skipped, no response plan for service %q", h.ServiceNameFromTags(tags)))
+		}
+	}
+	if h.cfg.OpsCenterEnabled && !slices.Contains(destinations, DestinationOpsCenter) {
+		ds = append(ds, "no opsitem, the alarm is paged")
+	}
+	if h.sn != nil && action == pagerduty.ActionTrigger && tags[SuppressServiceNowTagKey] == "true" {
+		ds = append(ds, fmt.Sprintf("servicenow suppressed by tag %s", SuppressServiceNowTagKey))
+	}
+	if (h.cfg.GoogleChatEnabled || h.cfg.MattermostEnabled) && h.OwnerFromTags(tags) == "" {
+		ds = append(ds, fmt.Sprintf("chat webhooks skipped, no %s tag", h.cfg.OwnerTagKey))
+	}
+	if h.cfg.GraphMode != GraphModeNone {
+		ds = append(ds, "graph not rendered; it's attached when delivered")
+	}
+	return ds
+}
+
+// mask hides all but the last 4 characters of a secret.
+func mask(secret string) string {
+	if len(secret) <= 4 {
+		return strings.Repeat("*", len(secret))
+	}
+	return strings.Repeat("*", len(secret)-4) + secret[len(secret)-4:]
+}
@@ -0,0 +1,198 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/flapping"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+)
+
+// DestinationSlackStabilised is the delivery announcing that a flapping
+// alarm is stable again.
+const DestinationSlackStabilised = "slack_stabilised"
+
+// heldWhileFlapping are the destinations whose resolves are held back while
+// an alarm flaps, so its incidents stay open instead of being resolved and
+// re-opened on every transition. Triggers are still delivered: they are
+// deduplicated against the open incident.
+var heldWhileFlapping = map[string]bool{
+	DestinationPagerDuty:       true,
+	DestinationIncidentManager: true,
+	DestinationOpsCenter:       true,
+	DestinationServiceNow:      true,
+}
+
+// FlapThreshold returns the number of transitions within the flap window
+// that make the alarm flapping: the alerts:flap_threshold tag if set to a
+// valid number, otherwise the configured threshold. 0 means disabled.
+func (h *Handler) FlapThreshold(tags map[string]string) int {
+	v, ok := tags[FlapThresholdTagKey]
+	if !ok {
+		return h.cfg.FlapThreshold
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		slog.Warn("ignoring invalid flap threshold tag", "value", v)
+		return h.cfg.FlapThreshold
+	}
+	return n
+}
+
+// observeFlapping records the transition with the flap detector. Detector
+// failures are logged and treated as not flapping: a noisy alarm beats a
+// silent one.
+func (h *Handler) observeFlapping(ctx context.Context, tags map[string]string, evt *cw.Event) (flapping.Decision, flapping.State) {
+	threshold := h.FlapThreshold(tags)
+	if threshold <= 0 {
+		return flapping.Normal, flapping.State{}
+	}
+	decision, state, err := h.flap.Observe(ctx, evt, threshold)
+	if err != nil {
+		slog.Error("failed tracking alarm transitions", "alarm", evt.Detail.AlarmName, "error", err)
+		return flapping.Normal, flapping.State{}
+	}
+	if decision != flapping.Normal {
+		slog.Info("alarm is flapping", "alarm", evt.Detail.AlarmName, "decision", decision,
+			"transitions", len(state.Transitions), "collapsed", state.Collapsed)
+	}
+	return decision, state
+}
+
+// flapTracked reports whether the alarm's transition will be collapsed by
+// the flap detector, which keeps it out of storm summaries. Detector
+// failures count as tracked: the alarm then gets its own message.
+func (h *Handler) flapTracked(ctx context.Context, tags map[string]string, evt *cw.Event) bool {
+	threshold := h.FlapThreshold(tags)
+	if threshold <= 0 {
+		return false
+	}
+	tracked, err := h.flap.Tracking(ctx, evt, threshold)
+	if err != nil {
+		slog.Warn("failed reading alarm transitions for grouping", "alarm", evt.Detail.AlarmName, "error", err)
+		return true
+	}
+	return tracked
+}
+
+// flappingDeliveries collapses the deliveries of a flapping alarm's
+// transition: the Slack message becomes the alarm's single flapping
+// message, resolves of held destinations wait for the alarm to stabilise,
+// and the chat webhooks stay quiet.
+func (h *Handler) flappingDeliveries(ds []delivery, tags map[string]string, action string, evt *cw.Event, state flapping.State) []delivery {
+	var out []delivery
+	for _, d := range ds {
+		switch {
+		case d.destination == DestinationSlack:
+			out = append(out, delivery{DestinationSlack, func(ctx context.Context) error {
+				return h.sendFlapping(ctx, h.SlackChannel(tags), evt, state)
+			}})
+		case heldWhileFlapping[d.destination] && action == pagerduty.ActionTrigger:
+			out = append(out, d)
+		default:
+			slog.Info("holding back notification of flapping alarm", "alarm", evt.Detail.AlarmName, "destination", d.destination)
+		}
+	}
+	return out
+}
+
+// sendFlapping posts the alarm's flapping message, or updates it if one was
+// already posted.
+func (h *Handler) sendFlapping(ctx context.Context, channel string, evt *cw.Event, state flapping.State) error {
+	transitions, window := len(state.Transitions), h.flap.Window()
+	if state.SlackTS != "" {
+		return h.sl.UpdateFlapping(ctx, state.SlackChannelID, state.SlackTS, evt, transitions, window)
+	}
+	channelID, ts, err := h.sl.SendFlapping(ctx, channel, evt, transitions, window)
+	if err != nil {
+		return err
+	}
+	if err := h.flap.SetMessage(ctx, state.AlarmARN, channelID, ts); err != nil {
+		// later transitions post a new message instead of updating this one
+		slog.Error("failed recording flapping message", "alarm", evt.Detail.AlarmName, "error", err)
+	}
+	return nil
+}
+
+// AnnounceStabilised finds flapping alarms that haven't transitioned for a
+// full flap window, announces them in Slack and delivers the resolves held
+// back while they flapped. Failures are logged and retried on the next
+// call; they never fail the batch. Invoke calls it for scheduled events;
+// long-running entry points should call it periodically.
+func (h *Handler) AnnounceStabilised(ctx context.Context) {
+	states, err := h.flap.Stabilised(ctx)
+	if err != nil {
+		slog.Error("failed checking for stabilised alarms", "error", err)
+		return
+	}
+	for _, state := range states {
+		if err := h.stabilise(ctx, state); err != nil {
+			slog.Error("failed announcing stabilised alarm", "alarm_arn", state.AlarmARN, "error", err)
+		}
+	}
+}
+
+// stabilise announces one stabilised alarm and clears its flapping state
+// once every delivery succeeded.
+func (h *Handler) stabilise(ctx context.Context, state flapping.State) error {
+	evt := state.LastEvent
+	if evt == nil {
+		return h.clearFlapping(ctx, state)
+	}
+	p, err := h.prepare(ctx, evt, state.AlarmARN)
+	if err != nil {
+		return err
+	}
+
+	ds := []delivery{{DestinationSlackStabilised, func(ctx context.Context) error {
+		_, _, err := h.sl.SendStabilised(ctx, h.SlackChannel(p.tags), evt, state.Collapsed)
+		return err
+	}}}
+	if action := pagerduty.Action(evt.Detail.PreviousState.Value, evt.Detail.State.Value); action == pagerduty.ActionResolve {
+		for _, d := range h.deliveries(ctx, p, action, evt) {
+			if heldWhileFlapping[d.destination] {
+				ds = append(ds, d)
+			}
+		}
+	}
+
+	slog.Info("alarm stabilised", "alarm", evt.Detail.AlarmName, "state", evt.Detail.State.Value, "collapsed", state.Collapsed)
+	var errs []error
+	for _, d := range ds {
+		if o := h.deliver(ctx, evt, d); o.Err != nil {
+			errs = append(errs, o.Err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return h.clearFlapping(ctx, state)
+}
+
+// clearFlapping ends the alarm's flapping. An alarm that transitioned in the
+// meantime is still flapping, and is left alone.
+func (h *Handler) clearFlapping(ctx context.Context, state flapping.State) error {
+	err := h.flap.Clear(ctx, state)
+	if errors.Is(err, flapping.ErrConflict) {
+		slog.Info("alarm transitioned again, still flapping", "alarm_arn", state.AlarmARN)
+		return nil
+	}
+	return err
+}
@@ -20,7 +20,6 @@ package lambda
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
@@ -32,13 +31,27 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/google/uuid"
 
+	"github.com/tidal-music/cw-alert-router/v2/archive"
 	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/flapping"
+	"github.com/tidal-music/cw-alert-router/v2/googlechat"
+	"github.com/tidal-music/cw-alert-router/v2/incidentmanager"
+	"github.com/tidal-music/cw-alert-router/v2/ledger"
+	"github.com/tidal-music/cw-alert-router/v2/mattermost"
+	"github.com/tidal-music/cw-alert-router/v2/metrics"
+	"github.com/tidal-music/cw-alert-router/v2/opscenter"
 	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
 	"github.com/tidal-music/cw-alert-router/v2/parameterstore"
+	"github.com/tidal-music/cw-alert-router/v2/quarantine"
 	"github.com/tidal-music/cw-alert-router/v2/s3"
+	"github.com/tidal-music/cw-alert-router/v2/servicenow"
 	"github.com/tidal-music/cw-alert-router/v2/slack"
 )
 
+// defaultChannelSource is the source slackChannel gives for the default
+// channel.
+const defaultChannelSource = "default channel"
+
 // presignTTL is how long presigned graph URLs stay valid (the SigV4 maximum).
 const presignTTL = 7 * 24 * time.Hour
 
@@ -59,14 +72,27 @@ func graphFilename(evt *cw.Event) string {
 type Handler struct {
 	cfg Config
 
-	cw *cw.Client
-	ps *parameterstore.Client
-	pd *pagerduty.Client
-	s3 *s3.Client
-	sl *slack.Client
+	cw  *cw.Client
+	ps  *parameterstore.Client
+	pd  *pagerduty.Client
+	im  *incidentmanager.Client
+	ops *opscenter.Client
+	s3  *s3.Client
+	sl  *slack.Client
+	gc  *googlechat.Client
+	mm  *mattermost.Client
+	sn  *servicenow.Client
 
 	slackToken  string
 	slackAPIURL string
+
+	ledger     ledger.Ledger
+	flap       *flapping.Detector
+	quarantine quarantine.Store
+	archive    archive.Store
+	override   *Override
+	sts        STSAPI
+	metrics    *metrics.Emitter
 }
 
 // Option overrides a Handler dependency (mostly for testing).
@@ -87,6 +113,16 @@ func WithPagerDutyClient(c *pagerduty.Client) Option {
 	return func(h *Handler) { h.pd = c }
 }
 
+// WithIncidentManagerClient allows overriding the Incident Manager client.
+func WithIncidentManagerClient(c *incidentmanager.Client) Option {
+	return func(h *Handler) { h.im = c }
+}
+
+// WithOpsCenterClient allows overriding the OpsCenter client.
+func WithOpsCenterClient(c *opscenter.Client) Option {
+	return func(h *Handler) { h.ops = c }
+}
+
 // WithS3Client allows overriding the S3 client.
 func WithS3Client(c *s3.Client) Option {
 	return func(h *Handler) { h.s3 = c }
@@ -97,6 +133,47 @@ func WithSlackClient(c *slack.Client) Option {
 	return func(h *Handler) { h.sl = c }
 }
 
+// WithGoogleChatClient allows overriding the Google Chat client.
+func WithGoogleChatClient(c *googlechat.Client) Option {
+	return func(h *Handler) { h.gc = c }
+}
+
+// WithMattermostClient allows overriding the Mattermost client.
+func WithMattermostClient(c *mattermost.Client) Option {
+	return func(h *Handler) { h.mm = c }
+}
+
+// WithServiceNowClient allows overriding the ServiceNow client.
+func WithServiceNowClient(c *servicenow.Client) Option {
+	return func(h *Handler) { h.sn = c }
+}
+
+// WithLedger allows overriding the delivery ledger.
+func WithLedger(l ledger.Ledger) Option {
+	return func(h *Handler) { h.ledger = l }
+}
+
+// WithFlapDetector allows overriding the flap detector.
+func WithFlapDetector(d *flapping.Detector) Option {
+	return func(h *Handler) { h.flap = d }
+}
+
+// WithQuarantine allows overriding the store malformed records are
+// quarantined in.
+func WithQuarantine(q quarantine.Store) Option {
+	return func(h *Handler) { h.quarantine = q }
+}
+
+// WithMetrics allows overriding the metrics emitter.
+func WithMetrics(e *metrics.Emitter) Option {
+	return func(h *Handler) { h.metrics = e }
+}
+
+// WithArchive allows overriding the event archive.
+func WithArchive(a archive.Store) Option {
+	return func(h *Handler) { h.archive = a }
+}
+
 // WithSlackToken sets the Slack token directly instead of fetching it from parameter store.
 func WithSlackToken(token string) Option {
 	return func(h *Handler) { h.slackToken = token }
@@ -119,12 +196,26 @@ func New(ctx context.Context, cfg Config, opts ...Option) (*Handler, error) {
 		Level: cfg.slogLevel(),
 	})))
 
+	if cfg.DryRun {
+		// a shadow router shares nothing with the live one: a claim in a
+		// shared ledger would stop the live router delivering
+		cfg.DeliveryLedgerTable, cfg.AlarmStateTable = "", ""
+		cfg.QuarantineBucket, cfg.QuarantineQueueURL, cfg.ArchiveBucket = "", "", ""
+		cfg.MetricsNamespace += "/DryRun"
+		slog.Warn("dry run, nothing is delivered", "shadow_slack_channel", cfg.ShadowSlackChannel)
+	}
+
 	h := &Handler{cfg: cfg}
 	for _, opt := range opts {
 		opt(h)
 	}
 
-	if h.cw == nil || h.ps == nil {
+	if h.cw == nil || h.ps == nil ||
+		(h.im == nil && cfg.IncidentManagerEnabled) ||
+		(h.ops == nil && cfg.OpsCenterEnabled) ||
+		(h.ledger == nil && cfg.DeliveryLedgerTable != "") ||
+		(h.flap == nil && cfg.AlarmStateTable != "") ||
+		(h.quarantine == nil && cfg.QuarantineQueueURL != "") {
 		awscfg, err := config.LoadDefaultConfig(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("loading aws config: %w", err)
@@ -135,16 +226,61 @@ func New(ctx context.Context, cfg Config, opts ...Option) (*Handler, error) {
 		if h.ps == nil {
 			h.ps = parameterstore.New(awscfg)
 		}
+		if h.im == nil && cfg.IncidentManagerEnabled {
+			h.im = incidentmanager.New(awscfg)
+		}
+		if h.ops == nil && cfg.OpsCenterEnabled {
+			h.ops = opscenter.New(awscfg)
+		}
+		if h.ledger == nil && cfg.DeliveryLedgerTable != "" {
+			h.ledger = ledger.NewDynamoDB(awscfg, cfg.DeliveryLedgerTable, ledger.WithTTL(cfg.DeliveryLedgerTTL))
+		}
+		if h.flap == nil && cfg.AlarmStateTable != "" {
+			h.flap = flapping.NewDetector(flapping.NewDynamoDB(awscfg, cfg.AlarmStateTable), cfg.FlapWindow)
+		}
+		if h.quarantine == nil && cfg.QuarantineQueueURL != "" {
+			h.quarantine = quarantine.NewSQS(awscfg, cfg.QuarantineQueueURL)
+		}
+	}
+	if h.ledger == nil {
+		h.ledger = ledger.NewMemory(ledger.WithTTL(cfg.DeliveryLedgerTTL))
+	}
+	if h.flap == nil {
+		h.flap = flapping.NewDetector(flapping.NewMemory(), cfg.FlapWindow)
 	}
 
 	if h.pd == nil {
-		pd, err := pagerduty.New()
+		pd, err := pagerduty.New(pagerduty.WithEventsURL(cfg.PagerDutyEventsURL))
 		if err != nil {
 			return nil, err
 		}
 		h.pd = pd
 	}
 
+	if h.gc == nil && cfg.GoogleChatEnabled {
+		gc, err := googlechat.New()
+		if err != nil {
+			return nil, err
+		}
+		h.gc = gc
+	}
+
+	if h.mm == nil && cfg.MattermostEnabled {
+		mm, err := mattermost.New()
+		if err != nil {
+			return nil, err
+		}
+		h.mm = mm
+	}
+
+	if h.sn == nil && cfg.ServiceNowInstanceURL != "" {
+		sn, err := h.newServiceNowClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		h.sn = sn
+	}
+
 	if h.s3 == nil && cfg.GraphMode == GraphModeS3 {
 		s3c, err := s3.New(ctx, s3.WithRegion(cfg.ImageBucketRegion), s3.WithRoleARN(cfg.ImageBucketRoleArn))
 		if err != nil {
@@ -153,6 +289,26 @@ func New(ctx context.Context, cfg Config, opts ...Option) (*Handler, error) {
 		h.s3 = s3c
 	}
 
+	if h.quarantine == nil && cfg.QuarantineBucket != "" {
+		s3c, err := s3.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		h.quarantine = quarantine.NewS3(s3c, cfg.QuarantineBucket, quarantinePrefix)
+	}
+
+	if h.archive == nil && cfg.ArchiveBucket != "" {
+		s3c, err := s3.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		h.archive = archive.NewS3(s3c, cfg.ArchiveBucket, archivePrefix)
+	}
+
+	if h.metrics == nil && !cfg.MetricsDisabled {
+		h.metrics = metrics.New(metrics.WithNamespace(cfg.MetricsNamespace))
+	}
+
 	if h.sl == nil {
 		token := h.slackToken
 		if token == "" {
@@ -165,10 +321,17 @@ func New(ctx context.Context, cfg Config, opts ...Option) (*Handler, error) {
 				return nil, fmt.Errorf("fetching slack token from %s: %w", cfg.SlackTokenSSMKey, err)
 			}
 		}
-		var slackOpts []slack.ClientOptions
+		interval := cfg.SlackChannelInterval
+		if cfg.SlackPacingDisabled {
+			interval = 0
+		}
+		slackOpts := []slack.ClientOptions{slack.WithChannelInterval(interval)}
 		if h.slackAPIURL != "" {
 			slackOpts = append(slackOpts, slack.WithAlternativeURL(h.slackAPIURL))
 		}
+		if cfg.DryRun {
+			slackOpts = append(slackOpts, slack.WithDryRun(cfg.ShadowSlackChannel))
+		}
 		sl, err := slack.New(token, slackOpts...)
 		if err != nil {
 			return nil, err
@@ -179,6 +342,22 @@ func New(ctx context.Context, cfg Config, opts ...Option) (*Handler, error) {
 	return h, nil
 }
 
+// newServiceNowClient creates the ServiceNow client with credentials from
+// parameter store, storing open incidents there too.
+func (h *Handler) newServiceNowClient(ctx context.Context) (*servicenow.Client, error) {
+	username, err := h.ps.GetParameterValue(ctx, h.cfg.ServiceNowUsernameSSMKey)
+	if err != nil {
+		return nil, fmt.Errorf("fetching servicenow username from %s: %w", h.cfg.ServiceNowUsernameSSMKey, err)
+	}
+	password, err := h.ps.GetParameterValue(ctx, h.cfg.ServiceNowPasswordSSMKey)
+	if err != nil {
+		return nil, fmt.Errorf("fetching servicenow password from %s: %w", h.cfg.ServiceNowPasswordSSMKey, err)
+	}
+	return servicenow.New(h.cfg.ServiceNowInstanceURL,
+		servicenow.Credentials{Username: username, Password: password},
+		servicenow.NewParameterStore(h.ps, h.cfg.ServiceNowIncidentSSMPattern))
+}
+
 // Config returns the handler's effective configuration.
 func (h *Handler) Config() Config {
 	return h.cfg
@@ -198,14 +377,25 @@ func (h *Handler) ServiceNameFromTags(tags map[string]string) string {
 //  1. the alerts:slack_channel override tag, if present
 //  2. "<owner>-alarms" (lowercased) derived from the owner tag
 //  3. the configured default channel
+//
+// A destination override (see WithDestinationOverride) replaces them all.
 func (h *Handler) SlackChannel(tags map[string]string) string {
+	channel, _ := h.slackChannel(tags)
+	return channel
+}
+
+// slackChannel is SlackChannel, also describing where the channel came from.
+func (h *Handler) slackChannel(tags map[string]string) (channel, source string) {
+	if h.override != nil {
+		return h.override.SlackChannel, "destination override"
+	}
 	if override := tags[SlackChannelOverrideTagKey]; override != "" {
-		return override
+		return override, fmt.Sprintf("tag %s", SlackChannelOverrideTagKey)
 	}
 	if owner := h.OwnerFromTags(tags); owner != "" {
-		return fmt.Sprintf("%s-alarms", strings.ToLower(owner))
+		return fmt.Sprintf("%s-alarms", strings.ToLower(owner)), fmt.Sprintf("tag %s=%s", h.cfg.OwnerTagKey, owner)
 	}
-	return h.cfg.DefaultSlackChannel
+	return h.cfg.DefaultSlackChannel, defaultChannelSource
 }
 
 // PagerDutyRoutingKey returns the routing key for the given service name:
@@ -214,38 +404,54 @@ func (h *Handler) SlackChannel(tags map[string]string) string {
 //     hyphens replaced with underscores), if it exists and is non-empty
 //  3. otherwise the default routing key
 func (h *Handler) PagerDutyRoutingKey(ctx context.Context, serviceName string) (string, error) {
-	if serviceName == "" {
-		return h.cfg.DefaultPagerDutyRoutingKey, nil
+	return h.namedParameter(ctx, h.cfg.PagerDutyRoutingKeySSMPattern, serviceName, h.cfg.DefaultPagerDutyRoutingKey)
+}
+
+// IncidentManagerResponsePlan returns the Incident Manager response plan ARN
+// for the given service name, looked up like PagerDutyRoutingKey with the
+// default response plan as the fallback.
+func (h *Handler) IncidentManagerResponsePlan(ctx context.Context, serviceName string) (string, error) {
+	return h.namedParameter(ctx, h.cfg.IncidentManagerResponsePlanSSMPattern, serviceName, h.cfg.IncidentManagerDefaultResponsePlanARN)
+}
+
+// namedParameter returns the parameter-store value registered for a name
+// (service or owner) under the given key pattern, or fallback if the name is
+// empty or has no (non-empty) value registered. Names are lowercased with
+// hyphens replaced by underscores.
+func (h *Handler) namedParameter(ctx context.Context, pattern, name, fallback string) (string, error) {
+	val, _, err := h.lookupNamedParameter(ctx, pattern, name, fallback)
+	return val, err
+}
+
+// lookupNamedParameter is namedParameter, also returning the parameter-store
+// key the value came from, empty for the fallback.
+func (h *Handler) lookupNamedParameter(ctx context.Context, pattern, name, fallback string) (val, key string, err error) {
+	if name == "" {
+		return fallback, "", nil
 	}
-	name := strings.ReplaceAll(strings.ToLower(serviceName), "-", "_")
-	key := fmt.Sprintf(h.cfg.PagerDutyRoutingKeySSMPattern, name)
+	name = strings.ReplaceAll(strings.ToLower(name), "-", "_")
+	key = fmt.Sprintf(pattern, name)
 
-	val, err := h.ps.GetParameterValue(ctx, key)
+	val, err = h.ps.GetParameterValue(ctx, key)
 	if err != nil {
 		if parameterstore.IsNotFound(err) {
-			slog.Debug("no service-specific pagerduty routing key, using default", "ssm_key", key)
-			return h.cfg.DefaultPagerDutyRoutingKey, nil
+			slog.Debug("no parameter registered, using default", "ssm_key", key)
+			return fallback, "", nil
 		}
-		return "", fmt.Errorf("fetching pagerduty routing key %s: %w", key, err)
+		return "", "", fmt.Errorf("fetching %s: %w", key, err)
 	}
 	if val == "" {
-		return h.cfg.DefaultPagerDutyRoutingKey, nil
+		return fallback, "", nil
 	}
-	slog.Debug("using service-specific pagerduty routing key", "ssm_key", key)
-	return val, nil
+	slog.Debug("using registered parameter", "ssm_key", key)
+	return val, key, nil
 }
 
-// graphImage renders the alarm graph and returns a reference to embed in the
-// Slack message. Failures are logged, not returned - a missing graph should
-// never block an alert.
-func (h *Handler) graphImage(ctx context.Context, evt *cw.Event) slack.ImageRef {
-	if h.cfg.GraphMode == GraphModeNone {
-		return slack.ImageRef{}
-	}
-
-	png, err := h.cw.AlarmWidgetImage(ctx, evt, evt.StateChangeTime(), cw.DefaultGraphWindow)
-	if err != nil {
-		slog.Error("failed rendering alarm graph", "alarm", evt.Detail.AlarmName, "error", err)
+// publishGraph makes the rendered graph available to embed in messages:
+// uploaded to Slack or stored in S3, depending on the graph mode. Failures
+// are logged, not returned - a missing graph should never block an alert.
+func (h *Handler) publishGraph(ctx context.Context, evt *cw.Event, png []byte) slack.ImageRef {
+	if png == nil {
 		return slack.ImageRef{}
 	}
 
@@ -288,96 +494,77 @@ func (h *Handler) storeGraphInS3(ctx context.Context, evt *cw.Event, png []byte)
 	return h.s3.PresignedURL(ctx, h.cfg.ImageBucket, key, presignTTL)
 }
 
-// ProcessEvent handles one CloudWatch alarm state change event.
-func (h *Handler) ProcessEvent(ctx context.Context, evt *cw.Event) error {
-	alarmARN, err := evt.AlarmARN()
-	if err != nil {
-		return err
-	}
-
-	action := pagerduty.Action(evt.Detail.PreviousState.Value, evt.Detail.State.Value)
-	if action == pagerduty.ActionNone {
-		slog.Info("ignoring alarm state transition",
-			"alarm", evt.Detail.AlarmName,
-			"previous", evt.Detail.PreviousState.Value,
-			"current", evt.Detail.State.Value)
-		return nil
-	}
-
-	tags, err := h.cw.AlarmTags(ctx, alarmARN)
-	if err != nil {
-		return fmt.Errorf("fetching alarm tags: %w", err)
-	}
-
-	channel := h.SlackChannel(tags)
-	img := h.graphImage(ctx, evt)
-
-	var channelID, ts string
-	var slackErr error
-	switch action {
-	case pagerduty.ActionResolve:
-		channelID, ts, slackErr = h.sl.SendEventResolved(ctx, channel, evt, img)
-	case pagerduty.ActionTrigger:
-		channelID, ts, slackErr = h.sl.SendEventTriggered(ctx, channel, evt, img)
-	}
-	if slackErr != nil {
-		return slackErr
-	}
-	slog.Info("sent slack message", "channel_id", channelID, "timestamp", ts)
-
-	if tags[SuppressPagerDutyTagKey] == "true" {
-		slog.Info("pagerduty suppressed via tag", "alarm", evt.Detail.AlarmName)
-		return nil
-	}
-
-	serviceName := h.ServiceNameFromTags(tags)
-	routingKey, err := h.PagerDutyRoutingKey(ctx, serviceName)
-	if err != nil {
-		return err
-	}
-	if routingKey == "" {
-		return fmt.Errorf("no pagerduty routing key available for service %q", serviceName)
-	}
-	return h.pd.SubmitEvent(ctx, routingKey, action, evt)
-}
-
-// HandleRequest is the main entrypoint for the lambda. Records are processed
-// in order; on the first failure the failed record and every remaining record
-// are reported as batch item failures, so only successfully processed records
-// are deleted from the queue. Stopping at the first failure preserves FIFO
-// queue ordering: successors are never handled before a failed record's
-// redelivery. The SQS event source mapping must enable
+// HandleRequest is the main entrypoint for the lambda. It first groups
+// alarm storms into summary Slack messages (see groupStorms), then
+// processes the records per alarm (per message group on FIFO queues):
+// different alarms concurrently, each alarm's records in order. A failed
+// record and the remaining records of its alarm are reported as batch item
+// failures, so an alarm's transitions are never handled before an earlier
+// one's redelivery. The SQS event source mapping must enable
 // ReportBatchItemFailures.
+//
+// Processing is budgeted against the invocation's deadline: records not
+// started or finished in time are reported as failures, instead of the
+// whole batch being redelivered after a timeout. The batch's events are
+// archived together once it's processed, and the number of failed records
+// is emitted as a metric.
 func (h *Handler) HandleRequest(ctx context.Context, sqsEvent awsevents.SQSEvent) (awsevents.SQSEventResponse, error) {
 	var resp awsevents.SQSEventResponse
+	ctx, flush := h.withArchiveBatch(ctx)
+	defer flush()
+	ctx, cancel := withResponseReserve(ctx)
+	defer cancel()
+	ctx = withTagCache(ctx)
+	throttled := h.sl.ThrottleStats()
+	defer h.logThrottling(throttled)
+	if h.lowOnTime(ctx) {
+		slog.Warn("low on time, skipping storm grouping")
+	} else {
+		h.groupStorms(ctx, sqsEvent.Records)
+	}
 
-	for i, msg := range sqsEvent.Records {
-		slog.Info("processing sqs message", "message_id", msg.MessageId, "source", msg.EventSource)
-		slog.Debug("sqs message body", "body", msg.Body)
-
-		if err := h.processRecord(ctx, msg); err != nil {
-			slog.Error("failed processing sqs message", "message_id", msg.MessageId, "error", err)
-			for _, unprocessed := range sqsEvent.Records[i:] {
-				resp.BatchItemFailures = append(resp.BatchItemFailures,
-					awsevents.SQSBatchItemFailure{ItemIdentifier: unprocessed.MessageId})
-			}
-			break
+	failed := h.processBatch(ctx, sqsEvent.Records)
+	h.emitBatchMetrics(len(sqsEvent.Records), len(failed))
+	for _, msg := range sqsEvent.Records {
+		if failed[msg.MessageId] {
+			resp.BatchItemFailures = append(resp.BatchItemFailures,
+				awsevents.SQSBatchItemFailure{ItemIdentifier: msg.MessageId})
 		}
 	}
-
 	return resp, nil
 }
 
-// processRecord decodes and processes a single SQS record.
+// logThrottling logs how much Slack rate limiting slowed down or failed
+// deliveries since the given stats were taken, if at all.
+func (h *Handler) logThrottling(since slack.ThrottleStats) {
+	stats := h.sl.ThrottleStats().Sub(since)
+	if stats == (slack.ThrottleStats{}) {
+		return
+	}
+	slog.Warn("slack throttling",
+		"rate_limited", stats.RateLimited,
+		"retried", stats.Retried,
+		"gave_up", stats.GaveUp,
+		"paced", stats.Paced,
+		"pacing_delay_ms", stats.PacingDelay.Milliseconds())
+}
+
+// processRecord decodes and processes a single SQS record: an EventBridge
+// event or a classic SNS alarm notification (see cw.DecodeEvent). Records
+// that can't be decoded fail with ErrMalformed.
 func (h *Handler) processRecord(ctx context.Context, msg awsevents.SQSMessage) error {
-	evt := &cw.Event{}
-	if err := json.Unmarshal([]byte(msg.Body), evt); err != nil {
-		return fmt.Errorf("decoding sqs message body: %w", err)
+	evt, err := cw.DecodeEvent([]byte(msg.Body))
+	if err != nil {
+		return fmt.Errorf("decoding sqs message body: %w: %w", ErrMalformed, err)
 	}
 	return h.ProcessEvent(ctx, evt)
 }
 
-// Start begins the lambda handler.
+// Start runs the preflight checks at cold start, unless disabled, and begins
+// the lambda handler, accepting every invocation Invoke does.
 func (h *Handler) Start() {
-	awslambda.Start(h.HandleRequest)
+	if !h.cfg.PreflightDisabled {
+		h.LogPreflight(context.Background())
+	}
+	awslambda.Start(h.Invoke)
 }
@@ -15,16 +15,33 @@
 package lambda_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	pdapi "github.com/PagerDuty/go-pagerduty"
 	awsevents "github.com/aws/aws-lambda-go/events"
 
+	"github.com/tidal-music/cw-alert-router/v2/archive"
 	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/flapping"
+	"github.com/tidal-music/cw-alert-router/v2/incidentmanager"
 	"github.com/tidal-music/cw-alert-router/v2/lambda"
+	"github.com/tidal-music/cw-alert-router/v2/ledger"
+	"github.com/tidal-music/cw-alert-router/v2/metrics"
+	"github.com/tidal-music/cw-alert-router/v2/opscenter"
 	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
 	"github.com/tidal-music/cw-alert-router/v2/parameterstore"
+	"github.com/tidal-music/cw-alert-router/v2/quarantine"
 	"github.com/tidal-music/cw-alert-router/v2/s3"
 	"github.com/tidal-music/cw-alert-router/v2/test"
 )
@@ -34,22 +51,30 @@ type testFixture struct {
 	handler *lambda.Handler
 	slack   *test.SlackServer
 	pd      *test.MockPDClient
+	im      *test.MockIncidentsAPI
+	ops     *test.MockOpsCenterAPI
+	ssm     *test.MockSSMClient
 	s3      *test.MockS3API
 	cw      *test.MockCWAPI
+	metrics *bytes.Buffer
 }
 
-func newFixture(t *testing.T, cfg lambda.Config) *testFixture {
+func newFixture(t *testing.T, cfg lambda.Config, opts ...lambda.Option) *testFixture {
 	t.Helper()
 
 	f := &testFixture{
-		slack: test.NewSlackServer(),
-		pd:    &test.MockPDClient{},
-		s3:    &test.MockS3API{},
-		cw:    &test.MockCWAPI{},
+		slack:   test.NewSlackServer(),
+		pd:      &test.MockPDClient{},
+		im:      &test.MockIncidentsAPI{},
+		ops:     &test.MockOpsCenterAPI{},
+		ssm:     &test.MockSSMClient{},
+		s3:      &test.MockS3API{},
+		cw:      &test.MockCWAPI{},
+		metrics: &bytes.Buffer{},
 	}
 	t.Cleanup(f.slack.Close)
 
-	pdclient, err := pagerduty.New(pagerduty.WithAPI(f.pd))
+	pdclient, err := pagerduty.New(pagerduty.WithAPI(f.pd), pagerduty.WithRetry(2, time.Millisecond))
 	if err != nil {
 		t.Fatalf("failed creating pagerduty client: %v", err)
 	}
@@ -58,14 +83,17 @@ func newFixture(t *testing.T, cfg lambda.Config) *testFixture {
 		t.Fatalf("failed creating s3 client: %v", err)
 	}
 
-	f.handler, err = lambda.New(context.Background(), cfg,
+	f.handler, err = lambda.New(context.Background(), cfg, append([]lambda.Option{
 		lambda.WithCWClient(cw.NewClientWithAPI(f.cw)),
-		lambda.WithParameterStoreClient(parameterstore.NewWithAPI(&test.MockSSMClient{})),
+		lambda.WithParameterStoreClient(parameterstore.NewWithAPI(f.ssm)),
 		lambda.WithPagerDutyClient(pdclient),
+		lambda.WithIncidentManagerClient(incidentmanager.NewWithAPI(f.im)),
+		lambda.WithOpsCenterClient(opscenter.NewWithAPI(f.ops)),
 		lambda.WithS3Client(s3client),
 		lambda.WithSlackToken("test-token"),
 		lambda.WithSlackAPIURL(f.slack.APIURL()),
-	)
+		lambda.WithMetrics(metrics.New(metrics.WithWriter(f.metrics))),
+	}, opts...)...)
 	if err != nil {
 		t.Fatalf("failed creating handler: %v", err)
 	}
@@ -77,6 +105,7 @@ func baseConfig() lambda.Config {
 		DefaultSlackChannel:        "test-alarms",
 		DefaultPagerDutyRoutingKey: "default-pd-key",
 		GraphMode:                  lambda.GraphModeNone,
+		SlackChannelInterval:       time.Millisecond,
 	}
 }
 
@@ -157,6 +186,38 @@ func TestConfigValidation(t *testing.T) {
 	if _, err := lambda.New(context.Background(), cfg); err == nil {
 		t.Errorf("expected error for invalid graph mode")
 	}
+	// invalid flap threshold
+	cfg = baseConfig()
+	cfg.FlapThreshold = -1
+	if _, err := lambda.New(context.Background(), cfg); err == nil {
+		t.Errorf("expected error for a negative flap threshold")
+	}
+	// invalid record budget
+	cfg = baseConfig()
+	cfg.RecordBudget = -1
+	if _, err := lambda.New(context.Background(), cfg); err == nil {
+		t.Errorf("expected error for a negative record budget")
+	}
+}
+
+func TestConfigFromEnvSlackChannelInterval(t *testing.T) {
+	t.Setenv(lambda.DefaultSlackChannelEnv, "test-alarms")
+	t.Setenv(lambda.DefaultPagerDutyRoutingKeyEnv, "default-pd-key")
+
+	t.Setenv(lambda.SlackChannelIntervalEnv, "2s")
+	if cfg := lambda.ConfigFromEnv(); cfg.SlackChannelInterval != 2*time.Second || cfg.SlackPacingDisabled {
+		t.Errorf("expected a 2s interval, got %s (disabled %t)", cfg.SlackChannelInterval, cfg.SlackPacingDisabled)
+	}
+	t.Setenv(lambda.SlackChannelIntervalEnv, "0")
+	if cfg := lambda.ConfigFromEnv(); !cfg.SlackPacingDisabled {
+		t.Errorf("expected 0 to disable pacing")
+	}
+
+	// an invalid interval is rejected rather than defaulted
+	t.Setenv(lambda.SlackChannelIntervalEnv, "soon")
+	if _, err := lambda.New(context.Background(), lambda.ConfigFromEnv()); err == nil {
+		t.Errorf("expected error for an invalid slack channel interval")
+	}
 }
 
 func TestGraphModeDefaults(t *testing.T) {
@@ -198,6 +259,90 @@ func TestProcessEventTriggered(t *testing.T) {
 	}
 }
 
+func TestProcessEventSlackFailureStillPages(t *testing.T) {
+	f := newFixture(t, baseConfig())
+	f.slack.FailPostMessage("channel_not_found")
+
+	evt := test.TriggeredAlarmDetails
+	err := f.handler.ProcessEvent(context.Background(), &evt)
+	var deliveryErr *lambda.DeliveryError
+	if !errors.As(err, &deliveryErr) {
+		t.Fatalf("expected a delivery error, got %v", err)
+	}
+	if failed := deliveryErr.Failed(); len(failed) != 1 || failed[0] != lambda.DestinationSlack {
+		t.Errorf("expected only slack to fail, got %v", failed)
+	}
+	if got := len(f.pd.Events()); got != 1 {
+		t.Fatalf("pagerduty must be paged despite the slack failure, got %d events", got)
+	}
+
+	// the retry only goes to slack
+	f.slack.FailPostMessage("")
+	outcomes, err := f.handler.DeliverEvent(context.Background(), &evt)
+	if err != nil {
+		t.Fatalf("retry returned error: %v", err)
+	}
+	if got := len(f.slack.Messages()); got != 1 {
+		t.Errorf("expected the retry to post to slack, got %d messages", got)
+	}
+	if got := len(f.pd.Events()); got != 1 {
+		t.Errorf("the retry must not page again, got %d events", got)
+	}
+	for _, o := range outcomes {
+		if o.Skipped != (o.Destination == lambda.DestinationPagerDuty) {
+			t.Errorf("unexpected outcome on retry: %+v", o)
+		}
+	}
+}
+
+func TestProcessEventPagerDutyFailureRetriesOnlyPagerDuty(t *testing.T) {
+	f := newFixture(t, baseConfig())
+	f.pd.Fail(errors.New("pagerduty unavailable"))
+
+	evt := test.TriggeredAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err == nil {
+		t.Fatalf("expected an error for the failed page")
+	}
+	if got := len(f.slack.Messages()); got != 1 {
+		t.Fatalf("expected the slack message despite the pagerduty failure, got %d", got)
+	}
+
+	f.pd.Fail(nil)
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("retry returned error: %v", err)
+	}
+	if got := len(f.pd.Events()); got != 1 {
+		t.Errorf("expected the retry to page, got %d events", got)
+	}
+	if got := len(f.slack.Messages()); got != 1 {
+		t.Errorf("the retry must not post to slack again, got %d messages", got)
+	}
+}
+
+func TestProcessEventPagerDutyRejected(t *testing.T) {
+	cfg := baseConfig()
+	cfg.PagerDutyFallbackSlackChannel = "pagerduty-fallback"
+	f := newFixture(t, cfg)
+	f.pd.Fail(pdapi.APIError{StatusCode: http.StatusBadRequest})
+
+	// a rejected event isn't retried: the fallback channel is alerted instead
+	evt := test.TriggeredAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	messages := f.slack.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("expected the alarm and the fallback slack messages, got %d", len(messages))
+	}
+	var fallback bool
+	for _, m := range messages {
+		fallback = fallback || strings.Contains(string(m), "page+rejected") && strings.Contains(string(m), "channel=pagerduty-fallback")
+	}
+	if !fallback {
+		t.Errorf("expected a page rejected message in the fallback channel: %s", messages)
+	}
+}
+
 func TestProcessEventSuppressedStillGoesToSlack(t *testing.T) {
 	f := newFixture(t, baseConfig())
 
@@ -214,6 +359,162 @@ func TestProcessEventSuppressedStillGoesToSlack(t *testing.T) {
 	}
 }
 
+func TestProcessEventIncidentManager(t *testing.T) {
+	cfg := baseConfig()
+	cfg.IncidentManagerEnabled = true
+	f := newFixture(t, cfg)
+
+	triggered := test.TriggeredAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &triggered); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	started := f.im.Started()
+	if len(started) != 1 {
+		t.Fatalf("expected 1 started incident, got %d", len(started))
+	}
+	// tags register service test-service -> its own response plan
+	if got := *started[0].ResponsePlanArn; got != "arn:aws:ssm-incidents::1234567890123:response-plan/test-service" {
+		t.Errorf("unexpected response plan: %s", got)
+	}
+	if len(f.pd.Events()) != 1 {
+		t.Errorf("pagerduty should still be paged, got %d events", len(f.pd.Events()))
+	}
+
+	resolved := test.ResolvedEvent(triggered)
+	if err := f.handler.ProcessEvent(context.Background(), &resolved); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	if incidents := f.im.Incidents(); len(incidents) != 1 || incidents[0].Status != "RESOLVED" {
+		t.Errorf("expected the incident to be resolved, got %+v", incidents)
+	}
+}
+
+func TestProcessEventIncidentManagerNoResponsePlan(t *testing.T) {
+	cfg := baseConfig()
+	cfg.IncidentManagerEnabled = true
+	f := newFixture(t, cfg)
+
+	f.cw.Tags = map[string]map[string]string{
+		test.TriggeredAlarmDetails.Resources[0]: {"owner": "test", "service": "unregistered-service"},
+	}
+	evt := test.TriggeredAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	if got := len(f.im.Started()); got != 0 {
+		t.Errorf("no incident should start without a response plan, got %d", got)
+	}
+}
+
+func TestProcessEventOpsCenter(t *testing.T) {
+	cfg := baseConfig()
+	cfg.OpsCenterEnabled = true
+	f := newFixture(t, cfg)
+
+	// a paged alarm doesn't need an opsitem
+	paged := test.TriggeredAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &paged); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	if got := len(f.ops.OpsItems()); got != 0 {
+		t.Fatalf("paged alarm should not create an opsitem, got %d", got)
+	}
+
+	// a non-paging alarm does
+	evt := test.SuppressedAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	items := f.ops.OpsItems()
+	if len(items) != 1 {
+		t.Fatalf("expected 1 opsitem for the non-paging alarm, got %d", len(items))
+	}
+
+	resolved := test.ResolvedEvent(evt)
+	if err := f.handler.ProcessEvent(context.Background(), &resolved); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	if items := f.ops.OpsItems(); items[0].Status != "Resolved" {
+		t.Errorf("expected the opsitem to be resolved, got %s", items[0].Status)
+	}
+}
+
+func TestProcessEventChatWebhooks(t *testing.T) {
+	cfg := baseConfig()
+	cfg.GoogleChatEnabled = true
+	cfg.MattermostEnabled = true
+	f := newFixture(t, cfg)
+
+	server := test.NewWebhookServer()
+	t.Cleanup(server.Close)
+	f.ssm.Parameters = map[string]string{
+		"/service/cw_alert_router/google_chat/webhooks/test": server.URL("/googlechat"),
+		"/service/cw_alert_router/mattermost/webhooks/test":  server.URL("/mattermost"),
+	}
+	f.cw.Tags = map[string]map[string]string{
+		test.TriggeredAlarmDetails.Resources[0]: {
+			"owner":                     "test",
+			"alerts:mattermost_channel": "test-alarms",
+		},
+	}
+
+	evt := test.TriggeredAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	requests := map[string]test.WebhookRequest{}
+	for _, r := range server.Requests() {
+		requests[r.Path] = r
+	}
+	if len(requests) != 2 || requests["/googlechat"].Body == nil || requests["/mattermost"].Body == nil {
+		t.Fatalf("expected a google chat and a mattermost message, got %+v", server.Requests())
+	}
+	if body := requests["/mattermost"].Body; !strings.Contains(string(body), `"channel":"test-alarms"`) {
+		t.Errorf("mattermost channel tag not applied: %s", body)
+	}
+
+	// owners without a registered webhook are skipped
+	f.ssm.Parameters = nil
+	evt.ID = "another-event"
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	if got := len(server.Requests()); got != 2 {
+		t.Errorf("expected no further webhook requests, got %d", got-2)
+	}
+}
+
+func TestProcessEventServiceNow(t *testing.T) {
+	server := test.NewServiceNowServer()
+	t.Cleanup(server.Close)
+	cfg := baseConfig()
+	cfg.ServiceNowInstanceURL = server.URL()
+	f := newFixture(t, cfg)
+
+	evt := test.TriggeredAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	incidents := server.Incidents()
+	if len(incidents) != 1 {
+		t.Fatalf("expected 1 servicenow incident, got %d", len(incidents))
+	}
+	if got := incidents[0].Fields["assignment_group"]; got != "Test Team" {
+		t.Errorf("expected the owner's assignment group, got %q", got)
+	}
+	if got := incidents[0].Fields["cmdb_ci"]; got != "test-service" {
+		t.Errorf("expected the service as CI, got %q", got)
+	}
+
+	resolved := test.ResolvedEvent(evt)
+	if err := f.handler.ProcessEvent(context.Background(), &resolved); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	if got := server.Incidents()[0].Fields["state"]; got != "6" {
+		t.Errorf("expected the incident to be resolved, got state %q", got)
+	}
+}
+
 func TestProcessEventIgnoredTransition(t *testing.T) {
 	f := newFixture(t, baseConfig())
 
@@ -251,6 +552,26 @@ func TestProcessEventGraphModeSlack(t *testing.T) {
 	}
 }
 
+func TestProcessEventTagsFailureCancelsGraph(t *testing.T) {
+	cfg := baseConfig()
+	cfg.GraphMode = lambda.GraphModeSlack
+	f := newFixture(t, cfg)
+	f.cw.Tags = map[string]map[string]string{}
+	f.cw.RenderDelay = time.Minute
+
+	start := time.Now()
+	evt := test.TriggeredAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err == nil {
+		t.Fatal("expected an error when the alarm tags can't be fetched")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("graph rendering should be cancelled when fetching tags fails, took %s", elapsed)
+	}
+	if len(f.slack.Uploads()) != 0 || len(f.slack.Messages()) != 0 {
+		t.Errorf("expected nothing sent to slack (uploads=%d messages=%d)", len(f.slack.Uploads()), len(f.slack.Messages()))
+	}
+}
+
 func TestProcessEventGraphModeS3(t *testing.T) {
 	cfg := baseConfig()
 	cfg.GraphMode = lambda.GraphModeS3
@@ -279,6 +600,90 @@ func TestProcessEventGraphModeS3(t *testing.T) {
 	}
 }
 
+func TestHandleRequestRedeliveredRecord(t *testing.T) {
+	ddb := &test.MockDynamoDBAPI{}
+	f := newFixture(t, baseConfig(), lambda.WithLedger(ledger.NewDynamoDBWithAPI(ddb, "deliveries")))
+
+	sqsEvent := test.GenTestSQSEvent()
+	for attempt := 0; attempt < 2; attempt++ {
+		resp, err := f.handler.HandleRequest(context.Background(), sqsEvent)
+		if err != nil {
+			t.Fatalf("HandleRequest returned error: %v", err)
+		}
+		if len(resp.BatchItemFailures) != 0 {
+			t.Fatalf("unexpected batch item failures: %+v", resp.BatchItemFailures)
+		}
+	}
+
+	// the redelivered record was skipped for every destination
+	if got := len(f.slack.Messages()); got != 1 {
+		t.Errorf("expected 1 slack message, got %d", got)
+	}
+	if got := len(f.pd.Events()); got != 1 {
+		t.Errorf("expected 1 pagerduty event, got %d", got)
+	}
+	var evt cw.Event
+	if err := json.Unmarshal([]byte(sqsEvent.Records[0].Body), &evt); err != nil {
+		t.Fatalf("couldn't decode test record: %v", err)
+	}
+	if got := ddb.Status(evt.ID, lambda.DestinationPagerDuty); got != "delivered" {
+		t.Errorf("expected the pagerduty delivery to be recorded, got %q", got)
+	}
+}
+
+// cancellingLedger cancels the delivery context once a delivery is
+// claimed, as the deadline would during the send, and fails calls made on
+// a cancelled context like a real store.
+type cancellingLedger struct {
+	ledger.Ledger
+	cancel context.CancelFunc
+}
+
+func (l *cancellingLedger) Claim(ctx context.Context, eventID, destination string) (ledger.ClaimResult, error) {
+	defer l.cancel()
+	return l.Ledger.Claim(ctx, eventID, destination)
+}
+
+func (l *cancellingLedger) Complete(ctx context.Context, eventID, destination string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.Ledger.Complete(ctx, eventID, destination)
+}
+
+func (l *cancellingLedger) Release(ctx context.Context, eventID, destination string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return l.Ledger.Release(ctx, eventID, destination)
+}
+
+func TestProcessEventDeadlineDuringSend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &cancellingLedger{Ledger: ledger.NewMemory(), cancel: cancel}
+	f := newFixture(t, baseConfig(), lambda.WithLedger(l))
+
+	// the page gets out before the deadline, the slack message doesn't:
+	// both are still recorded
+	evt := test.TriggeredAlarmDetails
+	var derr *lambda.DeliveryError
+	if err := f.handler.ProcessEvent(ctx, &evt); !errors.As(err, &derr) || len(derr.Failed()) != 1 || derr.Failed()[0] != lambda.DestinationSlack {
+		t.Fatalf("expected only the slack delivery to fail, got %v", err)
+	}
+
+	// so the retry isn't held up by the claims, and doesn't page again
+	l.cancel = func() {}
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("retry returned error: %v", err)
+	}
+	if got := len(f.slack.Messages()); got != 1 {
+		t.Errorf("expected 1 slack message, got %d", got)
+	}
+	if got := len(f.pd.Events()); got != 1 {
+		t.Errorf("expected 1 pagerduty event, got %d", got)
+	}
+}
+
 func TestHandleRequestBatchFailures(t *testing.T) {
 	f := newFixture(t, baseConfig())
 
@@ -296,32 +701,1148 @@ func TestHandleRequestBatchFailures(t *testing.T) {
 	}
 }
 
-func TestHandleRequestStopsOnFirstFailure(t *testing.T) {
-	f := newFixture(t, baseConfig())
+func TestHandleRequestOutOfTime(t *testing.T) {
+	cfg := baseConfig()
+	cfg.RecordBudget = 10 * time.Second
+	f := newFixture(t, cfg)
 
-	// a failing record followed by a valid one: the valid record must not be
-	// processed (FIFO ordering) and both must be reported as failures
-	sqsEvent := test.GenTestSQSEvent()
-	good := sqsEvent.Records[0]
-	bad := good
-	bad.MessageId = "bad-record"
-	bad.Body = "this is not json{"
-	sqsEvent.Records = []awsevents.SQSMessage{bad, good}
+	// less than the record budget left: nothing is started
+	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
+	defer cancel()
+	sqsEvent := test.SQSEventFor(test.TriggeredAlarmDetails, test.AlarmEvent(test.TriggeredAlarmDetails, "other-alarm"))
+	resp, err := f.handler.HandleRequest(ctx, sqsEvent)
+	if err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != len(sqsEvent.Records) {
+		t.Errorf("expected all %d records to be retried, got %d", len(sqsEvent.Records), len(resp.BatchItemFailures))
+	}
+	if len(f.slack.Messages()) != 0 || len(f.pd.Events()) != 0 {
+		t.Errorf("expected no notifications when out of time (slack=%d pd=%d)", len(f.slack.Messages()), len(f.pd.Events()))
+	}
+}
+
+func TestHandleRequestLowOnTimeSkipsGraph(t *testing.T) {
+	cfg := baseConfig()
+	cfg.GraphMode = lambda.GraphModeSlack
+	cfg.RecordBudget = 10 * time.Second
+	f := newFixture(t, cfg)
+
+	// between one and two record budgets left: delivered, without a graph
+	ctx, cancel := context.WithTimeout(context.Background(), 16*time.Second)
+	defer cancel()
+	resp, err := f.handler.HandleRequest(ctx, test.SQSEventFor(test.TriggeredAlarmDetails))
+	if err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Errorf("expected no batch item failures, got %d", len(resp.BatchItemFailures))
+	}
+	if len(f.slack.Messages()) != 1 {
+		t.Errorf("expected 1 slack message, got %d", len(f.slack.Messages()))
+	}
+	if len(f.slack.Uploads()) != 0 || f.cw.LastWidgetJSON != "" {
+		t.Errorf("expected the graph to be skipped when low on time")
+	}
+}
+
+func TestHandleRequestQuarantine(t *testing.T) {
+	queue := &test.MockSQSAPI{}
+	f := newFixture(t, baseConfig(), lambda.WithQuarantine(quarantine.NewSQSWithAPI(queue, "quarantine-queue")))
+
+	sqsEvent := test.SQSEventFor(test.TriggeredAlarmDetails)
+	sqsEvent.Records = append(sqsEvent.Records,
+		awsevents.SQSMessage{MessageId: "not-json", Body: "this is not json{"},
+		awsevents.SQSMessage{MessageId: "not-an-alarm", Body: `{"detail-type":"EC2 Instance State-change Notification","resources":["arn:aws:ec2:us-east-1:123:instance/i-1"]}`})
 
 	resp, err := f.handler.HandleRequest(context.Background(), sqsEvent)
 	if err != nil {
 		t.Fatalf("HandleRequest returned error: %v", err)
 	}
-	if len(resp.BatchItemFailures) != 2 {
-		t.Fatalf("expected 2 batch item failures, got %+v", resp.BatchItemFailures)
+	if len(resp.BatchItemFailures) != 0 {
+		t.Errorf("expected quarantined records to be reported as processed, got %v", resp.BatchItemFailures)
 	}
-	if resp.BatchItemFailures[0].ItemIdentifier != "bad-record" {
-		t.Errorf("first failure should be the bad record, got %s", resp.BatchItemFailures[0].ItemIdentifier)
+	if got := len(queue.Messages()); got != 2 {
+		t.Errorf("expected 2 quarantined records, got %d", got)
 	}
-	if resp.BatchItemFailures[1].ItemIdentifier != good.MessageId {
-		t.Errorf("second failure should be the unprocessed record, got %s", resp.BatchItemFailures[1].ItemIdentifier)
+	var notices int
+	for _, m := range f.slack.Messages() {
+		if strings.Contains(string(m), "quarantined") && strings.Contains(string(m), "channel=test-alarms") {
+			notices++
+		}
 	}
-	if got := len(f.slack.Messages()); got != 0 {
-		t.Errorf("no records should have been processed after the failure, got %d slack messages", got)
+	if notices != 2 {
+		t.Errorf("expected 2 quarantine notices in the default channel, got %d", notices)
+	}
+
+	// a record that can't be quarantined is retried
+	queue.Fail(errors.New("queue unavailable"))
+	resp, err = f.handler.HandleRequest(context.Background(), awsevents.SQSEvent{
+		Records: []awsevents.SQSMessage{{MessageId: "not-json", Body: "this is not json{"}},
+	})
+	if err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != 1 {
+		t.Errorf("expected the record to be retried, got %d batch item failures", len(resp.BatchItemFailures))
+	}
+}
+
+func TestHandleRequestClassicNotifications(t *testing.T) {
+	f := newFixture(t, baseConfig())
+	evt := test.TriggeredAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	expected, err := url.ParseQuery(string(f.slack.Messages()[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, body := range map[string]string{
+		"raw":     test.ClassicAlarmJSON,
+		"wrapped": test.SNSNotification(test.ClassicAlarmJSON),
+	} {
+		f := newFixture(t, baseConfig())
+		resp, err := f.handler.HandleRequest(context.Background(), awsevents.SQSEvent{
+			Records: []awsevents.SQSMessage{{MessageId: "classic", Body: body}},
+		})
+		if err != nil {
+			t.Fatalf("%s: HandleRequest returned error: %v", name, err)
+		}
+		if len(resp.BatchItemFailures) != 0 {
+			t.Errorf("%s: expected no batch item failures, got %v", name, resp.BatchItemFailures)
+		}
+
+		// routed like the EventBridge event for the same state change
+		messages := f.slack.Messages()
+		if len(messages) != 1 {
+			t.Fatalf("%s: expected 1 slack message, got %d", name, len(messages))
+		}
+		msg, err := url.ParseQuery(string(messages[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Get("channel") != expected.Get("channel") {
+			t.Errorf("%s: expected slack channel %s, got %s", name, expected.Get("channel"), msg.Get("channel"))
+		}
+		events := f.pd.Events()
+		if len(events) != 1 || events[0].Action != pagerduty.ActionTrigger || events[0].RoutingKey != "pagerduty-key-1" {
+			t.Errorf("%s: expected 1 pagerduty trigger with routing key pagerduty-key-1, got %+v", name, events)
+		}
+	}
+}
+
+func TestHandleRequestClassicNotificationTopics(t *testing.T) {
+	// the account is taken from the body, so only the topic tells where a
+	// classic notification came from
+	otherTopic := strings.ReplaceAll(test.SNSNotification(test.ClassicAlarmJSON), "1234567890123:alarms", "999999999999:alarms")
+	for name, tc := range map[string]struct {
+		topics  []string
+		body    string
+		trusted bool
+	}{
+		"allowed account topic": {nil, test.SNSNotification(test.ClassicAlarmJSON), true},
+		"other account topic":   {nil, otherTopic, false},
+		"no topic":              {nil, test.ClassicAlarmJSON, false},
+		"allowed topic":         {[]string{"arn:aws:sns:us-east-1:999999999999:alarms"}, otherTopic, true},
+		"unlisted topic":        {[]string{"arn:aws:sns:us-east-1:999999999999:alarms"}, test.SNSNotification(test.ClassicAlarmJSON), false},
+	} {
+		queue := &test.MockSQSAPI{}
+		cfg := baseConfig()
+		cfg.AllowedAccounts = []string{"1234567890123"}
+		cfg.AllowedTopicARNs = tc.topics
+		f := newFixture(t, cfg, lambda.WithQuarantine(quarantine.NewSQSWithAPI(queue, "quarantine-queue")))
+
+		resp, err := f.handler.HandleRequest(context.Background(), awsevents.SQSEvent{
+			Records: []awsevents.SQSMessage{{MessageId: "classic", Body: tc.body}},
+		})
+		if err != nil {
+			t.Fatalf("%s: HandleRequest returned error: %v", name, err)
+		}
+		if len(resp.BatchItemFailures) != 0 {
+			t.Errorf("%s: unexpected batch item failures: %v", name, resp.BatchItemFailures)
+		}
+		pages, quarantined := 0, 1
+		if tc.trusted {
+			pages, quarantined = 1, 0
+		}
+		if got := len(f.pd.Events()); got != pages {
+			t.Errorf("%s: expected %d pagerduty events, got %d", name, pages, got)
+		}
+		if got := len(queue.Messages()); got != quarantined {
+			t.Errorf("%s: expected %d quarantined records, got %d", name, quarantined, got)
+		}
+	}
+}
+
+func TestInvokeSNSUntrustedTopic(t *testing.T) {
+	cfg := baseConfig()
+	cfg.AllowedAccounts = []string{"1234567890123"}
+	f := newFixture(t, cfg)
+	payload, _ := json.Marshal(awsevents.SNSEvent{Records: []awsevents.SNSEventRecord{{
+		EventSource: "aws:sns",
+		SNS: awsevents.SNSEntity{
+			MessageID: "d0c6a7a1-26d2-5d7c-9d4e-2b3a1c1f6f3e",
+			TopicArn:  "arn:aws:sns:us-east-1:999999999999:alarms",
+			Message:   test.ClassicAlarmJSON,
+		},
+	}}})
+
+	if _, err := f.handler.Invoke(context.Background(), payload); !errors.Is(err, lambda.ErrUntrusted) {
+		t.Errorf("expected ErrUntrusted, got %v", err)
+	}
+	if got := len(f.pd.Events()); got != 0 {
+		t.Errorf("expected no pagerduty events, got %d", got)
+	}
+}
+
+func TestInvokeEventBridge(t *testing.T) {
+	f := newFixture(t, baseConfig())
+	payload, _ := json.Marshal(test.TriggeredAlarmDetails)
+
+	f.pd.Fail(errors.New("pagerduty unavailable"))
+	if _, err := f.handler.Invoke(context.Background(), payload); err == nil {
+		t.Fatal("expected the failed page to fail the invocation, for lambda to retry it")
+	}
+	f.pd.Fail(nil)
+	resp, err := f.handler.Invoke(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("retried invocation returned error: %v", err)
+	}
+	if resp != nil {
+		t.Errorf("expected no response, got %v", resp)
+	}
+	if got := len(f.pd.Events()); got != 1 {
+		t.Errorf("expected the retry to page, got %d events", got)
+	}
+	if got := len(f.slack.Messages()); got != 1 {
+		t.Errorf("expected 1 slack message across the retry, got %d", got)
+	}
+}
+
+func TestInvokeSQS(t *testing.T) {
+	f := newFixture(t, baseConfig())
+	payload, _ := json.Marshal(test.SQSEventFor(test.TriggeredAlarmDetails))
+
+	resp, err := f.handler.Invoke(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("Invoke returned error: %v", err)
+	}
+	if r, ok := resp.(awsevents.SQSEventResponse); !ok || len(r.BatchItemFailures) != 0 {
+		t.Errorf("expected an sqs response without failures, got %#v", resp)
+	}
+	if got := len(f.pd.Events()); got != 1 {
+		t.Errorf("expected 1 pagerduty event, got %d", got)
+	}
+}
+
+func TestInvokeSNS(t *testing.T) {
+	f := newFixture(t, baseConfig())
+	payload, _ := json.Marshal(awsevents.SNSEvent{Records: []awsevents.SNSEventRecord{{
+		EventSource: "aws:sns",
+		SNS: awsevents.SNSEntity{
+			MessageID: "d0c6a7a1-26d2-5d7c-9d4e-2b3a1c1f6f3e",
+			TopicArn:  "arn:aws:sns:us-east-1:1234567890123:alarms",
+			Message:   test.ClassicAlarmJSON,
+		},
+	}}})
+
+	if _, err := f.handler.Invoke(context.Background(), payload); err != nil {
+		t.Fatalf("Invoke returned error: %v", err)
+	}
+	if events := f.pd.Events(); len(events) != 1 || events[0].Action != pagerduty.ActionTrigger {
+		t.Errorf("expected 1 pagerduty trigger, got %+v", events)
+	}
+}
+
+// scheduledEvent is the event of the scheduled stabilised sweep.
+var scheduledEvent = json.RawMessage(`{"version":"0","id":"89d1a02d-5ec7-412e-82f5-13505f849b41","detail-type":"Scheduled Event","source":"aws.events","account":"1234567890123","time":"2024-03-07T12:00:00Z","region":"us-east-1","resources":["arn:aws:events:us-east-1:1234567890123:rule/stabilised-sweep"],"detail":{}}`)
+
+func TestInvokeScheduled(t *testing.T) {
+	f := newFixture(t, baseConfig())
+	if _, err := f.handler.Invoke(context.Background(), scheduledEvent); err != nil {
+		t.Errorf("expected the scheduled sweep to succeed, got %v", err)
+	}
+	if got := len(f.slack.Messages()); got != 0 {
+		t.Errorf("expected no slack messages, got %d", got)
+	}
+}
+
+func TestInvokeMalformed(t *testing.T) {
+	payload := json.RawMessage(`{"detail-type":"EC2 Instance State-change Notification","resources":["arn:aws:ec2:us-east-1:123:instance/i-1"]}`)
+
+	// without a quarantine the event fails, to end up in the dead-letter queue
+	f := newFixture(t, baseConfig())
+	if _, err := f.handler.Invoke(context.Background(), payload); !errors.Is(err, lambda.ErrUntrusted) {
+		t.Errorf("expected ErrUntrusted, got %v", err)
+	}
+	if _, err := f.handler.Invoke(context.Background(), json.RawMessage(`"this is not an event"`)); !errors.Is(err, lambda.ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+
+	queue := &test.MockSQSAPI{}
+	f = newFixture(t, baseConfig(), lambda.WithQuarantine(quarantine.NewSQSWithAPI(queue, "quarantine-queue")))
+	if _, err := f.handler.Invoke(context.Background(), payload); err != nil {
+		t.Errorf("expected the quarantined event to succeed, got %v", err)
+	}
+	if got := len(queue.Messages()); got != 1 {
+		t.Errorf("expected 1 quarantined event, got %d", got)
+	}
+	if len(f.slack.Messages()) != 1 || len(f.pd.Events()) != 0 {
+		t.Errorf("expected only a quarantine notice, got %d slack messages and %d pagerduty events", len(f.slack.Messages()), len(f.pd.Events()))
+	}
+}
+
+func TestExplain(t *testing.T) {
+	f := newFixture(t, baseConfig())
+
+	evt := test.TriggeredAlarmDetails
+	e, err := f.handler.Explain(context.Background(), &evt)
+	if err != nil {
+		t.Fatalf("Explain returned error: %v", err)
+	}
+	if e.Action != pagerduty.ActionTrigger || e.Transition != "INSUFFICIENT_DATA -> ALARM" {
+		t.Errorf("expected a trigger for INSUFFICIENT_DATA -> ALARM, got %s for %s", e.Action, e.Transition)
+	}
+	if e.SlackChannel != f.handler.SlackChannel(e.Tags) || e.SlackChannelSource != "tag owner=test" {
+		t.Errorf("expected the owner's channel, got %s from %s", e.SlackChannel, e.SlackChannelSource)
+	}
+	pd := e.PagerDuty
+	if pd == nil || pd.Suppressed || pd.Service != "test-service" || !strings.HasSuffix(pd.Source, "/test_service") {
+		t.Fatalf("expected the routing key registered for test-service, got %+v", pd)
+	}
+	if pd.RoutingKey == "pagerduty-key-1" || !strings.HasSuffix(pd.RoutingKey, "ey-1") {
+		t.Errorf("expected a masked routing key, got %s", pd.RoutingKey)
+	}
+	if !slices.Equal(e.Destinations, []string{lambda.DestinationSlack, lambda.DestinationPagerDuty}) {
+		t.Errorf("expected slack and pagerduty, got %v", e.Destinations)
+	}
+	var msg struct {
+		Blocks []map[string]any `json:"blocks"`
+	}
+	if err := json.Unmarshal(e.SlackMessage, &msg); err != nil || len(msg.Blocks) == 0 {
+		t.Errorf("expected the slack blocks, got %s (%v)", e.SlackMessage, err)
+	}
+	if !strings.Contains(string(e.SlackMessage), "triggered") {
+		t.Errorf("expected a triggered message, got %s", e.SlackMessage)
+	}
+
+	if len(f.slack.Messages()) != 0 || len(f.pd.Events()) != 0 {
+		t.Errorf("explaining must not deliver anything, got %d slack messages and %d pagerduty events",
+			len(f.slack.Messages()), len(f.pd.Events()))
+	}
+}
+
+func TestExplainSuppressedAndRejected(t *testing.T) {
+	cfg := baseConfig()
+	cfg.AllowedAccounts = []string{"1234567890123"}
+	f := newFixture(t, cfg)
+
+	evt := test.SuppressedAlarmDetails
+	e, err := f.handler.Explain(context.Background(), &evt)
+	if err != nil {
+		t.Fatalf("Explain returned error: %v", err)
+	}
+	if !e.PagerDuty.Suppressed || e.PagerDuty.RoutingKey != "" || slices.Contains(e.Destinations, lambda.DestinationPagerDuty) {
+		t.Errorf("expected pagerduty to be suppressed, got %+v, destinations %v", e.PagerDuty, e.Destinations)
+	}
+	if len(e.Decisions) == 0 || !strings.Contains(e.Decisions[0], lambda.SuppressPagerDutyTagKey) {
+		t.Errorf("expected the suppression to be explained, got %v", e.Decisions)
+	}
+
+	evt = test.TriggeredAlarmDetails
+	evt.Account = "999999999999"
+	evt.Resources = []string{"arn:aws:cloudwatch:us-east-1:999999999999:alarm:test-service-alarm-abcd"}
+	e, err = f.handler.Explain(context.Background(), &evt)
+	if err != nil {
+		t.Fatalf("Explain returned error: %v", err)
+	}
+	if e.Rejected == "" || len(e.Destinations) != 0 {
+		t.Errorf("expected the event to be rejected, got %+v", e)
+	}
+}
+
+func TestExplainAlarm(t *testing.T) {
+	f := newFixture(t, baseConfig())
+
+	e, err := f.handler.ExplainAlarm(context.Background(), test.TriggeredAlarmDetails.Resources[0])
+	if err != nil {
+		t.Fatalf("ExplainAlarm returned error: %v", err)
+	}
+	if e.Alarm != test.TriggeredAlarmDetails.Detail.AlarmName || e.Action != pagerduty.ActionTrigger {
+		t.Errorf("expected the alarm's trigger to be explained, got %+v", e)
+	}
+	if !slices.Equal(e.Destinations, []string{lambda.DestinationSlack, lambda.DestinationPagerDuty}) {
+		t.Errorf("expected slack and pagerduty, got %v", e.Destinations)
+	}
+}
+
+func TestHandleRequestRejectsUntrusted(t *testing.T) {
+	queue := &test.MockSQSAPI{}
+	cfg := baseConfig()
+	cfg.AllowedAccounts = []string{"1234567890123"}
+	cfg.AllowedRegions = []string{"us-east-1"}
+	f := newFixture(t, cfg, lambda.WithQuarantine(quarantine.NewSQSWithAPI(queue, "quarantine-queue")))
+
+	otherAccount := test.TriggeredAlarmDetails
+	otherAccount.Account = "999999999999"
+	otherAccount.Resources = []string{"arn:aws:cloudwatch:us-east-1:999999999999:alarm:test-service-alarm-abcd"}
+	otherRegion := test.AlarmEvent(test.TriggeredAlarmDetails, "other-region")
+	otherRegion.Region = "eu-west-1"
+	otherRegion.Resources = []string{"arn:aws:cloudwatch:eu-west-1:1234567890123:alarm:other-region"}
+	forged := test.AlarmEvent(test.TriggeredAlarmDetails, "forged")
+	forged.Detail.AlarmName = "test-service-alarm-abcd"
+
+	resp, err := f.handler.HandleRequest(context.Background(), test.SQSEventFor(otherAccount, otherRegion, forged))
+	if err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Errorf("expected rejected records to be quarantined, got %v", resp.BatchItemFailures)
+	}
+	if got := len(queue.Messages()); got != 3 {
+		t.Errorf("expected 3 quarantined records, got %d", got)
+	}
+	if got := len(f.pd.Events()); got != 0 {
+		t.Errorf("rejected events must never page, got %d pagerduty events", got)
+	}
+	for _, m := range f.slack.Messages() {
+		if !strings.Contains(string(m), "quarantined") {
+			t.Errorf("rejected events must never be posted, got %s", m)
+		}
+	}
+
+	// without a quarantine they fail, still undelivered
+	f = newFixture(t, cfg)
+	evt := forged
+	if err := f.handler.ProcessEvent(context.Background(), &evt); !errors.Is(err, lambda.ErrUntrusted) {
+		t.Errorf("expected ErrUntrusted, got %v", err)
+	}
+}
+
+func TestHandleRequestRetriesOnlyFailedGroup(t *testing.T) {
+	f := newFixture(t, baseConfig())
+
+	// a failing record doesn't hold up another alarm's record
+	sqsEvent := test.GenTestSQSEvent()
+	good := sqsEvent.Records[0]
+	bad := good
+	bad.MessageId = "bad-record"
+	bad.Body = "this is not json{"
+	sqsEvent.Records = []awsevents.SQSMessage{bad, good}
+
+	resp, err := f.handler.HandleRequest(context.Background(), sqsEvent)
+	if err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "bad-record" {
+		t.Fatalf("expected only the bad record to fail, got %+v", resp.BatchItemFailures)
+	}
+	if got := len(f.slack.Messages()); got != 1 {
+		t.Errorf("expected the good record to be processed, got %d slack messages", got)
+	}
+}
+
+func TestHandleRequestFIFOGroupOrder(t *testing.T) {
+	f := newFixture(t, baseConfig())
+
+	// the first alarm has no tags, so its record fails; its successor in the
+	// same message group must wait, the other group goes ahead
+	untagged := test.AlarmEvent(test.TriggeredAlarmDetails, "untagged-alarm")
+	tagged := test.TriggeredAlarmDetails
+	other := test.AlarmEvent(test.TriggeredAlarmDetails, "other-alarm")
+	f.cw.Tags = map[string]map[string]string{
+		tagged.Resources[0]: test.TagsByARN[tagged.Resources[0]],
+		other.Resources[0]:  test.TagsByARN[tagged.Resources[0]],
+	}
+	sqsEvent := test.SQSEventFor(untagged, tagged, other)
+	for i, group := range []string{"g1", "g1", "g2"} {
+		sqsEvent.Records[i].Attributes = map[string]string{"MessageGroupId": group}
+	}
+
+	resp, err := f.handler.HandleRequest(context.Background(), sqsEvent)
+	if err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	var failed []string
+	for _, item := range resp.BatchItemFailures {
+		failed = append(failed, item.ItemIdentifier)
+	}
+	want := []string{sqsEvent.Records[0].MessageId, sqsEvent.Records[1].MessageId}
+	if strings.Join(failed, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected %v to be retried, got %v", want, failed)
+	}
+	if got := len(f.pd.Events()); got != 1 {
+		t.Errorf("expected only the other group's alarm to page, got %d events", got)
+	}
+}
+
+func TestHandleRequestConcurrentAlarms(t *testing.T) {
+	cfg := baseConfig()
+	cfg.MaxConcurrency = 3
+	f := newFixture(t, cfg)
+
+	f.cw.Tags = map[string]map[string]string{}
+	var evts []cw.Event
+	for i := 0; i < 6; i++ {
+		evt := test.AlarmEvent(test.TriggeredAlarmDetails, fmt.Sprintf("alarm-%d", i))
+		f.cw.Tags[evt.Resources[0]] = map[string]string{"owner": fmt.Sprintf("team-%d", i)}
+		evts = append(evts, evt)
+		// each alarm resolves again within the batch
+		resolved := test.ResolvedEvent(evt)
+		evts = append(evts, resolved)
+	}
+
+	resp, err := f.handler.HandleRequest(context.Background(), test.SQSEventFor(evts...))
+	if err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("unexpected batch item failures: %+v", resp.BatchItemFailures)
+	}
+
+	// every alarm's trigger was paged before its resolve
+	seen := make(map[string]string)
+	for _, e := range f.pd.Events() {
+		alarm := e.DedupKey
+		if e.Action == pagerduty.ActionResolve && seen[alarm] != pagerduty.ActionTrigger {
+			t.Errorf("resolve of %s sent before its trigger", alarm)
+		}
+		seen[alarm] = e.Action
+	}
+	if len(seen) != 6 {
+		t.Errorf("expected events for 6 alarms, got %d", len(seen))
+	}
+}
+
+func TestProcessEventFlapping(t *testing.T) {
+	start := time.Date(2020, 7, 31, 6, 0, 0, 0, time.UTC)
+	now := start
+	detector := flapping.NewDetector(flapping.NewMemory(), 10*time.Minute, flapping.WithClock(func() time.Time { return now }))
+	cfg := baseConfig()
+	cfg.FlapThreshold = 3
+	f := newFixture(t, cfg, lambda.WithFlapDetector(detector))
+	ctx := context.Background()
+
+	// transition i alternates between ALARM and OK, a minute apart
+	transition := func(i int) *cw.Event {
+		evt := test.TriggeredAlarmDetails
+		if i%2 == 1 {
+			evt = test.ResolvedEvent(evt)
+		}
+		evt.ID = fmt.Sprintf("flap-%d", i)
+		now = start.Add(time.Duration(i) * time.Minute)
+		evt.Detail.State.Timestamp = now.Format("2006-01-02T15:04:05.000-0700")
+		return &evt
+	}
+	for i := 0; i < 4; i++ {
+		if err := f.handler.ProcessEvent(ctx, transition(i)); err != nil {
+			t.Fatalf("ProcessEvent(%d) returned error: %v", i, err)
+		}
+	}
+
+	// the third transition started flapping: one flapping message, updated
+	// by the fourth, whose resolve is held back
+	if got := len(f.slack.Messages()); got != 3 {
+		t.Fatalf("expected 3 slack messages, got %d", got)
+	}
+	if !strings.Contains(string(f.slack.Messages()[2]), "flapping") {
+		t.Errorf("expected a flapping message, got %s", f.slack.Messages()[2])
+	}
+	if got := len(f.slack.Updates()); got != 1 {
+		t.Errorf("expected the flapping message to be updated once, got %d", got)
+	}
+	events := f.pd.Events()
+	if len(events) != 3 || events[2].Action != pagerduty.ActionTrigger {
+		t.Fatalf("expected trigger, resolve, trigger pagerduty events, got %d", len(events))
+	}
+
+	// not stable yet
+	if _, err := f.handler.Invoke(ctx, scheduledEvent); err != nil {
+		t.Fatalf("Invoke returned error: %v", err)
+	}
+	if got := len(f.slack.Messages()); got != 3 {
+		t.Fatalf("alarm shouldn't be announced stable yet, got %d slack messages", got)
+	}
+
+	// a quiet window later the alarm is stable in OK: announced, and the
+	// held resolve is delivered
+	now = now.Add(10 * time.Minute)
+
+	// only the scheduled sweep announces it, batches don't wait for it
+	ignored := test.AlarmEvent(test.TriggeredAlarmDetails, "other-alarm")
+	ignored.Detail.PreviousState.Value = ignored.Detail.State.Value
+	if _, err := f.handler.HandleRequest(ctx, test.SQSEventFor(ignored)); err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	if got := len(f.slack.Messages()); got != 3 {
+		t.Fatalf("a batch shouldn't announce stabilised alarms, got %d slack messages", got)
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := f.handler.Invoke(ctx, scheduledEvent); err != nil {
+			t.Fatalf("Invoke returned error: %v", err)
+		}
+	}
+	messages := f.slack.Messages()
+	if len(messages) != 4 || !strings.Contains(string(messages[3]), "stabilised") {
+		t.Fatalf("expected a single stabilised message, got %d messages", len(messages))
+	}
+	events = f.pd.Events()
+	if len(events) != 4 || events[3].Action != pagerduty.ActionResolve {
+		t.Fatalf("expected the held resolve to be sent to pagerduty, got %d events", len(events))
+	}
+
+	// the next transition is notified normally again
+	if err := f.handler.ProcessEvent(ctx, transition(20)); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+	if got := string(f.slack.Messages()[4]); !strings.Contains(got, "triggered") {
+		t.Errorf("expected a normal triggered message, got %s", got)
+	}
+}
+
+func TestFlapThreshold(t *testing.T) {
+	cfg := baseConfig()
+	cfg.FlapThreshold = 5
+	f := newFixture(t, cfg)
+	tests := []struct {
+		tags     map[string]string
+		expected int
+	}{
+		{map[string]string{}, 5},
+		{map[string]string{lambda.FlapThresholdTagKey: "3"}, 3},
+		{map[string]string{lambda.FlapThresholdTagKey: "0"}, 0},
+		{map[string]string{lambda.FlapThresholdTagKey: "many"}, 5},
+	}
+	for _, tc := range tests {
+		if got := f.handler.FlapThreshold(tc.tags); got != tc.expected {
+			t.Errorf("FlapThreshold(%v) = %d, want %d", tc.tags, got, tc.expected)
+		}
+	}
+}
+
+func TestHandleRequestStorm(t *testing.T) {
+	cfg := baseConfig()
+	cfg.StormThreshold = 3
+	f := newFixture(t, cfg)
+
+	// four triggers for the test team, one for another team, and a resolve
+	f.cw.Tags = map[string]map[string]string{}
+	var evts []cw.Event
+	for _, name := range []string{"db-latency", "db-errors", "api-errors", "api-latency", "other-team-alarm"} {
+		evt := test.AlarmEvent(test.TriggeredAlarmDetails, name)
+		f.cw.Tags[evt.Resources[0]] = map[string]string{"owner": "test", "service": "test-service"}
+		evts = append(evts, evt)
+	}
+	f.cw.Tags[evts[4].Resources[0]] = map[string]string{"owner": "other", "service": "test-service"}
+	resolved := test.ResolvedEvent(test.TriggeredAlarmDetails)
+	f.cw.Tags[resolved.Resources[0]] = test.TagsByARN[resolved.Resources[0]]
+	sqsEvent := test.SQSEventFor(append(evts, resolved)...)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		resp, err := f.handler.HandleRequest(context.Background(), sqsEvent)
+		if err != nil {
+			t.Fatalf("HandleRequest returned error: %v", err)
+		}
+		if len(resp.BatchItemFailures) != 0 {
+			t.Fatalf("unexpected batch item failures: %+v", resp.BatchItemFailures)
+		}
+	}
+
+	// one summary, the other team's trigger and the resolve
+	messages := f.slack.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 slack messages, got %d", len(messages))
+	}
+	summary := string(messages[0])
+	if !strings.Contains(summary, "test-alarms") || !strings.Contains(summary, "4+CloudWatch+alarms") {
+		t.Errorf("expected a summary of 4 alarms to test-alarms, got %s", summary)
+	}
+	for _, evt := range evts[:4] {
+		if !strings.Contains(summary, evt.Detail.AlarmName) {
+			t.Errorf("summary missing %s", evt.Detail.AlarmName)
+		}
+	}
+	// paging stays per alarm
+	if got := len(f.pd.Events()); got != 6 {
+		t.Errorf("expected 6 pagerduty events, got %d", got)
+	}
+}
+
+func TestHandleRequestStormRejectsUntrusted(t *testing.T) {
+	queue := &test.MockSQSAPI{}
+	cfg := baseConfig()
+	cfg.StormThreshold = 3
+	cfg.AllowedAccounts = []string{"1234567890123"}
+	f := newFixture(t, cfg, lambda.WithQuarantine(quarantine.NewSQSWithAPI(queue, "quarantine-queue")))
+
+	// two trusted triggers and two forged ones to the same channel
+	f.cw.Tags = map[string]map[string]string{}
+	var evts []cw.Event
+	for _, name := range []string{"db-latency", "db-errors", "forged-1", "forged-2"} {
+		evt := test.AlarmEvent(test.TriggeredAlarmDetails, name)
+		if strings.HasPrefix(name, "forged") {
+			evt.Account = "999999999999"
+			evt.Resources = []string{"arn:aws:cloudwatch:us-east-1:999999999999:alarm:" + name}
+		}
+		f.cw.Tags[evt.Resources[0]] = map[string]string{"owner": "test", "service": "test-service"}
+		evts = append(evts, evt)
+	}
+	resp, err := f.handler.HandleRequest(context.Background(), test.SQSEventFor(evts...))
+	if err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("unexpected batch item failures: %+v", resp.BatchItemFailures)
+	}
+
+	// the forged events don't make a storm: the trusted ones are posted
+	// individually, the forged ones quarantined
+	if got := len(queue.Messages()); got != 2 {
+		t.Errorf("expected 2 quarantined records, got %d", got)
+	}
+	posted := 0
+	for _, m := range f.slack.Messages() {
+		if strings.Contains(string(m), "CloudWatch+alarms") || strings.Contains(string(m), "forged") {
+			t.Errorf("forged events must never be posted, got %s", m)
+		}
+		if !strings.Contains(string(m), "quarantined") {
+			posted++
+		}
+	}
+	if posted != 2 {
+		t.Errorf("expected 2 individual messages, got %d", posted)
+	}
+}
+
+func TestHandleRequestStormFlapping(t *testing.T) {
+	start := time.Date(2020, 7, 31, 6, 0, 0, 0, time.UTC)
+	now := start
+	detector := flapping.NewDetector(flapping.NewMemory(), 10*time.Minute, flapping.WithClock(func() time.Time { return now }))
+	cfg := baseConfig()
+	cfg.StormThreshold = 3
+	cfg.FlapThreshold = 2
+	f := newFixture(t, cfg, lambda.WithFlapDetector(detector))
+	ctx := context.Background()
+
+	// transition i of the test alarm alternates between ALARM and OK
+	transition := func(i int) cw.Event {
+		evt := test.TriggeredAlarmDetails
+		if i%2 == 1 {
+			evt = test.ResolvedEvent(evt)
+		}
+		evt.ID = fmt.Sprintf("flap-%d", i)
+		now = start.Add(time.Duration(i) * time.Minute)
+		evt.Detail.State.Timestamp = now.Format("2006-01-02T15:04:05.000-0700")
+		return evt
+	}
+	for i := 0; i < 2; i++ {
+		evt := transition(i)
+		if err := f.handler.ProcessEvent(ctx, &evt); err != nil {
+			t.Fatalf("ProcessEvent(%d) returned error: %v", i, err)
+		}
+	}
+
+	// the flapping alarm triggers again along with a storm
+	flapping := transition(2)
+	f.cw.Tags = map[string]map[string]string{flapping.Resources[0]: test.TagsByARN[flapping.Resources[0]]}
+	evts := []cw.Event{flapping}
+	for _, name := range []string{"db-latency", "db-errors", "api-errors"} {
+		evt := test.AlarmEvent(test.TriggeredAlarmDetails, name)
+		f.cw.Tags[evt.Resources[0]] = map[string]string{"owner": "test", "service": "test-service"}
+		evts = append(evts, evt)
+	}
+	resp, err := f.handler.HandleRequest(ctx, test.SQSEventFor(evts...))
+	if err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("unexpected batch item failures: %+v", resp.BatchItemFailures)
+	}
+
+	// the storm summary leaves out the flapping alarm, whose message is
+	// updated instead
+	messages := f.slack.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 slack messages, got %d", len(messages))
+	}
+	summary := string(messages[2])
+	if !strings.Contains(summary, "3+CloudWatch+alarms") || strings.Contains(summary, flapping.Detail.AlarmName) {
+		t.Errorf("expected a summary of the 3 other alarms, got %s", summary)
+	}
+	if got := len(f.slack.Updates()); got != 1 {
+		t.Errorf("expected the flapping message to be updated once, got %d", got)
+	}
+}
+
+func TestHandleRequestSlackRateLimited(t *testing.T) {
+	f := newFixture(t, baseConfig())
+
+	// a 429 that fits in the invocation is waited out instead of failing
+	// the record
+	f.slack.RateLimit(1, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := f.handler.HandleRequest(ctx, test.GenTestSQSEvent())
+	if err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	if len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("unexpected batch item failures: %+v", resp.BatchItemFailures)
+	}
+	if got := len(f.slack.Messages()); got != 1 {
+		t.Errorf("expected 1 slack message, got %d", got)
+	}
+
+	// one that doesn't fails only the slack delivery
+	f.slack.RateLimit(1, 60)
+	evt := test.ResolvedEvent(test.TriggeredAlarmDetails)
+	err = f.handler.ProcessEvent(ctx, &evt)
+	var derr *lambda.DeliveryError
+	if !errors.As(err, &derr) || len(derr.Failed()) != 1 || derr.Failed()[0] != lambda.DestinationSlack {
+		t.Fatalf("expected only the slack delivery to fail, got %v", err)
+	}
+}
+
+func TestHandleRequestArchive(t *testing.T) {
+	api := &test.MockS3API{}
+	s3client, err := s3.New(context.Background(), s3.WithAPI(api))
+	if err != nil {
+		t.Fatalf("failed creating s3 client: %v", err)
+	}
+	store := archive.NewS3(s3client, "archive-bucket", "archive")
+	f := newFixture(t, baseConfig(), lambda.WithArchive(store))
+	f.pd.Fail(errors.New("pagerduty unavailable"))
+
+	ignored := test.AlarmEvent(test.ExpectedAlarmDetails, "ignored-alarm")
+	if _, err := f.handler.HandleRequest(context.Background(), test.SQSEventFor(test.TriggeredAlarmDetails, ignored)); err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+
+	// the batch is archived as one object
+	objects := api.Objects()
+	if len(objects) != 1 || !strings.HasPrefix(objects[0], "archive-bucket/archive/") {
+		t.Fatalf("expected one archive object, got %v", objects)
+	}
+	now := time.Now()
+	entries := map[string]archive.Entry{}
+	err = store.Read(context.Background(), now.Add(-time.Minute), now.Add(time.Minute), func(e archive.Entry) error {
+		entries[e.Event.ID] = e
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reading the archive: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 archived events, got %d", len(entries))
+	}
+
+	triggered := entries[test.TriggeredAlarmDetails.ID]
+	if triggered.Action != pagerduty.ActionTrigger || triggered.SlackChannel != "test-alarms" || triggered.Tags["service"] != "test-service" {
+		t.Errorf("unexpected routing archived: %+v", triggered)
+	}
+	if o := triggered.Outcomes; len(o) != 2 ||
+		o[0] != (archive.Outcome{Destination: lambda.DestinationSlack}) ||
+		o[1].Destination != lambda.DestinationPagerDuty || !strings.Contains(o[1].Error, "pagerduty unavailable") {
+		t.Errorf("expected slack delivered and pagerduty failed, got %+v", o)
+	}
+	if !strings.Contains(triggered.Error, "pagerduty unavailable") {
+		t.Errorf("expected the delivery error to be archived, got %q", triggered.Error)
+	}
+
+	if e := entries[ignored.ID]; e.Action != pagerduty.ActionNone || e.Outcomes != nil || e.Error != "" {
+		t.Errorf("expected the ignored transition archived without outcomes, got %+v", e)
+	}
+}
+
+func TestProcessEventDestinationOverride(t *testing.T) {
+	cfg := baseConfig()
+	cfg.OpsCenterEnabled = true
+	f := newFixture(t, cfg, lambda.WithDestinationOverride(lambda.Override{
+		SlackChannel:        "replay",
+		PagerDutyRoutingKey: "replay-key",
+	}))
+
+	evt := test.TriggeredAlarmDetails
+	outcomes, err := f.handler.DeliverEvent(context.Background(), &evt)
+	if err != nil {
+		t.Fatalf("DeliverEvent returned error: %v", err)
+	}
+	if len(outcomes) != 2 {
+		t.Errorf("expected only slack and pagerduty deliveries, got %+v", outcomes)
+	}
+	messages := f.slack.Messages()
+	if len(messages) != 1 || !strings.Contains(string(messages[0]), "channel=replay") {
+		t.Errorf("expected the slack message in the override channel: %s", messages)
+	}
+	if events := f.pd.Events(); len(events) != 1 || events[0].RoutingKey != "replay-key" {
+		t.Errorf("expected a page with the override routing key, got %+v", events)
+	}
+
+	// without a routing key, nothing is paged
+	f = newFixture(t, baseConfig(), lambda.WithDestinationOverride(lambda.Override{SlackChannel: "replay"}))
+	if _, err := f.handler.DeliverEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("DeliverEvent returned error: %v", err)
+	}
+	if got := len(f.pd.Events()); got != 0 {
+		t.Errorf("expected no page without an override routing key, got %d", got)
+	}
+	// a rejected page alerts the override channel, not the fallback one
+	cfg = baseConfig()
+	cfg.PagerDutyFallbackSlackChannel = "pagerduty-fallback"
+	f = newFixture(t, cfg, lambda.WithDestinationOverride(lambda.Override{
+		SlackChannel:        "replay",
+		PagerDutyRoutingKey: "replay-key",
+	}))
+	f.pd.Fail(pdapi.APIError{StatusCode: http.StatusBadRequest})
+	if _, err := f.handler.DeliverEvent(context.Background(), &evt); err != nil {
+		t.Fatalf("DeliverEvent returned error: %v", err)
+	}
+	for _, m := range f.slack.Messages() {
+		if !strings.Contains(string(m), "channel=replay") {
+			t.Errorf("expected every slack message in the override channel: %s", m)
+		}
+	}
+}
+
+func TestProcessEventDryRun(t *testing.T) {
+	cfg := baseConfig()
+	cfg.DryRun = true
+	cfg.OpsCenterEnabled = true
+	cfg.DeliveryLedgerTable = "live-ledger"
+	f := newFixture(t, cfg)
+
+	paged := test.TriggeredAlarmDetails
+	suppressed := test.SuppressedAlarmDetails
+	for _, evt := range []*cw.Event{&paged, &suppressed} {
+		outcomes, err := f.handler.DeliverEvent(context.Background(), evt)
+		if err != nil {
+			t.Fatalf("DeliverEvent returned error: %v", err)
+		}
+		if len(outcomes) != 2 {
+			t.Errorf("expected the live routing's 2 deliveries, got %+v", outcomes)
+		}
+	}
+	if got := len(f.slack.Messages()); got != 0 {
+		t.Errorf("expected no slack messages, got %d", got)
+	}
+	if got := len(f.pd.Events()); got != 0 {
+		t.Errorf("expected no pagerduty events, got %d", got)
+	}
+	if got := len(f.ops.OpsItems()); got != 0 {
+		t.Errorf("expected no opsitems, got %d", got)
+	}
+	if table := f.handler.Config().DeliveryLedgerTable; table != "" {
+		t.Errorf("expected the dry run to keep its own ledger, got table %q", table)
+	}
+
+	// with a shadow channel, the slack messages go there
+	cfg.ShadowSlackChannel = "shadow-alarms"
+	f = newFixture(t, cfg)
+	if _, err := f.handler.DeliverEvent(context.Background(), &paged); err != nil {
+		t.Fatalf("DeliverEvent returned error: %v", err)
+	}
+	messages := f.slack.Messages()
+	if len(messages) != 1 || !strings.Contains(string(messages[0]), "channel=shadow-alarms") {
+		t.Errorf("expected the slack message in the shadow channel: %s", messages)
+	}
+	if got := len(f.pd.Events()); got != 0 {
+		t.Errorf("expected no pagerduty events, got %d", got)
+	}
+
+	// a shadow channel is only for dry runs
+	cfg.DryRun = false
+	if _, err := lambda.New(context.Background(), cfg); err == nil {
+		t.Error("expected a shadow channel without a dry run to be rejected")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	f := newFixture(t, baseConfig())
+	f.slack.SetChannels("test-alarms", "special-alarms")
+	arn := func(name string) string { return "arn:aws:cloudwatch:us-east-1:1234567890123:alarm:" + name }
+	f.cw.Tags = map[string]map[string]string{
+		arn("good"):         {"owner": "test", "service": "test-service"},
+		arn("suppressed"):   {"owner": "test", "alerts:suppress_pagerduty": "true"},
+		arn("untagged"):     {},
+		arn("typos"):        {"owner": "test", "service": "test-service", "alerts:slack_chanel": "special-alarms", "alerts:slack_channel": "#speical-alarms"},
+		arn("unregistered"): {"owner": "nobody", "service": "other-service"},
+	}
+	auditor, err := f.handler.NewAuditor(context.Background())
+	if err != nil {
+		t.Fatalf("NewAuditor returned error: %v", err)
+	}
+
+	tests := map[string][]string{
+		"good":         nil,
+		"suppressed":   {lambda.CheckMissingService},
+		"untagged":     {lambda.CheckMissingOwner, lambda.CheckMissingService},
+		"typos":        {lambda.CheckUnknownSlackChannel, lambda.CheckUnknownTag},
+		"unregistered": {lambda.CheckUnknownSlackChannel, lambda.CheckNoRoutingKey},
+		"deleted":      {lambda.CheckTagsUnavailable},
+	}
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			for _, finding := range auditor.Audit(context.Background(), nil, cw.Alarm{Name: name, ARN: arn(name)}) {
+				if finding.Alarm != name || finding.AlarmARN != arn(name) || finding.Detail == "" {
+					t.Errorf("incomplete finding %+v", finding)
+				}
+				got = append(got, finding.Check)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("expected findings %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	statuses := func(r *lambda.PreflightReport) map[string]lambda.Status {
+		m := map[string]lambda.Status{}
+		for _, c := range r.Checks {
+			if c.Detail == "" {
+				t.Errorf("check %s has no detail", c.Name)
+			}
+			m[c.Name] = c.Status
+		}
+		return m
+	}
+	cfg := baseConfig()
+	cfg.DefaultPagerDutyRoutingKey = "0123456789abcdef0123456789ABCDEF"
+
+	t.Run("pass", func(t *testing.T) {
+		f := newFixture(t, cfg, lambda.WithSTSAPI(&test.MockSTSAPI{}))
+		f.slack.SetChannels("test-alarms")
+		r := f.handler.Preflight(context.Background())
+		want := map[string]lambda.Status{
+			lambda.PreflightSlackToken:     lambda.StatusPass,
+			lambda.PreflightSlackChannel:   lambda.StatusPass,
+			lambda.PreflightPagerDutyKey:   lambda.StatusPass,
+			lambda.PreflightCloudWatch:     lambda.StatusPass,
+			lambda.PreflightParameterStore: lambda.StatusPass,
+			lambda.PreflightImageBucket:    lambda.StatusSkip,
+		}
+		if got := statuses(r); !maps.Equal(got, want) {
+			t.Errorf("expected %v, got %v", want, got)
+		}
+		if !r.OK() || r.Summary() != "5 passed, 0 warned, 0 failed, 1 skipped" {
+			t.Errorf("unexpected summary %q", r.Summary())
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		cfg := baseConfig()
+		cfg.GraphMode = lambda.GraphModeSlack
+		f := newFixture(t, cfg, lambda.WithSTSAPI(&test.MockSTSAPI{}))
+		f.slack.SetScopes("chat:write,channels:read")
+		f.slack.AddChannel(test.SlackChannel{Name: "test-alarms"})
+		r := f.handler.Preflight(context.Background())
+		got := statuses(r)
+		for name, want := range map[string]lambda.Status{
+			lambda.PreflightSlackToken:   lambda.StatusFail, // no files:write
+			lambda.PreflightSlackChannel: lambda.StatusFail, // not a member, no chat:write.public
+			lambda.PreflightPagerDutyKey: lambda.StatusFail,
+		} {
+			if got[name] != want {
+				t.Errorf("expected %s to %s, got %s", name, want, got[name])
+			}
+		}
+		if r.OK() {
+			t.Error("expected the preflight to fail")
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		f := newFixture(t, cfg, lambda.WithSTSAPI(&test.MockSTSAPI{}))
+		f.slack.FailAuth("invalid_auth")
+		got := statuses(f.handler.Preflight(context.Background()))
+		if got[lambda.PreflightSlackToken] != lambda.StatusFail || got[lambda.PreflightSlackChannel] != lambda.StatusSkip {
+			t.Errorf("unexpected statuses %v", got)
+		}
+	})
+
+	t.Run("image bucket", func(t *testing.T) {
+		cfg := cfg
+		cfg.GraphMode = lambda.GraphModeS3
+		cfg.ImageBucket = "graphs"
+		cfg.ImageBucketPrefix = "alarms/"
+		f := newFixture(t, cfg, lambda.WithSTSAPI(&test.MockSTSAPI{}))
+		f.slack.SetChannels("test-alarms")
+		if got := statuses(f.handler.Preflight(context.Background())); got[lambda.PreflightImageBucket] != lambda.StatusPass {
+			t.Errorf("expected the image bucket check to pass, got %v", got)
+		}
+		if _, ok := f.s3.Object("graphs", "alarms/cw-alert-router-preflight.txt"); !ok {
+			t.Errorf("expected a preflight object, got %v", f.s3.Objects())
+		}
+	})
+}
+
+// emitted decodes the metrics records the fixture's handler emitted.
+func (f *testFixture) emitted(t *testing.T) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(f.metrics.Bytes()))
+	for dec.More() {
+		var r map[string]any
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("failed decoding metrics: %v", err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestProcessEventMetrics(t *testing.T) {
+	f := newFixture(t, baseConfig())
+	f.pd.Fail(errors.New("pagerduty is down"))
+
+	paged := test.TriggeredAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &paged); err == nil {
+		t.Fatal("expected the pagerduty delivery to fail")
+	}
+	suppressed := test.SuppressedAlarmDetails
+	if err := f.handler.ProcessEvent(context.Background(), &suppressed); err != nil {
+		t.Fatalf("ProcessEvent returned error: %v", err)
+	}
+
+	// records by destination, "" for the events'
+	got := map[string][]map[string]any{}
+	for _, r := range f.emitted(t) {
+		if r["Owner"] != "test" {
+			t.Errorf("expected the owner dimension, got %v", r)
+		}
+		destination, _ := r[lambda.DimensionDestination].(string)
+		got[destination] = append(got[destination], r)
+	}
+	events := got[""]
+	if len(events) != 2 || events[0][lambda.MetricEventsProcessed] != 1.0 ||
+		events[0][lambda.MetricEventsFailed] != 1.0 || events[1][lambda.MetricEventsFailed] != 0.0 ||
+		events[0][lambda.MetricDefaultChannelFallbacks] != 0.0 || events[0][lambda.MetricDefaultRoutingKeyFallbacks] != 0.0 {
+		t.Errorf("unexpected event records %v", events)
+	}
+	slack := got[lambda.DestinationSlack]
+	if len(slack) != 2 || slack[0][lambda.MetricDeliveries] != 1.0 || slack[0][lambda.MetricDeliveryLatency] == nil {
+		t.Errorf("unexpected slack records %v", slack)
+	}
+	pd := got[lambda.DestinationPagerDuty]
+	if len(pd) != 2 || pd[0][lambda.MetricDeliveryFailures] != 1.0 || pd[0][lambda.MetricDeliveryLatency] != nil ||
+		pd[1][lambda.MetricSuppressed] != 1.0 {
+		t.Errorf("unexpected pagerduty records %v", pd)
+	}
+
+	// the batch's failed records are counted, the invocation itself never
+	// fails
+	f.metrics.Reset()
+	sqsEvent := test.GenTestSQSEvent()
+	sqsEvent.Records[0].Body = "this is not json{"
+	if _, err := f.handler.HandleRequest(context.Background(), sqsEvent); err != nil {
+		t.Fatalf("HandleRequest returned error: %v", err)
+	}
+	records := f.emitted(t)
+	batch := records[len(records)-1]
+	if batch[lambda.MetricRecords] != float64(len(sqsEvent.Records)) || batch[lambda.MetricRecordsFailed] == 0.0 {
+		t.Errorf("unexpected batch record %v", batch)
 	}
 }
@@ -0,0 +1,136 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	awsevents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+)
+
+// Event sources of the Lambda invocations the router accepts records from.
+const (
+	eventSourceSQS = "aws:sqs"
+	eventSourceSNS = "aws:sns"
+)
+
+// detailTypeScheduled is the detail type of the events scheduled EventBridge
+// rules send, e.g. to sweep for stabilised alarms.
+const detailTypeScheduled = "Scheduled Event"
+
+// Invoke handles whatever invokes the Lambda: an SQS batch (see
+// HandleRequest), an SNS notification, or an alarm event sent directly by
+// an EventBridge rule. Scheduled events only announce stabilised alarms.
+// Everything but SQS batches is invoked asynchronously, so a failed event
+// fails the invocation, for Lambda to retry it and finally send it to the
+// function's dead-letter queue or on-failure destination. Malformed and
+// untrusted events are quarantined rather than failed, if possible.
+func (h *Handler) Invoke(ctx context.Context, payload json.RawMessage) (any, error) {
+	var probe struct {
+		Records []struct {
+			EventSource string `json:"eventSource"` // "EventSource" for SNS
+		} `json:"Records"`
+		Source     string `json:"source"`
+		DetailType string `json:"detail-type"`
+	}
+	_ = json.Unmarshal(payload, &probe) // anything but records is an event
+	if len(probe.Records) > 0 {
+		switch probe.Records[0].EventSource {
+		case eventSourceSQS:
+			var sqsEvent awsevents.SQSEvent
+			if err := json.Unmarshal(payload, &sqsEvent); err != nil {
+				return nil, fmt.Errorf("decoding sqs event: %w", err)
+			}
+			return h.HandleRequest(ctx, sqsEvent)
+		case eventSourceSNS:
+			var snsEvent awsevents.SNSEvent
+			if err := json.Unmarshal(payload, &snsEvent); err != nil {
+				return nil, fmt.Errorf("decoding sns event: %w", err)
+			}
+			return nil, h.handleSNS(ctx, snsEvent)
+		}
+	}
+
+	ctx, done := h.startInvocation(ctx)
+	defer done()
+	if probe.Source == "aws.events" && probe.DetailType == detailTypeScheduled {
+		h.AnnounceStabilised(ctx)
+		return nil, nil
+	}
+	id := ""
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		id = lc.AwsRequestID
+	}
+	return nil, h.invokeEvent(ctx, id, "", payload)
+}
+
+// handleSNS processes the notifications of an SNS invocation, failing it if
+// any of them failed.
+func (h *Handler) handleSNS(ctx context.Context, snsEvent awsevents.SNSEvent) error {
+	ctx, done := h.startInvocation(ctx)
+	defer done()
+	var errs []error
+	for _, rec := range snsEvent.Records {
+		slog.Info("processing sns notification", "message_id", rec.SNS.MessageID, "topic_arn", rec.SNS.TopicArn)
+		if err := h.invokeEvent(ctx, rec.SNS.MessageID, rec.SNS.TopicArn, []byte(rec.SNS.Message)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// startInvocation prepares an asynchronous invocation like HandleRequest
+// does a batch. done must be called when the invocation is handled.
+func (h *Handler) startInvocation(ctx context.Context) (_ context.Context, done func()) {
+	ctx, flush := h.withArchiveBatch(ctx)
+	ctx, cancel := withResponseReserve(ctx)
+	ctx = withTagCache(ctx)
+	throttled := h.sl.ThrottleStats()
+	return ctx, func() {
+		h.logThrottling(throttled)
+		cancel()
+		flush()
+	}
+}
+
+// invokeEvent decodes and processes one asynchronously invoked event (see
+// cw.DecodeEvent), quarantining it if it's malformed or untrusted. topicARN
+// is the SNS topic that delivered it, if any.
+func (h *Handler) invokeEvent(ctx context.Context, id, topicARN string, body []byte) error {
+	evt, err := cw.DecodeEvent(body)
+	if err != nil {
+		err = fmt.Errorf("decoding invocation payload: %w: %w", ErrMalformed, err)
+	} else {
+		if topicARN != "" {
+			evt.TopicARN = topicARN
+		}
+		err = h.ProcessEvent(ctx, evt)
+	}
+	if err == nil {
+		return nil
+	}
+	if quarantinable(err) && h.quarantineRecord(ctx, awsevents.SQSMessage{MessageId: id, Body: string(body)}, err) {
+		return nil
+	}
+	slog.Error("failed processing event", "id", id, "error", err)
+	return err
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/metrics"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+)
+
+// Metric names. Event metrics are dimensioned by owner, delivery metrics by
+// destination and by destination and owner, and batch metrics not at all.
+const (
+	MetricEventsProcessed            = "EventsProcessed"
+	MetricEventsFailed               = "EventsFailed"
+	MetricEventsRejected             = "EventsRejected"
+	MetricGraphRenderFailures        = "GraphRenderFailures"
+	MetricDefaultChannelFallbacks    = "DefaultChannelFallbacks"
+	MetricDefaultRoutingKeyFallbacks = "DefaultRoutingKeyFallbacks"
+	MetricDeliveries                 = "Deliveries"
+	MetricDeliveryFailures           = "DeliveryFailures"
+	MetricDeliveriesSkipped          = "DeliveriesSkipped"
+	MetricDeliveryLatency            = "DeliveryLatency"
+	MetricSuppressed                 = "Suppressed"
+	MetricRecords                    = "Records"
+	MetricRecordsFailed              = "RecordsFailed"
+)
+
+// Metric dimensions.
+const (
+	DimensionOwner       = "Owner"
+	DimensionDestination = "Destination"
+)
+
+// noOwner is the owner dimension of alarms without an owner tag.
+const noOwner = "none"
+
+// emit writes a metrics record, if metrics are enabled. Failures are only
+// logged.
+func (h *Handler) emit(r metrics.Record) {
+	if h.metrics == nil {
+		return
+	}
+	if err := h.metrics.Emit(r); err != nil {
+		slog.Error("failed emitting metrics", "error", err)
+	}
+}
+
+// count is a count metric.
+func count(name string, n int) metrics.Metric {
+	return metrics.Metric{Name: name, Unit: metrics.Count, Value: float64(n)}
+}
+
+// flag is a count metric of 1 if set, 0 otherwise, so the metric has data
+// whether or not it happened.
+func flag(name string, set bool) metrics.Metric {
+	if set {
+		return count(name, 1)
+	}
+	return count(name, 0)
+}
+
+// emitEventMetrics emits the metrics of a delivered event: one record for
+// the event, one per delivery with its latency from the alarm's state
+// change, and one per destination suppressed by tag.
+func (h *Handler) emitEventMetrics(evt *cw.Event, action string, p *prepared, outcomes []Outcome, latencies []time.Duration) {
+	owner := h.OwnerFromTags(p.tags)
+	if owner == "" {
+		owner = noOwner
+	}
+	_, channelSource := h.slackChannel(p.tags)
+	failed := false
+	for _, o := range outcomes {
+		failed = failed || o.Err != nil
+	}
+	h.emit(metrics.Record{
+		Dimensions:    map[string]string{DimensionOwner: owner},
+		DimensionSets: [][]string{{}, {DimensionOwner}},
+		Metrics: []metrics.Metric{
+			count(MetricEventsProcessed, 1),
+			flag(MetricEventsFailed, failed),
+			flag(MetricGraphRenderFailures, p.graphFailed),
+			flag(MetricDefaultChannelFallbacks, channelSource == defaultChannelSource),
+			flag(MetricDefaultRoutingKeyFallbacks, p.defaultRoutingKey),
+		},
+	})
+
+	deliveryRecord := func(destination string, ms ...metrics.Metric) metrics.Record {
+		return metrics.Record{
+			Dimensions:    map[string]string{DimensionDestination: destination, DimensionOwner: owner},
+			DimensionSets: [][]string{{DimensionDestination}, {DimensionDestination, DimensionOwner}},
+			Metrics:       ms,
+		}
+	}
+	for i, o := range outcomes {
+		delivered := o.Err == nil && !o.Skipped
+		r := deliveryRecord(o.Destination,
+			flag(MetricDeliveries, delivered),
+			flag(MetricDeliveryFailures, o.Err != nil),
+			flag(MetricDeliveriesSkipped, o.Skipped))
+		if delivered {
+			r.Metrics = append(r.Metrics, metrics.Metric{
+				Name: MetricDeliveryLatency, Unit: metrics.Milliseconds, Value: float64(latencies[i].Milliseconds()),
+			})
+		}
+		h.emit(r)
+	}
+	for _, destination := range h.suppressed(p.tags, action) {
+		h.emit(deliveryRecord(destination, count(MetricSuppressed, 1)))
+	}
+}
+
+// suppressed returns the destinations the alarm's tags suppress for the
+// action, as deliveries applies them.
+func (h *Handler) suppressed(tags map[string]string, action string) []string {
+	var ds []string
+	if tags[SuppressPagerDutyTagKey] == "true" {
+		ds = append(ds, DestinationPagerDuty)
+	}
+	if h.cfg.IncidentManagerEnabled && tags[SuppressIncidentManagerTagKey] == "true" {
+		ds = append(ds, DestinationIncidentManager)
+	}
+	if h.sn != nil && action == pagerduty.ActionTrigger && tags[SuppressServiceNowTagKey] == "true" {
+		ds = append(ds, DestinationServiceNow)
+	}
+	return ds
+}
+
+// emitBatchMetrics emits the number of records in a batch and of those
+// reported as failed: with partial batch responses the invocation itself
+// never fails, so Lambda's error metrics don't show them.
+func (h *Handler) emitBatchMetrics(records, failed int) {
+	h.emit(metrics.Record{Metrics: []metrics.Metric{
+		count(MetricRecords, records),
+		count(MetricRecordsFailed, failed),
+	}})
+}
@@ -0,0 +1,254 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+)
+
+// Preflight check names.
+const (
+	PreflightSlackToken     = "slack_token"
+	PreflightSlackChannel   = "slack_default_channel"
+	PreflightPagerDutyKey   = "pagerduty_routing_key"
+	PreflightCloudWatch     = "cloudwatch"
+	PreflightParameterStore = "parameter_store"
+	PreflightImageBucket    = "s3_image_bucket"
+)
+
+// Status is the result of a preflight check.
+type Status string
+
+// Preflight check statuses. Only failures fail the preflight; warnings are
+// problems that may be intended, or couldn't be checked.
+const (
+	StatusPass Status = "pass"
+	StatusWarn Status = "warn"
+	StatusFail Status = "fail"
+	StatusSkip Status = "skip"
+)
+
+// preflightName is the made-up alarm and service name preflight looks up to
+// check permissions without touching real ones.
+const preflightName = "cw-alert-router-preflight"
+
+// routingKeyPattern is the format of PagerDuty Events API v2 integration
+// keys.
+var routingKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9]{32}$`)
+
+// STSAPI is the STS call preflight uses to find the router's account.
+type STSAPI interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+// WithSTSAPI allows overriding the STS client preflight uses.
+func WithSTSAPI(api STSAPI) Option {
+	return func(h *Handler) { h.sts = api }
+}
+
+// PreflightCheck is the result of one preflight check.
+type PreflightCheck struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// PreflightReport is the result of all preflight checks.
+type PreflightReport struct {
+	Checks []PreflightCheck `json:"checks"`
+}
+
+// OK reports whether no check failed.
+func (r *PreflightReport) OK() bool {
+	return !slices.ContainsFunc(r.Checks, func(c PreflightCheck) bool { return c.Status == StatusFail })
+}
+
+// Summary counts the checks by status, e.g. "5 passed, 1 warned, 0 failed,
+// 1 skipped".
+func (r *PreflightReport) Summary() string {
+	counts := map[Status]int{}
+	for _, c := range r.Checks {
+		counts[c.Status]++
+	}
+	return fmt.Sprintf("%d passed, %d warned, %d failed, %d skipped",
+		counts[StatusPass], counts[StatusWarn], counts[StatusFail], counts[StatusSkip])
+}
+
+func (r *PreflightReport) add(name string, status Status, format string, args ...any) {
+	r.Checks = append(r.Checks, PreflightCheck{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Preflight checks what New can't without messages flowing: the Slack token
+// and its scopes, that the bot can post to the default channel, the default
+// PagerDuty routing key's format, and the CloudWatch, Parameter Store and
+// image bucket permissions. Nothing is sent anywhere; in s3 graph mode a
+// small object is written to the image bucket.
+func (h *Handler) Preflight(ctx context.Context) *PreflightReport {
+	r := &PreflightReport{}
+	h.preflightSlack(ctx, r)
+	if routingKeyPattern.MatchString(h.cfg.DefaultPagerDutyRoutingKey) {
+		r.add(PreflightPagerDutyKey, StatusPass, "default routing key %s is well-formed", mask(h.cfg.DefaultPagerDutyRoutingKey))
+	} else {
+		r.add(PreflightPagerDutyKey, StatusFail, "default routing key %s isn't a 32 character integration key (%s)", mask(h.cfg.DefaultPagerDutyRoutingKey), DefaultPagerDutyRoutingKeyEnv)
+	}
+	h.preflightCloudWatch(ctx, r)
+
+	if _, _, err := h.lookupNamedParameter(ctx, h.cfg.PagerDutyRoutingKeySSMPattern, preflightName, ""); err != nil {
+		r.add(PreflightParameterStore, StatusFail, "can't read routing keys: %v", err)
+	} else {
+		r.add(PreflightParameterStore, StatusPass, "can read routing keys (%s)", h.cfg.PagerDutyRoutingKeySSMPattern)
+	}
+
+	h.preflightImageBucket(ctx, r)
+	return r
+}
+
+// preflightSlack checks the token and its scopes, and that the bot can post
+// to the default channel.
+func (h *Handler) preflightSlack(ctx context.Context, r *PreflightReport) {
+	id, err := h.sl.AuthTest(ctx)
+	if err != nil {
+		r.add(PreflightSlackToken, StatusFail, "%v", err)
+		r.add(PreflightSlackChannel, StatusSkip, "the slack token doesn't work")
+		return
+	}
+	required := []string{"chat:write"}
+	if h.cfg.GraphMode == GraphModeSlack {
+		required = append(required, "files:write")
+	}
+	var missing []string
+	for _, scope := range required {
+		if !slices.Contains(id.Scopes, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	switch {
+	case len(missing) > 0:
+		r.add(PreflightSlackToken, StatusFail, "authenticated as %s in %s, missing scopes %s", id.User, id.Team, strings.Join(missing, ", "))
+	case !slices.Contains(id.Scopes, "chat:write.public"):
+		r.add(PreflightSlackToken, StatusWarn, "authenticated as %s in %s, without chat:write.public the bot only posts to channels it's a member of", id.User, id.Team)
+	default:
+		r.add(PreflightSlackToken, StatusPass, "authenticated as %s in %s", id.User, id.Team)
+	}
+
+	name := strings.TrimPrefix(h.cfg.DefaultSlackChannel, "#")
+	if !slices.Contains(id.Scopes, "channels:read") {
+		r.add(PreflightSlackChannel, StatusWarn, "can't check channel %s without the channels:read scope", name)
+		return
+	}
+	channels, err := h.sl.Channels(ctx)
+	if err != nil {
+		r.add(PreflightSlackChannel, StatusWarn, "can't check channel %s: %v", name, err)
+		return
+	}
+	ch, ok := channels[name]
+	switch {
+	case !ok:
+		r.add(PreflightSlackChannel, StatusFail, "channel %s doesn't exist, or is private and the bot isn't a member", name)
+	case ch.Private && !ch.Member:
+		r.add(PreflightSlackChannel, StatusFail, "the bot isn't a member of the private channel %s", name)
+	case !ch.Member && !slices.Contains(id.Scopes, "chat:write.public"):
+		r.add(PreflightSlackChannel, StatusFail, "the bot isn't a member of channel %s, and can't post to it without chat:write.public", name)
+	default:
+		r.add(PreflightSlackChannel, StatusPass, "the bot can post to channel %s (%s)", name, ch.ID)
+	}
+}
+
+// preflightCloudWatch checks that alarm tags can be read, by reading those
+// of a made-up alarm in the router's account: it's only not found with the
+// permission.
+func (h *Handler) preflightCloudWatch(ctx context.Context, r *PreflightReport) {
+	api, region := h.sts, ""
+	if api == nil {
+		awscfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			r.add(PreflightCloudWatch, StatusFail, "loading aws config: %v", err)
+			return
+		}
+		api, region = sts.NewFromConfig(awscfg), awscfg.Region
+	}
+	id, err := api.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		r.add(PreflightCloudWatch, StatusFail, "finding the account: %v", err)
+		return
+	}
+	alarmARN := fmt.Sprintf("arn:aws:cloudwatch:%s:%s:alarm:%s", region, *id.Account, preflightName)
+	if _, err := h.cw.AlarmTags(ctx, alarmARN); err != nil && !cw.IsNotFound(err) {
+		r.add(PreflightCloudWatch, StatusFail, "can't read alarm tags: %v", err)
+		return
+	}
+	r.add(PreflightCloudWatch, StatusPass, "can read alarm tags in account %s", *id.Account)
+}
+
+// preflightImageBucket writes a small object to the image bucket in s3 graph
+// mode, and presigns it unless graphs are served from an image host.
+func (h *Handler) preflightImageBucket(ctx context.Context, r *PreflightReport) {
+	if h.cfg.GraphMode != GraphModeS3 {
+		r.add(PreflightImageBucket, StatusSkip, "graph mode is %s", h.cfg.GraphMode)
+		return
+	}
+	key := preflightName + ".txt"
+	if prefix := strings.Trim(h.cfg.ImageBucketPrefix, "/"); prefix != "" {
+		key = prefix + "/" + key
+	}
+	if err := h.s3.WriteBytes(ctx, h.cfg.ImageBucket, key, strings.NewReader("written by the alert router's preflight check\n")); err != nil {
+		r.add(PreflightImageBucket, StatusFail, "%v", err)
+		return
+	}
+	if h.cfg.ImageHost == "" {
+		if _, err := h.s3.PresignedURL(ctx, h.cfg.ImageBucket, key, presignTTL); err != nil {
+			r.add(PreflightImageBucket, StatusFail, "%v", err)
+			return
+		}
+	}
+	r.add(PreflightImageBucket, StatusPass, "wrote s3://%s/%s", h.cfg.ImageBucket, key)
+}
+
+// LogPreflight runs the preflight checks, within DefaultPreflightTimeout,
+// and logs their results and a summary. Failures are only logged: the
+// router still starts, and keeps retrying what fails.
+func (h *Handler) LogPreflight(ctx context.Context) *PreflightReport {
+	ctx, cancel := context.WithTimeout(ctx, DefaultPreflightTimeout)
+	defer cancel()
+	r := h.Preflight(ctx)
+	for _, c := range r.Checks {
+		level := slog.LevelInfo
+		switch c.Status {
+		case StatusWarn:
+			level = slog.LevelWarn
+		case StatusFail:
+			level = slog.LevelError
+		case StatusSkip:
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "preflight check", "check", c.Name, "status", c.Status, "detail", c.Detail)
+	}
+	if r.OK() {
+		slog.Info("preflight passed", "summary", r.Summary())
+	} else {
+		slog.Error("preflight failed", "summary", r.Summary())
+	}
+	return r
+}
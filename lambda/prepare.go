@@ -0,0 +1,114 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+)
+
+// prepared is what routing and delivering an event needs to look up first.
+type prepared struct {
+	tags map[string]string
+	// png is the rendered alarm graph, nil if disabled or rendering failed
+	png         []byte
+	graphFailed bool
+	// routingKey is the PagerDuty routing key, unless PagerDuty is
+	// suppressed; routingKeyErr only fails the PagerDuty delivery.
+	// defaultRoutingKey is set when the service has no key of its own.
+	routingKey        string
+	routingKeyErr     error
+	defaultRoutingKey bool
+
+	timings timings
+}
+
+// timings is how long each step of processing an event took.
+type timings struct {
+	tags, graph, routingKey, deliver time.Duration
+}
+
+// logAttrs returns the timings as log attributes, in milliseconds.
+func (t timings) logAttrs() []any {
+	return []any{
+		"tags_ms", t.tags.Milliseconds(),
+		"graph_ms", t.graph.Milliseconds(),
+		"routing_key_ms", t.routingKey.Milliseconds(),
+		"deliver_ms", t.deliver.Milliseconds(),
+	}
+}
+
+// prepare fetches the alarm's tags and renders its graph concurrently,
+// resolving the PagerDuty routing key as soon as the tags are in. Failing to
+// fetch the tags fails the event and cancels the rendering; a failed
+// rendering only loses the graph. The graph is skipped when low on time.
+func (h *Handler) prepare(ctx context.Context, evt *cw.Event, alarmARN string) (*prepared, error) {
+	p := &prepared{}
+	g, gctx := errgroup.WithContext(ctx)
+
+	if h.cfg.GraphMode != GraphModeNone && h.lowOnTime(ctx) {
+		slog.Warn("low on time, skipping alarm graph", "alarm", evt.Detail.AlarmName)
+	} else if h.cfg.GraphMode != GraphModeNone {
+		g.Go(func() error {
+			start := time.Now()
+			p.png = h.renderGraph(gctx, evt)
+			p.graphFailed = p.png == nil
+			p.timings.graph = time.Since(start)
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		start := time.Now()
+		tags, err := h.alarmTags(gctx, alarmARN)
+		p.timings.tags = time.Since(start)
+		if err != nil {
+			return fmt.Errorf("fetching alarm tags: %w", err)
+		}
+		p.tags = tags
+
+		if tags[SuppressPagerDutyTagKey] == "true" {
+			return nil
+		}
+		start = time.Now()
+		var key string
+		p.routingKey, key, p.routingKeyErr = h.lookupNamedParameter(gctx, h.cfg.PagerDutyRoutingKeySSMPattern, h.ServiceNameFromTags(tags), h.cfg.DefaultPagerDutyRoutingKey)
+		p.defaultRoutingKey = p.routingKeyErr == nil && key == ""
+		p.timings.routingKey = time.Since(start)
+		return nil
+	})
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// renderGraph renders the alarm graph. Failures are logged, not returned - a
+// missing graph should never block an alert.
+func (h *Handler) renderGraph(ctx context.Context, evt *cw.Event) []byte {
+	png, err := h.cw.AlarmWidgetImage(ctx, evt, evt.StateChangeTime(), cw.DefaultGraphWindow)
+	if err != nil {
+		slog.Error("failed rendering alarm graph", "alarm", evt.Detail.AlarmName, "error", err)
+		return nil
+	}
+	return png
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	awsevents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/quarantine"
+)
+
+// quarantinePrefix is the key prefix of records quarantined in S3.
+const quarantinePrefix = "quarantine"
+
+var (
+	// ErrMalformed marks records that can't be decoded as alarm events, and
+	// never will be however often they're retried.
+	ErrMalformed = errors.New("malformed alarm event")
+	// ErrUntrusted marks alarm events that didn't come from CloudWatch in an
+	// allowed account and region; they're never delivered.
+	ErrUntrusted = errors.New("untrusted alarm event")
+)
+
+// quarantinable reports whether a record failing with err should be
+// quarantined rather than retried.
+func quarantinable(err error) bool {
+	return errors.Is(err, ErrMalformed) || errors.Is(err, ErrUntrusted)
+}
+
+// authenticate checks that the event came from CloudWatch (see
+// cw.Event.Verify) in an allowed account and region. Classic notifications
+// carry their account in the body, so they must also come from an allowed
+// topic.
+func (h *Handler) authenticate(evt *cw.Event) error {
+	if err := evt.Verify(); err != nil {
+		return fmt.Errorf("%w: %w", ErrUntrusted, err)
+	}
+	if evt.Classic {
+		if err := h.authenticateTopic(evt.TopicARN); err != nil {
+			return fmt.Errorf("%w: %w", ErrUntrusted, err)
+		}
+	}
+	if len(h.cfg.AllowedAccounts) > 0 && !slices.Contains(h.cfg.AllowedAccounts, evt.Account) {
+		return fmt.Errorf("%w: account %s isn't allowed", ErrUntrusted, evt.Account)
+	}
+	if len(h.cfg.AllowedRegions) > 0 && !slices.Contains(h.cfg.AllowedRegions, evt.Region) {
+		return fmt.Errorf("%w: region %s isn't allowed", ErrUntrusted, evt.Region)
+	}
+	return nil
+}
+
+// authenticateTopic checks that a classic notification was published to an
+// allowed topic: one of AllowedTopicARNs or, without those, a topic in one
+// of AllowedAccounts. Without either any topic is allowed, as is none.
+func (h *Handler) authenticateTopic(topicARN string) error {
+	if len(h.cfg.AllowedTopicARNs) == 0 && len(h.cfg.AllowedAccounts) == 0 {
+		return nil
+	}
+	if topicARN == "" {
+		return errors.New("classic notification without an sns topic")
+	}
+	if len(h.cfg.AllowedTopicARNs) > 0 {
+		if !slices.Contains(h.cfg.AllowedTopicARNs, topicARN) {
+			return fmt.Errorf("topic %s isn't allowed", topicARN)
+		}
+		return nil
+	}
+	topic, err := arn.Parse(topicARN)
+	if err != nil {
+		return fmt.Errorf("parsing topic arn: %w", err)
+	}
+	if !slices.Contains(h.cfg.AllowedAccounts, topic.AccountID) {
+		return fmt.Errorf("topic %s isn't in an allowed account", topicARN)
+	}
+	return nil
+}
+
+// quarantineRecord stores a rejected record (an SQS message, or the payload
+// of an asynchronous invocation) in the quarantine and notices the default
+// Slack channel, so the record can be dropped. It reports whether the record
+// was quarantined; without a quarantine configured it's left to be retried
+// into the dead-letter queue.
+func (h *Handler) quarantineRecord(ctx context.Context, msg awsevents.SQSMessage, reason error) bool {
+	if h.quarantine == nil {
+		return false
+	}
+	location, err := h.quarantine.Put(ctx, quarantine.Record{
+		MessageID:     msg.MessageId,
+		Body:          msg.Body,
+		Error:         reason.Error(),
+		QuarantinedAt: time.Now(),
+	})
+	if err != nil {
+		slog.Error("failed quarantining record", "message_id", msg.MessageId, "error", err)
+		return false
+	}
+	slog.Warn("quarantined record", "message_id", msg.MessageId, "location", location, "reason", reason)
+
+	if _, _, err := h.sl.SendQuarantined(ctx, h.cfg.DefaultSlackChannel, msg.MessageId, location, reason); err != nil {
+		slog.Error("failed sending quarantine notice", "message_id", msg.MessageId, "error", err)
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+)
+
+// Override redirects deliveries somewhere harmless, e.g. to replay archived
+// events against a routing change.
+type Override struct {
+	// SlackChannel replaces every alarm's Slack channel, and the PagerDuty
+	// fallback channel.
+	SlackChannel string
+	// PagerDutyRoutingKey replaces every service's routing key. Empty drops
+	// PagerDuty deliveries.
+	PagerDutyRoutingKey string
+}
+
+// WithDestinationOverride sends every event to the override's destinations
+// only: its Slack channel, and PagerDuty with its routing key if it has one.
+// Every other destination is dropped.
+func WithDestinationOverride(o Override) Option {
+	return func(h *Handler) { h.override = &o }
+}
+
+// overridden redirects an event's deliveries with the destination override.
+// Slack deliveries already use the override's channel (see SlackChannel).
+func (h *Handler) overridden(ds []delivery, serviceName, action string, evt *cw.Event) []delivery {
+	var out []delivery
+	for _, d := range ds {
+		switch d.destination {
+		case DestinationSlack:
+			out = append(out, d)
+		case DestinationPagerDuty:
+			if h.override.PagerDutyRoutingKey == "" {
+				slog.Info("dropping overridden delivery", "alarm", evt.Detail.AlarmName, "destination", d.destination)
+				continue
+			}
+			out = append(out, delivery{DestinationPagerDuty, func(ctx context.Context) error {
+				return h.submitPagerDuty(ctx, serviceName, h.override.PagerDutyRoutingKey, nil, action, evt)
+			}})
+		default:
+			slog.Info("dropping overridden delivery", "alarm", evt.Detail.AlarmName, "destination", d.destination)
+		}
+	}
+	return out
+}
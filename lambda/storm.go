@@ -0,0 +1,161 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lambda
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	awsevents "github.com/aws/aws-lambda-go/events"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/ledger"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+)
+
+// tagCacheKey is the context key of the batch's tagCache.
+type tagCacheKey struct{}
+
+// tagCache remembers alarm tags for the duration of one batch, so alarms
+// looked at more than once (storm grouping, then delivery) are only fetched
+// once.
+type tagCache struct {
+	mu   sync.Mutex
+	tags map[string]map[string]string
+}
+
+func withTagCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tagCacheKey{}, &tagCache{tags: make(map[string]map[string]string)})
+}
+
+// alarmTags returns the alarm's tags, from the batch's cache if possible.
+func (h *Handler) alarmTags(ctx context.Context, alarmARN string) (map[string]string, error) {
+	cache, _ := ctx.Value(tagCacheKey{}).(*tagCache)
+	if cache != nil {
+		cache.mu.Lock()
+		tags, ok := cache.tags[alarmARN]
+		cache.mu.Unlock()
+		if ok {
+			return tags, nil
+		}
+	}
+	tags, err := h.cw.AlarmTags(ctx, alarmARN)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		cache.mu.Lock()
+		cache.tags[alarmARN] = tags
+		cache.mu.Unlock()
+	}
+	return tags, nil
+}
+
+// storm is the triggers going to one Slack channel within a batch.
+type storm struct {
+	channel string
+	evts    []*cw.Event
+}
+
+// groupStorms posts one summary Slack message per channel receiving at
+// least StormThreshold triggers in the batch, instead of a message per
+// alarm. The grouped alarms' Slack deliveries are recorded in the ledger, so
+// processing the records afterwards skips Slack and only delivers the other
+// destinations (PagerDuty events stay individual). Flapping alarms keep
+// their own collapsed message. Anything going wrong here falls back to
+// individual messages.
+func (h *Handler) groupStorms(ctx context.Context, records []awsevents.SQSMessage) {
+	if h.cfg.StormThreshold <= 0 || len(records) < h.cfg.StormThreshold {
+		return
+	}
+
+	var storms []*storm
+	byChannel := make(map[string]*storm)
+	for _, msg := range records {
+		evt, err := cw.DecodeEvent([]byte(msg.Body))
+		if err != nil {
+			continue
+		}
+		// untrusted events are rejected (counted and quarantined) when
+		// their record is processed, and never make it into a summary
+		if err := h.authenticate(evt); err != nil {
+			continue
+		}
+		if pagerduty.Action(evt.Detail.PreviousState.Value, evt.Detail.State.Value) != pagerduty.ActionTrigger {
+			continue
+		}
+		alarmARN, err := evt.AlarmARN()
+		if err != nil {
+			continue
+		}
+		tags, err := h.alarmTags(ctx, alarmARN)
+		if err != nil {
+			slog.Warn("failed fetching alarm tags for grouping", "alarm", evt.Detail.AlarmName, "error", err)
+			continue
+		}
+		if h.flapTracked(ctx, tags, evt) {
+			continue
+		}
+		channel := h.SlackChannel(tags)
+		s, ok := byChannel[channel]
+		if !ok {
+			s = &storm{channel: channel}
+			byChannel[channel] = s
+			storms = append(storms, s)
+		}
+		s.evts = append(s.evts, evt)
+	}
+
+	for _, s := range storms {
+		if len(s.evts) >= h.cfg.StormThreshold {
+			h.sendStorm(ctx, s)
+		}
+	}
+}
+
+// sendStorm claims the Slack deliveries of the storm's alarms and posts
+// the summary. Alarms already posted (a redelivered batch) are left out.
+func (h *Handler) sendStorm(ctx context.Context, s *storm) {
+	var claimed []*cw.Event
+	for _, evt := range s.evts {
+		claim, err := h.ledger.Claim(ctx, evt.ID, DestinationSlack)
+		if err != nil {
+			slog.Error("failed claiming delivery, grouping anyway", "event_id", evt.ID, "destination", DestinationSlack, "error", err)
+			claim = ledger.Claimed
+		}
+		if claim == ledger.Claimed {
+			claimed = append(claimed, evt)
+		}
+	}
+	settle := func(delivered bool) {
+		for _, evt := range claimed {
+			h.settle(ctx, evt.ID, DestinationSlack, delivered)
+		}
+	}
+	if len(claimed) < h.cfg.StormThreshold {
+		settle(false)
+		return
+	}
+
+	channelID, ts, err := h.sl.SendStorm(ctx, s.channel, claimed)
+	if err != nil {
+		slog.Error("failed sending storm summary, sending individual messages", "channel", s.channel, "alarms", len(claimed), "error", err)
+		settle(false)
+		return
+	}
+	slog.Info("sent storm summary", "channel_id", channelID, "timestamp", ts, "alarms", len(claimed))
+	settle(true)
+}
@@ -0,0 +1,155 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDB table attribute names. The table's partition key is
+// AttrEventID and its sort key AttrDestination (both strings); TTL must be
+// enabled on AttrExpiresAt.
+const (
+	AttrEventID     = "event_id"
+	AttrDestination = "destination"
+	AttrStatus      = "status"
+	AttrLeaseUntil  = "lease_until"
+	AttrExpiresAt   = "expires_at"
+)
+
+// API is the subset of the DynamoDB API this service uses.
+type API interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+// DynamoDB is a Ledger backed by a DynamoDB table, using conditional writes
+// so concurrent attempts can't both claim a delivery.
+type DynamoDB struct {
+	api   API
+	table string
+	opts  options
+}
+
+// NewDynamoDB returns a DynamoDB ledger backed by the real DynamoDB API.
+func NewDynamoDB(cfg aws.Config, table string, opts ...Option) *DynamoDB {
+	return NewDynamoDBWithAPI(dynamodb.NewFromConfig(cfg), table, opts...)
+}
+
+// NewDynamoDBWithAPI returns a DynamoDB ledger backed by the given API
+// implementation (for testing).
+func NewDynamoDBWithAPI(api API, table string, opts ...Option) *DynamoDB {
+	return &DynamoDB{api: api, table: table, opts: newOptions(opts)}
+}
+
+func itemKey(eventID, destination string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		AttrEventID:     &types.AttributeValueMemberS{Value: eventID},
+		AttrDestination: &types.AttributeValueMemberS{Value: destination},
+	}
+}
+
+func unixValue(sec int64) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(sec, 10)}
+}
+
+// Claim implements Ledger. The claim succeeds if there is no entry, or only
+// a claim whose lease has expired (an attempt that died mid-delivery).
+// Expired entries TTL hasn't removed yet are treated as absent.
+func (d *DynamoDB) Claim(ctx context.Context, eventID, destination string) (ClaimResult, error) {
+	now := d.opts.now()
+	item := itemKey(eventID, destination)
+	item[AttrStatus] = &types.AttributeValueMemberS{Value: statusClaimed}
+	item[AttrLeaseUntil] = unixValue(now.Add(d.opts.lease).Unix())
+	item[AttrExpiresAt] = unixValue(now.Add(d.opts.ttl).Unix())
+
+	_, err := d.api.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item:      item,
+		ConditionExpression: aws.String("attribute_not_exists(#id) OR #expires <= :now OR " +
+			"(#status = :claimed AND #lease <= :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#id":      AttrEventID,
+			"#status":  AttrStatus,
+			"#lease":   AttrLeaseUntil,
+			"#expires": AttrExpiresAt,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":     unixValue(now.Unix()),
+			":claimed": &types.AttributeValueMemberS{Value: statusClaimed},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var ccf *types.ConditionalCheckFailedException
+	switch {
+	case err == nil:
+		return Claimed, nil
+	case errors.As(err, &ccf):
+		if status, ok := ccf.Item[AttrStatus].(*types.AttributeValueMemberS); ok && status.Value == statusDelivered {
+			return AlreadyDelivered, nil
+		}
+		return InFlight, nil
+	default:
+		return Claimed, fmt.Errorf("claiming delivery in %s: %w", d.table, err)
+	}
+}
+
+// Complete implements Ledger.
+func (d *DynamoDB) Complete(ctx context.Context, eventID, destination string) error {
+	_, err := d.api.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(d.table),
+		Key:              itemKey(eventID, destination),
+		UpdateExpression: aws.String("SET #status = :delivered, #expires = :expires REMOVE #lease"),
+		ExpressionAttributeNames: map[string]string{
+			"#status":  AttrStatus,
+			"#lease":   AttrLeaseUntil,
+			"#expires": AttrExpiresAt,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":delivered": &types.AttributeValueMemberS{Value: statusDelivered},
+			":expires":   unixValue(d.opts.now().Add(d.opts.ttl).Unix()),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("completing delivery in %s: %w", d.table, err)
+	}
+	return nil
+}
+
+// Release implements Ledger. Only claims are removed, never deliveries.
+func (d *DynamoDB) Release(ctx context.Context, eventID, destination string) error {
+	_, err := d.api.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(d.table),
+		Key:                      itemKey(eventID, destination),
+		ConditionExpression:      aws.String("#status = :claimed"),
+		ExpressionAttributeNames: map[string]string{"#status": AttrStatus},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":claimed": &types.AttributeValueMemberS{Value: statusClaimed},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &ccf) {
+		return fmt.Errorf("releasing delivery in %s: %w", d.table, err)
+	}
+	return nil
+}
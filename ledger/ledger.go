@@ -0,0 +1,190 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ledger records which destinations each event was delivered to, so
+// redelivered events are only sent to the destinations still missing.
+package ledger
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTTL is how long delivery entries are kept.
+	DefaultTTL = 24 * time.Hour
+	// DefaultLease is how long a claim blocks other attempts at the same
+	// delivery. It must exceed the time one delivery can take (the lambda
+	// timeout), or a slow attempt may be duplicated.
+	DefaultLease = 5 * time.Minute
+)
+
+// ClaimResult is the outcome of claiming a delivery.
+type ClaimResult int
+
+const (
+	// Claimed means the caller holds the delivery and should perform it,
+	// then Complete or Release it.
+	Claimed ClaimResult = iota
+	// AlreadyDelivered means an earlier attempt completed the delivery.
+	AlreadyDelivered
+	// InFlight means another attempt holds an unexpired claim; the caller
+	// should retry later.
+	InFlight
+)
+
+func (r ClaimResult) String() string {
+	switch r {
+	case Claimed:
+		return "claimed"
+	case AlreadyDelivered:
+		return "already_delivered"
+	case InFlight:
+		return "in_flight"
+	}
+	return "unknown"
+}
+
+// Ledger records deliveries of events (by EventBridge event ID) to
+// destinations.
+type Ledger interface {
+	// Claim reserves the delivery of an event to a destination.
+	Claim(ctx context.Context, eventID, destination string) (ClaimResult, error)
+	// Complete marks a claimed delivery as delivered.
+	Complete(ctx context.Context, eventID, destination string) error
+	// Release drops a claim after a failed delivery, so it's retried.
+	Release(ctx context.Context, eventID, destination string) error
+}
+
+// Item statuses.
+const (
+	statusClaimed   = "claimed"
+	statusDelivered = "delivered"
+)
+
+// Option configures a ledger.
+type Option func(*options)
+
+type options struct {
+	ttl   time.Duration
+	lease time.Duration
+	now   func() time.Time
+}
+
+func newOptions(opts []Option) options {
+	o := options{ttl: DefaultTTL, lease: DefaultLease, now: time.Now}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithTTL overrides how long delivery entries are kept.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		if ttl > 0 {
+			o.ttl = ttl
+		}
+	}
+}
+
+// WithLease overrides how long a claim blocks other attempts.
+func WithLease(lease time.Duration) Option {
+	return func(o *options) {
+		if lease > 0 {
+			o.lease = lease
+		}
+	}
+}
+
+// WithClock overrides the time source (for testing).
+func WithClock(now func() time.Time) Option {
+	return func(o *options) { o.now = now }
+}
+
+// Memory is an in-process Ledger. It only deduplicates within one process
+// (one warm lambda container), so it's meant for tests and deployments
+// without a ledger table.
+type Memory struct {
+	opts options
+
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	status     string
+	leaseUntil time.Time
+	expiresAt  time.Time
+}
+
+// NewMemory returns an empty in-memory Ledger.
+func NewMemory(opts ...Option) *Memory {
+	return &Memory{opts: newOptions(opts), entries: make(map[string]memoryEntry)}
+}
+
+func memoryKey(eventID, destination string) string {
+	return eventID + "/" + destination
+}
+
+// Claim implements Ledger.
+func (m *Memory) Claim(ctx context.Context, eventID, destination string) (ClaimResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.opts.now()
+	for k, e := range m.entries {
+		if !now.Before(e.expiresAt) {
+			delete(m.entries, k)
+		}
+	}
+
+	key := memoryKey(eventID, destination)
+	if e, ok := m.entries[key]; ok {
+		if e.status == statusDelivered {
+			return AlreadyDelivered, nil
+		}
+		if now.Before(e.leaseUntil) {
+			return InFlight, nil
+		}
+	}
+	m.entries[key] = memoryEntry{
+		status:     statusClaimed,
+		leaseUntil: now.Add(m.opts.lease),
+		expiresAt:  now.Add(m.opts.ttl),
+	}
+	return Claimed, nil
+}
+
+// Complete implements Ledger.
+func (m *Memory) Complete(ctx context.Context, eventID, destination string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[memoryKey(eventID, destination)] = memoryEntry{
+		status:    statusDelivered,
+		expiresAt: m.opts.now().Add(m.opts.ttl),
+	}
+	return nil
+}
+
+// Release implements Ledger.
+func (m *Memory) Release(ctx context.Context, eventID, destination string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memoryKey(eventID, destination)
+	if e, ok := m.entries[key]; ok && e.status == statusClaimed {
+		delete(m.entries, key)
+	}
+	return nil
+}
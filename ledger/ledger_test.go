@@ -0,0 +1,101 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ledger_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/ledger"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+// clock is a settable time source.
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time { return c.now }
+
+func ledgers(c *clock) map[string]ledger.Ledger {
+	opts := []ledger.Option{ledger.WithClock(c.Now), ledger.WithLease(time.Minute), ledger.WithTTL(time.Hour)}
+	return map[string]ledger.Ledger{
+		"memory":   ledger.NewMemory(opts...),
+		"dynamodb": ledger.NewDynamoDBWithAPI(&test.MockDynamoDBAPI{}, "deliveries", opts...),
+	}
+}
+
+func claim(t *testing.T, l ledger.Ledger, eventID, destination string, want ledger.ClaimResult) {
+	t.Helper()
+	got, err := l.Claim(context.Background(), eventID, destination)
+	if err != nil {
+		t.Fatalf("Claim(%s, %s) returned error: %v", eventID, destination, err)
+	}
+	if got != want {
+		t.Errorf("Claim(%s, %s) = %s, want %s", eventID, destination, got, want)
+	}
+}
+
+func TestClaimCompleteRelease(t *testing.T) {
+	c := &clock{now: time.Date(2020, 7, 31, 6, 56, 5, 0, time.UTC)}
+	for name, l := range ledgers(c) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			claim(t, l, "evt-1", "slack", ledger.Claimed)
+			claim(t, l, "evt-1", "slack", ledger.InFlight)
+			// destinations are independent
+			claim(t, l, "evt-1", "pagerduty", ledger.Claimed)
+
+			if err := l.Complete(ctx, "evt-1", "slack"); err != nil {
+				t.Fatalf("Complete returned error: %v", err)
+			}
+			claim(t, l, "evt-1", "slack", ledger.AlreadyDelivered)
+
+			// a released claim can be retried, a delivery can't be released
+			if err := l.Release(ctx, "evt-1", "pagerduty"); err != nil {
+				t.Fatalf("Release returned error: %v", err)
+			}
+			claim(t, l, "evt-1", "pagerduty", ledger.Claimed)
+			if err := l.Release(ctx, "evt-1", "slack"); err != nil {
+				t.Fatalf("Release returned error: %v", err)
+			}
+			claim(t, l, "evt-1", "slack", ledger.AlreadyDelivered)
+		})
+	}
+}
+
+func TestLeaseAndTTLExpiry(t *testing.T) {
+	c := &clock{now: time.Date(2020, 7, 31, 6, 56, 5, 0, time.UTC)}
+	for name, l := range ledgers(c) {
+		t.Run(name, func(t *testing.T) {
+			start := c.now
+			defer func() { c.now = start }()
+
+			claim(t, l, "evt-2", "slack", ledger.Claimed)
+			if err := l.Complete(context.Background(), "evt-2", "slack"); err != nil {
+				t.Fatalf("Complete returned error: %v", err)
+			}
+			claim(t, l, "evt-2", "pagerduty", ledger.Claimed)
+
+			// an attempt that died mid-delivery stops blocking once its lease expires
+			c.now = start.Add(2 * time.Minute)
+			claim(t, l, "evt-2", "pagerduty", ledger.Claimed)
+			claim(t, l, "evt-2", "slack", ledger.AlreadyDelivered)
+
+			// entries are forgotten after the TTL
+			c.now = start.Add(2 * time.Hour)
+			claim(t, l, "evt-2", "slack", ledger.Claimed)
+		})
+	}
+}
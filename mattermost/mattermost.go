@@ -0,0 +1,148 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mattermost sends alarm notifications to Mattermost via incoming
+// webhooks, as Slack-compatible message attachments.
+package mattermost
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/tidal-music/cw-alert-router/v2/message"
+)
+
+// Emoji prefixes and attachment colours per alarm state.
+const (
+	triggeredPrefix = ":rotating_light: (triggered)"
+	resolvedPrefix  = ":white_check_mark: (resolved)"
+	triggeredColor  = "#d00000"
+	resolvedColor   = "#2eb886"
+)
+
+// username is the display name messages are posted with (webhooks must
+// allow overriding it, otherwise the webhook's own name is used).
+const username = "cw-alert-router"
+
+// Client posts messages to Mattermost incoming webhooks.
+type Client struct {
+	httpClient *http.Client
+}
+
+// ClientOptions provides the function opts pattern for overriding.
+type ClientOptions func(*Client)
+
+// WithHTTPClient allows overriding the HTTP client (for testing).
+func WithHTTPClient(hc *http.Client) ClientOptions {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// New returns a new Client.
+func New(opts ...ClientOptions) (*Client, error) {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+	return c, nil
+}
+
+// Payload is a Mattermost incoming webhook body.
+type Payload struct {
+	Channel     string       `json:"channel,omitempty"`
+	Username    string       `json:"username,omitempty"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Attachment is a Slack-compatible message attachment.
+type Attachment struct {
+	Fallback  string  `json:"fallback"`
+	Color     string  `json:"color,omitempty"`
+	Title     string  `json:"title"`
+	TitleLink string  `json:"title_link,omitempty"`
+	Text      string  `json:"text,omitempty"`
+	Fields    []Field `json:"fields,omitempty"`
+	ImageURL  string  `json:"image_url,omitempty"`
+}
+
+// Field is an attachment field.
+type Field struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// BuildPayload renders the message as an incoming webhook payload. An empty
+// channel posts to the webhook's default channel.
+func BuildPayload(channel string, msg message.Message) Payload {
+	prefix, color := triggeredPrefix, triggeredColor
+	if msg.Resolved() {
+		prefix, color = resolvedPrefix, resolvedColor
+	}
+	title := fmt.Sprintf("%s %s", prefix, msg.Title())
+
+	fields := []Field{{Title: "Metrics", Value: fmt.Sprintf("`%s`", msg.MetricsText(" - "))}}
+	if msg.Reason != "" {
+		fields = append(fields, Field{Title: "Reason", Value: fmt.Sprintf("`%s`", msg.Reason)})
+	}
+	fields = append(fields, Field{Title: "Link", Value: fmt.Sprintf("[AWS Console](%s)", msg.ConsoleLink)})
+
+	return Payload{
+		Channel:  channel,
+		Username: username,
+		Attachments: []Attachment{{
+			Fallback:  title,
+			Color:     color,
+			Title:     title,
+			TitleLink: msg.ConsoleLink,
+			Text:      msg.Description,
+			Fields:    fields,
+			ImageURL:  msg.ImageURL,
+		}},
+	}
+}
+
+// SendMessage posts the message to the given incoming webhook URL.
+func (c *Client) SendMessage(ctx context.Context, webhookURL, channel string, msg message.Message) error {
+	body, err := json.Marshal(BuildPayload(channel, msg))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building mattermost request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	slog.Info("sending mattermost message", "alarm", msg.AlarmName, "channel", channel)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting mattermost message: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("posting mattermost message: status %d: %s", resp.StatusCode, detail)
+	}
+	return nil
+}
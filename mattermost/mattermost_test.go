@@ -0,0 +1,99 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mattermost_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tidal-music/cw-alert-router/v2/mattermost"
+	"github.com/tidal-music/cw-alert-router/v2/message"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+func TestBuildPayload(t *testing.T) {
+	msg := message.New(&test.TriggeredAlarmDetails, pagerduty.ActionTrigger)
+	payload := mattermost.BuildPayload("team-alarms", msg)
+
+	if payload.Channel != "team-alarms" {
+		t.Errorf("unexpected channel: %s", payload.Channel)
+	}
+	if len(payload.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(payload.Attachments))
+	}
+	att := payload.Attachments[0]
+	if !strings.Contains(att.Title, "(triggered) CloudWatch Alarm: test-service-alarm-abcd") {
+		t.Errorf("unexpected title: %s", att.Title)
+	}
+	got, _ := json.Marshal(att.Fields)
+	for _, want := range []string{"CPUUtilization", "Threshold Crossed", "AWS Console"} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("fields missing %q: %s", want, got)
+		}
+	}
+
+	resolved := mattermost.BuildPayload("", message.New(&test.TriggeredAlarmDetails, pagerduty.ActionResolve))
+	if !strings.Contains(resolved.Attachments[0].Title, "(resolved)") {
+		t.Errorf("resolved payload should have a resolved title: %s", resolved.Attachments[0].Title)
+	}
+	if resolved.Attachments[0].Color == att.Color {
+		t.Errorf("resolved and triggered attachments should differ in colour")
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	server := test.NewWebhookServer()
+	defer server.Close()
+
+	client, err := mattermost.New()
+	if err != nil {
+		t.Fatalf("failed creating mattermost client: %v", err)
+	}
+	msg := message.New(&test.TriggeredAlarmDetails, pagerduty.ActionTrigger)
+	if err := client.SendMessage(context.Background(), server.URL("/hooks/abc"), "", msg); err != nil {
+		t.Fatalf("failed sending message: %v", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 webhook request, got %d", len(requests))
+	}
+	var payload mattermost.Payload
+	if err := json.Unmarshal(requests[0].Body, &payload); err != nil {
+		t.Fatalf("posted body isn't a webhook payload: %v (%s)", err, requests[0].Body)
+	}
+	if payload.Channel != "" {
+		t.Errorf("empty channel should be omitted, got %q", payload.Channel)
+	}
+}
+
+func TestSendMessageError(t *testing.T) {
+	server := test.NewWebhookServer()
+	defer server.Close()
+	server.Status = http.StatusInternalServerError
+
+	client, err := mattermost.New()
+	if err != nil {
+		t.Fatalf("failed creating mattermost client: %v", err)
+	}
+	msg := message.New(&test.TriggeredAlarmDetails, pagerduty.ActionTrigger)
+	if err := client.SendMessage(context.Background(), server.URL("/hooks/abc"), "", msg); err == nil {
+		t.Errorf("expected an error for a non-2xx response")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package message is the destination-neutral content of an alarm
+// notification. Chat destinations (Slack, Google Chat, Mattermost) render
+// the same Message, so trigger and resolve notifications read alike
+// everywhere.
+package message
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+)
+
+// NoMetrics is the metrics text used when the alarm has no metrics
+// (e.g. composite alarms).
+const NoMetrics = "None found"
+
+// Message is an alarm notification, independent of where it is delivered.
+type Message struct {
+	// Action is the alarm transition: pagerduty.ActionTrigger or
+	// pagerduty.ActionResolve.
+	Action string
+
+	AlarmName   string
+	Description string
+
+	// Metrics holds one "<Label>: <values>" part per kind of metric detail
+	// (names, namespaces, dimensions, expressions); empty if none.
+	Metrics []string
+
+	// Reason is the CloudWatch state reason.
+	Reason string
+
+	// ConsoleLink links to the alarm in the AWS console.
+	ConsoleLink string
+
+	// ImageURL is a public URL of the alarm graph, if there is one.
+	ImageURL string
+}
+
+// New builds the message for an alarm state change event.
+func New(evt *cw.Event, action string) Message {
+	return Message{
+		Action:      action,
+		AlarmName:   evt.Detail.AlarmName,
+		Description: evt.Detail.Configuration.Description,
+		Metrics:     MetricParts(evt),
+		Reason:      evt.Detail.State.Reason,
+		ConsoleLink: evt.ConsoleLink(),
+	}
+}
+
+// MetricParts returns the alarm's metric summary as "<Label>: <values>"
+// parts, one per kind of metric detail present.
+func MetricParts(evt *cw.Event) []string {
+	summary := evt.MetricSummary()
+	var parts []string
+	if len(summary.Names) > 0 {
+		parts = append(parts, fmt.Sprintf("Names: %s", strings.Join(summary.Names, ",")))
+	}
+	if len(summary.Namespaces) > 0 {
+		parts = append(parts, fmt.Sprintf("Namespaces: %s", strings.Join(summary.Namespaces, ",")))
+	}
+	if len(summary.Dimensions) > 0 {
+		parts = append(parts, fmt.Sprintf("Dimensions: %s", strings.Join(summary.Dimensions, ",")))
+	}
+	if len(summary.Expressions) > 0 {
+		parts = append(parts, fmt.Sprintf("Expressions: %s", strings.Join(summary.Expressions, ",")))
+	}
+	return parts
+}
+
+// Resolved reports whether the message announces a resolved alarm.
+func (m Message) Resolved() bool {
+	return m.Action == pagerduty.ActionResolve
+}
+
+// StateLabel returns "triggered" or "resolved".
+func (m Message) StateLabel() string {
+	if m.Resolved() {
+		return "resolved"
+	}
+	return "triggered"
+}
+
+// Title returns the message title, without any state prefix.
+func (m Message) Title() string {
+	return fmt.Sprintf("CloudWatch Alarm: %s", m.AlarmName)
+}
+
+// MetricsText returns the metric parts joined with sep, or NoMetrics.
+func (m Message) MetricsText(sep string) string {
+	if len(m.Metrics) == 0 {
+		return NoMetrics
+	}
+	return strings.Join(m.Metrics, sep)
+}
+
+// Truncate shortens s to at most n bytes, for destinations that limit the
+// length of a title. It cuts on a rune boundary, so a multi-byte character
+// is never split.
+func Truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message_test
+
+import (
+	"testing"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/message"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+func TestNew(t *testing.T) {
+	msg := message.New(&test.TriggeredAlarmDetails, pagerduty.ActionTrigger)
+
+	if msg.Title() != "CloudWatch Alarm: test-service-alarm-abcd" {
+		t.Errorf("unexpected title: %s", msg.Title())
+	}
+	if msg.Resolved() || msg.StateLabel() != "triggered" {
+		t.Errorf("trigger message should not be resolved")
+	}
+	expected := "Names: CPUUtilization - Namespaces: AWS/EC2 - Dimensions: AutoScalingGroupName:test-service"
+	if got := msg.MetricsText(" - "); got != expected {
+		t.Errorf("metrics text (%s) didn't match expected (%s)", got, expected)
+	}
+	if msg.ConsoleLink != test.TriggeredAlarmDetails.ConsoleLink() {
+		t.Errorf("unexpected console link: %s", msg.ConsoleLink)
+	}
+
+	resolved := message.New(&test.TriggeredAlarmDetails, pagerduty.ActionResolve)
+	if !resolved.Resolved() || resolved.StateLabel() != "resolved" {
+		t.Errorf("resolve message should be resolved")
+	}
+}
+
+func TestMetricsTextNone(t *testing.T) {
+	evt := test.TriggeredAlarmDetails
+	evt.Detail.Configuration = cw.Configuration{}
+	if got := message.New(&evt, pagerduty.ActionTrigger).MetricsText(", "); got != message.NoMetrics {
+		t.Errorf("expected %q for an alarm without metrics, got %q", message.NoMetrics, got)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		n        int
+		expected string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"truncated", 5, "trunc"},
+		// a 3-byte rune straddling the limit is left out whole
+		{"aa€b", 3, "aa"},
+		{"aa€b", 4, "aa"},
+		{"aa€b", 5, "aa€"},
+		{"€", 2, ""},
+	} {
+		if got := message.Truncate(tc.s, tc.n); got != tc.expected {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", tc.s, tc.n, got, tc.expected)
+		}
+	}
+}
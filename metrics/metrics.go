@@ -0,0 +1,147 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics emits CloudWatch metrics as Embedded Metric Format (EMF)
+// log lines: CloudWatch Logs extracts the metrics from them, without any
+// PutMetricData calls on the alert path.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultNamespace is the CloudWatch namespace metrics are emitted to.
+const DefaultNamespace = "CWAlertRouter"
+
+// Unit is a CloudWatch metric unit.
+type Unit string
+
+// Metric units.
+const (
+	Count        Unit = "Count"
+	Milliseconds Unit = "Milliseconds"
+)
+
+// Metric is one metric value.
+type Metric struct {
+	Name  string
+	Unit  Unit
+	Value float64
+}
+
+// Record is a set of metrics sharing dimension values.
+type Record struct {
+	// Dimensions are the record's dimension values, by name.
+	Dimensions map[string]string
+	// DimensionSets are the combinations of dimensions the metrics are
+	// aggregated by; an empty set aggregates across all dimensions.
+	DimensionSets [][]string
+	Metrics       []Metric
+}
+
+// Emitter writes records as EMF log lines.
+type Emitter struct {
+	w         io.Writer
+	namespace string
+	now       func() time.Time
+
+	mu sync.Mutex
+}
+
+// Option provides the function opts pattern for overriding.
+type Option func(*Emitter)
+
+// WithWriter sets where records are written (stdout by default).
+func WithWriter(w io.Writer) Option {
+	return func(e *Emitter) { e.w = w }
+}
+
+// WithNamespace sets the CloudWatch namespace (DefaultNamespace by default).
+func WithNamespace(namespace string) Option {
+	return func(e *Emitter) { e.namespace = namespace }
+}
+
+// WithClock sets the clock records are timestamped with (for testing).
+func WithClock(now func() time.Time) Option {
+	return func(e *Emitter) { e.now = now }
+}
+
+// New returns an emitter writing to stdout.
+func New(opts ...Option) *Emitter {
+	e := &Emitter{w: os.Stdout, namespace: DefaultNamespace, now: time.Now}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// emfMetric declares a metric in the EMF metadata.
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit Unit   `json:"Unit"`
+}
+
+// emfDirective is the EMF metadata for one namespace.
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+// emfMetadata is the _aws member of an EMF line.
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// Emit writes the record as one EMF line. Records without metrics aren't
+// written.
+func (e *Emitter) Emit(r Record) error {
+	if len(r.Metrics) == 0 {
+		return nil
+	}
+	sets := r.DimensionSets
+	if sets == nil {
+		sets = [][]string{{}}
+	}
+	directive := emfDirective{Namespace: e.namespace, Dimensions: sets}
+	line := make(map[string]any, len(r.Dimensions)+len(r.Metrics)+1)
+	for name, value := range r.Dimensions {
+		line[name] = value
+	}
+	for _, m := range r.Metrics {
+		directive.Metrics = append(directive.Metrics, emfMetric{Name: m.Name, Unit: m.Unit})
+		line[m.Name] = m.Value
+	}
+	line["_aws"] = emfMetadata{
+		Timestamp:         e.now().UnixMilli(),
+		CloudWatchMetrics: []emfDirective{directive},
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("encoding metrics: %w", err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("writing metrics: %w", err)
+	}
+	return nil
+}
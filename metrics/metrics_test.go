@@ -0,0 +1,99 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/metrics"
+)
+
+func TestEmit(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Date(2020, 7, 31, 6, 56, 5, 0, time.UTC)
+	e := metrics.New(metrics.WithWriter(&buf), metrics.WithNamespace("Test"), metrics.WithClock(func() time.Time { return now }))
+
+	err := e.Emit(metrics.Record{
+		Dimensions:    map[string]string{"Destination": "slack", "Owner": "plateng"},
+		DimensionSets: [][]string{{"Destination"}, {"Destination", "Owner"}},
+		Metrics: []metrics.Metric{
+			{Name: "Deliveries", Unit: metrics.Count, Value: 1},
+			{Name: "DeliveryLatency", Unit: metrics.Milliseconds, Value: 1500},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Emit returned error: %v", err)
+	}
+	if err := e.Emit(metrics.Record{}); err != nil || bytes.Count(buf.Bytes(), []byte("\n")) != 1 {
+		t.Fatalf("expected a record without metrics to be skipped, got %v: %s", err, buf.String())
+	}
+
+	var line struct {
+		AWS struct {
+			Timestamp         int64
+			CloudWatchMetrics []struct {
+				Namespace  string
+				Dimensions [][]string
+				Metrics    []struct{ Name, Unit string }
+			}
+		} `json:"_aws"`
+		Destination     string
+		Owner           string
+		Deliveries      float64
+		DeliveryLatency float64
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("failed decoding %s: %v", buf.String(), err)
+	}
+	if line.AWS.Timestamp != now.UnixMilli() || len(line.AWS.CloudWatchMetrics) != 1 {
+		t.Fatalf("unexpected metadata %+v", line.AWS)
+	}
+	directive := line.AWS.CloudWatchMetrics[0]
+	if directive.Namespace != "Test" || len(directive.Dimensions) != 2 || len(directive.Dimensions[1]) != 2 {
+		t.Errorf("unexpected directive %+v", directive)
+	}
+	if len(directive.Metrics) != 2 || directive.Metrics[1].Name != "DeliveryLatency" || directive.Metrics[1].Unit != "Milliseconds" {
+		t.Errorf("unexpected metrics %+v", directive.Metrics)
+	}
+	if line.Destination != "slack" || line.Owner != "plateng" || line.Deliveries != 1 || line.DeliveryLatency != 1500 {
+		t.Errorf("unexpected values %+v", line)
+	}
+}
+
+func TestEmitWithoutDimensions(t *testing.T) {
+	var buf bytes.Buffer
+	e := metrics.New(metrics.WithWriter(&buf))
+	if err := e.Emit(metrics.Record{Metrics: []metrics.Metric{{Name: "Records", Unit: metrics.Count, Value: 10}}}); err != nil {
+		t.Fatalf("Emit returned error: %v", err)
+	}
+	var line struct {
+		AWS struct {
+			CloudWatchMetrics []struct {
+				Namespace  string
+				Dimensions [][]string
+			}
+		} `json:"_aws"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("failed decoding %s: %v", buf.String(), err)
+	}
+	// CloudWatch needs one, empty, dimension set for undimensioned metrics
+	if d := line.AWS.CloudWatchMetrics[0]; d.Namespace != metrics.DefaultNamespace || len(d.Dimensions) != 1 || len(d.Dimensions[0]) != 0 {
+		t.Errorf("unexpected directive %+v", d)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package opscenter tracks alarms as AWS Systems Manager OpsCenter OpsItems,
+// giving non-urgent alarms a backlog that doesn't scroll away.
+package opscenter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/message"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+)
+
+const (
+	// source identifies the router as the OpsItem source (the "aws" and
+	// "amazon" prefixes are reserved).
+	source = "cw-alert-router"
+	// defaultSeverity is the OpsItem severity (1 = critical ... 4 = low).
+	defaultSeverity = "3"
+	// maxTitleLength is the limit OpsCenter puts on OpsItem titles.
+	maxTitleLength = 1024
+)
+
+// Operational data keys set on OpsItems.
+const (
+	// DedupKey is the OpsCenter-native deduplication key: while an OpsItem
+	// with the same dedup string is open, no new one is created.
+	DedupKey = "/aws/dedup"
+	// ResourcesKey lists the related resources (the alarm).
+	ResourcesKey = "/aws/resources"
+	// AlarmKey holds the alarm ARN, searchable to find the alarm's OpsItem.
+	AlarmKey = "/cw-alert-router/alarm"
+	// MetricsKey holds the alarm's metric summary.
+	MetricsKey = "metrics"
+	// ReasonKey holds the alarm state reason.
+	ReasonKey = "reason"
+	// GraphKey holds the URL of the alarm graph, if there is one.
+	GraphKey = "graph"
+	// ConsoleKey holds the link to the alarm in the AWS console.
+	ConsoleKey = "console"
+)
+
+// API is the subset of the Systems Manager API this service uses for OpsItems.
+type API interface {
+	CreateOpsItem(ctx context.Context, params *ssm.CreateOpsItemInput, optFns ...func(*ssm.Options)) (*ssm.CreateOpsItemOutput, error)
+	DescribeOpsItems(ctx context.Context, params *ssm.DescribeOpsItemsInput, optFns ...func(*ssm.Options)) (*ssm.DescribeOpsItemsOutput, error)
+	UpdateOpsItem(ctx context.Context, params *ssm.UpdateOpsItemInput, optFns ...func(*ssm.Options)) (*ssm.UpdateOpsItemOutput, error)
+}
+
+// Client creates and resolves OpsItems for alarms.
+type Client struct {
+	api API
+}
+
+// New returns a Client backed by the real Systems Manager API.
+func New(cfg aws.Config) *Client {
+	return &Client{api: ssm.NewFromConfig(cfg)}
+}
+
+// NewWithAPI returns a Client backed by the given API implementation (for testing).
+func NewWithAPI(api API) *Client {
+	return &Client{api: api}
+}
+
+// SubmitEvent creates (ActionTrigger) or resolves (ActionResolve) the
+// OpsItem for the alarm in the CloudWatch event. graphURL is recorded on
+// new OpsItems if non-empty.
+func (c *Client) SubmitEvent(ctx context.Context, action string, evt *cw.Event, graphURL string) error {
+	switch action {
+	case pagerduty.ActionTrigger:
+		return c.createOpsItem(ctx, evt, graphURL)
+	case pagerduty.ActionResolve:
+		return c.resolveOpsItem(ctx, evt)
+	default:
+		return nil
+	}
+}
+
+// searchable returns a searchable operational data value.
+func searchable(v string) types.OpsItemDataValue {
+	return types.OpsItemDataValue{Type: types.OpsItemDataTypeSearchableString, Value: aws.String(v)}
+}
+
+// plain returns a non-searchable operational data value.
+func plain(v string) types.OpsItemDataValue {
+	return types.OpsItemDataValue{Type: types.OpsItemDataTypeString, Value: aws.String(v)}
+}
+
+// createOpsItem creates an OpsItem for the alarm. An OpsItem that is still
+// open for the alarm is left alone (OpsCenter deduplicates by alarm ARN).
+func (c *Client) createOpsItem(ctx context.Context, evt *cw.Event, graphURL string) error {
+	alarmARN, err := evt.AlarmARN()
+	if err != nil {
+		return err
+	}
+
+	dedup, err := json.Marshal(map[string]string{"dedupString": alarmARN})
+	if err != nil {
+		return err
+	}
+	resources, err := json.Marshal([]map[string]string{{"arn": alarmARN}})
+	if err != nil {
+		return err
+	}
+	data := map[string]types.OpsItemDataValue{
+		DedupKey:     searchable(string(dedup)),
+		ResourcesKey: searchable(string(resources)),
+		AlarmKey:     searchable(alarmARN),
+		MetricsKey:   plain(message.New(evt, pagerduty.ActionTrigger).MetricsText("\n")),
+		ConsoleKey:   plain(evt.ConsoleLink()),
+	}
+	if reason := evt.Detail.State.Reason; reason != "" {
+		data[ReasonKey] = plain(reason)
+	}
+	if graphURL != "" {
+		data[GraphKey] = plain(graphURL)
+	}
+
+	title := message.Truncate(evt.Detail.AlarmName, maxTitleLength)
+	description := evt.Detail.Configuration.Description
+	if description == "" {
+		description = evt.Detail.State.Reason
+	}
+	if description == "" {
+		description = fmt.Sprintf("CloudWatch alarm %s is in state %s", evt.Detail.AlarmName, evt.Detail.State.Value)
+	}
+
+	slog.Info("creating opsitem", "alarm", evt.Detail.AlarmName)
+	resp, err := c.api.CreateOpsItem(ctx, &ssm.CreateOpsItemInput{
+		Source:          aws.String(source),
+		Title:           aws.String(title),
+		Description:     aws.String(description),
+		Severity:        aws.String(defaultSeverity),
+		OperationalData: data,
+	})
+	if err != nil {
+		var exists *types.OpsItemAlreadyExistsException
+		if errors.As(err, &exists) {
+			slog.Info("opsitem already open for alarm", "alarm", evt.Detail.AlarmName, "opsitem", aws.ToString(exists.OpsItemId))
+			return nil
+		}
+		return fmt.Errorf("creating opsitem for %s: %w", evt.Detail.AlarmName, err)
+	}
+	slog.Debug("opsitem created", "opsitem", aws.ToString(resp.OpsItemId))
+	return nil
+}
+
+// resolveOpsItem resolves the alarm's open OpsItem, if any.
+func (c *Client) resolveOpsItem(ctx context.Context, evt *cw.Event) error {
+	alarmARN, err := evt.AlarmARN()
+	if err != nil {
+		return err
+	}
+	id, err := c.OpenOpsItem(ctx, alarmARN)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		slog.Debug("no open opsitem to resolve", "alarm", evt.Detail.AlarmName)
+		return nil
+	}
+
+	data := map[string]types.OpsItemDataValue{}
+	if reason := evt.Detail.State.Reason; reason != "" {
+		data[ReasonKey] = plain(reason)
+	}
+	slog.Info("resolving opsitem", "opsitem", id, "alarm", evt.Detail.AlarmName)
+	_, err = c.api.UpdateOpsItem(ctx, &ssm.UpdateOpsItemInput{
+		OpsItemId:       aws.String(id),
+		Status:          types.OpsItemStatusResolved,
+		OperationalData: data,
+		ActualEndTime:   aws.Time(evt.StateChangeTime()),
+	})
+	if err != nil {
+		return fmt.Errorf("resolving opsitem %s: %w", id, err)
+	}
+	return nil
+}
+
+// OpenOpsItem returns the ID of the open (or in progress) OpsItem created
+// for the given alarm, or "" if there is none.
+func (c *Client) OpenOpsItem(ctx context.Context, alarmARN string) (string, error) {
+	alarmFilter, err := json.Marshal(map[string]string{"key": AlarmKey, "value": alarmARN})
+	if err != nil {
+		return "", err
+	}
+	input := &ssm.DescribeOpsItemsInput{
+		OpsItemFilters: []types.OpsItemFilter{
+			{
+				Key:      types.OpsItemFilterKeySource,
+				Operator: types.OpsItemFilterOperatorEqual,
+				Values:   []string{source},
+			},
+			{
+				Key:      types.OpsItemFilterKeyStatus,
+				Operator: types.OpsItemFilterOperatorEqual,
+				Values:   []string{string(types.OpsItemStatusOpen), string(types.OpsItemStatusInProgress)},
+			},
+			{
+				Key:      types.OpsItemFilterKeyOperationalData,
+				Operator: types.OpsItemFilterOperatorEqual,
+				Values:   []string{string(alarmFilter)},
+			},
+		},
+	}
+	paginator := ssm.NewDescribeOpsItemsPaginator(c.api, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", fmt.Errorf("describing opsitems for %s: %w", alarmARN, err)
+		}
+		for _, item := range page.OpsItemSummaries {
+			if v, ok := item.OperationalData[AlarmKey]; ok && aws.ToString(v.Value) != alarmARN {
+				continue
+			}
+			return aws.ToString(item.OpsItemId), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opscenter_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"github.com/tidal-music/cw-alert-router/v2/opscenter"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+func TestSubmitEventTrigger(t *testing.T) {
+	mock := &test.MockOpsCenterAPI{}
+	client := opscenter.NewWithAPI(mock)
+
+	evt := test.TriggeredAlarmDetails
+	if err := client.SubmitEvent(context.Background(), pagerduty.ActionTrigger, &evt, "https://images.example.com/graph.png"); err != nil {
+		t.Fatalf("failed creating opsitem: %v", err)
+	}
+
+	items := mock.OpsItems()
+	if len(items) != 1 {
+		t.Fatalf("expected 1 opsitem, got %d", len(items))
+	}
+	data := items[0].OperationalData
+	for key, want := range map[string]string{
+		opscenter.DedupKey:     evt.Resources[0],
+		opscenter.ResourcesKey: evt.Resources[0],
+		opscenter.MetricsKey:   "CPUUtilization",
+		opscenter.ReasonKey:    "Threshold Crossed",
+		opscenter.GraphKey:     "https://images.example.com/graph.png",
+	} {
+		if got := aws.ToString(data[key].Value); !strings.Contains(got, want) {
+			t.Errorf("operational data %s = %q, expected it to contain %q", key, got, want)
+		}
+	}
+}
+
+func TestSubmitEventTriggerDeduplicates(t *testing.T) {
+	mock := &test.MockOpsCenterAPI{}
+	client := opscenter.NewWithAPI(mock)
+
+	evt := test.TriggeredAlarmDetails
+	for range 2 {
+		if err := client.SubmitEvent(context.Background(), pagerduty.ActionTrigger, &evt, ""); err != nil {
+			t.Fatalf("failed creating opsitem: %v", err)
+		}
+	}
+	if got := len(mock.OpsItems()); got != 1 {
+		t.Errorf("expected the open opsitem to be reused, got %d opsitems", got)
+	}
+}
+
+func TestSubmitEventResolve(t *testing.T) {
+	mock := &test.MockOpsCenterAPI{}
+	client := opscenter.NewWithAPI(mock)
+
+	evt := test.TriggeredAlarmDetails
+	if err := client.SubmitEvent(context.Background(), pagerduty.ActionTrigger, &evt, ""); err != nil {
+		t.Fatalf("failed creating opsitem: %v", err)
+	}
+	if err := client.SubmitEvent(context.Background(), pagerduty.ActionResolve, &evt, ""); err != nil {
+		t.Fatalf("failed resolving opsitem: %v", err)
+	}
+
+	items := mock.OpsItems()
+	if len(items) != 1 || items[0].Status != ssmtypes.OpsItemStatusResolved {
+		t.Fatalf("expected 1 resolved opsitem, got %+v", items)
+	}
+
+	// the alarm triggering again opens a new opsitem
+	if err := client.SubmitEvent(context.Background(), pagerduty.ActionTrigger, &evt, ""); err != nil {
+		t.Fatalf("failed creating opsitem: %v", err)
+	}
+	if got := len(mock.OpsItems()); got != 2 {
+		t.Errorf("expected a new opsitem after resolving, got %d opsitems", got)
+	}
+}
+
+func TestSubmitEventResolveWithoutOpsItem(t *testing.T) {
+	mock := &test.MockOpsCenterAPI{}
+	client := opscenter.NewWithAPI(mock)
+
+	evt := test.ExpectedAlarmDetails
+	if err := client.SubmitEvent(context.Background(), pagerduty.ActionResolve, &evt, ""); err != nil {
+		t.Fatalf("resolving without an open opsitem should be a no-op, got: %v", err)
+	}
+	if got := len(mock.OpsItems()); got != 0 {
+		t.Errorf("expected no opsitems, got %d", got)
+	}
+}
@@ -17,8 +17,10 @@ package pagerduty
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 
 	pdapi "github.com/PagerDuty/go-pagerduty"
 	"github.com/tidal-music/cw-alert-router/v2/cw"
@@ -29,6 +31,23 @@ const (
 	clientName           = "cw-alert-router"
 )
 
+// Events API base URLs of the PagerDuty service regions.
+const (
+	DefaultEventsURL = "https://events.pagerduty.com"
+	EUEventsURL      = "https://events.eu.pagerduty.com"
+)
+
+// Retry defaults for retryable Events API failures.
+const (
+	DefaultMaxAttempts = 4
+	DefaultBackoff     = 500 * time.Millisecond
+	maxBackoff         = 8 * time.Second
+)
+
+// ErrRejected marks events PagerDuty rejected permanently, e.g. for an
+// invalid routing key: retrying them won't help.
+var ErrRejected = errors.New("pagerduty rejected the event")
+
 // Actions we submit to the PagerDuty events API.
 const (
 	ActionTrigger = "trigger"
@@ -43,7 +62,10 @@ type API interface {
 
 // Client is a wrapper for the pagerduty client.
 type Client struct {
-	api API
+	api         API
+	eventsURL   string
+	maxAttempts int
+	backoff     time.Duration
 }
 
 // ClientOptions provides the method to configure the new client.
@@ -56,15 +78,36 @@ func WithAPI(api API) ClientOptions {
 	}
 }
 
+// WithEventsURL sets the Events API base URL, e.g. EUEventsURL for the EU
+// service region (DefaultEventsURL by default).
+func WithEventsURL(url string) ClientOptions {
+	return func(c *Client) {
+		c.eventsURL = url
+	}
+}
+
+// WithRetry sets how many attempts are made to submit an event on
+// retryable failures, and the backoff before the first retry, which doubles
+// on every further one (DefaultMaxAttempts and DefaultBackoff by default).
+func WithRetry(maxAttempts int, backoff time.Duration) ClientOptions {
+	return func(c *Client) {
+		c.maxAttempts = maxAttempts
+		c.backoff = backoff
+	}
+}
+
 // New returns a new Client.
 func New(opts ...ClientOptions) (*Client, error) {
-	c := &Client{}
+	c := &Client{eventsURL: DefaultEventsURL, maxAttempts: DefaultMaxAttempts, backoff: DefaultBackoff}
 	for _, opt := range opts {
 		opt(c)
 	}
+	if c.maxAttempts < 1 {
+		return nil, fmt.Errorf("invalid pagerduty max attempts %d", c.maxAttempts)
+	}
 	if c.api == nil {
 		// the events API authenticates via routing key, not account token
-		c.api = pdapi.NewClient("")
+		c.api = pdapi.NewClient("", pdapi.WithV2EventsAPIEndpoint(c.eventsURL))
 	}
 	return c, nil
 }
@@ -85,22 +128,14 @@ func Action(previousState, currentState string) string {
 	}
 }
 
-// SubmitEvent sends an event with the given action to PagerDuty using alarm
-// details from the CloudWatch event.
-func (c *Client) SubmitEvent(ctx context.Context, routingKey string, action string, evt *cw.Event) error {
-	if action == ActionNone {
-		return nil
-	}
-
+// NewEvent builds the Events API v2 event SubmitEvent sends for the alarm
+// event, deduplicated by alarm ARN.
+func NewEvent(routingKey string, action string, evt *cw.Event) (*pdapi.V2Event, error) {
 	alarmARN, err := evt.AlarmARN()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	slog.Info("submitting pagerduty event",
-		"routing_key", maskKey(routingKey), "action", action, "alarm", evt.Detail.AlarmName)
-
-	resp, err := c.api.ManageEventWithContext(ctx, &pdapi.V2Event{
+	return &pdapi.V2Event{
 		RoutingKey: routingKey,
 		Action:     action,
 		DedupKey:   alarmARN,
@@ -112,12 +147,73 @@ func (c *Client) SubmitEvent(ctx context.Context, routingKey string, action stri
 			Timestamp: evt.Detail.State.Timestamp,
 			Details:   evt,
 		},
-	})
+	}, nil
+}
+
+// SubmitEvent sends an event with the given action to PagerDuty using alarm
+// details from the CloudWatch event. Retryable failures are retried with
+// exponential backoff, as long as the context deadline allows; events
+// PagerDuty rejects fail with ErrRejected.
+func (c *Client) SubmitEvent(ctx context.Context, routingKey string, action string, evt *cw.Event) error {
+	if action == ActionNone {
+		return nil
+	}
+
+	e, err := NewEvent(routingKey, action, evt)
 	if err != nil {
-		return fmt.Errorf("submitting pagerduty event for %s: %w", evt.Detail.AlarmName, err)
+		return err
+	}
+
+	slog.Info("submitting pagerduty event",
+		"routing_key", maskKey(routingKey), "action", action, "alarm", evt.Detail.AlarmName)
+
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := c.api.ManageEventWithContext(ctx, e)
+		if err == nil {
+			slog.Debug("pagerduty response", "status", resp.Status, "message", resp.Message)
+			return nil
+		}
+		if !retryable(err) {
+			return fmt.Errorf("submitting pagerduty event for %s: %w: %w", evt.Detail.AlarmName, ErrRejected, err)
+		}
+		if attempt == c.maxAttempts || !fitsDeadline(ctx, backoff) {
+			return fmt.Errorf("submitting pagerduty event for %s after %d attempts: %w", evt.Detail.AlarmName, attempt, err)
+		}
+
+		slog.Warn("pagerduty event failed, retrying", "alarm", evt.Detail.AlarmName, "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("submitting pagerduty event for %s: %w", evt.Detail.AlarmName, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
 	}
-	slog.Debug("pagerduty response", "status", resp.Status, "message", resp.Message)
-	return nil
+}
+
+// retryable reports whether a failed submission may succeed when retried:
+// rate limiting, timeouts, server errors and failures to reach PagerDuty at
+// all. Other responses (bad request, invalid routing key) are permanent.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var apiErr pdapi.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	var eventsErr pdapi.EventsAPIV2Error
+	if errors.As(err, &eventsErr) {
+		return eventsErr.Temporary()
+	}
+	return true
+}
+
+// fitsDeadline reports whether waiting d leaves time for another attempt
+// before the context deadline, if it has one.
+func fitsDeadline(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) >= 2*d
 }
 
 func maskKey(s string) string {
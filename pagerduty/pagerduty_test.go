@@ -16,7 +16,12 @@ package pagerduty_test
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
 	"github.com/tidal-music/cw-alert-router/v2/test"
@@ -79,3 +84,76 @@ func TestAction(t *testing.T) {
 		}
 	}
 }
+
+func TestSubmitEventRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/enqueue" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"status":"success","message":"Event processed"}`))
+	}))
+	defer server.Close()
+
+	client, err := pagerduty.New(pagerduty.WithEventsURL(server.URL), pagerduty.WithRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed creating pagerduty client: %v", err)
+	}
+	evt := test.TriggeredAlarmDetails
+	if err := client.SubmitEvent(context.Background(), "abc123", pagerduty.ActionTrigger, &evt); err != nil {
+		t.Errorf("expected the event to succeed on the third attempt: %v", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestSubmitEventGivesUp(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client, err := pagerduty.New(pagerduty.WithEventsURL(server.URL), pagerduty.WithRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed creating pagerduty client: %v", err)
+	}
+	evt := test.TriggeredAlarmDetails
+	err = client.SubmitEvent(context.Background(), "abc123", pagerduty.ActionTrigger, &evt)
+	if err == nil || errors.Is(err, pagerduty.ErrRejected) {
+		t.Errorf("expected a retryable error, got %v", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestSubmitEventRejected(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"status":"invalid event","message":"Event object is invalid","errors":["Invalid routing key"]}`))
+	}))
+	defer server.Close()
+
+	client, err := pagerduty.New(pagerduty.WithEventsURL(server.URL), pagerduty.WithRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed creating pagerduty client: %v", err)
+	}
+	evt := test.TriggeredAlarmDetails
+	if err := client.SubmitEvent(context.Background(), "abc123", pagerduty.ActionTrigger, &evt); !errors.Is(err, pagerduty.ErrRejected) {
+		t.Errorf("expected ErrRejected, got %v", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected a rejected event not to be retried, got %d attempts", n)
+	}
+}
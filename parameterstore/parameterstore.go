@@ -28,6 +28,8 @@ import (
 // API is the subset of the Systems Manager API this service uses.
 type API interface {
 	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+	PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error)
+	DeleteParameter(ctx context.Context, params *ssm.DeleteParameterInput, optFns ...func(*ssm.Options)) (*ssm.DeleteParameterOutput, error)
 }
 
 // Client is our own parameter store client.
@@ -58,6 +60,28 @@ func (c *Client) GetParameterValue(ctx context.Context, key string) (string, err
 	return aws.ToString(resp.Parameter.Value), nil
 }
 
+// PutParameterValue stores a plain String value under the given key,
+// overwriting any previous value.
+func (c *Client) PutParameterValue(ctx context.Context, key, value string) error {
+	_, err := c.api.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(key),
+		Value:     aws.String(value),
+		Type:      types.ParameterTypeString,
+		Overwrite: aws.Bool(true),
+	})
+	return err
+}
+
+// DeleteParameter removes the given key. Deleting a key that doesn't exist
+// is not an error.
+func (c *Client) DeleteParameter(ctx context.Context, key string) error {
+	_, err := c.api.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(key)})
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
 // IsNotFound reports whether the error means the requested parameter does not exist.
 func IsNotFound(err error) bool {
 	var nf *types.ParameterNotFound
@@ -49,3 +49,23 @@ func TestGetInvalidKey(t *testing.T) {
 		t.Errorf("expected IsNotFound to be true for error: %v", err)
 	}
 }
+
+func TestPutAndDeleteParameter(t *testing.T) {
+	psclient := parameterstore.NewWithAPI(&test.MockSSMClient{})
+	key := "/service/cw_alert_router/test/put"
+	if err := psclient.PutParameterValue(context.Background(), key, "value"); err != nil {
+		t.Fatalf("Error putting key %s: %v", key, err)
+	}
+	if value, err := psclient.GetParameterValue(context.Background(), key); err != nil || value != "value" {
+		t.Errorf("expected stored value for key %s, got %q (%v)", key, value, err)
+	}
+	if err := psclient.DeleteParameter(context.Background(), key); err != nil {
+		t.Fatalf("Error deleting key %s: %v", key, err)
+	}
+	if _, err := psclient.GetParameterValue(context.Background(), key); !parameterstore.IsNotFound(err) {
+		t.Errorf("expected key %s to be gone, got %v", key, err)
+	}
+	if err := psclient.DeleteParameter(context.Background(), key); err != nil {
+		t.Errorf("deleting a missing key should not fail: %v", err)
+	}
+}
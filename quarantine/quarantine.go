@@ -0,0 +1,114 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quarantine keeps SQS records that can never be processed, such as
+// bodies that aren't CloudWatch alarm events, out of the retry loop: they
+// are stored with the error for inspection instead.
+package quarantine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+
+	"github.com/tidal-music/cw-alert-router/v2/s3"
+)
+
+// Record is a quarantined SQS record.
+type Record struct {
+	MessageID     string    `json:"message_id"`
+	Body          string    `json:"body"`
+	Error         string    `json:"error"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// Store keeps quarantined records.
+type Store interface {
+	// Put stores the record and returns where it went, for people to find
+	// it.
+	Put(ctx context.Context, rec Record) (string, error)
+}
+
+// S3 stores each quarantined record as a JSON object in a bucket.
+type S3 struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 returns a store writing to the bucket, under the key prefix.
+func NewS3(client *s3.Client, bucket, prefix string) *S3 {
+	return &S3{client: client, bucket: bucket, prefix: strings.Trim(prefix, "/")}
+}
+
+// Put implements Store. Objects are keyed by date and message ID.
+func (s *S3) Put(ctx context.Context, rec Record) (string, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return "", fmt.Errorf("encoding quarantined record: %w", err)
+	}
+	t := rec.QuarantinedAt.UTC()
+	key := fmt.Sprintf("%d/%02d/%02d/%s.json", t.Year(), t.Month(), t.Day(), rec.MessageID)
+	if s.prefix != "" {
+		key = fmt.Sprintf("%s/%s", s.prefix, key)
+	}
+	if err := s.client.WriteBytes(ctx, s.bucket, key, bytes.NewReader(body)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key), nil
+}
+
+// SQSAPI is the subset of the SQS API the SQS store uses.
+type SQSAPI interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+// SQS sends each quarantined record as a JSON message to a queue.
+type SQS struct {
+	api      SQSAPI
+	queueURL string
+}
+
+// NewSQS returns a store backed by the real SQS API.
+func NewSQS(cfg aws.Config, queueURL string) *SQS {
+	return &SQS{api: sqs.NewFromConfig(cfg), queueURL: queueURL}
+}
+
+// NewSQSWithAPI returns a store backed by the given API implementation (for
+// testing).
+func NewSQSWithAPI(api SQSAPI, queueURL string) *SQS {
+	return &SQS{api: api, queueURL: queueURL}
+}
+
+// Put implements Store.
+func (s *SQS) Put(ctx context.Context, rec Record) (string, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return "", fmt.Errorf("encoding quarantined record: %w", err)
+	}
+	_, err = s.api.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(s.queueURL),
+		MessageBody: aws.String(string(body)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("sending to quarantine queue %s: %w", s.queueURL, err)
+	}
+	return s.queueURL, nil
+}
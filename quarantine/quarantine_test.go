@@ -0,0 +1,91 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quarantine_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/quarantine"
+	"github.com/tidal-music/cw-alert-router/v2/s3"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+var testRecord = quarantine.Record{
+	MessageID:     "message-1",
+	Body:          `{"detail-type":"EC2 Instance State-change Notification"}`,
+	Error:         "malformed alarm event",
+	QuarantinedAt: time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC),
+}
+
+func TestS3Put(t *testing.T) {
+	api := &test.MockS3API{}
+	client, err := s3.New(context.Background(), s3.WithAPI(api))
+	if err != nil {
+		t.Fatalf("failed creating s3 client: %v", err)
+	}
+	store := quarantine.NewS3(client, "bucket", "/quarantine/")
+
+	location, err := store.Put(context.Background(), testRecord)
+	if err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if location != "s3://bucket/quarantine/2024/03/07/message-1.json" {
+		t.Errorf("unexpected location %s", location)
+	}
+	obj, ok := api.Object("bucket", "quarantine/2024/03/07/message-1.json")
+	if !ok {
+		t.Fatalf("expected the record to be written, got %v", api.Objects())
+	}
+	var got quarantine.Record
+	if err := json.Unmarshal(obj, &got); err != nil {
+		t.Fatalf("decoding quarantined record: %v", err)
+	}
+	if got != testRecord {
+		t.Errorf("expected %+v, got %+v", testRecord, got)
+	}
+}
+
+func TestSQSPut(t *testing.T) {
+	api := &test.MockSQSAPI{}
+	store := quarantine.NewSQSWithAPI(api, "https://sqs.eu-west-1.amazonaws.com/123/quarantine")
+
+	location, err := store.Put(context.Background(), testRecord)
+	if err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if location != "https://sqs.eu-west-1.amazonaws.com/123/quarantine" {
+		t.Errorf("unexpected location %s", location)
+	}
+	messages := api.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	var got quarantine.Record
+	if err := json.Unmarshal([]byte(messages[0]), &got); err != nil {
+		t.Fatalf("decoding quarantined record: %v", err)
+	}
+	if got != testRecord {
+		t.Errorf("expected %+v, got %+v", testRecord, got)
+	}
+
+	api.Fail(errors.New("queue unavailable"))
+	if _, err := store.Put(context.Background(), testRecord); err == nil {
+		t.Error("expected an error when the queue is unavailable")
+	}
+}
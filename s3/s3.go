@@ -33,6 +33,8 @@ import (
 // API is the subset of the S3 API this service uses.
 type API interface {
 	PutObject(ctx context.Context, params *s3api.PutObjectInput, optFns ...func(*s3api.Options)) (*s3api.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3api.GetObjectInput, optFns ...func(*s3api.Options)) (*s3api.GetObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3api.ListObjectsV2Input, optFns ...func(*s3api.Options)) (*s3api.ListObjectsV2Output, error)
 }
 
 // Presigner generates presigned GET URLs for S3 objects.
@@ -123,6 +125,38 @@ func (c *Client) WriteBytes(ctx context.Context, bucket string, key string, r io
 	return nil
 }
 
+// ReadObject returns the content of an object key; the caller closes it.
+func (c *Client) ReadObject(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	out, err := c.api.GetObject(ctx, &s3api.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading s3://%s/%s: %w", bucket, key, err)
+	}
+	return out.Body, nil
+}
+
+// ListKeys returns the keys of the objects under a key prefix, in
+// lexicographic order.
+func (c *Client) ListKeys(ctx context.Context, bucket string, prefix string) ([]string, error) {
+	var keys []string
+	p := s3api.NewListObjectsV2Paginator(c.api, &s3api.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing s3://%s/%s: %w", bucket, prefix, err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+	return keys, nil
+}
+
 // PresignedURL returns a presigned GET URL for the given object.
 func (c *Client) PresignedURL(ctx context.Context, bucket string, key string, ttl time.Duration) (string, error) {
 	if c.presigner == nil {
@@ -17,6 +17,7 @@ package s3_test
 import (
 	"bytes"
 	"context"
+	"io"
 	"strings"
 	"testing"
 	"time"
@@ -63,3 +64,38 @@ func TestPresignedURL(t *testing.T) {
 		t.Errorf("presigned url doesn't reference the object: %s", url)
 	}
 }
+
+func TestReadObjectAndListKeys(t *testing.T) {
+	client, err := s3.New(context.Background(), s3.WithAPI(&test.MockS3API{}))
+	if err != nil {
+		t.Fatalf("Failed initializing mock s3 client: %v", err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"b/2.json", "a/1.json", "b/1.json"} {
+		if err := client.WriteBytes(ctx, "test-bucket-1", key, strings.NewReader(key)); err != nil {
+			t.Fatalf("Error writing data to s3: %v", err)
+		}
+	}
+
+	keys, err := client.ListKeys(ctx, "test-bucket-1", "b/")
+	if err != nil {
+		t.Fatalf("Error listing keys: %v", err)
+	}
+	if strings.Join(keys, ",") != "b/1.json,b/2.json" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	r, err := client.ReadObject(ctx, "test-bucket-1", "a/1.json")
+	if err != nil {
+		t.Fatalf("Error reading object: %v", err)
+	}
+	defer r.Close()
+	body, _ := io.ReadAll(r)
+	if string(body) != "a/1.json" {
+		t.Errorf("unexpected content %q", body)
+	}
+
+	if _, err := client.ReadObject(ctx, "test-bucket-1", "missing.json"); err == nil {
+		t.Error("expected an error reading a missing object")
+	}
+}
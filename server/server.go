@@ -0,0 +1,332 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server runs the router as a long-running HTTP server, for
+// deployments outside Lambda. It receives alarm events as an EventBridge API
+// destination and as an SNS HTTPS subscription, and feeds them to the same
+// pipeline as the Lambda.
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/lambda"
+)
+
+// Default configuration values.
+const (
+	DefaultAddr            = ":8080"
+	DefaultAPIKeyHeader    = "X-API-Key"
+	DefaultProcessTimeout  = 30 * time.Second
+	DefaultShutdownTimeout = 20 * time.Second
+
+	// stabilisedInterval is how often flapping alarms are checked for
+	// having stabilised.
+	stabilisedInterval = time.Minute
+	// maxBodySize is the largest request accepted; EventBridge events are
+	// at most 256 KB, SNS messages a little more with their envelope.
+	maxBodySize = 512 << 10
+)
+
+// Environment variable keys.
+const (
+	// AddrEnv is the env var key for the address the server listens on.
+	AddrEnv = "SERVER_ADDR"
+	// APIKeyHeaderEnv is the env var key for the header carrying the API key.
+	APIKeyHeaderEnv = "SERVER_API_KEY_HEADER"
+	// APIKeyEnv is the env var key for the API key EventBridge sends.
+	APIKeyEnv = "SERVER_API_KEY"
+	// BasicAuthUserEnv is the env var key for the basic auth user name.
+	BasicAuthUserEnv = "SERVER_BASIC_AUTH_USER"
+	// BasicAuthPasswordEnv is the env var key for the basic auth password.
+	BasicAuthPasswordEnv = "SERVER_BASIC_AUTH_PASSWORD"
+	// SNSTopicARNsEnv is the env var key for the comma separated SNS topics
+	// accepted on the SNS endpoint.
+	SNSTopicARNsEnv = "SERVER_SNS_TOPIC_ARNS"
+	// ProcessTimeoutEnv is the env var key for how long processing one
+	// event may take (a Go duration, e.g. "30s").
+	ProcessTimeoutEnv = "SERVER_PROCESS_TIMEOUT"
+)
+
+// Config holds configuration options for the server.
+type Config struct {
+	// Addr is the address to listen on (default DefaultAddr).
+	Addr string
+
+	// APIKeyHeader is the header the API key is sent in (default
+	// DefaultAPIKeyHeader).
+	APIKeyHeader string
+	// APIKey authenticates EventBridge API destination requests.
+	APIKey string
+	// BasicAuthUser and BasicAuthPassword authenticate EventBridge API
+	// destination requests, as an alternative to an API key.
+	BasicAuthUser     string
+	BasicAuthPassword string
+
+	// SNSTopicARNs are the topics accepted on the SNS endpoint. Empty
+	// disables the endpoint.
+	SNSTopicARNs []string
+
+	// ProcessTimeout is how long processing one event may take (default
+	// DefaultProcessTimeout). Processing carries on when the caller gives
+	// up waiting, so a retry finds the event delivered.
+	ProcessTimeout time.Duration
+
+	// ShutdownTimeout is how long in-flight requests get to finish on
+	// shutdown (default DefaultShutdownTimeout).
+	ShutdownTimeout time.Duration
+}
+
+// ConfigFromEnv builds a Config from the environment variables documented in the README.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Addr:              os.Getenv(AddrEnv),
+		APIKeyHeader:      os.Getenv(APIKeyHeaderEnv),
+		APIKey:            os.Getenv(APIKeyEnv),
+		BasicAuthUser:     os.Getenv(BasicAuthUserEnv),
+		BasicAuthPassword: os.Getenv(BasicAuthPasswordEnv),
+	}
+	for _, arn := range strings.Split(os.Getenv(SNSTopicARNsEnv), ",") {
+		if arn = strings.TrimSpace(arn); arn != "" {
+			cfg.SNSTopicARNs = append(cfg.SNSTopicARNs, arn)
+		}
+	}
+	if v := os.Getenv(ProcessTimeoutEnv); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			slog.Error("invalid process timeout", "value", v, "error", err)
+			d = -1
+		}
+		cfg.ProcessTimeout = d
+	}
+	return cfg
+}
+
+// withDefaults fills in defaults for unset fields.
+func (c Config) withDefaults() Config {
+	if c.Addr == "" {
+		c.Addr = DefaultAddr
+	}
+	if c.APIKeyHeader == "" {
+		c.APIKeyHeader = DefaultAPIKeyHeader
+	}
+	if c.ProcessTimeout == 0 {
+		c.ProcessTimeout = DefaultProcessTimeout
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	return c
+}
+
+// validate checks required fields and value ranges.
+func (c Config) validate() error {
+	if c.APIKey == "" && (c.BasicAuthUser == "" || c.BasicAuthPassword == "") {
+		return fmt.Errorf("an api key (%s) or basic auth credentials (%s, %s) are required",
+			APIKeyEnv, BasicAuthUserEnv, BasicAuthPasswordEnv)
+	}
+	if c.ProcessTimeout < 0 {
+		return fmt.Errorf("process timeout must be a positive duration (%s)", ProcessTimeoutEnv)
+	}
+	return nil
+}
+
+// Processor processes alarm events; *lambda.Handler implements it.
+type Processor interface {
+	ProcessEvent(ctx context.Context, evt *cw.Event) error
+	AnnounceStabilised(ctx context.Context)
+}
+
+// Server receives alarm events over HTTP.
+type Server struct {
+	cfg    Config
+	p      Processor
+	client *http.Client
+	mux    *http.ServeMux
+	ready  atomic.Bool
+
+	certHost *regexp.Regexp
+	certsMu  sync.Mutex
+	certs    map[string]*snsCert
+}
+
+// Option overrides a Server dependency (mostly for testing).
+type Option func(*Server)
+
+// WithHTTPClient sets the client SNS signing certificates are fetched and
+// subscriptions confirmed with.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Server) { s.client = c }
+}
+
+// WithSNSCertHost sets the pattern the hosts of SNS signing certificate and
+// subscription URLs must match (by default SNS's own hosts).
+func WithSNSCertHost(re *regexp.Regexp) Option {
+	return func(s *Server) { s.certHost = re }
+}
+
+// New returns a Server feeding events to p.
+func New(p Processor, cfg Config, opts ...Option) (*Server, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	s := &Server{
+		cfg:      cfg,
+		p:        p,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		certHost: snsHost,
+		certs:    make(map[string]*snsCert),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("POST /events", s.handleEvent)
+	if len(cfg.SNSTopicARNs) > 0 {
+		s.mux.HandleFunc("POST /sns", s.handleSNS)
+	}
+	s.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	s.mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	s.ready.Store(true)
+	return s, nil
+}
+
+// Handler returns the server's HTTP handler.
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Run serves until ctx is cancelled, then stops accepting requests (failing
+// the readiness check) and waits up to the shutdown timeout for in-flight
+// ones to finish. Flapping alarms are checked for having stabilised every
+// minute meanwhile.
+func (s *Server) Run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              s.cfg.Addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "addr", s.cfg.Addr)
+		errc <- srv.ListenAndServe()
+	}()
+	go s.announceStabilised(ctx)
+
+	select {
+	case err := <-errc:
+		return fmt.Errorf("serving http: %w", err)
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down server")
+	s.ready.Store(false)
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutting down http server: %w", err)
+	}
+	return nil
+}
+
+// announceStabilised periodically announces stabilised flapping alarms until
+// ctx is cancelled.
+func (s *Server) announceStabilised(ctx context.Context) {
+	ticker := time.NewTicker(stabilisedInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.p.AnnounceStabilised(ctx)
+		}
+	}
+}
+
+// handleEvent receives an alarm event from an EventBridge API destination.
+func (s *Server) handleEvent(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cw-alert-router"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	evt := &cw.Event{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(evt); err != nil {
+		slog.Warn("rejecting undecodable event", "error", err)
+		http.Error(w, "malformed alarm event", http.StatusBadRequest)
+		return
+	}
+	s.process(w, r, evt)
+}
+
+// authorized checks the request's API key or basic auth credentials.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.cfg.APIKey != "" && equal(r.Header.Get(s.cfg.APIKeyHeader), s.cfg.APIKey) {
+		return true
+	}
+	if s.cfg.BasicAuthUser != "" && s.cfg.BasicAuthPassword != "" {
+		user, password, ok := r.BasicAuth()
+		return ok && equal(user, s.cfg.BasicAuthUser) && equal(password, s.cfg.BasicAuthPassword)
+	}
+	return false
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// process runs the event through the pipeline and maps the outcome to a
+// status code: callers retry 5xx responses, not 4xx ones.
+func (s *Server) process(w http.ResponseWriter, r *http.Request, evt *cw.Event) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), s.cfg.ProcessTimeout)
+	defer cancel()
+
+	err := s.p.ProcessEvent(ctx, evt)
+	switch {
+	case errors.Is(err, lambda.ErrUntrusted):
+		http.Error(w, "untrusted alarm event", http.StatusForbidden)
+	case errors.Is(err, lambda.ErrMalformed):
+		http.Error(w, "malformed alarm event", http.StatusBadRequest)
+	case err != nil:
+		slog.Error("failed processing event", "event_id", evt.ID, "error", err)
+		http.Error(w, "failed processing alarm event", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
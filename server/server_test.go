@@ -0,0 +1,364 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/lambda"
+	"github.com/tidal-music/cw-alert-router/v2/server"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+const testTopic = "arn:aws:sns:us-east-1:1234567890123:alarms"
+
+// fakeProcessor records processed events and fails with err, if set.
+type fakeProcessor struct {
+	mu   sync.Mutex
+	evts []*cw.Event
+	err  error
+}
+
+func (p *fakeProcessor) ProcessEvent(ctx context.Context, evt *cw.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.evts = append(p.evts, evt)
+	return p.err
+}
+
+func (p *fakeProcessor) AnnounceStabilised(ctx context.Context) {}
+
+func (p *fakeProcessor) events() []*cw.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*cw.Event(nil), p.evts...)
+}
+
+func newServer(t *testing.T, p server.Processor, cfg server.Config, opts ...server.Option) *httptest.Server {
+	t.Helper()
+	srv, err := server.New(p, cfg, opts...)
+	if err != nil {
+		t.Fatalf("failed creating server: %v", err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func post(t *testing.T, url string, body []byte, header http.Header) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func eventJSON(t *testing.T) []byte {
+	t.Helper()
+	body, err := json.Marshal(test.TriggeredAlarmDetails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestConfigValidation(t *testing.T) {
+	if _, err := server.New(&fakeProcessor{}, server.Config{}); err == nil {
+		t.Error("expected an error without api key or basic auth")
+	}
+	if _, err := server.New(&fakeProcessor{}, server.Config{BasicAuthUser: "eventbridge"}); err == nil {
+		t.Error("expected an error for basic auth without a password")
+	}
+}
+
+func TestEventsAuth(t *testing.T) {
+	p := &fakeProcessor{}
+	ts := newServer(t, p, server.Config{APIKey: "secret", BasicAuthUser: "eventbridge", BasicAuthPassword: "hunter2"})
+	body := eventJSON(t)
+
+	basic := func(user, password string) http.Header {
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(user, password)
+		return req.Header
+	}
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected int
+	}{
+		{"no credentials", nil, http.StatusUnauthorized},
+		{"wrong api key", http.Header{"X-Api-Key": {"guess"}}, http.StatusUnauthorized},
+		{"api key", http.Header{"X-Api-Key": {"secret"}}, http.StatusOK},
+		{"wrong password", basic("eventbridge", "guess"), http.StatusUnauthorized},
+		{"basic auth", basic("eventbridge", "hunter2"), http.StatusOK},
+	}
+	for _, tc := range tests {
+		if got := post(t, ts.URL+"/events", body, tc.header); got != tc.expected {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.expected, got)
+		}
+	}
+	if got := len(p.events()); got != 2 {
+		t.Errorf("expected only the 2 authorized events to be processed, got %d", got)
+	}
+}
+
+func TestEventsStatus(t *testing.T) {
+	p := &fakeProcessor{}
+	ts := newServer(t, p, server.Config{APIKey: "secret"})
+	auth := http.Header{"X-Api-Key": {"secret"}}
+
+	if got := post(t, ts.URL+"/events", []byte("this is not json{"), auth); got != http.StatusBadRequest {
+		t.Errorf("malformed event: expected status 400, got %d", got)
+	}
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{nil, http.StatusOK},
+		{fmt.Errorf("%w: forged", lambda.ErrUntrusted), http.StatusForbidden},
+		{errors.New("slack unavailable"), http.StatusInternalServerError},
+	}
+	for _, tc := range tests {
+		p.err = tc.err
+		if got := post(t, ts.URL+"/events", eventJSON(t), auth); got != tc.expected {
+			t.Errorf("processing error %v: expected status %d, got %d", tc.err, tc.expected, got)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ts := newServer(t, &fakeProcessor{}, server.Config{APIKey: "secret"})
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: expected status 200, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv, err := server.New(&fakeProcessor{}, server.Config{APIKey: "secret", Addr: addr})
+	if err != nil {
+		t.Fatalf("failed creating server: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+
+	var up bool
+	for range 50 {
+		if resp, err := http.Get("http://" + addr + "/healthz"); err == nil {
+			resp.Body.Close()
+			up = true
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !up {
+		t.Fatal("server didn't start")
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't shut down")
+	}
+}
+
+// snsFake serves a signing certificate and subscription confirmations, and
+// signs messages like SNS.
+type snsFake struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	confirmed atomic.Int32
+}
+
+func newSNSFake(t *testing.T) *snsFake {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	f := &snsFake{key: key}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cert.pem":
+			_, _ = w.Write(certPEM)
+		case "/confirm":
+			f.confirmed.Add(1)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// message returns a signed SNS message of the given type.
+func (f *snsFake) message(t *testing.T, typ, topic, msg string) []byte {
+	t.Helper()
+	m := map[string]string{
+		"Type":             typ,
+		"MessageId":        "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+		"TopicArn":         topic,
+		"Message":          msg,
+		"Timestamp":        "2024-03-07T12:00:00.000Z",
+		"SignatureVersion": "2",
+		"SigningCertURL":   f.URL + "/cert.pem",
+	}
+	keys := []string{"Message", "MessageId", "Timestamp", "TopicArn", "Type"}
+	if typ != "Notification" {
+		m["Token"] = "token"
+		m["SubscribeURL"] = f.URL + "/confirm"
+		keys = []string{"Message", "MessageId", "SubscribeURL", "Timestamp", "Token", "TopicArn", "Type"}
+	}
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "\n" + m[k] + "\n")
+	}
+	digest := sha256.Sum256([]byte(b.String()))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	m["Signature"] = base64.StdEncoding.EncodeToString(sig)
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestSNS(t *testing.T) {
+	sns := newSNSFake(t)
+	p := &fakeProcessor{}
+	ts := newServer(t, p, server.Config{APIKey: "secret", SNSTopicARNs: []string{testTopic}},
+		server.WithHTTPClient(sns.Client()), server.WithSNSCertHost(regexp.MustCompile(`^127\.0\.0\.1$`)))
+
+	if got := post(t, ts.URL+"/sns", sns.message(t, "SubscriptionConfirmation", testTopic, "You have chosen to subscribe"), nil); got != http.StatusOK {
+		t.Errorf("subscription confirmation: expected status 200, got %d", got)
+	}
+	if got := sns.confirmed.Load(); got != 1 {
+		t.Errorf("expected the subscription to be confirmed, got %d confirmations", got)
+	}
+
+	if got := post(t, ts.URL+"/sns", sns.message(t, "Notification", testTopic, string(eventJSON(t))), nil); got != http.StatusOK {
+		t.Errorf("notification: expected status 200, got %d", got)
+	}
+	evts := p.events()
+	if len(evts) != 1 || evts[0].Detail.AlarmName != test.TriggeredAlarmDetails.Detail.AlarmName {
+		t.Errorf("expected the notification's alarm event to be processed, got %v", evts)
+	}
+
+	// classic alarm actions publish their own notification format
+	if got := post(t, ts.URL+"/sns", sns.message(t, "Notification", testTopic, test.ClassicAlarmJSON), nil); got != http.StatusOK {
+		t.Errorf("classic notification: expected status 200, got %d", got)
+	}
+	evts = p.events()
+	if len(evts) != 2 || evts[1].Detail.AlarmName != test.TriggeredAlarmDetails.Detail.AlarmName || evts[1].Source != cw.SourceCloudWatch {
+		t.Errorf("expected the classic notification to be converted and processed, got %v", evts)
+	}
+
+	if got := post(t, ts.URL+"/sns", sns.message(t, "Notification", "arn:aws:sns:us-east-1:1234567890123:other", string(eventJSON(t))), nil); got != http.StatusForbidden {
+		t.Errorf("unexpected topic: expected status 403, got %d", got)
+	}
+
+	var tampered map[string]string
+	if err := json.Unmarshal(sns.message(t, "Notification", testTopic, string(eventJSON(t))), &tampered); err != nil {
+		t.Fatal(err)
+	}
+	tampered["Message"] = strings.Replace(tampered["Message"], "ALARM", "OK", 1)
+	body, _ := json.Marshal(tampered)
+	if got := post(t, ts.URL+"/sns", body, nil); got != http.StatusForbidden {
+		t.Errorf("tampered message: expected status 403, got %d", got)
+	}
+	if got := len(p.events()); got != 2 {
+		t.Errorf("expected only the valid notifications to be processed, got %d", got)
+	}
+}
+
+func TestSNSRejectsForeignCertificate(t *testing.T) {
+	sns := newSNSFake(t)
+	p := &fakeProcessor{}
+	// default certificate hosts: the fake isn't SNS
+	ts := newServer(t, p, server.Config{APIKey: "secret", SNSTopicARNs: []string{testTopic}},
+		server.WithHTTPClient(sns.Client()))
+
+	if got := post(t, ts.URL+"/sns", sns.message(t, "Notification", testTopic, string(eventJSON(t))), nil); got != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", got)
+	}
+	if got := len(p.events()); got != 0 {
+		t.Errorf("expected no events to be processed, got %d", got)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+)
+
+// SNS message types.
+const (
+	snsNotification             = "Notification"
+	snsSubscriptionConfirmation = "SubscriptionConfirmation"
+	snsUnsubscribeConfirmation  = "UnsubscribeConfirmation"
+)
+
+// snsHost matches the hosts SNS serves signing certificates and
+// subscription confirmations from.
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// snsMessage is an SNS HTTP(S) delivery.
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL"`
+}
+
+// snsCert is a fetched SNS signing certificate's public key.
+type snsCert struct {
+	key *rsa.PublicKey
+}
+
+// handleSNS receives a message from an SNS HTTPS subscription to one of the
+// configured topics, after verifying SNS signed it.
+func (s *Server) handleSNS(w http.ResponseWriter, r *http.Request) {
+	var m snsMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&m); err != nil {
+		slog.Warn("rejecting undecodable sns message", "error", err)
+		http.Error(w, "malformed sns message", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(s.cfg.SNSTopicARNs, m.TopicArn) {
+		slog.Warn("rejecting sns message from unexpected topic", "topic_arn", m.TopicArn, "message_id", m.MessageID)
+		http.Error(w, "unexpected topic", http.StatusForbidden)
+		return
+	}
+	if err := s.verifySNS(r.Context(), &m); err != nil {
+		slog.Warn("rejecting sns message with invalid signature", "topic_arn", m.TopicArn, "message_id", m.MessageID, "error", err)
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	switch m.Type {
+	case snsSubscriptionConfirmation:
+		if err := s.confirmSubscription(r.Context(), &m); err != nil {
+			slog.Error("failed confirming sns subscription", "topic_arn", m.TopicArn, "error", err)
+			http.Error(w, "failed confirming subscription", http.StatusBadGateway)
+			return
+		}
+		slog.Info("confirmed sns subscription", "topic_arn", m.TopicArn)
+		w.WriteHeader(http.StatusOK)
+	case snsUnsubscribeConfirmation:
+		slog.Warn("unsubscribed from sns topic", "topic_arn", m.TopicArn)
+		w.WriteHeader(http.StatusOK)
+	case snsNotification:
+		// EventBridge rules and classic alarm actions can both publish to
+		// the topic
+		evt, err := cw.DecodeEvent([]byte(m.Message))
+		if err != nil {
+			slog.Warn("rejecting undecodable sns notification", "message_id", m.MessageID, "error", err)
+			http.Error(w, "malformed alarm event", http.StatusBadRequest)
+			return
+		}
+		evt.TopicARN = m.TopicArn
+		s.process(w, r, evt)
+	default:
+		http.Error(w, "unknown sns message type", http.StatusBadRequest)
+	}
+}
+
+// verifySNS checks the message's signature against the SNS signing
+// certificate it references.
+func (s *Server) verifySNS(ctx context.Context, m *snsMessage) error {
+	var hash crypto.Hash
+	switch m.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+	case "2":
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("unsupported signature version %q", m.SignatureVersion)
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	cert, err := s.signingCert(ctx, m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+
+	h := hash.New()
+	h.Write([]byte(m.stringToSign()))
+	return rsa.VerifyPKCS1v15(cert.key, hash, h.Sum(nil), sig)
+}
+
+// stringToSign builds the string SNS signs, from the fields present in the
+// message's type, in order.
+func (m *snsMessage) stringToSign() string {
+	fields := [][2]string{{"Message", m.Message}, {"MessageId", m.MessageID}}
+	if m.Type == snsNotification {
+		if m.Subject != "" {
+			fields = append(fields, [2]string{"Subject", m.Subject})
+		}
+		fields = append(fields, [2]string{"Timestamp", m.Timestamp})
+	} else {
+		fields = append(fields,
+			[2]string{"SubscribeURL", m.SubscribeURL},
+			[2]string{"Timestamp", m.Timestamp},
+			[2]string{"Token", m.Token})
+	}
+	fields = append(fields, [2]string{"TopicArn", m.TopicArn}, [2]string{"Type", m.Type})
+
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(f[0] + "\n" + f[1] + "\n")
+	}
+	return b.String()
+}
+
+// signingCert returns the signing certificate at the URL, which must be an
+// SNS one, fetching it once.
+func (s *Server) signingCert(ctx context.Context, certURL string) (*snsCert, error) {
+	if err := s.checkSNSURL(certURL); err != nil {
+		return nil, fmt.Errorf("signing certificate url: %w", err)
+	}
+	s.certsMu.Lock()
+	cert, ok := s.certs[certURL]
+	s.certsMu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	body, err := s.get(ctx, certURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching signing certificate: %w", err)
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("no pem certificate at %s", certURL)
+	}
+	x, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing certificate: %w", err)
+	}
+	key, ok := x.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("signing certificate has a %T key, expected rsa", x.PublicKey)
+	}
+
+	cert = &snsCert{key: key}
+	s.certsMu.Lock()
+	s.certs[certURL] = cert
+	s.certsMu.Unlock()
+	return cert, nil
+}
+
+// confirmSubscription visits the subscription's confirmation URL.
+func (s *Server) confirmSubscription(ctx context.Context, m *snsMessage) error {
+	if err := s.checkSNSURL(m.SubscribeURL); err != nil {
+		return fmt.Errorf("subscribe url: %w", err)
+	}
+	_, err := s.get(ctx, m.SubscribeURL)
+	return err
+}
+
+// checkSNSURL checks that the URL points at SNS, over https.
+func (s *Server) checkSNSURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || !s.certHost.MatchString(u.Hostname()) {
+		return fmt.Errorf("%s isn't an sns url", raw)
+	}
+	return nil
+}
+
+func (s *Server) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: unexpected status %d", u, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
@@ -0,0 +1,365 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package servicenow records alarms as ServiceNow incidents via the Table
+// API: alarms create an incident on trigger and resolve it again on OK.
+package servicenow
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/message"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+	"github.com/tidal-music/cw-alert-router/v2/parameterstore"
+)
+
+const (
+	// incidentPath is the Table API path of the incident table.
+	incidentPath = "/api/now/table/incident"
+	// stateResolved is the incident state value for "Resolved".
+	stateResolved = "6"
+	// DefaultCloseCode is the resolution code set on resolved incidents.
+	DefaultCloseCode = "Solution provided"
+	// maxShortDescriptionLength is the default length of the short_description column.
+	maxShortDescriptionLength = 160
+)
+
+// Store persists the sys_id of each alarm's open incident, keyed by alarm
+// ARN, so it can be resolved when the alarm returns to OK.
+type Store interface {
+	// Get returns the stored sys_id, or "" if there is none.
+	Get(ctx context.Context, alarmARN string) (string, error)
+	Put(ctx context.Context, alarmARN, sysID string) error
+	Delete(ctx context.Context, alarmARN string) error
+}
+
+// Credentials are the basic-auth credentials of the integration user.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Client creates and resolves ServiceNow incidents for alarms.
+type Client struct {
+	instanceURL string
+	creds       Credentials
+	store       Store
+	closeCode   string
+	httpClient  *http.Client
+}
+
+// ClientOptions provides the function opts pattern for overriding.
+type ClientOptions func(*Client)
+
+// WithHTTPClient allows overriding the HTTP client (for testing).
+func WithHTTPClient(hc *http.Client) ClientOptions {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithCloseCode overrides the resolution code (instances differ in the
+// choices they offer).
+func WithCloseCode(code string) ClientOptions {
+	return func(c *Client) {
+		c.closeCode = code
+	}
+}
+
+// New returns a new Client for the given instance (e.g.
+// https://example.service-now.com).
+func New(instanceURL string, creds Credentials, store Store, opts ...ClientOptions) (*Client, error) {
+	if instanceURL == "" {
+		return nil, fmt.Errorf("empty servicenow instance url provided")
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return nil, fmt.Errorf("empty servicenow credentials provided")
+	}
+	if store == nil {
+		return nil, fmt.Errorf("no servicenow incident store provided")
+	}
+
+	c := &Client{
+		instanceURL: strings.TrimRight(instanceURL, "/"),
+		creds:       creds,
+		store:       store,
+		closeCode:   DefaultCloseCode,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+	return c, nil
+}
+
+// Incident is the subset of incident columns the router writes. Reference
+// columns (assignment group, CI) are given by display value.
+type Incident struct {
+	ShortDescription   string `json:"short_description,omitempty"`
+	Description        string `json:"description,omitempty"`
+	AssignmentGroup    string `json:"assignment_group,omitempty"`
+	ConfigurationItem  string `json:"cmdb_ci,omitempty"`
+	CorrelationID      string `json:"correlation_id,omitempty"`
+	CorrelationDisplay string `json:"correlation_display,omitempty"`
+	State              string `json:"state,omitempty"`
+	CloseCode          string `json:"close_code,omitempty"`
+	CloseNotes         string `json:"close_notes,omitempty"`
+}
+
+// Record is a Table API record as returned by the instance.
+type Record struct {
+	SysID  string `json:"sys_id"`
+	Number string `json:"number"`
+}
+
+// SubmitEvent creates (ActionTrigger) or resolves (ActionResolve) the
+// incident for the alarm in the CloudWatch event, using the pagerduty
+// action semantics for alarm state transitions. assignmentGroup and
+// configurationItem may be empty.
+func (c *Client) SubmitEvent(ctx context.Context, action string, evt *cw.Event, assignmentGroup, configurationItem string) error {
+	switch action {
+	case pagerduty.ActionTrigger:
+		return c.createIncident(ctx, evt, assignmentGroup, configurationItem)
+	case pagerduty.ActionResolve:
+		return c.resolveIncident(ctx, evt)
+	default:
+		return nil
+	}
+}
+
+// createIncident creates an incident for the alarm unless one is already
+// open: recorded in the store, or found by correlation ID when the store
+// missed it (e.g. storing a created incident failed).
+func (c *Client) createIncident(ctx context.Context, evt *cw.Event, assignmentGroup, configurationItem string) error {
+	alarmARN, err := evt.AlarmARN()
+	if err != nil {
+		return err
+	}
+	existing, err := c.openIncident(ctx, alarmARN)
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		slog.Info("servicenow incident already open for alarm", "alarm", evt.Detail.AlarmName, "sys_id", existing)
+		return nil
+	}
+
+	msg := message.New(evt, pagerduty.ActionTrigger)
+	var rec Record
+	err = c.do(ctx, http.MethodPost, incidentPath, Incident{
+		ShortDescription:   message.Truncate(msg.Title(), maxShortDescriptionLength),
+		Description:        description(msg),
+		AssignmentGroup:    assignmentGroup,
+		ConfigurationItem:  configurationItem,
+		CorrelationID:      correlationID(alarmARN),
+		CorrelationDisplay: "cw-alert-router",
+	}, &rec)
+	if err != nil {
+		return fmt.Errorf("creating servicenow incident: %w", err)
+	}
+	slog.Info("created servicenow incident", "alarm", evt.Detail.AlarmName, "number", rec.Number, "sys_id", rec.SysID)
+
+	// the incident exists either way: failing here would create another one
+	// on retry, and it's found by correlation ID without the store
+	if err := c.store.Put(ctx, alarmARN, rec.SysID); err != nil {
+		slog.Error("failed storing servicenow incident", "alarm", evt.Detail.AlarmName, "number", rec.Number, "error", err)
+	}
+	return nil
+}
+
+// resolveIncident resolves the alarm's open incident, if any.
+func (c *Client) resolveIncident(ctx context.Context, evt *cw.Event) error {
+	alarmARN, err := evt.AlarmARN()
+	if err != nil {
+		return err
+	}
+	sysID, err := c.openIncident(ctx, alarmARN)
+	if err != nil {
+		return err
+	}
+	if sysID == "" {
+		slog.Info("no servicenow incident to resolve for alarm", "alarm", evt.Detail.AlarmName)
+		return nil
+	}
+
+	err = c.do(ctx, http.MethodPatch, fmt.Sprintf("%s/%s", incidentPath, sysID), Incident{
+		State:     stateResolved,
+		CloseCode: c.closeCode,
+		CloseNotes: fmt.Sprintf("Alarm %s returned to %s at %s: %s",
+			evt.Detail.AlarmName, evt.Detail.State.Value, evt.Detail.State.Timestamp, evt.Detail.State.Reason),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("resolving servicenow incident %s: %w", sysID, err)
+	}
+	slog.Info("resolved servicenow incident", "alarm", evt.Detail.AlarmName, "sys_id", sysID)
+	return c.store.Delete(ctx, alarmARN)
+}
+
+// openIncident returns the sys_id of the alarm's open incident: the stored
+// one, or else an active incident with the alarm's correlation ID. It's ""
+// if there is none.
+func (c *Client) openIncident(ctx context.Context, alarmARN string) (string, error) {
+	sysID, err := c.store.Get(ctx, alarmARN)
+	if err != nil {
+		return "", fmt.Errorf("looking up servicenow incident: %w", err)
+	}
+	if sysID != "" {
+		return sysID, nil
+	}
+
+	q := url.Values{
+		"sysparm_query":  {fmt.Sprintf("correlation_id=%s^active=true", correlationID(alarmARN))},
+		"sysparm_fields": {"sys_id,number"},
+		"sysparm_limit":  {"1"},
+	}
+	resp, err := c.send(ctx, http.MethodGet, c.instanceURL+incidentPath+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("querying servicenow incidents: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Result []Record `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding servicenow incidents: %w", err)
+	}
+	if len(result.Result) == 0 {
+		return "", nil
+	}
+	return result.Result[0].SysID, nil
+}
+
+// description renders the incident description from the alarm content.
+func description(msg message.Message) string {
+	var b strings.Builder
+	if msg.Description != "" {
+		fmt.Fprintf(&b, "%s\n\n", msg.Description)
+	}
+	fmt.Fprintf(&b, "Metrics: %s\n", msg.MetricsText(" - "))
+	if msg.Reason != "" {
+		fmt.Fprintf(&b, "Reason: %s\n", msg.Reason)
+	}
+	fmt.Fprintf(&b, "AWS Console: %s\n", msg.ConsoleLink)
+	return b.String()
+}
+
+// correlationID shortens the alarm ARN to fit the correlation_id column (100
+// characters), which alarm ARNs can exceed.
+func correlationID(alarmARN string) string {
+	sum := sha256.Sum256([]byte(alarmARN))
+	return hex.EncodeToString(sum[:])
+}
+
+// do sends a Table API request and decodes the returned record into out
+// (if non-nil).
+func (c *Client) do(ctx context.Context, method, path string, in any, out *Record) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	// reference columns are set by display value (group/CI names)
+	resp, err := c.send(ctx, method, c.instanceURL+path+"?sysparm_input_display_value=true&sysparm_fields=sys_id,number", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	var result struct {
+		Result Record `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	if result.Result.SysID == "" {
+		return fmt.Errorf("response has no sys_id")
+	}
+	*out = result.Result
+	return nil
+}
+
+// send makes an authenticated Table API request, failing on non-2xx
+// responses. The caller closes the response body.
+func (c *Client) send(ctx context.Context, method, target string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.creds.Username, c.creds.Password)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, detail)
+	}
+	return resp, nil
+}
+
+// ParameterStore is a Store backed by Parameter Store: one String parameter
+// per open incident, named by the pattern and a hash of the alarm ARN
+// (alarm ARNs contain characters parameter names can't).
+type ParameterStore struct {
+	ps      *parameterstore.Client
+	pattern string
+}
+
+// NewParameterStore returns a ParameterStore writing under the given key
+// pattern (must contain one %s).
+func NewParameterStore(ps *parameterstore.Client, pattern string) *ParameterStore {
+	return &ParameterStore{ps: ps, pattern: pattern}
+}
+
+// Key returns the parameter name the alarm's sys_id is stored under.
+func (s *ParameterStore) Key(alarmARN string) string {
+	return fmt.Sprintf(s.pattern, correlationID(alarmARN))
+}
+
+// Get implements Store.
+func (s *ParameterStore) Get(ctx context.Context, alarmARN string) (string, error) {
+	sysID, err := s.ps.GetParameterValue(ctx, s.Key(alarmARN))
+	if parameterstore.IsNotFound(err) {
+		return "", nil
+	}
+	return sysID, err
+}
+
+// Put implements Store.
+func (s *ParameterStore) Put(ctx context.Context, alarmARN, sysID string) error {
+	return s.ps.PutParameterValue(ctx, s.Key(alarmARN), sysID)
+}
+
+// Delete implements Store.
+func (s *ParameterStore) Delete(ctx context.Context, alarmARN string) error {
+	return s.ps.DeleteParameter(ctx, s.Key(alarmARN))
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servicenow_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
+	"github.com/tidal-music/cw-alert-router/v2/parameterstore"
+	"github.com/tidal-music/cw-alert-router/v2/servicenow"
+	"github.com/tidal-music/cw-alert-router/v2/test"
+)
+
+const storePattern = "/service/cw_alert_router/servicenow/incidents/%s"
+
+func newClient(t *testing.T, creds servicenow.Credentials) (*servicenow.Client, *test.ServiceNowServer, *servicenow.ParameterStore) {
+	t.Helper()
+	server := test.NewServiceNowServer()
+	t.Cleanup(server.Close)
+
+	store := servicenow.NewParameterStore(parameterstore.NewWithAPI(&test.MockSSMClient{}), storePattern)
+	client, err := servicenow.New(server.URL(), creds, store)
+	if err != nil {
+		t.Fatalf("failed creating servicenow client: %v", err)
+	}
+	return client, server, store
+}
+
+func validCredentials() servicenow.Credentials {
+	return servicenow.Credentials{Username: test.ServiceNowUsername, Password: test.ServiceNowPassword}
+}
+
+func TestCreateAndResolveIncident(t *testing.T) {
+	client, server, store := newClient(t, validCredentials())
+	ctx := context.Background()
+	evt := test.TriggeredAlarmDetails
+	alarmARN := evt.Resources[0]
+
+	if err := client.SubmitEvent(ctx, pagerduty.ActionTrigger, &evt, "Platform Engineering", "test-service"); err != nil {
+		t.Fatalf("SubmitEvent(trigger) returned error: %v", err)
+	}
+	incidents := server.Incidents()
+	if len(incidents) != 1 {
+		t.Fatalf("expected 1 incident, got %d", len(incidents))
+	}
+	fields := incidents[0].Fields
+	if fields["assignment_group"] != "Platform Engineering" || fields["cmdb_ci"] != "test-service" {
+		t.Errorf("unexpected assignment group/CI: %v", fields)
+	}
+	if !strings.Contains(fields["short_description"], "test-service-alarm-abcd") {
+		t.Errorf("unexpected short description: %s", fields["short_description"])
+	}
+	if sysID, _ := store.Get(ctx, alarmARN); sysID != incidents[0].SysID {
+		t.Errorf("expected sys_id %s to be stored, got %q", incidents[0].SysID, sysID)
+	}
+
+	// a redelivered trigger doesn't create a second incident
+	if err := client.SubmitEvent(ctx, pagerduty.ActionTrigger, &evt, "Platform Engineering", "test-service"); err != nil {
+		t.Fatalf("SubmitEvent(trigger) returned error: %v", err)
+	}
+	if got := len(server.Incidents()); got != 1 {
+		t.Fatalf("expected the open incident to be reused, got %d incidents", got)
+	}
+
+	resolved := test.ResolvedEvent(evt)
+	if err := client.SubmitEvent(ctx, pagerduty.ActionResolve, &resolved, "", ""); err != nil {
+		t.Fatalf("SubmitEvent(resolve) returned error: %v", err)
+	}
+	fields = server.Incidents()[0].Fields
+	if fields["state"] != "6" || fields["close_notes"] == "" || fields["close_code"] != servicenow.DefaultCloseCode {
+		t.Errorf("expected a resolved incident with close notes, got %v", fields)
+	}
+	if sysID, _ := store.Get(ctx, alarmARN); sysID != "" {
+		t.Errorf("expected the stored sys_id to be removed, got %q", sysID)
+	}
+}
+
+// failingStore is a Store that can't store anything.
+type failingStore struct{}
+
+func (failingStore) Get(context.Context, string) (string, error) { return "", nil }
+func (failingStore) Put(context.Context, string, string) error   { return errors.New("access denied") }
+func (failingStore) Delete(context.Context, string) error        { return nil }
+
+func TestCreateIncidentStoreFailure(t *testing.T) {
+	server := test.NewServiceNowServer()
+	t.Cleanup(server.Close)
+	client, err := servicenow.New(server.URL(), validCredentials(), failingStore{})
+	if err != nil {
+		t.Fatalf("failed creating servicenow client: %v", err)
+	}
+	ctx := context.Background()
+	evt := test.TriggeredAlarmDetails
+
+	// the incident was created, so the delivery succeeds and a retry finds
+	// it by correlation ID instead of creating another
+	for range 2 {
+		if err := client.SubmitEvent(ctx, pagerduty.ActionTrigger, &evt, "", ""); err != nil {
+			t.Fatalf("SubmitEvent(trigger) returned error: %v", err)
+		}
+	}
+	if got := len(server.Incidents()); got != 1 {
+		t.Fatalf("expected 1 incident, got %d", got)
+	}
+
+	resolved := test.ResolvedEvent(evt)
+	if err := client.SubmitEvent(ctx, pagerduty.ActionResolve, &resolved, "", ""); err != nil {
+		t.Fatalf("SubmitEvent(resolve) returned error: %v", err)
+	}
+	if state := server.Incidents()[0].Fields["state"]; state != "6" {
+		t.Errorf("expected the incident found by correlation ID to be resolved, got state %q", state)
+	}
+}
+
+func TestResolveWithoutIncident(t *testing.T) {
+	client, server, _ := newClient(t, validCredentials())
+
+	evt := test.TriggeredAlarmDetails
+	evt.Detail.PreviousState = test.TestTriggeredAlarm.State
+	evt.Detail.State = test.TestOKAlarm.State
+	if err := client.SubmitEvent(context.Background(), pagerduty.ActionResolve, &evt, "", ""); err != nil {
+		t.Fatalf("SubmitEvent(resolve) returned error: %v", err)
+	}
+	if got := len(server.Incidents()); got != 0 {
+		t.Errorf("expected no incidents, got %d", got)
+	}
+}
+
+func TestCreateIncidentAuthFailure(t *testing.T) {
+	client, _, _ := newClient(t, servicenow.Credentials{Username: "someone", Password: "wrong"})
+
+	evt := test.TriggeredAlarmDetails
+	if err := client.SubmitEvent(context.Background(), pagerduty.ActionTrigger, &evt, "", ""); err == nil {
+		t.Errorf("expected an error for rejected credentials")
+	}
+}
@@ -18,20 +18,50 @@ package slack
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	slackapi "github.com/slack-go/slack"
 
 	"github.com/tidal-music/cw-alert-router/v2/cw"
+	"github.com/tidal-music/cw-alert-router/v2/message"
+	"github.com/tidal-music/cw-alert-router/v2/pagerduty"
 )
 
 // Emoji prefixes for the alarm state headers.
 const (
-	triggeredPrefix = ":rotating_light: (triggered)"
-	resolvedPrefix  = ":white_check_mark: (resolved)"
+	triggeredPrefix   = ":rotating_light: (triggered)"
+	resolvedPrefix    = ":white_check_mark: (resolved)"
+	flappingPrefix    = ":warning: (flapping)"
+	stablePrefix      = ":large_green_circle: (stabilised)"
+	rejectedPrefix    = ":no_entry: (page rejected)"
+	quarantinedPrefix = ":biohazard_sign: (quarantined)"
+	dryRunPrefix      = ":test_tube: (dry run)"
+)
+
+// Slack limits a section's text to 3000 characters and a message to 50
+// blocks; storm summaries stay below both.
+const (
+	maxSectionText   = 3000
+	maxStormSections = 45
+)
+
+// DefaultChannelInterval is the minimum time between messages to one
+// channel, following Slack's guideline of about one message per second.
+const DefaultChannelInterval = time.Second
+
+// Rate-limit handling: a rate-limited call is retried after the Retry-After
+// Slack asks for, as long as that leaves deadlineReserve before the context
+// deadline (the rest of the lambda invocation still needs to run).
+const (
+	maxRateLimitAttempts = 5
+	deadlineReserve      = time.Second
 )
 
 // Retry budget for referencing a just-uploaded file from an image block.
@@ -48,11 +78,50 @@ type ImageRef struct {
 	SlackFileID string
 }
 
+// ThrottleStats counts how often Slack calls were slowed down or rejected
+// by rate limiting.
+type ThrottleStats struct {
+	// RateLimited counts 429 responses from Slack.
+	RateLimited int64
+	// Retried counts calls retried after a 429.
+	Retried int64
+	// GaveUp counts calls that failed because waiting out a 429 would
+	// overrun the deadline.
+	GaveUp int64
+	// Paced counts calls that waited for their channel's next slot (pacing,
+	// or the Retry-After of an earlier call), and PacingDelay the total time
+	// they waited.
+	Paced       int64
+	PacingDelay time.Duration
+}
+
+// Sub returns the stats accumulated since o was taken.
+func (s ThrottleStats) Sub(o ThrottleStats) ThrottleStats {
+	return ThrottleStats{
+		RateLimited: s.RateLimited - o.RateLimited,
+		Retried:     s.Retried - o.Retried,
+		GaveUp:      s.GaveUp - o.GaveUp,
+		Paced:       s.Paced - o.Paced,
+		PacingDelay: s.PacingDelay - o.PacingDelay,
+	}
+}
+
 // Client wraps slack with simpler more specific calls suited for this lambda.
 type Client struct {
-	api          *slackapi.Client
-	alternateURL string
-	debug        bool
+	api             *slackapi.Client
+	token           string
+	alternateURL    string
+	debug           bool
+	channelInterval time.Duration
+	dryRun          bool
+	shadowChannel   string
+
+	mu       sync.Mutex
+	nextSlot map[string]time.Time
+	// channelIDs maps the channel names posted to onto their IDs, so a
+	// channel is paced once whether it's addressed by name or by ID.
+	channelIDs map[string]string
+	stats      ThrottleStats
 }
 
 // ClientOptions provides the function opts pattern for overriding.
@@ -72,13 +141,31 @@ func OptionDebug(d bool) ClientOptions {
 	}
 }
 
+// WithChannelInterval sets the minimum time between messages to one channel
+// (DefaultChannelInterval by default, 0 disables pacing).
+func WithChannelInterval(d time.Duration) ClientOptions {
+	return func(c *Client) {
+		c.channelInterval = d
+	}
+}
+
+// WithDryRun logs messages instead of posting them, with their blocks. With
+// a shadow channel, they're posted there instead, noting the channel they
+// were meant for.
+func WithDryRun(shadowChannel string) ClientOptions {
+	return func(c *Client) {
+		c.dryRun = true
+		c.shadowChannel = shadowChannel
+	}
+}
+
 // New returns a newly initialized slack client.
 func New(slackAPIToken string, opts ...ClientOptions) (*Client, error) {
 	if slackAPIToken == "" {
 		return nil, fmt.Errorf("empty slack token provided")
 	}
 
-	c := &Client{}
+	c := &Client{token: slackAPIToken, channelInterval: DefaultChannelInterval, nextSlot: make(map[string]time.Time), channelIDs: make(map[string]string)}
 	for _, opt := range opts {
 		opt(c)
 	}
@@ -94,36 +181,29 @@ func New(slackAPIToken string, opts ...ClientOptions) (*Client, error) {
 
 // HeaderBlock produces a slack block for the alarm details - regardless of state.
 func (c *Client) HeaderBlock(evt *cw.Event, prefix string) *slackapi.SectionBlock {
+	return c.headerBlock(message.New(evt, pagerduty.ActionNone), prefix)
+}
+
+func (c *Client) headerBlock(msg message.Message, prefix string) *slackapi.SectionBlock {
 	header := slackapi.NewTextBlockObject(slackapi.MarkdownType,
-		fmt.Sprintf("*%s CloudWatch Alarm: %s*", prefix, evt.Detail.AlarmName), false, false)
+		fmt.Sprintf("*%s %s*", prefix, msg.Title()), false, false)
 	return slackapi.NewSectionBlock(header, nil, nil)
 }
 
 // SummaryBlock returns a slack block with the alarm summary (metrics and state reason).
 func (c *Client) SummaryBlock(evt *cw.Event) *slackapi.SectionBlock {
-	summary := evt.MetricSummary()
-	var parts []string
-	if len(summary.Names) > 0 {
-		parts = append(parts, fmt.Sprintf("Names: %s", strings.Join(summary.Names, ",")))
-	}
-	if len(summary.Namespaces) > 0 {
-		parts = append(parts, fmt.Sprintf("Namespaces: %s", strings.Join(summary.Namespaces, ",")))
-	}
-	if len(summary.Dimensions) > 0 {
-		parts = append(parts, fmt.Sprintf("Dimensions: %s", strings.Join(summary.Dimensions, ",")))
-	}
-	if len(summary.Expressions) > 0 {
-		parts = append(parts, fmt.Sprintf("Expressions: %s", strings.Join(summary.Expressions, ",")))
-	}
+	return c.summaryBlock(message.New(evt, pagerduty.ActionNone))
+}
 
+func (c *Client) summaryBlock(msg message.Message) *slackapi.SectionBlock {
 	var text string
-	if len(parts) > 0 {
-		text = fmt.Sprintf("*Metrics*: `%s`", strings.Join(parts, " - "))
+	if len(msg.Metrics) > 0 {
+		text = fmt.Sprintf("*Metrics*: `%s`", msg.MetricsText(" - "))
 	} else {
-		text = "*Metrics*\n`None found`"
+		text = fmt.Sprintf("*Metrics*\n`%s`", message.NoMetrics)
 	}
-	if reason := evt.Detail.State.Reason; reason != "" {
-		text = fmt.Sprintf("%s\nReason: `%s`", text, reason)
+	if msg.Reason != "" {
+		text = fmt.Sprintf("%s\nReason: `%s`", text, msg.Reason)
 	}
 
 	block := slackapi.NewTextBlockObject(slackapi.MarkdownType, text, false, false)
@@ -132,8 +212,12 @@ func (c *Client) SummaryBlock(evt *cw.Event) *slackapi.SectionBlock {
 
 // LinkBlock adds a link to the CloudWatch console to the slack message.
 func (c *Client) LinkBlock(evt *cw.Event) *slackapi.SectionBlock {
+	return c.linkBlock(message.New(evt, pagerduty.ActionNone))
+}
+
+func (c *Client) linkBlock(msg message.Message) *slackapi.SectionBlock {
 	link := slackapi.NewTextBlockObject(slackapi.MarkdownType,
-		fmt.Sprintf("Link: <%s|AWS Console>", evt.ConsoleLink()), false, false)
+		fmt.Sprintf("Link: <%s|AWS Console>", msg.ConsoleLink), false, false)
 	return slackapi.NewSectionBlock(link, nil, nil)
 }
 
@@ -158,6 +242,10 @@ func (c *Client) imageBlock(img ImageRef) *slackapi.ImageBlock {
 // UploadImage uploads a PNG to Slack (unshared) and returns its file ID for
 // referencing from an image block.
 func (c *Client) UploadImage(ctx context.Context, filename string, png []byte) (string, error) {
+	if c.dryRun && c.shadowChannel == "" {
+		slog.Info("dry run, not uploading image to slack", "filename", filename, "size", len(png))
+		return "", nil
+	}
 	file, err := c.api.UploadFileContext(ctx, slackapi.UploadFileParameters{
 		Filename: filename,
 		Title:    filename,
@@ -172,24 +260,38 @@ func (c *Client) UploadImage(ctx context.Context, filename string, png []byte) (
 
 // SendEventResolved will send a resolved message given the event details.
 func (c *Client) SendEventResolved(ctx context.Context, channel string, evt *cw.Event, img ImageRef) (string, string, error) {
-	return c.sendEvent(ctx, channel, evt, img, resolvedPrefix)
+	return c.sendEvent(ctx, channel, message.New(evt, pagerduty.ActionResolve), img)
 }
 
 // SendEventTriggered will send a triggered message given the event details.
 func (c *Client) SendEventTriggered(ctx context.Context, channel string, evt *cw.Event, img ImageRef) (string, string, error) {
-	return c.sendEvent(ctx, channel, evt, img, triggeredPrefix)
+	return c.sendEvent(ctx, channel, message.New(evt, pagerduty.ActionTrigger), img)
 }
 
-func (c *Client) sendEvent(ctx context.Context, channel string, evt *cw.Event, img ImageRef, prefix string) (string, string, error) {
+// EventBlocks returns the blocks of the triggered or resolved message for
+// the event, as SendEventTriggered and SendEventResolved send them.
+func (c *Client) EventBlocks(evt *cw.Event, action string, img ImageRef) []slackapi.Block {
+	return c.eventBlocks(message.New(evt, action), img)
+}
+
+func (c *Client) eventBlocks(msg message.Message, img ImageRef) []slackapi.Block {
+	prefix := triggeredPrefix
+	if msg.Resolved() {
+		prefix = resolvedPrefix
+	}
+	blocks := []slackapi.Block{c.headerBlock(msg, prefix), c.summaryBlock(msg)}
+	if imgBlock := c.imageBlock(img); imgBlock != nil {
+		blocks = append(blocks, imgBlock)
+	}
+	return append(blocks, c.linkBlock(msg))
+}
+
+func (c *Client) sendEvent(ctx context.Context, channel string, msg message.Message, img ImageRef) (string, string, error) {
 	buildBlocks := func(withImage bool) []slackapi.Block {
-		blocks := []slackapi.Block{c.HeaderBlock(evt, prefix), c.SummaryBlock(evt)}
 		if withImage {
-			if imgBlock := c.imageBlock(img); imgBlock != nil {
-				blocks = append(blocks, imgBlock)
-			}
+			return c.eventBlocks(msg, img)
 		}
-		blocks = append(blocks, c.LinkBlock(evt))
-		return blocks
+		return c.eventBlocks(msg, ImageRef{})
 	}
 
 	// A freshly uploaded slack file can take a moment before it is
@@ -197,7 +299,7 @@ func (c *Client) sendEvent(ctx context.Context, channel string, evt *cw.Event, i
 	// sending without the graph - the alert matters more than the image.
 	var lastErr error
 	for attempt := 0; attempt < uploadedFileAttempts; attempt++ {
-		id, ts, err := c.SendMessage(ctx, channel, slackapi.MsgOptionBlocks(buildBlocks(true)...))
+		id, ts, err := c.sendBlocks(ctx, channel, buildBlocks(true)...)
 		if err == nil {
 			return id, ts, nil
 		}
@@ -213,7 +315,122 @@ func (c *Client) sendEvent(ctx context.Context, channel string, evt *cw.Event, i
 		}
 	}
 	slog.Error("giving up embedding the uploaded graph, sending without it", "error", lastErr)
-	return c.SendMessage(ctx, channel, slackapi.MsgOptionBlocks(buildBlocks(false)...))
+	return c.sendBlocks(ctx, channel, buildBlocks(false)...)
+}
+
+// flappingBlocks builds the blocks of the collapsed message for a flapping
+// alarm, reflecting its latest transition.
+func (c *Client) flappingBlocks(evt *cw.Event, transitions int, window time.Duration) []slackapi.Block {
+	msg := message.New(evt, pagerduty.Action(evt.Detail.PreviousState.Value, evt.Detail.State.Value))
+	text := fmt.Sprintf("State changed %d times in the last %s, now `%s` (%s).\nFurther notifications are collapsed into this message until the alarm is stable for %s.",
+		transitions, window, evt.Detail.State.Value, evt.StateChangeTime().UTC().Format(time.RFC3339), window)
+	status := slackapi.NewTextBlockObject(slackapi.MarkdownType, text, false, false)
+	return []slackapi.Block{
+		c.headerBlock(msg, flappingPrefix),
+		slackapi.NewSectionBlock(status, nil, nil),
+		c.summaryBlock(msg),
+		c.linkBlock(msg),
+	}
+}
+
+// SendFlapping announces that an alarm is flapping and returns the channel
+// ID and timestamp of the message, for UpdateFlapping.
+func (c *Client) SendFlapping(ctx context.Context, channel string, evt *cw.Event, transitions int, window time.Duration) (string, string, error) {
+	return c.sendBlocks(ctx, channel, c.flappingBlocks(evt, transitions, window)...)
+}
+
+// UpdateFlapping updates a message sent by SendFlapping with a further
+// transition of the alarm.
+func (c *Client) UpdateFlapping(ctx context.Context, channelID, ts string, evt *cw.Event, transitions int, window time.Duration) error {
+	if c.dryRun && c.shadowChannel == "" {
+		// only shadow messages have a timestamp to update
+		return nil
+	}
+	slog.Info("updating slack message", "channel", channelID, "ts", ts)
+	err := c.call(ctx, channelID, func() error {
+		_, _, _, err := c.api.UpdateMessageContext(ctx, channelID, ts, slackapi.MsgOptionBlocks(c.flappingBlocks(evt, transitions, window)...))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("updating slack message %s in %s: %w", ts, channelID, err)
+	}
+	return nil
+}
+
+// SendStabilised announces that a flapping alarm is stable again, in the
+// state of its last transition.
+func (c *Client) SendStabilised(ctx context.Context, channel string, evt *cw.Event, collapsed int) (string, string, error) {
+	msg := message.New(evt, pagerduty.Action(evt.Detail.PreviousState.Value, evt.Detail.State.Value))
+	text := fmt.Sprintf("Stopped flapping after %d collapsed notifications, now `%s`.", collapsed, evt.Detail.State.Value)
+	status := slackapi.NewTextBlockObject(slackapi.MarkdownType, text, false, false)
+	return c.sendBlocks(ctx, channel,
+		c.headerBlock(msg, stablePrefix),
+		slackapi.NewSectionBlock(status, nil, nil),
+		c.linkBlock(msg),
+	)
+}
+
+// SendPagerDutyRejected alerts that PagerDuty rejected the alarm's event,
+// so nobody was paged for it.
+func (c *Client) SendPagerDutyRejected(ctx context.Context, channel string, evt *cw.Event, reason error) (string, string, error) {
+	msg := message.New(evt, pagerduty.Action(evt.Detail.PreviousState.Value, evt.Detail.State.Value))
+	text := fmt.Sprintf("PagerDuty rejected this alarm's event, nobody was paged. Check the service's routing key.\n```%s```", reason)
+	status := slackapi.NewTextBlockObject(slackapi.MarkdownType, text, false, false)
+	return c.sendBlocks(ctx, channel,
+		c.headerBlock(msg, rejectedPrefix),
+		slackapi.NewSectionBlock(status, nil, nil),
+		c.linkBlock(msg),
+	)
+}
+
+// SendQuarantined notices that an SQS record that was rejected as malformed
+// or untrusted was quarantined, and where to find it.
+func (c *Client) SendQuarantined(ctx context.Context, channel, messageID, location string, reason error) (string, string, error) {
+	text := fmt.Sprintf("%s Quarantined SQS message `%s`, it was rejected: `%s`\nStored in `%s`.",
+		quarantinedPrefix, messageID, reason, location)
+	return c.sendBlocks(ctx, channel,
+		slackapi.NewSectionBlock(slackapi.NewTextBlockObject(slackapi.MarkdownType, text, false, false), nil, nil),
+	)
+}
+
+// SendStorm posts one summary message for alarms triggered together,
+// listing each alarm with a link to it.
+func (c *Client) SendStorm(ctx context.Context, channel string, evts []*cw.Event) (string, string, error) {
+	header := slackapi.NewTextBlockObject(slackapi.MarkdownType,
+		fmt.Sprintf("*%s %d CloudWatch alarms*", triggeredPrefix, len(evts)), false, false)
+	blocks := []slackapi.Block{slackapi.NewSectionBlock(header, nil, nil)}
+
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			body := slackapi.NewTextBlockObject(slackapi.MarkdownType, text.String(), false, false)
+			blocks = append(blocks, slackapi.NewSectionBlock(body, nil, nil))
+			text.Reset()
+		}
+	}
+	for i, evt := range evts {
+		msg := message.New(evt, pagerduty.ActionTrigger)
+		line := fmt.Sprintf("• <%s|%s>", msg.ConsoleLink, msg.AlarmName)
+		if len(msg.Metrics) > 0 {
+			line = fmt.Sprintf("%s `%s`", line, msg.MetricsText(" - "))
+		}
+		if text.Len()+len(line)+1 > maxSectionText {
+			flush()
+		}
+		if len(blocks) == maxStormSections {
+			if text.Len() > 0 {
+				text.WriteString("\n")
+			}
+			text.WriteString(fmt.Sprintf("…and %d more", len(evts)-i))
+			break
+		}
+		if text.Len() > 0 {
+			text.WriteString("\n")
+		}
+		text.WriteString(line)
+	}
+	flush()
+	return c.sendBlocks(ctx, channel, blocks...)
 }
 
 // isTransientFileError reports whether a postMessage failure looks like the
@@ -223,17 +440,278 @@ func isTransientFileError(err error) bool {
 	return strings.Contains(msg, "invalid_blocks") || strings.Contains(msg, "file_not_found")
 }
 
-// SendMessage sends a message to a slack channel and returns the channel ID and timestamp.
+// SendMessage sends a message to a slack channel and returns the channel ID
+// and timestamp. In a dry run it's only logged: the client's own messages are
+// posted to the shadow channel, but arbitrary options can't be rewritten.
 func (c *Client) SendMessage(ctx context.Context, channel string, opts ...slackapi.MsgOption) (string, string, error) {
+	if c.dryRun {
+		_, values, _ := slackapi.UnsafeApplyMsgOptions(c.token, channel, "", opts...)
+		slog.Info("dry run, not posting slack message", "channel", channel, "text", values.Get("text"))
+		return "", "", nil
+	}
+	return c.post(ctx, channel, opts...)
+}
+
+// sendBlocks sends a message of blocks. In a dry run it's logged instead,
+// and posted to the shadow channel if there is one.
+func (c *Client) sendBlocks(ctx context.Context, channel string, blocks ...slackapi.Block) (string, string, error) {
+	if c.dryRun {
+		b, err := json.Marshal(blocks)
+		if err != nil {
+			return "", "", fmt.Errorf("encoding slack message to %s: %w", channel, err)
+		}
+		slog.Info("dry run, not posting slack message", "channel", channel, "shadow_channel", c.shadowChannel, "blocks", string(b))
+		if c.shadowChannel == "" {
+			return "", "", nil
+		}
+		note := slackapi.NewContextBlock("", slackapi.NewTextBlockObject(slackapi.MarkdownType, c.shadowNote(channel), false, false))
+		channel, blocks = c.shadowChannel, append([]slackapi.Block{note}, blocks...)
+	}
+	return c.post(ctx, channel, slackapi.MsgOptionBlocks(blocks...))
+}
+
+// shadowNote introduces a shadow message with the channel it was meant for.
+func (c *Client) shadowNote(channel string) string {
+	return fmt.Sprintf("%s meant for `%s`", dryRunPrefix, channel)
+}
+
+// post sends a message to a slack channel and returns the channel ID and
+// timestamp.
+func (c *Client) post(ctx context.Context, channel string, opts ...slackapi.MsgOption) (string, string, error) {
 	slog.Info("sending slack message", "channel", channel)
-	channelID, timestamp, err := c.api.PostMessageContext(ctx, channel, opts...)
+	var channelID, timestamp string
+	err := c.call(ctx, channel, func() error {
+		var err error
+		channelID, timestamp, err = c.api.PostMessageContext(ctx, channel, opts...)
+		return err
+	})
 	if err != nil {
 		return "", "", fmt.Errorf("posting slack message to %s: %w", channel, err)
 	}
+	c.learnChannelID(channel, channelID)
 	return channelID, timestamp, nil
 }
 
+// ThrottleStats returns the throttling counters accumulated by the client.
+func (c *Client) ThrottleStats() ThrottleStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// call makes a message call to a channel: paced to the channel interval,
+// and retried when Slack rate limits it and Retry-After fits in the
+// context deadline.
+func (c *Client) call(ctx context.Context, channel string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := c.pace(ctx, channel); err != nil {
+			return err
+		}
+		err := fn()
+		var rle *slackapi.RateLimitedError
+		if !errors.As(err, &rle) {
+			return err
+		}
+
+		c.count(func(s *ThrottleStats) { s.RateLimited++ })
+		if attempt == maxRateLimitAttempts || !fitsDeadline(ctx, rle.RetryAfter) {
+			c.count(func(s *ThrottleStats) { s.GaveUp++ })
+			slog.Warn("slack rate limited, giving up", "channel", channel, "retry_after", rle.RetryAfter, "attempt", attempt)
+			return err
+		}
+		c.count(func(s *ThrottleStats) { s.Retried++ })
+		slog.Warn("slack rate limited, retrying", "channel", channel, "retry_after", rle.RetryAfter, "attempt", attempt)
+		c.delay(channel, rle.RetryAfter)
+	}
+}
+
+// pace waits for the channel's next free slot, and reserves the one after.
+// A call that can't wait for its slot within the deadline reserves nothing.
+func (c *Client) pace(ctx context.Context, channel string) error {
+	c.mu.Lock()
+	now := time.Now()
+	key := c.paceKey(channel)
+	slot := c.nextSlot[key]
+	if slot.Before(now) {
+		slot = now
+	}
+	wait := slot.Sub(now)
+	if wait > 0 && !fitsDeadline(ctx, wait) {
+		c.mu.Unlock()
+		return fmt.Errorf("waiting %s to post to %s would overrun the deadline", wait, channel)
+	}
+	c.nextSlot[key] = slot.Add(c.channelInterval)
+	if wait > 0 {
+		c.stats.Paced++
+		c.stats.PacingDelay += wait
+	}
+	c.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	slog.Debug("pacing slack message", "channel", channel, "wait", wait)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// delay pushes the channel's next free slot back by d from now.
+func (c *Client) delay(channel string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := c.paceKey(channel)
+	if next := time.Now().Add(d); next.After(c.nextSlot[key]) {
+		c.nextSlot[key] = next
+	}
+}
+
+// paceKey returns the key a channel is paced under: its ID once known.
+// The caller holds c.mu.
+func (c *Client) paceKey(channel string) string {
+	if id, ok := c.channelIDs[channel]; ok {
+		return id
+	}
+	return channel
+}
+
+// learnChannelID records the ID of a channel posted to by name, moving the
+// channel's pacing over to the ID.
+func (c *Client) learnChannelID(channel, id string) {
+	if id == "" || id == channel {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.channelIDs[channel]; ok {
+		return
+	}
+	c.channelIDs[channel] = id
+	if slot, ok := c.nextSlot[channel]; ok {
+		if slot.After(c.nextSlot[id]) {
+			c.nextSlot[id] = slot
+		}
+		delete(c.nextSlot, channel)
+	}
+}
+
+func (c *Client) count(fn func(*ThrottleStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn(&c.stats)
+}
+
+// fitsDeadline reports whether waiting d leaves deadlineReserve before the
+// context deadline, if it has one.
+func fitsDeadline(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) >= d+deadlineReserve
+}
+
+// Identity is who the client's token authenticates as.
+type Identity struct {
+	User   string
+	UserID string
+	Team   string
+	TeamID string
+	BotID  string
+	// Scopes are the OAuth scopes granted to the token.
+	Scopes []string
+}
+
+// AuthTest checks the token with auth.test, returning who it authenticates
+// as and its scopes. The scopes only come in a response header, which the
+// Slack library doesn't expose, so auth.test is called directly.
+func (c *Client) AuthTest(ctx context.Context) (*Identity, error) {
+	base := slackapi.APIURL
+	if c.alternateURL != "" {
+		base = c.alternateURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"auth.test", nil)
+	if err != nil {
+		return nil, fmt.Errorf("testing slack token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("testing slack token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		OK     bool   `json:"ok"`
+		Error  string `json:"error"`
+		User   string `json:"user"`
+		UserID string `json:"user_id"`
+		Team   string `json:"team"`
+		TeamID string `json:"team_id"`
+		BotID  string `json:"bot_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("testing slack token: decoding response (status %d): %w", resp.StatusCode, err)
+	}
+	if !body.OK {
+		return nil, fmt.Errorf("testing slack token: %s", body.Error)
+	}
+	id := &Identity{User: body.User, UserID: body.UserID, Team: body.Team, TeamID: body.TeamID, BotID: body.BotID}
+	for _, scope := range strings.Split(resp.Header.Get("X-OAuth-Scopes"), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			id.Scopes = append(id.Scopes, scope)
+		}
+	}
+	return id, nil
+}
+
+// Channel is a Slack channel the bot can see.
+type Channel struct {
+	ID      string
+	Name    string
+	Private bool
+	// Member is whether the bot is a member of the channel; it can only
+	// post to public channels it isn't a member of with chat:write.public.
+	Member bool
+}
+
+// Channels returns the channels the bot can see (public channels, and
+// private ones it's a member of), keyed by name and by ID. It needs the
+// channels:read scope, and groups:read for private channels.
+func (c *Client) Channels(ctx context.Context) (map[string]Channel, error) {
+	channels := make(map[string]Channel)
+	params := &slackapi.GetConversationsParameters{
+		ExcludeArchived: true,
+		Limit:           1000,
+		Types:           []string{"public_channel", "private_channel"},
+	}
+	for {
+		var page []slackapi.Channel
+		// pages are paced and retried like messages to a pseudo-channel
+		err := c.call(ctx, "conversations.list", func() error {
+			var err error
+			page, params.Cursor, err = c.api.GetConversationsContext(ctx, params)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing slack channels: %w", err)
+		}
+		for _, ch := range page {
+			channel := Channel{ID: ch.ID, Name: ch.Name, Private: ch.IsPrivate, Member: ch.IsMember}
+			channels[ch.Name] = channel
+			channels[ch.ID] = channel
+		}
+		if params.Cursor == "" {
+			return channels, nil
+		}
+	}
+}
+
 // SendSimpleTextMessage sends a plain text message to a slack channel.
 func (c *Client) SendSimpleTextMessage(ctx context.Context, channel string, message string) (string, string, error) {
+	if c.dryRun && c.shadowChannel != "" {
+		slog.Info("dry run, not posting slack message", "channel", channel, "shadow_channel", c.shadowChannel, "text", message)
+		return c.post(ctx, c.shadowChannel, slackapi.MsgOptionText(c.shadowNote(channel)+"\n"+message, false))
+	}
 	return c.SendMessage(ctx, channel, slackapi.MsgOptionText(message, false))
 }
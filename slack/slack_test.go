@@ -18,20 +18,29 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
+	slackapi "github.com/slack-go/slack"
+
+	"github.com/tidal-music/cw-alert-router/v2/cw"
 	"github.com/tidal-music/cw-alert-router/v2/slack"
 	"github.com/tidal-music/cw-alert-router/v2/test"
 )
 
-func newTestClient(t *testing.T, server *test.SlackServer) *slack.Client {
+// newTestClient returns a client for the fake server, without pacing unless
+// opts set it.
+func newTestClient(t *testing.T, server *test.SlackServer, opts ...slack.ClientOptions) *slack.Client {
 	t.Helper()
-	sc, err := slack.New("blah", slack.WithAlternativeURL(server.APIURL()))
+	opts = append([]slack.ClientOptions{slack.WithAlternativeURL(server.APIURL()), slack.WithChannelInterval(0)}, opts...)
+	sc, err := slack.New("blah", opts...)
 	if err != nil {
 		t.Fatalf("failed initializing slack client: %v", err)
 	}
@@ -267,3 +276,302 @@ func TestSendSimpleTextMessage(t *testing.T) {
 	}
 	t.Logf("Sent message to channel %s (ts: %s)", cid, ts)
 }
+
+func TestFlappingMessages(t *testing.T) {
+	server := test.NewSlackServer()
+	defer server.Close()
+	sc := newTestClient(t, server)
+	ctx := context.Background()
+
+	channelID, ts, err := sc.SendFlapping(ctx, "test-channel", &test.TriggeredAlarmDetails, 4, 30*time.Minute)
+	if err != nil {
+		t.Fatalf("failed sending flapping message: %v", err)
+	}
+	blocks := postedBlocks(t, server.Messages()[0])
+	if !strings.Contains(blocks, "flapping") || !strings.Contains(blocks, "changed 4 times in the last 30m0s") {
+		t.Errorf("posted blocks missing flapping status: %s", blocks)
+	}
+
+	if err := sc.UpdateFlapping(ctx, channelID, ts, &test.ExpectedAlarmDetails, 5, 30*time.Minute); err != nil {
+		t.Fatalf("failed updating flapping message: %v", err)
+	}
+	updates := server.Updates()
+	if len(updates) != 1 {
+		t.Fatalf("expected 1 update, got %d", len(updates))
+	}
+	values, _ := url.ParseQuery(string(updates[0]))
+	if values.Get("ts") != ts || values.Get("channel") != channelID {
+		t.Errorf("update addressed %s/%s, want %s/%s", values.Get("channel"), values.Get("ts"), channelID, ts)
+	}
+	if !strings.Contains(values.Get("blocks"), "changed 5 times") {
+		t.Errorf("updated blocks missing new count: %s", values.Get("blocks"))
+	}
+
+	if _, _, err := sc.SendStabilised(ctx, "test-channel", &test.ExpectedAlarmDetails, 5); err != nil {
+		t.Fatalf("failed sending stabilised message: %v", err)
+	}
+	blocks = postedBlocks(t, server.Messages()[1])
+	if !strings.Contains(blocks, "stabilised") || !strings.Contains(blocks, "after 5 collapsed notifications") {
+		t.Errorf("posted blocks missing stabilised status: %s", blocks)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	img := slack.ImageRef{URL: "https://example.com/graph.png"}
+
+	t.Run("logged only", func(t *testing.T) {
+		server := test.NewSlackServer()
+		defer server.Close()
+		sc := newTestClient(t, server, slack.WithDryRun(""))
+
+		if _, _, err := sc.SendEventTriggered(ctx, "test-channel", &test.TriggeredAlarmDetails, img); err != nil {
+			t.Fatalf("failed sending event: %v", err)
+		}
+		channelID, ts, err := sc.SendFlapping(ctx, "test-channel", &test.TriggeredAlarmDetails, 4, 30*time.Minute)
+		if err != nil || channelID != "" || ts != "" {
+			t.Fatalf("expected no message to update, got %q %q %v", channelID, ts, err)
+		}
+		if fileID, err := sc.UploadImage(ctx, "graph.png", []byte("png")); err != nil || fileID != "" {
+			t.Errorf("expected no upload, got %q %v", fileID, err)
+		}
+		if len(server.Messages()) != 0 || len(server.Uploads()) != 0 {
+			t.Errorf("expected nothing posted, got %d messages and %d uploads", len(server.Messages()), len(server.Uploads()))
+		}
+	})
+
+	t.Run("shadow channel", func(t *testing.T) {
+		server := test.NewSlackServer()
+		defer server.Close()
+		sc := newTestClient(t, server, slack.WithDryRun("shadow-alarms"))
+
+		if _, _, err := sc.SendEventTriggered(ctx, "test-channel", &test.TriggeredAlarmDetails, img); err != nil {
+			t.Fatalf("failed sending event: %v", err)
+		}
+		if _, _, err := sc.SendSimpleTextMessage(ctx, "test-channel", "Hello There!"); err != nil {
+			t.Fatalf("failed sending text: %v", err)
+		}
+		messages := server.Messages()
+		if len(messages) != 2 {
+			t.Fatalf("expected 2 shadow messages, got %d", len(messages))
+		}
+		for _, m := range messages {
+			if values, _ := url.ParseQuery(string(m)); values.Get("channel") != "shadow-alarms" {
+				t.Errorf("expected the shadow channel, got %s", values.Get("channel"))
+			}
+		}
+		blocks := postedBlocks(t, messages[0])
+		if !strings.Contains(blocks, "meant for `test-channel`") || !strings.Contains(blocks, "graph.png") ||
+			!strings.Contains(blocks, test.TriggeredAlarmDetails.Detail.AlarmName) {
+			t.Errorf("shadow message missing the original: %s", blocks)
+		}
+		if values, _ := url.ParseQuery(string(messages[1])); !strings.Contains(values.Get("text"), "Hello There!") {
+			t.Errorf("shadow text message missing the original: %s", values.Get("text"))
+		}
+	})
+}
+
+func TestSendStorm(t *testing.T) {
+	server := test.NewSlackServer()
+	defer server.Close()
+	sc := newTestClient(t, server)
+
+	var evts []*cw.Event
+	for i := 0; i < 60; i++ {
+		evt := test.AlarmEvent(test.TriggeredAlarmDetails, fmt.Sprintf("dependency-alarm-%02d", i))
+		evts = append(evts, &evt)
+	}
+	if _, _, err := sc.SendStorm(context.Background(), "test-channel", evts); err != nil {
+		t.Fatalf("failed sending storm summary: %v", err)
+	}
+
+	var blocks []map[string]any
+	if err := json.Unmarshal([]byte(postedBlocks(t, server.Messages()[0])), &blocks); err != nil {
+		t.Fatalf("couldn't decode posted blocks: %v", err)
+	}
+	if len(blocks) > 50 {
+		t.Errorf("summary has %d blocks, more than slack allows", len(blocks))
+	}
+	var text strings.Builder
+	for _, b := range blocks {
+		section := b["text"].(map[string]any)["text"].(string)
+		if len(section) > 3000 {
+			t.Errorf("section of %d characters is longer than slack allows", len(section))
+		}
+		text.WriteString(section)
+	}
+	if !strings.Contains(text.String(), "60 CloudWatch alarms") {
+		t.Errorf("summary header missing alarm count: %s", text.String())
+	}
+	for _, name := range []string{"dependency-alarm-00", "dependency-alarm-59"} {
+		if !strings.Contains(text.String(), name) {
+			t.Errorf("summary missing %s", name)
+		}
+	}
+}
+
+func TestSendMessageRetriesRateLimited(t *testing.T) {
+	server := test.NewSlackServer()
+	defer server.Close()
+	sc := newTestClient(t, server)
+
+	server.RateLimit(1, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, _, err := sc.SendSimpleTextMessage(ctx, "test-channel", "hello"); err != nil {
+		t.Fatalf("expected the rate limited message to be retried, got %v", err)
+	}
+	if got := len(server.Messages()); got != 1 {
+		t.Errorf("expected 1 message, got %d", got)
+	}
+	stats := sc.ThrottleStats()
+	if stats.RateLimited != 1 || stats.Retried != 1 || stats.GaveUp != 0 {
+		t.Errorf("unexpected throttle stats: %+v", stats)
+	}
+	if stats.PacingDelay < 500*time.Millisecond {
+		t.Errorf("expected the retry to wait for Retry-After, waited %s", stats.PacingDelay)
+	}
+}
+
+func TestSendMessageRateLimitedPastDeadline(t *testing.T) {
+	server := test.NewSlackServer()
+	defer server.Close()
+	sc := newTestClient(t, server)
+
+	// Retry-After doesn't fit in the remaining time: fail straight away
+	server.RateLimit(1, 30)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, _, err := sc.SendSimpleTextMessage(ctx, "test-channel", "hello")
+	var rle *slackapi.RateLimitedError
+	if !errors.As(err, &rle) {
+		t.Fatalf("expected a rate limited error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("giving up took %s, expected it to be immediate", elapsed)
+	}
+	if stats := sc.ThrottleStats(); stats.GaveUp != 1 || stats.Retried != 0 {
+		t.Errorf("unexpected throttle stats: %+v", stats)
+	}
+}
+
+func TestChannelPacing(t *testing.T) {
+	server := test.NewSlackServer()
+	defer server.Close()
+	sc := newTestClient(t, server, slack.WithChannelInterval(200*time.Millisecond))
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, _, err := sc.SendSimpleTextMessage(ctx, "busy-channel", "hello"); err != nil {
+			t.Fatalf("failed sending message: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("3 messages to one channel took %s, expected pacing", elapsed)
+	}
+
+	// other channels have their own pace
+	start = time.Now()
+	if _, _, err := sc.SendSimpleTextMessage(ctx, "quiet-channel", "hello"); err != nil {
+		t.Fatalf("failed sending message: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("first message to another channel took %s", elapsed)
+	}
+	if stats := sc.ThrottleStats(); stats.Paced != 2 {
+		t.Errorf("expected 2 paced messages, got %+v", stats)
+	}
+
+	// a channel addressed by ID is paced with the messages posted by name
+	channelID, ts, err := sc.SendSimpleTextMessage(ctx, "flapping-channel", "hello")
+	if err != nil {
+		t.Fatalf("failed sending message: %v", err)
+	}
+	start = time.Now()
+	evt := test.TriggeredAlarmDetails
+	if err := sc.UpdateFlapping(ctx, channelID, ts, &evt, 3, time.Minute); err != nil {
+		t.Fatalf("failed updating message: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("update right after a message took %s, expected pacing", elapsed)
+	}
+}
+
+func TestChannelPacingDeadline(t *testing.T) {
+	server := test.NewSlackServer()
+	defer server.Close()
+	sc := newTestClient(t, server, slack.WithChannelInterval(300*time.Millisecond))
+	ctx := context.Background()
+
+	if _, _, err := sc.SendSimpleTextMessage(ctx, "busy-channel", "hello"); err != nil {
+		t.Fatalf("failed sending message: %v", err)
+	}
+
+	// a message that can't wait for its slot fails without taking it
+	short, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	if _, _, err := sc.SendSimpleTextMessage(short, "busy-channel", "hello"); err == nil {
+		t.Fatalf("expected the message to overrun the deadline")
+	}
+	start := time.Now()
+	if _, _, err := sc.SendSimpleTextMessage(ctx, "busy-channel", "hello"); err != nil {
+		t.Fatalf("failed sending message: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 450*time.Millisecond {
+		t.Errorf("next message waited %s, expected one interval at most", elapsed)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	server := test.NewSlackServer()
+	defer server.Close()
+	server.SetChannels("alarms", "test-alarms")
+	server.AddChannel(test.SlackChannel{Name: "private-alarms", Private: true, Member: true})
+	sc := newTestClient(t, server)
+
+	// every page is listed
+	channels, err := sc.Channels(context.Background())
+	if err != nil {
+		t.Fatalf("Channels returned error: %v", err)
+	}
+	for _, c := range []string{"alarms", "test-alarms", "private-alarms", "C0", "C2"} {
+		if _, ok := channels[c]; !ok {
+			t.Errorf("expected channel %s, got %v", c, channels)
+		}
+	}
+	if _, ok := channels["missing"]; ok {
+		t.Error("unexpected channel missing")
+	}
+	if got := channels["C2"]; got.Name != "private-alarms" || !got.Private || !got.Member {
+		t.Errorf("unexpected channel C2 %+v", got)
+	}
+
+	server.RateLimit(1, 0)
+	if _, err := sc.Channels(context.Background()); err != nil {
+		t.Errorf("expected a rate limited page to be retried, got %v", err)
+	}
+}
+
+func TestAuthTest(t *testing.T) {
+	server := test.NewSlackServer()
+	defer server.Close()
+	sc := newTestClient(t, server)
+
+	id, err := sc.AuthTest(context.Background())
+	if err != nil {
+		t.Fatalf("AuthTest returned error: %v", err)
+	}
+	if id.User != "alert-router" || id.Team != "Test" || id.BotID != "B123" {
+		t.Errorf("unexpected identity %+v", id)
+	}
+	if got := strings.Join(id.Scopes, ","); got != test.DefaultSlackScopes {
+		t.Errorf("expected scopes %s, got %s", test.DefaultSlackScopes, got)
+	}
+
+	server.FailAuth("invalid_auth")
+	if _, err := sc.AuthTest(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid_auth") {
+		t.Errorf("expected invalid_auth, got %v", err)
+	}
+}
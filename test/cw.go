@@ -18,8 +18,12 @@ package test
 import (
 	"context"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"io"
+	"slices"
+	"strconv"
+	"time"
 
 	awsevents "github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -44,6 +48,38 @@ var (
 	// TestEventJSONFromSQS - a test event as seen from eventbridge -> SQS -> lambda
 	TestEventJSONFromSQS = "{\"version\":\"0\",\"id\":\"19905c58-8563-0126-6a9d-c8530ac6c240\",\"detail-type\":\"CloudWatch Alarm State Change\",\"source\":\"aws.cloudwatch\",\"account\":\"1234567890123\",\"time\":\"2020-10-05T06:47:38Z\",\"region\":\"us-east-1\",\"resources\":[\"arn:aws:cloudwatch:us-east-1:1234567890123:alarm:test-service_aurora_serverless_cpu_utilization\"],\"detail\":{\"alarmName\":\"test-service_aurora_serverless_cpu_utilization\",\"state\":{\"value\":\"OK\",\"reason\":\"Threshold Crossed: 2 out of the last 2 datapoints [10.0 (05/10/20 06:42:00), 10.0 (05/10/20 06:37:00)] were not greater than or equal to the threshold (30.0) (minimum 1 datapoint for ALARM -> OK transition).\",\"reasonData\":\"{\\\"version\\\":\\\"1.0\\\",\\\"queryDate\\\":\\\"2020-10-05T06:47:38.031+0000\\\",\\\"startDate\\\":\\\"2020-10-05T06:37:00.000+0000\\\",\\\"statistic\\\":\\\"Average\\\",\\\"period\\\":300,\\\"recentDatapoints\\\":[10.0,10.0],\\\"threshold\\\":30.0}\",\"timestamp\":\"2020-10-05T06:47:38.033+0000\"},\"previousState\":{\"value\":\"ALARM\",\"reason\":\"Threshold Crossed: 2 out of the last 2 datapoints [10.25 (05/10/20 06:25:00), 10.0 (05/10/20 06:20:00)] were greater than or equal to the threshold (10.0) (minimum 2 datapoints for OK -> ALARM transition).\",\"reasonData\":\"{\\\"version\\\":\\\"1.0\\\",\\\"queryDate\\\":\\\"2020-10-05T06:30:58.947+0000\\\",\\\"startDate\\\":\\\"2020-10-05T06:20:00.000+0000\\\",\\\"statistic\\\":\\\"Average\\\",\\\"period\\\":300,\\\"recentDatapoints\\\":[10.0,10.25],\\\"threshold\\\":10.0}\",\"timestamp\":\"2020-10-05T06:30:58.967+0000\"},\"configuration\":{\"description\":\"High CPU Utilization\",\"metrics\":[{\"id\":\"62ba7bc1-7c4c-3747-4ab5-3a3dc4e40530\",\"metricStat\":{\"metric\":{\"namespace\":\"AWS/RDS\",\"name\":\"CPUUtilization\",\"dimensions\":{\"DBClusterIdentifier\":\"testdb\"}},\"period\":300,\"stat\":\"Average\"},\"returnData\":true}]}}}"
 
+	// ClassicAlarmJSON is the classic SNS alarm notification for the state
+	// change in TriggeredAlarmDetails.
+	ClassicAlarmJSON = `{
+  "AlarmName": "test-service-alarm-abcd",
+  "AlarmDescription": null,
+  "AWSAccountId": "1234567890123",
+  "AlarmConfigurationUpdatedTimestamp": "2020-07-30T10:12:44.315+0000",
+  "NewStateValue": "ALARM",
+  "NewStateReason": "Threshold Crossed: 1 datapoint [200.0 (31/07/20 06:50:00)] was greater than the threshold (60.0).",
+  "StateChangeTime": "2020-07-31T06:56:05.606+0000",
+  "Region": "US East (N. Virginia)",
+  "AlarmArn": "arn:aws:cloudwatch:us-east-1:1234567890123:alarm:test-service-alarm-abcd",
+  "OldStateValue": "INSUFFICIENT_DATA",
+  "OKActions": [],
+  "AlarmActions": ["arn:aws:sns:us-east-1:1234567890123:alarms"],
+  "InsufficientDataActions": [],
+  "Trigger": {
+    "MetricName": "CPUUtilization",
+    "Namespace": "AWS/EC2",
+    "StatisticType": "Statistic",
+    "Statistic": "AVERAGE",
+    "Unit": null,
+    "Dimensions": [{"value": "test-service", "name": "AutoScalingGroupName"}],
+    "Period": 60,
+    "EvaluationPeriods": 1,
+    "ComparisonOperator": "GreaterThanThreshold",
+    "Threshold": 60.0,
+    "TreatMissingData": "missing",
+    "EvaluateLowSampleCountPercentile": ""
+  }
+}`
+
 	// TestEventJSON provides a test cw alarm eventbridge event
 	TestEventJSON = `{
 		"version": "0",
@@ -204,7 +240,24 @@ var (
 		Region:     "us-east-1",
 		ID:         "0cd5bdb7-df8b-f066-50c5-cc06faac60c2",
 		DetailType: "CloudWatch Alarm State Change",
-		Detail:     TestTriggeredAlarm,
+		Detail:     suppressedAlarm(),
+	}
+
+	// DescribedAlarm is the alarm of TriggeredAlarmDetails as DescribeAlarms
+	// returns it.
+	DescribedAlarm = cwtypes.MetricAlarm{
+		AlarmName:                  aws.String("test-service-alarm-abcd"),
+		AlarmArn:                   aws.String("arn:aws:cloudwatch:us-east-1:1234567890123:alarm:test-service-alarm-abcd"),
+		StateValue:                 cwtypes.StateValueAlarm,
+		StateReason:                aws.String(TestTriggeredAlarm.State.Reason),
+		StateReasonData:            aws.String(TestTriggeredAlarm.State.ReasonData),
+		StateTransitionedTimestamp: aws.Time(time.Date(2020, 7, 31, 6, 56, 5, 606e6, time.UTC)),
+		Namespace:                  aws.String("AWS/EC2"),
+		MetricName:                 aws.String("CPUUtilization"),
+		Dimensions:                 []cwtypes.Dimension{{Name: aws.String("AutoScalingGroupName"), Value: aws.String("test-service")}},
+		Period:                     aws.Int32(60),
+		Statistic:                  cwtypes.StatisticAverage,
+		Threshold:                  aws.Float64(60),
 	}
 
 	// TagsByARN holds the tags the mock CloudWatch client returns per alarm ARN.
@@ -227,14 +280,66 @@ var (
 
 // MockCWAPI is a mock CloudWatch API for testing.
 type MockCWAPI struct {
+	// Tags overrides TagsByARN for this mock when set.
+	Tags map[string]map[string]string
+
+	// RenderDelay makes GetMetricWidgetImage take this long, or until its
+	// context is cancelled.
+	RenderDelay time.Duration
+
 	// LastWidgetJSON records the widget definition of the most recent
 	// GetMetricWidgetImage call.
 	LastWidgetJSON string
+
+	// Alarms overrides the alarms DescribeAlarms finds ([DescribedAlarm])
+	// when set.
+	Alarms []cwtypes.MetricAlarm
+
+	// CompositeAlarms are the composite alarms DescribeAlarms finds.
+	CompositeAlarms []cwtypes.CompositeAlarm
+}
+
+// DescribeAlarms implements the describe alarms api call, finding alarms by
+// name. Without names it lists every alarm, one per page.
+func (m *MockCWAPI) DescribeAlarms(ctx context.Context, r *cloudwatch.DescribeAlarmsInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.DescribeAlarmsOutput, error) {
+	alarms := m.Alarms
+	if alarms == nil {
+		alarms = []cwtypes.MetricAlarm{DescribedAlarm}
+	}
+	out := &cloudwatch.DescribeAlarmsOutput{}
+	if len(r.AlarmNames) == 0 {
+		i, _ := strconv.Atoi(aws.ToString(r.NextToken))
+		switch {
+		case i < len(alarms):
+			out.MetricAlarms = alarms[i : i+1]
+		case i < len(alarms)+len(m.CompositeAlarms):
+			out.CompositeAlarms = m.CompositeAlarms[i-len(alarms) : i-len(alarms)+1]
+		}
+		if i+1 < len(alarms)+len(m.CompositeAlarms) {
+			out.NextToken = aws.String(strconv.Itoa(i + 1))
+		}
+		return out, nil
+	}
+	for _, a := range alarms {
+		if slices.Contains(r.AlarmNames, aws.ToString(a.AlarmName)) {
+			out.MetricAlarms = append(out.MetricAlarms, a)
+		}
+	}
+	for _, a := range m.CompositeAlarms {
+		if slices.Contains(r.AlarmNames, aws.ToString(a.AlarmName)) {
+			out.CompositeAlarms = append(out.CompositeAlarms, a)
+		}
+	}
+	return out, nil
 }
 
 // ListTagsForResource implements the list tags api call.
 func (m *MockCWAPI) ListTagsForResource(ctx context.Context, r *cloudwatch.ListTagsForResourceInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.ListTagsForResourceOutput, error) {
-	tags, ok := TagsByARN[aws.ToString(r.ResourceARN)]
+	byARN := TagsByARN
+	if m.Tags != nil {
+		byARN = m.Tags
+	}
+	tags, ok := byARN[aws.ToString(r.ResourceARN)]
 	if !ok {
 		return nil, &cwtypes.ResourceNotFoundException{
 			Message: aws.String(fmt.Sprintf("resource %s not found", aws.ToString(r.ResourceARN))),
@@ -250,12 +355,21 @@ func (m *MockCWAPI) ListTagsForResource(ctx context.Context, r *cloudwatch.ListT
 // GetMetricWidgetImage implements the metric widget rendering api call.
 func (m *MockCWAPI) GetMetricWidgetImage(ctx context.Context, r *cloudwatch.GetMetricWidgetImageInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricWidgetImageOutput, error) {
 	m.LastWidgetJSON = aws.ToString(r.MetricWidget)
+	if m.RenderDelay > 0 {
+		select {
+		case <-time.After(m.RenderDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 	return &cloudwatch.GetMetricWidgetImageOutput{MetricWidgetImage: TestPNG}, nil
 }
 
 // GenTestSQSEvent returns a test SQS event with a correct body md5.
 func GenTestSQSEvent() awsevents.SQSEvent {
 	evt := testSQSEvent
+	// copy the records, so callers can modify them
+	evt.Records = append([]awsevents.SQSMessage(nil), testSQSEvent.Records...)
 	for idx := range evt.Records {
 		h := md5.New()
 		io.WriteString(h, evt.Records[idx].Body)
@@ -263,3 +377,60 @@ func GenTestSQSEvent() awsevents.SQSEvent {
 	}
 	return evt
 }
+
+// ResolvedEvent returns the ALARM -> OK state change following evt. Like
+// EventBridge, it gives the new event its own ID.
+func ResolvedEvent(evt cw.Event) cw.Event {
+	evt.ID += "-resolved"
+	evt.Detail.PreviousState = TestTriggeredAlarm.State
+	evt.Detail.State = TestOKAlarm.State
+	return evt
+}
+
+// SQSEventFor returns an SQS event with one record per CloudWatch event.
+func SQSEventFor(evts ...cw.Event) awsevents.SQSEvent {
+	var sqsEvent awsevents.SQSEvent
+	for i, evt := range evts {
+		body, _ := json.Marshal(evt)
+		msg := testSQSEvent.Records[0]
+		msg.MessageId = fmt.Sprintf("message-%d", i)
+		msg.Body = string(body)
+		msg.Md5OfBody = fmt.Sprintf("%x", md5.Sum(body))
+		sqsEvent.Records = append(sqsEvent.Records, msg)
+	}
+	return sqsEvent
+}
+
+// suppressedAlarm is TestTriggeredAlarm renamed to the suppressed alarm.
+func suppressedAlarm() cw.AlarmStateChange {
+	a := TestTriggeredAlarm
+	a.AlarmName = "suppressed-alarm"
+	return a
+}
+
+// AlarmEvent returns a copy of evt for another alarm: a new name, ARN and
+// event ID.
+func AlarmEvent(evt cw.Event, name string) cw.Event {
+	evt.ID = fmt.Sprintf("%s-%s", evt.ID, name)
+	evt.Detail.AlarmName = name
+	evt.Resources = []string{"arn:aws:cloudwatch:us-east-1:1234567890123:alarm:" + name}
+	return evt
+}
+
+// SNSNotification wraps msg in the envelope SNS delivers messages in without
+// raw message delivery.
+func SNSNotification(msg string) string {
+	body, _ := json.Marshal(map[string]string{
+		"Type":             "Notification",
+		"MessageId":        "d0c6a7a1-26d2-5d7c-9d4e-2b3a1c1f6f3e",
+		"TopicArn":         "arn:aws:sns:us-east-1:1234567890123:alarms",
+		"Subject":          "ALARM: \"test-service-alarm-abcd\" in US East (N. Virginia)",
+		"Message":          msg,
+		"Timestamp":        "2020-07-31T06:56:05.650Z",
+		"SignatureVersion": "1",
+		"Signature":        "c2lnbmF0dXJl",
+		"SigningCertURL":   "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-0000.pem",
+		"UnsubscribeURL":   "https://sns.us-east-1.amazonaws.com/?Action=Unsubscribe",
+	})
+	return string(body)
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MockDynamoDBAPI is a mock DynamoDB table for the delivery ledger. It
+// doesn't parse expressions: it applies the ledger's claim, complete and
+// release conditions to items keyed by event_id and destination.
+type MockDynamoDBAPI struct {
+	mu    sync.Mutex
+	items map[string]map[string]types.AttributeValue
+}
+
+func dynamoKey(item map[string]types.AttributeValue) string {
+	return fmt.Sprintf("%s/%s", dynamoString(item["event_id"]), dynamoString(item["destination"]))
+}
+
+func dynamoString(v types.AttributeValue) string {
+	if s, ok := v.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+func dynamoNumber(v types.AttributeValue) int64 {
+	if n, ok := v.(*types.AttributeValueMemberN); ok {
+		i, _ := strconv.ParseInt(n.Value, 10, 64)
+		return i
+	}
+	return 0
+}
+
+func conditionFailed(old map[string]types.AttributeValue) error {
+	return &types.ConditionalCheckFailedException{
+		Message: aws.String("The conditional request failed"),
+		Item:    old,
+	}
+}
+
+// PutItem implements the ledger claim: the write succeeds if there is no
+// item, the item has expired, or it is a claim whose lease has expired.
+func (m *MockDynamoDBAPI) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.items == nil {
+		m.items = make(map[string]map[string]types.AttributeValue)
+	}
+	key := dynamoKey(params.Item)
+	if old, ok := m.items[key]; ok && params.ConditionExpression != nil {
+		now := dynamoNumber(params.ExpressionAttributeValues[":now"])
+		expired := dynamoNumber(old["expires_at"]) <= now
+		leaseExpired := dynamoString(old["status"]) == "claimed" && dynamoNumber(old["lease_until"]) <= now
+		if !expired && !leaseExpired {
+			return nil, conditionFailed(old)
+		}
+	}
+	m.items[key] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// UpdateItem implements the ledger completion: the item becomes delivered.
+func (m *MockDynamoDBAPI) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.items == nil {
+		m.items = make(map[string]map[string]types.AttributeValue)
+	}
+	item := map[string]types.AttributeValue{
+		"event_id":    params.Key["event_id"],
+		"destination": params.Key["destination"],
+		"status":      params.ExpressionAttributeValues[":delivered"],
+		"expires_at":  params.ExpressionAttributeValues[":expires"],
+	}
+	m.items[dynamoKey(item)] = item
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+// DeleteItem implements the ledger release: only claims are deleted.
+func (m *MockDynamoDBAPI) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := dynamoKey(params.Key)
+	old, ok := m.items[key]
+	if !ok || dynamoString(old["status"]) != "claimed" {
+		return nil, conditionFailed(old)
+	}
+	delete(m.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// Status returns the status of the ledger item for the event and
+// destination ("" if there is none).
+func (m *MockDynamoDBAPI) Status(eventID, destination string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return dynamoString(m.items[eventID+"/"+destination]["status"])
+}
+
+// MockStateTableAPI is a mock DynamoDB table for the flapping state store,
+// keyed by alarm_arn. Puts are conditional on the version attribute, and
+// queries of the flapping index return the items with a flapping_key.
+type MockStateTableAPI struct {
+	mu    sync.Mutex
+	items map[string]map[string]types.AttributeValue
+}
+
+// GetItem implements the same function from dynamodb.
+func (m *MockStateTableAPI) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: m.items[dynamoString(params.Key["alarm_arn"])]}, nil
+}
+
+// PutItem implements the same function from dynamodb.
+func (m *MockStateTableAPI) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.items == nil {
+		m.items = make(map[string]map[string]types.AttributeValue)
+	}
+	key := dynamoString(params.Item["alarm_arn"])
+	if old, ok := m.items[key]; ok && dynamoNumber(old["version"]) != dynamoNumber(params.ExpressionAttributeValues[":version"]) {
+		return nil, conditionFailed(nil)
+	}
+	m.items[key] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// Query implements the same function from dynamodb, for the flapping index:
+// it returns the items with the queried flapping_key.
+func (m *MockStateTableAPI) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if aws.ToString(params.IndexName) != "flapping" {
+		return nil, fmt.Errorf("unexpected index %q", aws.ToString(params.IndexName))
+	}
+	var items []map[string]types.AttributeValue
+	for _, item := range m.items {
+		if dynamoString(item["flapping_key"]) == dynamoString(params.ExpressionAttributeValues[":flapping"]) {
+			items = append(items, item)
+		}
+	}
+	return &dynamodb.QueryOutput{Items: items, Count: int32(len(items))}, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssmincidents"
+	imtypes "github.com/aws/aws-sdk-go-v2/service/ssmincidents/types"
+)
+
+// MockIncidentsAPI is a mock Incident Manager API that keeps incidents in
+// memory. Started incidents are deduplicated by client token, like the real
+// API.
+type MockIncidentsAPI struct {
+	mu        sync.Mutex
+	incidents []*imtypes.IncidentRecordSummary
+	started   []*ssmincidents.StartIncidentInput
+	tokens    map[string]string
+	timeline  []*ssmincidents.CreateTimelineEventInput
+}
+
+// StartIncident implements the start incident api call.
+func (m *MockIncidentsAPI) StartIncident(ctx context.Context, r *ssmincidents.StartIncidentInput, optFns ...func(*ssmincidents.Options)) (*ssmincidents.StartIncidentOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens == nil {
+		m.tokens = make(map[string]string)
+	}
+	if arn, ok := m.tokens[aws.ToString(r.ClientToken)]; ok {
+		return &ssmincidents.StartIncidentOutput{IncidentRecordArn: aws.String(arn)}, nil
+	}
+	arn := fmt.Sprintf("arn:aws:ssm-incidents::1234567890123:incident-record/test/%d", len(m.incidents)+1)
+	m.tokens[aws.ToString(r.ClientToken)] = arn
+	m.started = append(m.started, r)
+	m.incidents = append(m.incidents, &imtypes.IncidentRecordSummary{
+		Arn:    aws.String(arn),
+		Title:  r.Title,
+		Status: imtypes.IncidentRecordStatusOpen,
+		IncidentRecordSource: &imtypes.IncidentRecordSource{
+			CreatedBy:   aws.String("arn:aws:iam::1234567890123:role/cw-alert-router"),
+			Source:      r.TriggerDetails.Source,
+			ResourceArn: r.TriggerDetails.TriggerArn,
+		},
+	})
+	return &ssmincidents.StartIncidentOutput{IncidentRecordArn: aws.String(arn)}, nil
+}
+
+// ListIncidentRecords implements the list incident records api call. Only
+// the status filter is supported.
+func (m *MockIncidentsAPI) ListIncidentRecords(ctx context.Context, r *ssmincidents.ListIncidentRecordsInput, optFns ...func(*ssmincidents.Options)) (*ssmincidents.ListIncidentRecordsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := map[imtypes.IncidentRecordStatus]bool{}
+	for _, f := range r.Filters {
+		if aws.ToString(f.Key) != "status" {
+			continue
+		}
+		if eq, ok := f.Condition.(*imtypes.ConditionMemberEquals); ok {
+			if vals, ok := eq.Value.(*imtypes.AttributeValueListMemberStringValues); ok {
+				for _, v := range vals.Value {
+					statuses[imtypes.IncidentRecordStatus(v)] = true
+				}
+			}
+		}
+	}
+	out := &ssmincidents.ListIncidentRecordsOutput{}
+	for _, inc := range m.incidents {
+		if len(statuses) == 0 || statuses[inc.Status] {
+			out.IncidentRecordSummaries = append(out.IncidentRecordSummaries, *inc)
+		}
+	}
+	return out, nil
+}
+
+// CreateTimelineEvent implements the create timeline event api call.
+func (m *MockIncidentsAPI) CreateTimelineEvent(ctx context.Context, r *ssmincidents.CreateTimelineEventInput, optFns ...func(*ssmincidents.Options)) (*ssmincidents.CreateTimelineEventOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeline = append(m.timeline, r)
+	return &ssmincidents.CreateTimelineEventOutput{
+		EventId:           aws.String(fmt.Sprintf("event-%d", len(m.timeline))),
+		IncidentRecordArn: r.IncidentRecordArn,
+	}, nil
+}
+
+// UpdateIncidentRecord implements the update incident record api call (status only).
+func (m *MockIncidentsAPI) UpdateIncidentRecord(ctx context.Context, r *ssmincidents.UpdateIncidentRecordInput, optFns ...func(*ssmincidents.Options)) (*ssmincidents.UpdateIncidentRecordOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, inc := range m.incidents {
+		if aws.ToString(inc.Arn) == aws.ToString(r.Arn) {
+			if r.Status != "" {
+				inc.Status = r.Status
+			}
+			return &ssmincidents.UpdateIncidentRecordOutput{}, nil
+		}
+	}
+	return nil, &imtypes.ResourceNotFoundException{
+		Message: aws.String(fmt.Sprintf("incident %s not found", aws.ToString(r.Arn))),
+	}
+}
+
+// Started returns the StartIncident requests that created an incident.
+func (m *MockIncidentsAPI) Started() []*ssmincidents.StartIncidentInput {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*ssmincidents.StartIncidentInput(nil), m.started...)
+}
+
+// Timeline returns the timeline events created so far.
+func (m *MockIncidentsAPI) Timeline() []*ssmincidents.CreateTimelineEventInput {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*ssmincidents.CreateTimelineEventInput(nil), m.timeline...)
+}
+
+// Incidents returns a snapshot of all incidents.
+func (m *MockIncidentsAPI) Incidents() []imtypes.IncidentRecordSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []imtypes.IncidentRecordSummary
+	for _, inc := range m.incidents {
+		out = append(out, *inc)
+	}
+	return out
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// MockOpsCenterAPI is a mock Systems Manager OpsItem API that keeps OpsItems
+// in memory. Like OpsCenter, it refuses to create an OpsItem while another
+// one with the same /aws/dedup string is open.
+type MockOpsCenterAPI struct {
+	mu    sync.Mutex
+	items []*ssmtypes.OpsItemSummary
+}
+
+// dedupString extracts the dedup string from /aws/dedup operational data.
+func dedupString(data map[string]ssmtypes.OpsItemDataValue) string {
+	v, ok := data["/aws/dedup"]
+	if !ok {
+		return ""
+	}
+	var d struct {
+		DedupString string `json:"dedupString"`
+	}
+	json.Unmarshal([]byte(aws.ToString(v.Value)), &d)
+	return d.DedupString
+}
+
+func isOpen(item *ssmtypes.OpsItemSummary) bool {
+	return item.Status == ssmtypes.OpsItemStatusOpen || item.Status == ssmtypes.OpsItemStatusInProgress
+}
+
+// CreateOpsItem implements the create opsitem api call.
+func (m *MockOpsCenterAPI) CreateOpsItem(ctx context.Context, r *ssm.CreateOpsItemInput, optFns ...func(*ssm.Options)) (*ssm.CreateOpsItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if dedup := dedupString(r.OperationalData); dedup != "" {
+		for _, item := range m.items {
+			if isOpen(item) && dedupString(item.OperationalData) == dedup {
+				return nil, &ssmtypes.OpsItemAlreadyExistsException{
+					Message:   aws.String("opsitem already exists"),
+					OpsItemId: item.OpsItemId,
+				}
+			}
+		}
+	}
+	id := fmt.Sprintf("oi-%012d", len(m.items)+1)
+	m.items = append(m.items, &ssmtypes.OpsItemSummary{
+		OpsItemId:       aws.String(id),
+		Title:           r.Title,
+		Source:          r.Source,
+		Severity:        r.Severity,
+		Status:          ssmtypes.OpsItemStatusOpen,
+		OperationalData: maps.Clone(r.OperationalData),
+	})
+	return &ssm.CreateOpsItemOutput{OpsItemId: aws.String(id)}, nil
+}
+
+// DescribeOpsItems implements the describe opsitems api call. Source, Status
+// and OperationalData ({"key":...,"value":...}) equality filters are supported.
+func (m *MockOpsCenterAPI) DescribeOpsItems(ctx context.Context, r *ssm.DescribeOpsItemsInput, optFns ...func(*ssm.Options)) (*ssm.DescribeOpsItemsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := &ssm.DescribeOpsItemsOutput{}
+	for _, item := range m.items {
+		if matchesOpsItemFilters(item, r.OpsItemFilters) {
+			out.OpsItemSummaries = append(out.OpsItemSummaries, *item)
+		}
+	}
+	return out, nil
+}
+
+func matchesOpsItemFilters(item *ssmtypes.OpsItemSummary, filters []ssmtypes.OpsItemFilter) bool {
+	for _, f := range filters {
+		switch f.Key {
+		case ssmtypes.OpsItemFilterKeySource:
+			if !slices.Contains(f.Values, aws.ToString(item.Source)) {
+				return false
+			}
+		case ssmtypes.OpsItemFilterKeyStatus:
+			if !slices.Contains(f.Values, string(item.Status)) {
+				return false
+			}
+		case ssmtypes.OpsItemFilterKeyOperationalData:
+			matched := false
+			for _, v := range f.Values {
+				var kv struct{ Key, Value string }
+				if json.Unmarshal([]byte(v), &kv) != nil {
+					continue
+				}
+				if data, ok := item.OperationalData[kv.Key]; ok && aws.ToString(data.Value) == kv.Value {
+					matched = true
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// UpdateOpsItem implements the update opsitem api call (status and operational data).
+func (m *MockOpsCenterAPI) UpdateOpsItem(ctx context.Context, r *ssm.UpdateOpsItemInput, optFns ...func(*ssm.Options)) (*ssm.UpdateOpsItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, item := range m.items {
+		if aws.ToString(item.OpsItemId) != aws.ToString(r.OpsItemId) {
+			continue
+		}
+		if r.Status != "" {
+			item.Status = r.Status
+		}
+		maps.Copy(item.OperationalData, r.OperationalData)
+		return &ssm.UpdateOpsItemOutput{}, nil
+	}
+	return nil, &ssmtypes.OpsItemNotFoundException{
+		Message: aws.String(fmt.Sprintf("opsitem %s not found", aws.ToString(r.OpsItemId))),
+	}
+}
+
+// OpsItems returns a snapshot of all OpsItems.
+func (m *MockOpsCenterAPI) OpsItems() []ssmtypes.OpsItemSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []ssmtypes.OpsItemSummary
+	for _, item := range m.items {
+		out = append(out, *item)
+	}
+	return out
+}
@@ -25,11 +25,23 @@ import (
 type MockPDClient struct {
 	mu     sync.Mutex
 	events []*pdapi.V2Event
+	err    error
+}
+
+// Fail makes subsequent events fail with err (nil restores success).
+func (p *MockPDClient) Fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
 }
 
 // ManageEventWithContext implements the pagerduty events API call.
 func (p *MockPDClient) ManageEventWithContext(ctx context.Context, e *pdapi.V2Event) (*pdapi.V2EventResponse, error) {
 	p.mu.Lock()
+	if p.err != nil {
+		defer p.mu.Unlock()
+		return nil, p.err
+	}
 	p.events = append(p.events, e)
 	p.mu.Unlock()
 	return &pdapi.V2EventResponse{
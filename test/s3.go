@@ -18,11 +18,14 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	s3api "github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 // MockS3API is a mock S3 client that records written objects.
@@ -46,6 +49,30 @@ func (m *MockS3API) PutObject(ctx context.Context, req *s3api.PutObjectInput, op
 	return &s3api.PutObjectOutput{ETag: aws.String("blah")}, nil
 }
 
+// GetObject implements the said function for the s3 client, returning
+// written objects.
+func (m *MockS3API) GetObject(ctx context.Context, req *s3api.GetObjectInput, optFns ...func(*s3api.Options)) (*s3api.GetObjectOutput, error) {
+	obj, ok := m.Object(aws.ToString(req.Bucket), aws.ToString(req.Key))
+	if !ok {
+		return nil, &s3types.NoSuchKey{Message: aws.String("no such key")}
+	}
+	return &s3api.GetObjectOutput{Body: io.NopCloser(strings.NewReader(string(obj)))}, nil
+}
+
+// ListObjectsV2 implements the said function for the s3 client, listing
+// written objects (in a single page).
+func (m *MockS3API) ListObjectsV2(ctx context.Context, req *s3api.ListObjectsV2Input, optFns ...func(*s3api.Options)) (*s3api.ListObjectsV2Output, error) {
+	prefix := fmt.Sprintf("%s/%s", aws.ToString(req.Bucket), aws.ToString(req.Prefix))
+	var contents []s3types.Object
+	for _, k := range m.Objects() {
+		if strings.HasPrefix(k, prefix) {
+			contents = append(contents, s3types.Object{Key: aws.String(strings.TrimPrefix(k, aws.ToString(req.Bucket)+"/"))})
+		}
+	}
+	sort.Slice(contents, func(i, j int) bool { return aws.ToString(contents[i].Key) < aws.ToString(contents[j].Key) })
+	return &s3api.ListObjectsV2Output{Contents: contents, KeyCount: aws.Int32(int32(len(contents)))}, nil
+}
+
 // Object returns the recorded content written to bucket/key, if any.
 func (m *MockS3API) Object(bucket, key string) ([]byte, bool) {
 	m.mu.Lock()
@@ -0,0 +1,148 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+const (
+	// ServiceNowUsername is the user the fake ServiceNow instance accepts.
+	ServiceNowUsername = "cw-alert-router"
+	// ServiceNowPassword is the password the fake ServiceNow instance accepts.
+	ServiceNowPassword = "servicenow-password"
+
+	serviceNowIncidentPath = "/api/now/table/incident"
+)
+
+// ServiceNowIncident is an incident record held by a ServiceNowServer.
+type ServiceNowIncident struct {
+	SysID  string
+	Number string
+	// Fields are the columns written by create and update calls.
+	Fields map[string]string
+}
+
+// ServiceNowServer is a fake ServiceNow instance serving the incident
+// Table API (create, update, and queries by active correlation_id) with
+// basic auth.
+type ServiceNowServer struct {
+	Server *httptest.Server
+
+	mu        sync.Mutex
+	incidents []ServiceNowIncident
+}
+
+// NewServiceNowServer starts a fake ServiceNow instance.
+func NewServiceNowServer() *ServiceNowServer {
+	s := &ServiceNowServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// URL returns the instance URL.
+func (s *ServiceNowServer) URL() string {
+	return s.Server.URL
+}
+
+// Close shuts the server down.
+func (s *ServiceNowServer) Close() {
+	s.Server.Close()
+}
+
+// Incidents returns the incidents created so far.
+func (s *ServiceNowServer) Incidents() []ServiceNowIncident {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ServiceNowIncident(nil), s.incidents...)
+}
+
+func (s *ServiceNowServer) handle(rw http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != ServiceNowUsername || pass != ServiceNowPassword {
+		http.Error(rw, `{"error":{"message":"User Not Authenticated"}}`, http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == serviceNowIncidentPath {
+		s.query(rw, r.URL.Query().Get("sysparm_query"))
+		return
+	}
+	var fields map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var inc *ServiceNowIncident
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == serviceNowIncidentPath:
+		n := len(s.incidents) + 1
+		s.incidents = append(s.incidents, ServiceNowIncident{
+			SysID:  fmt.Sprintf("%032x", n),
+			Number: fmt.Sprintf("INC%07d", n),
+			Fields: map[string]string{},
+		})
+		inc = &s.incidents[n-1]
+		rw.WriteHeader(http.StatusCreated)
+	case (r.Method == http.MethodPatch || r.Method == http.MethodPut) && strings.HasPrefix(r.URL.Path, serviceNowIncidentPath+"/"):
+		sysID := strings.TrimPrefix(r.URL.Path, serviceNowIncidentPath+"/")
+		for i := range s.incidents {
+			if s.incidents[i].SysID == sysID {
+				inc = &s.incidents[i]
+			}
+		}
+		if inc == nil {
+			http.Error(rw, `{"error":{"message":"No Record found"}}`, http.StatusNotFound)
+			return
+		}
+	default:
+		http.NotFound(rw, r)
+		return
+	}
+
+	for k, v := range fields {
+		inc.Fields[k] = v
+	}
+	json.NewEncoder(rw).Encode(map[string]any{
+		"result": map[string]string{"sys_id": inc.SysID, "number": inc.Number},
+	})
+}
+
+// query lists the incidents matching a "correlation_id=<id>^active=true"
+// query; resolved incidents aren't active.
+func (s *ServiceNowServer) query(rw http.ResponseWriter, query string) {
+	correlationID, ok := strings.CutSuffix(strings.TrimPrefix(query, "correlation_id="), "^active=true")
+	if !ok {
+		http.Error(rw, `{"error":{"message":"unsupported query"}}`, http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []map[string]string{}
+	for _, inc := range s.incidents {
+		if inc.Fields["correlation_id"] == correlationID && inc.Fields["state"] != "6" {
+			result = append(result, map[string]string{"sys_id": inc.SysID, "number": inc.Number})
+		}
+	}
+	json.NewEncoder(rw).Encode(map[string]any{"result": result})
+}
@@ -20,29 +20,58 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 // SlackServer is a fake Slack API server for testing. It records posted
-// messages and uploaded files, and implements the chat.postMessage and
-// files.uploadV2 (getUploadURLExternal/completeUploadExternal) flows.
+// messages, updates and uploaded files, and implements the chat.postMessage,
+// chat.update and files.uploadV2 (getUploadURLExternal/completeUploadExternal)
+// flows, lists the channels it's given (SetChannels, AddChannel) one per
+// page of conversations.list, and answers auth.test. It can be told to rate
+// limit (RateLimit).
 type SlackServer struct {
 	Server *httptest.Server
 
-	mu       sync.Mutex
-	messages [][]byte
-	uploads  map[string][]byte
-	fileSeq  int
+	mu        sync.Mutex
+	messages  [][]byte
+	updates   [][]byte
+	uploads   map[string][]byte
+	fileSeq   int
+	postError string
+
+	rateLimited int
+	retryAfter  int
+
+	channels  []SlackChannel
+	scopes    string
+	authError string
 }
 
+// SlackChannel is a channel of the fake Slack server.
+type SlackChannel struct {
+	Name    string
+	Private bool
+	Member  bool
+}
+
+// DefaultSlackScopes are the scopes the fake server's auth.test reports
+// unless told otherwise (SetScopes).
+const DefaultSlackScopes = "chat:write,chat:write.public,files:write,channels:read,groups:read"
+
 // NewSlackServer starts a fake Slack API server.
 func NewSlackServer() *SlackServer {
-	s := &SlackServer{uploads: make(map[string][]byte)}
+	s := &SlackServer{uploads: make(map[string][]byte), scopes: DefaultSlackScopes}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/chat.postMessage", s.postMessage)
+	mux.HandleFunc("/chat.update", s.update)
 	mux.HandleFunc("/files.getUploadURLExternal", s.getUploadURL)
 	mux.HandleFunc("/upload/", s.upload)
 	mux.HandleFunc("/files.completeUploadExternal", s.completeUpload)
+	mux.HandleFunc("/conversations.list", s.conversationsList)
+	mux.HandleFunc("/auth.test", s.authTest)
 	s.Server = httptest.NewServer(mux)
 	return s
 }
@@ -64,6 +93,42 @@ func (s *SlackServer) Messages() [][]byte {
 	return append([][]byte(nil), s.messages...)
 }
 
+// Updates returns the raw chat.update request bodies received so far.
+func (s *SlackServer) Updates() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.updates...)
+}
+
+// FailPostMessage makes chat.postMessage answer with the given Slack error
+// code (e.g. "channel_not_found"); an empty code restores success.
+func (s *SlackServer) FailPostMessage(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.postError = code
+}
+
+// RateLimit makes the next n chat.postMessage/chat.update calls answer 429
+// with the given Retry-After (in seconds).
+func (s *SlackServer) RateLimit(n, retryAfter int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimited, s.retryAfter = n, retryAfter
+}
+
+// rateLimit answers 429 if the server was told to rate limit this call.
+func (s *SlackServer) rateLimit(rw http.ResponseWriter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rateLimited == 0 {
+		return false
+	}
+	s.rateLimited--
+	rw.Header().Set("Retry-After", strconv.Itoa(s.retryAfter))
+	rw.WriteHeader(http.StatusTooManyRequests)
+	return true
+}
+
 // Uploads returns the uploaded file contents by file ID.
 func (s *SlackServer) Uploads() map[string][]byte {
 	s.mu.Lock()
@@ -75,24 +140,59 @@ func (s *SlackServer) Uploads() map[string][]byte {
 	return out
 }
 
+// SlackChannelID returns the ID the fake server answers posts to the named
+// channel with.
+func SlackChannelID(name string) string {
+	return "C" + strings.ToUpper(strings.TrimPrefix(name, "#"))
+}
+
 func writeJSON(rw http.ResponseWriter, v any) {
 	rw.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(rw).Encode(v)
 }
 
 func (s *SlackServer) postMessage(rw http.ResponseWriter, r *http.Request) {
+	if s.rateLimit(rw) {
+		return
+	}
 	body, _ := io.ReadAll(r.Body)
+	values, _ := url.ParseQuery(string(body))
 	s.mu.Lock()
-	s.messages = append(s.messages, body)
+	postError := s.postError
+	if postError == "" {
+		s.messages = append(s.messages, body)
+	}
 	s.mu.Unlock()
 
+	if postError != "" {
+		writeJSON(rw, map[string]any{"ok": false, "error": postError})
+		return
+	}
+
 	writeJSON(rw, map[string]any{
 		"ok":      true,
-		"channel": "XVB123123123",
+		"channel": SlackChannelID(values.Get("channel")),
 		"ts":      "123123123123123",
 	})
 }
 
+func (s *SlackServer) update(rw http.ResponseWriter, r *http.Request) {
+	if s.rateLimit(rw) {
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	values, _ := url.ParseQuery(string(body))
+	s.mu.Lock()
+	s.updates = append(s.updates, body)
+	s.mu.Unlock()
+
+	writeJSON(rw, map[string]any{
+		"ok":      true,
+		"channel": values.Get("channel"),
+		"ts":      values.Get("ts"),
+	})
+}
+
 func (s *SlackServer) getUploadURL(rw http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
 	s.fileSeq++
@@ -135,3 +235,84 @@ func (s *SlackServer) completeUpload(rw http.ResponseWriter, r *http.Request) {
 		"files": files,
 	})
 }
+
+// SetChannels sets the channel names conversations.list returns, as public
+// channels the bot is a member of; each gets the ID "C" followed by its
+// index.
+func (s *SlackServer) SetChannels(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels = nil
+	for _, name := range names {
+		s.channels = append(s.channels, SlackChannel{Name: name, Member: true})
+	}
+}
+
+// AddChannel adds a channel to the ones conversations.list returns.
+func (s *SlackServer) AddChannel(c SlackChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels = append(s.channels, c)
+}
+
+// SetScopes sets the comma separated scopes auth.test reports.
+func (s *SlackServer) SetScopes(scopes string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scopes = scopes
+}
+
+// FailAuth makes auth.test fail with the given error code ("" to succeed).
+func (s *SlackServer) FailAuth(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authError = code
+}
+
+func (s *SlackServer) conversationsList(rw http.ResponseWriter, r *http.Request) {
+	if s.rateLimit(rw) {
+		return
+	}
+	r.ParseForm()
+	i, _ := strconv.Atoi(r.Form.Get("cursor"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var channels []map[string]any
+	next := ""
+	if i < len(s.channels) {
+		c := s.channels[i]
+		channels = append(channels, map[string]any{
+			"id":         fmt.Sprintf("C%d", i),
+			"name":       c.Name,
+			"is_private": c.Private,
+			"is_member":  c.Member,
+		})
+		if i+1 < len(s.channels) {
+			next = strconv.Itoa(i + 1)
+		}
+	}
+	writeJSON(rw, map[string]any{
+		"ok":                true,
+		"channels":          channels,
+		"response_metadata": map[string]any{"next_cursor": next},
+	})
+}
+
+func (s *SlackServer) authTest(rw http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	scopes, authError := s.scopes, s.authError
+	s.mu.Unlock()
+	if authError != "" {
+		writeJSON(rw, map[string]any{"ok": false, "error": authError})
+		return
+	}
+	rw.Header().Set("X-OAuth-Scopes", scopes)
+	writeJSON(rw, map[string]any{
+		"ok":      true,
+		"user":    "alert-router",
+		"user_id": "U123",
+		"team":    "Test",
+		"team_id": "T123",
+		"bot_id":  "B123",
+	})
+}
@@ -0,0 +1,211 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// MockSQSAPI is a mock SQS API that records sent messages.
+type MockSQSAPI struct {
+	mu       sync.Mutex
+	messages []string
+	err      error
+}
+
+// Fail makes subsequent sends fail with err (nil restores success).
+func (m *MockSQSAPI) Fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+// SendMessage implements the send message api call.
+func (m *MockSQSAPI) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.messages = append(m.messages, aws.ToString(params.MessageBody))
+	return &sqs.SendMessageOutput{MessageId: aws.String("quarantined-message")}, nil
+}
+
+// Messages returns the bodies of the messages sent so far.
+func (m *MockSQSAPI) Messages() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.messages...)
+}
+
+// SQSQueue is an in-memory SQS queue for running consumers against: it
+// long-polls, hides received messages for their visibility timeout and
+// redelivers them unless deleted.
+type SQSQueue struct {
+	mu       sync.Mutex
+	seq      int
+	messages []*queuedMessage
+	deleted  []string
+	extended int
+}
+
+type queuedMessage struct {
+	id, body, groupID string
+	receiptHandle     string
+	receives          int
+	visibleAt         time.Time
+}
+
+// Send enqueues a message, in the given message group if not empty, and
+// returns its ID.
+func (q *SQSQueue) Send(body, groupID string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	id := fmt.Sprintf("message-%d", q.seq)
+	q.messages = append(q.messages, &queuedMessage{id: id, body: body, groupID: groupID})
+	return id
+}
+
+// Len returns the number of messages in the queue, visible or not.
+func (q *SQSQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// Deleted returns the IDs of the messages deleted so far, in order.
+func (q *SQSQueue) Deleted() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.deleted...)
+}
+
+// Extended returns how many times message visibility was changed.
+func (q *SQSQueue) Extended() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.extended
+}
+
+// ReceiveMessage implements the receive message api call, waiting up to
+// WaitTimeSeconds for visible messages.
+func (q *SQSQueue) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	wait := time.NewTimer(time.Duration(params.WaitTimeSeconds) * time.Second)
+	defer wait.Stop()
+	for {
+		if msgs := q.receive(params); len(msgs) > 0 {
+			return &sqs.ReceiveMessageOutput{Messages: msgs}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wait.C:
+			return &sqs.ReceiveMessageOutput{}, nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (q *SQSQueue) receive(params *sqs.ReceiveMessageInput) []types.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limit := int(params.MaxNumberOfMessages)
+	if limit == 0 {
+		limit = 1
+	}
+	visibility := time.Duration(params.VisibilityTimeout) * time.Second
+	now := time.Now()
+	var msgs []types.Message
+	for _, m := range q.messages {
+		if len(msgs) == limit {
+			break
+		}
+		if now.Before(m.visibleAt) {
+			continue
+		}
+		q.seq++
+		m.receives++
+		m.receiptHandle = fmt.Sprintf("receipt-%d", q.seq)
+		m.visibleAt = now.Add(visibility)
+		attrs := map[string]string{"ApproximateReceiveCount": strconv.Itoa(m.receives)}
+		if m.groupID != "" {
+			attrs["MessageGroupId"] = m.groupID
+		}
+		msgs = append(msgs, types.Message{
+			MessageId:     aws.String(m.id),
+			ReceiptHandle: aws.String(m.receiptHandle),
+			Body:          aws.String(m.body),
+			Attributes:    attrs,
+		})
+	}
+	return msgs
+}
+
+// DeleteMessageBatch implements the delete message batch api call.
+func (q *SQSQueue) DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, e := range params.Entries {
+		i := q.byReceiptHandle(aws.ToString(e.ReceiptHandle))
+		if i < 0 {
+			out.Failed = append(out.Failed, types.BatchResultErrorEntry{Id: e.Id, Code: aws.String("ReceiptHandleIsInvalid")})
+			continue
+		}
+		q.deleted = append(q.deleted, q.messages[i].id)
+		q.messages = append(q.messages[:i], q.messages[i+1:]...)
+		out.Successful = append(out.Successful, types.DeleteMessageBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+
+// ChangeMessageVisibilityBatch implements the change message visibility
+// batch api call.
+func (q *SQSQueue) ChangeMessageVisibilityBatch(ctx context.Context, params *sqs.ChangeMessageVisibilityBatchInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := &sqs.ChangeMessageVisibilityBatchOutput{}
+	for _, e := range params.Entries {
+		i := q.byReceiptHandle(aws.ToString(e.ReceiptHandle))
+		if i < 0 {
+			out.Failed = append(out.Failed, types.BatchResultErrorEntry{Id: e.Id, Code: aws.String("ReceiptHandleIsInvalid")})
+			continue
+		}
+		q.messages[i].visibleAt = time.Now().Add(time.Duration(e.VisibilityTimeout) * time.Second)
+		q.extended++
+		out.Successful = append(out.Successful, types.ChangeMessageVisibilityBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+
+// byReceiptHandle returns the index of the message last received with the
+// receipt handle, or -1.
+func (q *SQSQueue) byReceiptHandle(receiptHandle string) int {
+	for i, m := range q.messages {
+		if m.receiptHandle == receiptHandle {
+			return i
+		}
+	}
+	return -1
+}
@@ -17,6 +17,7 @@ package test
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
@@ -32,16 +33,33 @@ const (
 
 // TestSSMParameters defines the parameters the mock Systems Manager client serves.
 var TestSSMParameters = map[string]string{
-	"/service/cw_alert_router/pagerduty/routing_keys/test_service": "pagerduty-key-1",
-	"/service/cw_alert_router/pagerduty/routing_keys/shared_key":   "shared-key-test-string",
+	"/service/cw_alert_router/pagerduty/routing_keys/test_service":          "pagerduty-key-1",
+	"/service/cw_alert_router/pagerduty/routing_keys/shared_key":            "shared-key-test-string",
+	"/service/cw_alert_router/incident_manager/response_plans/test_service": "arn:aws:ssm-incidents::1234567890123:response-plan/test-service",
+	"/service/cw_alert_router/servicenow/username":                          ServiceNowUsername,
+	"/service/cw_alert_router/servicenow/password":                          ServiceNowPassword,
+	"/service/cw_alert_router/servicenow/assignment_groups/test":            "Test Team",
 	SlackTokenSSMKey: SlackTokenValue,
 }
 
 // MockSSMClient is a mock Systems Manager client for testing.
-type MockSSMClient struct{}
+type MockSSMClient struct {
+	// Parameters are served in addition to (and take precedence over)
+	// TestSSMParameters. PutParameter writes here.
+	Parameters map[string]string
+
+	mu sync.Mutex
+}
 
 // GetParameter implements the same function from ssm.
 func (m *MockSSMClient) GetParameter(ctx context.Context, req *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if value, ok := m.Parameters[aws.ToString(req.Name)]; ok {
+		return &ssm.GetParameterOutput{
+			Parameter: &ssmtypes.Parameter{Value: aws.String(value)},
+		}, nil
+	}
 	if value, ok := TestSSMParameters[aws.ToString(req.Name)]; ok {
 		return &ssm.GetParameterOutput{
 			Parameter: &ssmtypes.Parameter{Value: aws.String(value)},
@@ -51,3 +69,35 @@ func (m *MockSSMClient) GetParameter(ctx context.Context, req *ssm.GetParameterI
 		Message: aws.String(fmt.Sprintf("parameter %s not found", aws.ToString(req.Name))),
 	}
 }
+
+// PutParameter implements the same function from ssm.
+func (m *MockSSMClient) PutParameter(ctx context.Context, req *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Parameters == nil {
+		m.Parameters = map[string]string{}
+	}
+	m.Parameters[aws.ToString(req.Name)] = aws.ToString(req.Value)
+	return &ssm.PutParameterOutput{Version: 1}, nil
+}
+
+// DeleteParameter implements the same function from ssm.
+func (m *MockSSMClient) DeleteParameter(ctx context.Context, req *ssm.DeleteParameterInput, optFns ...func(*ssm.Options)) (*ssm.DeleteParameterOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.Parameters[aws.ToString(req.Name)]; !ok {
+		return nil, &ssmtypes.ParameterNotFound{
+			Message: aws.String(fmt.Sprintf("parameter %s not found", aws.ToString(req.Name))),
+		}
+	}
+	delete(m.Parameters, aws.ToString(req.Name))
+	return &ssm.DeleteParameterOutput{}, nil
+}
+
+// Parameter returns the value PutParameter stored under name, if any.
+func (m *MockSSMClient) Parameter(name string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.Parameters[name]
+	return v, ok
+}
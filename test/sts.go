@@ -0,0 +1,38 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// MockSTSAPI is a mock STS client for testing.
+type MockSTSAPI struct {
+	// Account is returned as the caller's account, defaulting to
+	// 1234567890123.
+	Account string
+}
+
+// GetCallerIdentity implements the same function from sts.
+func (m *MockSTSAPI) GetCallerIdentity(ctx context.Context, req *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	account := m.Account
+	if account == "" {
+		account = "1234567890123"
+	}
+	return &sts.GetCallerIdentityOutput{Account: aws.String(account)}, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// WebhookRequest is one request received by a WebhookServer.
+type WebhookRequest struct {
+	Path  string
+	Query string
+	Body  []byte
+}
+
+// WebhookServer is a fake incoming-webhook endpoint (Google Chat,
+// Mattermost) that records every request and answers with Status.
+type WebhookServer struct {
+	Server *httptest.Server
+
+	// Status is the HTTP status to answer with (default 200).
+	Status int
+
+	mu       sync.Mutex
+	requests []WebhookRequest
+}
+
+// NewWebhookServer starts a fake webhook server.
+func NewWebhookServer() *WebhookServer {
+	s := &WebhookServer{Status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, WebhookRequest{Path: r.URL.Path, Query: r.URL.RawQuery, Body: body})
+		status := s.Status
+		s.mu.Unlock()
+		rw.WriteHeader(status)
+		rw.Write([]byte("{}"))
+	}))
+	return s
+}
+
+// URL returns the webhook URL for the given path (e.g. "/hooks/abc").
+func (s *WebhookServer) URL(path string) string {
+	return s.Server.URL + path
+}
+
+// Close shuts the server down.
+func (s *WebhookServer) Close() {
+	s.Server.Close()
+}
+
+// Requests returns the requests received so far.
+func (s *WebhookServer) Requests() []WebhookRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]WebhookRequest(nil), s.requests...)
+}
@@ -0,0 +1,374 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package worker consumes alarm events by long-polling an SQS queue, as an
+// alternative to the Lambda event source mapping for container deployments.
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	awsevents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Default configuration values.
+const (
+	DefaultMaxMessages       = 10
+	DefaultWaitTime          = 20 * time.Second
+	DefaultVisibilityTimeout = time.Minute
+	DefaultShutdownTimeout   = 25 * time.Second
+
+	// maxMessages and maxWaitTime are SQS's limits for a receive.
+	maxMessages = 10
+	maxWaitTime = 20 * time.Second
+	// minVisibilityTimeout is the shortest timeout the heartbeat, extending
+	// it every half timeout in whole seconds, can keep up with.
+	minVisibilityTimeout = 2 * time.Second
+	// stabilisedInterval is how often flapping alarms are checked for
+	// having stabilised while the queue is idle.
+	stabilisedInterval = time.Minute
+	// receiveBackoff is how long to wait after a failed receive.
+	receiveBackoff = 5 * time.Second
+)
+
+// Environment variable keys.
+const (
+	// QueueURLEnv is the env var key for the URL of the queue to consume.
+	QueueURLEnv = "WORKER_QUEUE_URL"
+	// MaxMessagesEnv is the env var key for how many messages to receive at
+	// once (1-10).
+	MaxMessagesEnv = "WORKER_MAX_MESSAGES"
+	// WaitTimeEnv is the env var key for how long a receive waits for
+	// messages (a Go duration, at most "20s").
+	WaitTimeEnv = "WORKER_WAIT_TIME"
+	// VisibilityTimeoutEnv is the env var key for how long received
+	// messages are hidden from other consumers (a Go duration, e.g. "1m").
+	VisibilityTimeoutEnv = "WORKER_VISIBILITY_TIMEOUT"
+)
+
+// Config holds configuration options for the worker.
+type Config struct {
+	// QueueURL is the queue alarm events are consumed from.
+	QueueURL string
+	// MaxMessages is how many messages are received and processed as one
+	// batch (default DefaultMaxMessages).
+	MaxMessages int
+	// WaitTime is how long a receive waits for messages to arrive (default
+	// DefaultWaitTime).
+	WaitTime time.Duration
+	// VisibilityTimeout is how long received messages are hidden from other
+	// consumers (default DefaultVisibilityTimeout). It's extended while a
+	// batch is processed; failed messages are retried once it expires.
+	VisibilityTimeout time.Duration
+	// ShutdownTimeout is how long the batch in flight gets to finish on
+	// shutdown (default DefaultShutdownTimeout).
+	ShutdownTimeout time.Duration
+}
+
+// ConfigFromEnv builds a Config from the environment variables documented in the README.
+func ConfigFromEnv() Config {
+	cfg := Config{QueueURL: os.Getenv(QueueURLEnv)}
+	if v := os.Getenv(MaxMessagesEnv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			slog.Error("invalid max messages", "value", v, "error", err)
+			n = -1
+		}
+		cfg.MaxMessages = n
+	}
+	cfg.WaitTime = durationFromEnv(WaitTimeEnv)
+	cfg.VisibilityTimeout = durationFromEnv(VisibilityTimeoutEnv)
+	return cfg
+}
+
+// durationFromEnv parses the duration in the env var key, -1 if it's
+// invalid so validation fails, 0 if unset.
+func durationFromEnv(key string) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Error("invalid duration", "key", key, "value", v, "error", err)
+		return -1
+	}
+	return d
+}
+
+// withDefaults fills in defaults for unset fields.
+func (c Config) withDefaults() Config {
+	if c.MaxMessages == 0 {
+		c.MaxMessages = DefaultMaxMessages
+	}
+	if c.WaitTime == 0 {
+		c.WaitTime = DefaultWaitTime
+	}
+	if c.VisibilityTimeout == 0 {
+		c.VisibilityTimeout = DefaultVisibilityTimeout
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	return c
+}
+
+// validate checks required fields and value ranges.
+func (c Config) validate() error {
+	if c.QueueURL == "" {
+		return fmt.Errorf("queue url is required (%s)", QueueURLEnv)
+	}
+	if c.MaxMessages < 1 || c.MaxMessages > maxMessages {
+		return fmt.Errorf("max messages must be between 1 and %d (%s)", maxMessages, MaxMessagesEnv)
+	}
+	if c.WaitTime < 0 || c.WaitTime > maxWaitTime {
+		return fmt.Errorf("wait time must be between 0 and %s (%s)", maxWaitTime, WaitTimeEnv)
+	}
+	if c.VisibilityTimeout < minVisibilityTimeout {
+		return fmt.Errorf("visibility timeout must be at least %s (%s)", minVisibilityTimeout, VisibilityTimeoutEnv)
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown timeout must be a positive duration")
+	}
+	return nil
+}
+
+// SQSAPI is the subset of the SQS API the worker uses.
+type SQSAPI interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibilityBatch(ctx context.Context, params *sqs.ChangeMessageVisibilityBatchInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error)
+}
+
+// Processor processes batches of SQS records; *lambda.Handler implements
+// it.
+type Processor interface {
+	HandleRequest(ctx context.Context, sqsEvent awsevents.SQSEvent) (awsevents.SQSEventResponse, error)
+	AnnounceStabilised(ctx context.Context)
+}
+
+// Worker long-polls an SQS queue and feeds the messages to a Processor.
+type Worker struct {
+	cfg Config
+	api SQSAPI
+	p   Processor
+
+	lastAnnounced time.Time
+}
+
+// New returns a Worker backed by the real SQS API.
+func New(awsCfg aws.Config, p Processor, cfg Config) (*Worker, error) {
+	return NewWithAPI(sqs.NewFromConfig(awsCfg), p, cfg)
+}
+
+// NewWithAPI returns a Worker backed by the given API implementation (for
+// testing).
+func NewWithAPI(api SQSAPI, p Processor, cfg Config) (*Worker, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &Worker{cfg: cfg, api: api, p: p}, nil
+}
+
+// Run receives and processes batches until ctx is cancelled. Each batch is
+// processed like a Lambda invocation: by alarm (or message group) in order,
+// with a failed record holding back the rest of its alarm's records.
+// Processed messages are deleted; failed ones become visible again once the
+// visibility timeout expires, and are retried. On cancellation, the batch in
+// flight gets up to the shutdown timeout to finish.
+func (w *Worker) Run(ctx context.Context) error {
+	slog.Info("starting worker", "queue_url", w.cfg.QueueURL)
+	for {
+		msgs, err := w.receive(ctx)
+		if ctx.Err() != nil {
+			slog.Info("shutting down worker")
+			return nil
+		}
+		if err != nil {
+			slog.Error("failed receiving sqs messages", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(receiveBackoff):
+			}
+			continue
+		}
+		if len(msgs) > 0 {
+			w.process(ctx, msgs)
+		}
+		w.announceStabilised(ctx)
+	}
+}
+
+// receive long-polls the queue for a batch of messages.
+func (w *Worker) receive(ctx context.Context) ([]types.Message, error) {
+	out, err := w.api.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:                    aws.String(w.cfg.QueueURL),
+		MaxNumberOfMessages:         int32(w.cfg.MaxMessages),
+		WaitTimeSeconds:             int32(w.cfg.WaitTime.Seconds()),
+		VisibilityTimeout:           int32(w.cfg.VisibilityTimeout.Seconds()),
+		MessageSystemAttributeNames: []types.MessageSystemAttributeName{types.MessageSystemAttributeNameAll},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("receiving messages: %w", err)
+	}
+	return out.Messages, nil
+}
+
+// announceStabilised announces stabilised flapping alarms between batches,
+// at most every stabilisedInterval.
+func (w *Worker) announceStabilised(ctx context.Context) {
+	if time.Since(w.lastAnnounced) < stabilisedInterval {
+		return
+	}
+	w.p.AnnounceStabilised(ctx)
+	w.lastAnnounced = time.Now()
+}
+
+// process processes a batch, extending the messages' visibility until it's
+// done, and deletes the processed messages. Processing outlives ctx by up to
+// the shutdown timeout.
+func (w *Worker) process(ctx context.Context, msgs []types.Message) {
+	pctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		slog.Warn("shutting down, waiting for the batch in flight", "messages", len(msgs), "timeout", w.cfg.ShutdownTimeout)
+		time.AfterFunc(w.cfg.ShutdownTimeout, cancel)
+	})
+	defer stop()
+
+	heartbeat := make(chan struct{})
+	go func() {
+		defer close(heartbeat)
+		w.extendVisibility(pctx, msgs)
+	}()
+
+	records := make([]awsevents.SQSMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		records = append(records, record(msg))
+	}
+	resp, err := w.p.HandleRequest(pctx, awsevents.SQSEvent{Records: records})
+	cancel()
+	<-heartbeat
+	w.lastAnnounced = time.Now()
+	if err != nil {
+		slog.Error("failed processing sqs messages", "messages", len(msgs), "error", err)
+		return
+	}
+
+	failed := make(map[string]bool, len(resp.BatchItemFailures))
+	for _, f := range resp.BatchItemFailures {
+		failed[f.ItemIdentifier] = true
+	}
+	var processed []types.Message
+	for _, msg := range msgs {
+		if !failed[aws.ToString(msg.MessageId)] {
+			processed = append(processed, msg)
+		}
+	}
+	w.delete(context.WithoutCancel(ctx), processed)
+}
+
+// extendVisibility keeps the messages hidden from other consumers until ctx
+// is done, extending their visibility timeout halfway through.
+func (w *Worker) extendVisibility(ctx context.Context, msgs []types.Message) {
+	ticker := time.NewTicker(w.cfg.VisibilityTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		entries := make([]types.ChangeMessageVisibilityBatchRequestEntry, 0, len(msgs))
+		for i, msg := range msgs {
+			entries = append(entries, types.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i)),
+				ReceiptHandle:     msg.ReceiptHandle,
+				VisibilityTimeout: int32(w.cfg.VisibilityTimeout.Seconds()),
+			})
+		}
+		out, err := w.api.ChangeMessageVisibilityBatch(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+			QueueUrl: aws.String(w.cfg.QueueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("failed extending sqs message visibility", "messages", len(msgs), "error", err)
+			}
+			continue
+		}
+		for _, f := range out.Failed {
+			slog.Error("failed extending sqs message visibility", "message_id", messageID(msgs, f.Id), "code", aws.ToString(f.Code), "error", aws.ToString(f.Message))
+		}
+	}
+}
+
+// delete deletes the processed messages from the queue. Messages failing to
+// be deleted are redelivered; the delivery ledger keeps them from being
+// delivered twice.
+func (w *Worker) delete(ctx context.Context, msgs []types.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	entries := make([]types.DeleteMessageBatchRequestEntry, 0, len(msgs))
+	for i, msg := range msgs {
+		entries = append(entries, types.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: msg.ReceiptHandle,
+		})
+	}
+	out, err := w.api.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(w.cfg.QueueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		slog.Error("failed deleting sqs messages", "messages", len(msgs), "error", err)
+		return
+	}
+	for _, f := range out.Failed {
+		slog.Error("failed deleting sqs message", "message_id", messageID(msgs, f.Id), "code", aws.ToString(f.Code), "error", aws.ToString(f.Message))
+	}
+}
+
+// messageID returns the ID of the message a batch entry ID refers to.
+func messageID(msgs []types.Message, entryID *string) string {
+	i, err := strconv.Atoi(aws.ToString(entryID))
+	if err != nil || i < 0 || i >= len(msgs) {
+		return aws.ToString(entryID)
+	}
+	return aws.ToString(msgs[i].MessageId)
+}
+
+// record converts a received message into the record a Lambda event source
+// mapping would deliver.
+func record(msg types.Message) awsevents.SQSMessage {
+	return awsevents.SQSMessage{
+		MessageId:     aws.ToString(msg.MessageId),
+		ReceiptHandle: aws.ToString(msg.ReceiptHandle),
+		Body:          aws.ToString(msg.Body),
+		Md5OfBody:     aws.ToString(msg.MD5OfBody),
+		Attributes:    msg.Attributes,
+		EventSource:   "aws:sqs",
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2022 Aspiro AB
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker_test
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	awsevents "github.com/aws/aws-lambda-go/events"
+
+	"github.com/tidal-music/cw-alert-router/v2/test"
+	"github.com/tidal-music/cw-alert-router/v2/worker"
+)
+
+// fakeProcessor records the batches it's handed and fails the records with
+// body "fail", taking delay per batch.
+type fakeProcessor struct {
+	mu         sync.Mutex
+	batches    [][]awsevents.SQSMessage
+	delay      time.Duration
+	cancelled  bool
+	announced  int
+	processing chan struct{}
+}
+
+func (p *fakeProcessor) HandleRequest(ctx context.Context, sqsEvent awsevents.SQSEvent) (awsevents.SQSEventResponse, error) {
+	p.mu.Lock()
+	p.batches = append(p.batches, sqsEvent.Records)
+	processing := p.processing
+	p.mu.Unlock()
+	if processing != nil {
+		close(processing)
+	}
+
+	select {
+	case <-ctx.Done():
+		p.mu.Lock()
+		p.cancelled = true
+		p.mu.Unlock()
+	case <-time.After(p.delay):
+	}
+
+	var resp awsevents.SQSEventResponse
+	for _, msg := range sqsEvent.Records {
+		if msg.Body == "fail" {
+			resp.BatchItemFailures = append(resp.BatchItemFailures,
+				awsevents.SQSBatchItemFailure{ItemIdentifier: msg.MessageId})
+		}
+	}
+	return resp, nil
+}
+
+func (p *fakeProcessor) AnnounceStabilised(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.announced++
+}
+
+func (p *fakeProcessor) wasCancelled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cancelled
+}
+
+func (p *fakeProcessor) received() [][]awsevents.SQSMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.batches)
+}
+
+// run runs the worker until stopped.
+func run(t *testing.T, w *worker.Worker) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx) }()
+	return func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run returned error: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("worker didn't shut down")
+		}
+	}
+}
+
+// waitFor polls cond until it holds or the timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newWorker(t *testing.T, q *test.SQSQueue, p worker.Processor, cfg worker.Config) *worker.Worker {
+	t.Helper()
+	cfg.QueueURL = "https://sqs.us-east-1.amazonaws.com/1234567890123/alarms"
+	w, err := worker.NewWithAPI(q, p, cfg)
+	if err != nil {
+		t.Fatalf("failed creating worker: %v", err)
+	}
+	return w
+}
+
+func TestConfigValidation(t *testing.T) {
+	q, p := &test.SQSQueue{}, &fakeProcessor{}
+	tests := []struct {
+		name string
+		cfg  worker.Config
+	}{
+		{"no queue url", worker.Config{}},
+		{"too many messages", worker.Config{QueueURL: "q", MaxMessages: 11}},
+		{"invalid max messages", worker.Config{QueueURL: "q", MaxMessages: -1}},
+		{"wait time too long", worker.Config{QueueURL: "q", WaitTime: time.Minute}},
+		{"visibility timeout too short", worker.Config{QueueURL: "q", VisibilityTimeout: time.Second}},
+	}
+	for _, tc := range tests {
+		if _, err := worker.NewWithAPI(q, p, tc.cfg); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestRunDeletesProcessedMessages(t *testing.T) {
+	q, p := &test.SQSQueue{}, &fakeProcessor{}
+	ok1 := q.Send("ok", "")
+	failed := q.Send("fail", "")
+	ok2 := q.Send("ok", "")
+
+	stop := run(t, newWorker(t, q, p, worker.Config{WaitTime: time.Second, VisibilityTimeout: 2 * time.Second}))
+	waitFor(t, time.Second, func() bool { return len(q.Deleted()) == 2 })
+
+	if got := q.Deleted(); !slices.Equal(got, []string{ok1, ok2}) {
+		t.Errorf("expected the processed messages to be deleted, got %v", got)
+	}
+	if batches := p.received(); len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("expected one batch of 3 records, got %v", batches)
+	}
+
+	// the failed message is retried once its visibility timeout expires
+	waitFor(t, 4*time.Second, func() bool { return len(p.received()) == 2 })
+	stop()
+	batches := p.received()
+	if len(batches[1]) != 1 || batches[1][0].MessageId != failed {
+		t.Errorf("expected the failed message to be retried, got %v", batches[1])
+	}
+	if got := batches[1][0].Attributes["ApproximateReceiveCount"]; got != "2" {
+		t.Errorf("expected the retry to be the second receive, got %q", got)
+	}
+	if q.Len() != 1 {
+		t.Errorf("expected the failed message to stay queued, got %d messages", q.Len())
+	}
+}
+
+func TestRunExtendsVisibility(t *testing.T) {
+	q, p := &test.SQSQueue{}, &fakeProcessor{delay: 1500 * time.Millisecond}
+	q.Send("ok", "")
+
+	stop := run(t, newWorker(t, q, p, worker.Config{WaitTime: time.Second, VisibilityTimeout: 2 * time.Second}))
+	waitFor(t, 3*time.Second, func() bool { return len(q.Deleted()) == 1 })
+	stop()
+
+	if q.Extended() == 0 {
+		t.Error("expected the visibility of the slow message to be extended")
+	}
+	if got := len(p.received()); got != 1 {
+		t.Errorf("expected the message to be processed once, got %d", got)
+	}
+}
+
+func TestRunFinishesBatchOnShutdown(t *testing.T) {
+	q := &test.SQSQueue{}
+	p := &fakeProcessor{delay: 200 * time.Millisecond, processing: make(chan struct{})}
+	q.Send("ok", "")
+
+	stop := run(t, newWorker(t, q, p, worker.Config{WaitTime: time.Second}))
+	<-p.processing
+	stop()
+
+	if p.wasCancelled() {
+		t.Error("expected the batch in flight not to be cancelled")
+	}
+	if got := len(q.Deleted()); got != 1 {
+		t.Errorf("expected the batch in flight to be deleted, got %d deleted", got)
+	}
+}
+
+func TestRunCancelsBatchAfterShutdownTimeout(t *testing.T) {
+	q := &test.SQSQueue{}
+	p := &fakeProcessor{delay: time.Minute, processing: make(chan struct{})}
+	q.Send("ok", "")
+
+	stop := run(t, newWorker(t, q, p, worker.Config{WaitTime: time.Second, ShutdownTimeout: 50 * time.Millisecond}))
+	<-p.processing
+	stop()
+
+	if !p.wasCancelled() {
+		t.Error("expected the batch in flight to be cancelled")
+	}
+}
+
+func TestRunAnnouncesStabilisedWhenIdle(t *testing.T) {
+	q, p := &test.SQSQueue{}, &fakeProcessor{}
+
+	stop := run(t, newWorker(t, q, p, worker.Config{WaitTime: time.Second}))
+	waitFor(t, 3*time.Second, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.announced > 0
+	})
+	stop()
+}